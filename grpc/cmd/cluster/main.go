@@ -0,0 +1,148 @@
+// Command cluster runs a three-node replicated cluster on loopback listeners
+// and checks that writes and reads survive the loss of the leader.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	igrpc "github.com/Roma7-7-7/sandbox/grpc/internal"
+)
+
+func main() {
+	size := flag.Int("nodes", 3, "number of nodes")
+	dir := flag.String("dir", "", "directory for the nodes' state; a temporary one when empty")
+	timeout := flag.Duration("timeout", 30*time.Second, "overall deadline")
+	flag.Parse()
+
+	if *dir == "" {
+		tmp, err := os.MkdirTemp("", "cluster")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(tmp)
+		*dir = tmp
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	c, err := igrpc.StartLocalCluster(*size, *dir)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+	if ctx, err = c.Operator(ctx); err != nil {
+		panic(err)
+	}
+
+	if err = run(ctx, c); err != nil {
+		fmt.Println("FAIL:", err)
+		os.Exit(1)
+	}
+	fmt.Println("OK")
+}
+
+func run(ctx context.Context, c *igrpc.LocalCluster) error {
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println("leader:", leader.ID)
+
+	followers := others(c, leader.ID)
+	if len(followers) < 2 {
+		return errors.New("at least three nodes are required")
+	}
+
+	// A write through a follower is forwarded to the leader and a
+	// linearizable read on another follower observes it.
+	alice, err := mustClient(followers[0]).CreateUser(ctx, "alice")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created %s through %s\n", alice.ID, followers[0].ID)
+	if _, err = mustClient(followers[1]).GetUser(igrpc.WithReadConsistency(ctx, igrpc.ReadLinearizable), alice.ID); err != nil {
+		return fmt.Errorf("linearizable read on %s: %w", followers[1].ID, err)
+	}
+	fmt.Println("read back on", followers[1].ID)
+
+	if err = c.Stop(leader.ID); err != nil {
+		return err
+	}
+	fmt.Println("stopped", leader.ID)
+
+	next, err := c.Leader(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println("new leader:", next.ID)
+
+	survivors := others(c, leader.ID)
+	bob, err := mustClient(survivors[len(survivors)-1]).CreateUser(ctx, "bob")
+	if err != nil {
+		return fmt.Errorf("write after failover: %w", err)
+	}
+	fmt.Printf("created %s through %s\n", bob.ID, survivors[len(survivors)-1].ID)
+	_, err = mustClient(survivors[0]).CreateUser(ctx, "bob")
+	if status.Code(errors.Unwrap(err)) != codes.AlreadyExists {
+		return fmt.Errorf("duplicate name: want AlreadyExists, got %v", err)
+	}
+	fmt.Println("rejected duplicate through", survivors[0].ID)
+
+	if err = c.Restart(leader.ID); err != nil {
+		return err
+	}
+	fmt.Println("restarted", leader.ID)
+
+	old, _ := c.Node(leader.ID)
+	for {
+		_, err = mustClient(old).GetUser(igrpc.WithReadConsistency(ctx, igrpc.ReadStale), bob.ID)
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not catch up: %w", old.ID, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	fmt.Println(old.ID, "caught up")
+
+	users, err := mustClient(old).ListUsers(igrpc.WithReadConsistency(ctx, igrpc.ReadLinearizable), "")
+	if err != nil {
+		return err
+	}
+	// alice, bob and the operator.
+	if len(users) != 3 {
+		return fmt.Errorf("%s lists %d users, want 3", old.ID, len(users))
+	}
+
+	return nil
+}
+
+// others returns the running nodes except id.
+func others(c *igrpc.LocalCluster, id string) []*igrpc.LocalNode {
+	var res []*igrpc.LocalNode
+	for _, n := range c.Nodes() {
+		if n.ID != id && n.Node != nil {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func mustClient(n *igrpc.LocalNode) *igrpc.Client {
+	client, err := n.Client()
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
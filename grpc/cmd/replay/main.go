@@ -0,0 +1,87 @@
+// Command replay sends the calls of a capture file, as written by a server
+// started with -capture-file, to another server and reports the responses
+// that differ from the captured ones.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	igrpc "github.com/Roma7-7-7/sandbox/grpc/internal"
+)
+
+func main() {
+	file := flag.String("file", "", "capture file to replay")
+	addr := flag.String("addr", "localhost:9090", "address of the server to replay against")
+	md := flag.String("metadata", "", "metadata sent with every call as key=value pairs separated by commas, e.g. authorization=Bearer <access token>; replaces captured values, which lack credentials")
+	ignore := flag.String("ignore", "id,createdAt,updatedAt,revision,modifiedRevision", "response fields not compared, separated by commas")
+	timeout := flag.Duration("timeout", 5*time.Second, "deadline of each call")
+	flag.Parse()
+
+	if *file == "" {
+		fmt.Println("-file is required")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	conn, err := grpc.Dial(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	outgoing := metadata.MD{}
+	for _, pair := range strings.Split(*md, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(pair), "="); ok {
+			outgoing.Append(k, v)
+		}
+	}
+	ignored := make(map[string]bool)
+	for _, field := range strings.Split(*ignore, ",") {
+		ignored[strings.TrimSpace(field)] = true
+	}
+
+	var calls, differing int
+	err = igrpc.ReadCapture(f, func(want igrpc.CaptureRecord) error {
+		calls++
+		ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), outgoing), *timeout)
+		defer cancel()
+
+		got, err := igrpc.Replay(ctx, conn, want)
+		if err != nil {
+			return fmt.Errorf("call %d %s: %w", calls, want.Method, err)
+		}
+		diffs := igrpc.DiffCapture(want, got, ignored)
+		if len(diffs) == 0 {
+			fmt.Printf("%d %s: same (%s, %v, was %v)\n", calls, want.Method, got.Code, got.Duration.Round(time.Microsecond), want.Duration.Round(time.Microsecond))
+			return nil
+		}
+		differing++
+		fmt.Printf("%d %s: differs\n", calls, want.Method)
+		for _, d := range diffs {
+			fmt.Println("    " + d)
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("%d calls replayed, %d differ\n", calls, differing)
+	if differing > 0 {
+		os.Exit(1)
+	}
+}
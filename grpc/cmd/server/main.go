@@ -2,34 +2,404 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
 
 	igrpc "github.com/Roma7-7-7/sandbox/grpc/internal"
 	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
 )
 
 func main() {
-	lis, err := net.Listen("tcp", ":9090")
+	addr := flag.String("addr", ":9090", "listen address")
+	dataDir := flag.String("data-dir", "", "directory for the snapshot and write-ahead log; in-memory only when empty")
+	walSync := flag.String("wal-sync", "always", "write-ahead log fsync policy: always, interval or never")
+	walSyncInterval := flag.Duration("wal-sync-interval", time.Second, "fsync interval for -wal-sync=interval")
+	snapshotInterval := flag.Duration("snapshot-interval", 10*time.Minute, "periodic snapshot interval, 0 disables")
+	keyringPath := flag.String("keyring", "", "keyring file to encrypt user names, emails, birth dates and TOTP secrets in -data-dir with; required once they are encrypted; see LoadKeyring for its format")
+	tenantQuota := flag.Int("tenant-quota", 0, "default maximum number of users per tenant, 0 is unlimited")
+	tenantQuotas := flag.String("tenant-quotas", "", "per-tenant user limits as tenant=limit pairs separated by commas")
+	tokenSecret := flag.String("token-secret", "", "HMAC secret for access and refresh tokens; random per process when empty")
+	bootstrapAdmin := flag.String("bootstrap-admin", "", "name of a default tenant user granted the admin role; created with the password in $BOOTSTRAP_ADMIN_PASSWORD if missing")
+	headerAuth := flag.Bool("insecure-header-auth", false, "accept the userID header of an existing user as its credentials; for local development only")
+	accessTTL := flag.Duration("access-token-ttl", 15*time.Minute, "access token lifetime")
+	refreshTTL := flag.Duration("refresh-token-ttl", 7*24*time.Hour, "refresh token lifetime")
+	raftID := flag.String("raft-id", "", "node ID; enables replication through -raft-peers, with the raft state kept in -data-dir")
+	raftPeers := flag.String("raft-peers", "", "cluster members, including this one, as id=raftAddr/grpcAddr pairs separated by commas")
+	clusterSecret := flag.String("cluster-secret", "", "secret shared by the cluster members; nodes should also share -token-secret")
+	apiKeysEnabled := flag.Bool("api-keys", true, "serve API keys; they are kept in memory per node, so -api-keys=false is required with -raft-id")
+	groupsEnabled := flag.Bool("groups", true, "serve groups; they are kept in -data-dir if set but not replicated, so -groups=false is required with -raft-id")
+	readConsistency := flag.String("read-consistency", igrpc.ReadLinearizable, "default read consistency of a replicated node: linearizable or stale")
+	webAddr := flag.String("web-addr", "", "listen address for gRPC-Web and Connect over HTTP/1.1 and HTTP/2; disabled when empty")
+	webOrigins := flag.String("web-allowed-origins", "", "origins allowed to call the web listener, separated by commas; * allows any")
+	webReadHeaderTimeout := flag.Duration("web-read-header-timeout", 10*time.Second, "how long the web listener waits for request headers")
+	webIdleTimeout := flag.Duration("web-idle-timeout", 2*time.Minute, "how long the web listener keeps idle keep-alive connections")
+	faultRules := flag.String("fault-rules", "", "faults to inject as method:spec rules separated by commas, e.g. GetUser:latency=200ms;error=unavailable;error-rate=0.1; requires -tags faultinjection")
+	faultSeed := flag.Int64("fault-seed", 0, "seed of the injected faults; random when 0")
+	faultHeader := flag.Bool("fault-header", false, "let callers request faults with the x-fault-injection header; requires -tags faultinjection")
+	captureFile := flag.String("capture-file", "", "append every RPC to this JSONL file for replay; disabled when empty")
+	captureMethods := flag.String("capture-methods", "", "full method names to capture, separated by commas; all when empty")
+	emailOutbox := flag.String("email-outbox", "", "file email verification tokens are written to, - for stdout; verification is disabled when empty")
+	emailTokenTTL := flag.Duration("email-token-ttl", igrpc.DefaultEmailTokenTTL, "email verification token lifetime")
+	bannedNames := flag.String("banned-names", "", "names users may not be created or renamed with, separated by commas")
+	requireSurname := flag.String("require-surname-tenants", "", "tenants whose users must have a surname, separated by commas")
+	webhooks := flag.String("webhooks", "", "user mutation webhooks separated by commas, each name=url;timeout=1s;ops=create|update|delete;post;fail-open")
+	keepaliveTime := flag.Duration("keepalive-time", 2*time.Hour, "idle time after which the server pings a client")
+	keepaliveTimeout := flag.Duration("keepalive-timeout", 20*time.Second, "time to wait for a ping ack before closing the connection")
+	keepaliveMinTime := flag.Duration("keepalive-min-time", 5*time.Minute, "minimum interval between client pings; clients pinging more often are disconnected")
+	keepaliveWithoutStream := flag.Bool("keepalive-permit-without-stream", false, "allow client pings on connections without active streams")
+	maxConnIdle := flag.Duration("max-connection-idle", 0, "close connections idle for this long, 0 never")
+	maxConnAge := flag.Duration("max-connection-age", 0, "close connections older than this, 0 never")
+	maxStreams := flag.Uint("max-concurrent-streams", 1000, "maximum concurrent streams per connection, 0 is unlimited")
+	maxConns := flag.Int("max-connections", 0, "maximum open connections, 0 is unlimited")
+	maxConnsPerHost := flag.Int("max-connections-per-host", 0, "maximum open connections from one client address, 0 is unlimited")
+	maxInFlight := flag.Int("max-in-flight", 0, "unary calls handled at once before new ones are rejected with Unavailable, 0 is unlimited")
+	maxLatency := flag.Duration("max-latency", 0, "average unary call latency above which a growing share of calls is rejected with Unavailable, 0 disables")
+	mfaIssuer := flag.String("mfa-issuer", igrpc.DefaultMFAIssuer, "issuer shown by authenticator apps for TOTP secrets")
+	mfaMethods := flag.String("mfa-methods", "", "full method names that require a recently verified second factor, separated by commas")
+	mfaMaxAge := flag.Duration("mfa-max-age", igrpc.DefaultStepUpMaxAge, "how long a verified second factor satisfies -mfa-methods")
+	metricsAddr := flag.String("metrics-addr", "", "listen address for expvar metrics at /debug/vars; disabled when empty")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to let in-flight calls finish on SIGINT or SIGTERM before cancelling them")
+	flag.Parse()
+
+	quotas, err := igrpc.ParseTenantQuotas(*tenantQuotas)
+	if err != nil {
+		panic(err)
+	}
+
+	if *keyringPath != "" && *dataDir == "" {
+		panic("-keyring requires -data-dir")
+	}
+
+	secret := []byte(*tokenSecret)
+	if len(secret) == 0 {
+		fmt.Println("no -token-secret given, tokens will not survive a restart")
+		secret = make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			panic(err)
+		}
+	}
+	tokens := igrpc.NewTokenIssuer(secret, *accessTTL, *refreshTTL)
+
+	userService := igrpc.NewUserService()
+	var node *igrpc.Node
+	if *raftID != "" {
+		peers, err := igrpc.ParsePeers(*raftPeers)
+		if err != nil {
+			panic(err)
+		}
+		if *dataDir == "" {
+			panic("-data-dir is required with -raft-id")
+		}
+		if *keyringPath != "" {
+			panic("-keyring is not supported with -raft-id")
+		}
+		if *bootstrapAdmin != "" {
+			panic("-bootstrap-admin is not supported with -raft-id")
+		}
+		if *apiKeysEnabled || *groupsEnabled {
+			panic("API keys and groups are not replicated, -api-keys=false and -groups=false are required with -raft-id")
+		}
+		node, err = igrpc.StartNode(igrpc.ReplicationConfig{
+			NodeID:          *raftID,
+			Dir:             *dataDir,
+			Peers:           peers,
+			Secret:          *clusterSecret,
+			Tokens:          tokens,
+			ReadConsistency: *readConsistency,
+		}, userService)
+		if err != nil {
+			panic(err)
+		}
+		defer node.Close()
+	} else if *dataDir != "" {
+		policy, err := igrpc.ParseSyncPolicy(*walSync)
+		if err != nil {
+			panic(err)
+		}
+		var keyring *igrpc.Keyring
+		if *keyringPath != "" {
+			if keyring, err = igrpc.LoadKeyring(*keyringPath); err != nil {
+				panic(err)
+			}
+		}
+		userService, err = igrpc.OpenUserService(igrpc.PersistenceConfig{
+			Dir:              *dataDir,
+			Sync:             policy,
+			SyncInterval:     *walSyncInterval,
+			SnapshotInterval: *snapshotInterval,
+			Keyring:          keyring,
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	defer userService.Close()
+	userService.SetTenantQuotas(igrpc.TenantQuotas{Default: *tenantQuota, PerTenant: quotas})
+	hooks := igrpc.NewHookRegistry()
+	if names := splitList(*bannedNames); len(names) > 0 {
+		if err = hooks.Register(igrpc.HookConfig{Name: "banned-names", Ops: []string{igrpc.HookCreate, igrpc.HookUpdate}}, igrpc.BannedNames(names...)); err != nil {
+			panic(err)
+		}
+	}
+	if tenants := splitList(*requireSurname); len(tenants) > 0 {
+		if err = hooks.Register(igrpc.HookConfig{Name: "require-surname", Ops: []string{igrpc.HookCreate, igrpc.HookUpdate}}, igrpc.RequireSurname(tenants...)); err != nil {
+			panic(err)
+		}
+	}
+	webhookConfigs, err := igrpc.ParseWebhooks(*webhooks)
 	if err != nil {
 		panic(err)
 	}
+	for _, cfg := range webhookConfigs {
+		if err = hooks.Register(cfg.HookConfig, igrpc.NewWebhookHook(cfg.URL, nil)); err != nil {
+			panic(err)
+		}
+	}
+	userService.SetHooks(hooks)
+	scheduler := igrpc.StartScheduler(userService)
+	defer scheduler.Close()
 
-	s := grpc.NewServer(grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Println("panic:", r)
-				err = status.Errorf(codes.Internal, "panic: %v", r)
+	var apiKeys *igrpc.APIKeyStore
+	if *apiKeysEnabled {
+		apiKeys = igrpc.NewAPIKeyStore()
+	}
+	auth := igrpc.NewAuthenticator(userService, tokens, apiKeys)
+	var groups *igrpc.GroupStore
+	if *groupsEnabled {
+		if *dataDir != "" {
+			if groups, err = igrpc.OpenGroupStore(userService, *dataDir); err != nil {
+				panic(err)
+			}
+		} else {
+			groups = igrpc.NewGroupStore(userService)
+		}
+		auth.AddRoleSource(groups)
+	}
+	if *bootstrapAdmin != "" {
+		admin := ensureUser(userService, *bootstrapAdmin, os.Getenv("BOOTSTRAP_ADMIN_PASSWORD"))
+		auth.AddRoleSource(igrpc.StaticRoles{admin.ID: {igrpc.RoleAdmin}})
+		fmt.Printf("bootstrap admin %s is %s\n", admin.Name, admin.ID)
+	}
+	if *headerAuth {
+		fmt.Println("insecure header authentication enabled")
+		auth.AllowHeaderAuth()
+	}
+	auth.AddPublicMethods(healthpb.Health_Check_FullMethodName, healthpb.Health_Watch_FullMethodName)
+	auth.RequireMFA(*mfaMaxAge, splitList(*mfaMethods)...)
+	// Recovery comes first, so that a panic in any other interceptor fails
+	// the call instead of the server.
+	interceptors := []grpc.UnaryServerInterceptor{igrpc.RecoverInterceptor}
+	streamInterceptors := []grpc.StreamServerInterceptor{igrpc.RecoverStreamInterceptor}
+	if *maxInFlight > 0 || *maxLatency > 0 {
+		shedder := igrpc.NewLoadShedder(igrpc.LoadShedConfig{
+			MaxInFlight: *maxInFlight,
+			MaxLatency:  *maxLatency,
+			Exempt: append([]string{healthpb.Health_Check_FullMethodName, healthpb.Health_Watch_FullMethodName},
+				igrpc.ReplicationMethods...),
+		})
+		expvar.Publish("load_shedding", shedder.Metrics())
+		interceptors = append(interceptors, shedder.UnaryInterceptor)
+		streamInterceptors = append(streamInterceptors, shedder.StreamInterceptor)
+	}
+	if *captureFile != "" {
+		recorder, err := igrpc.NewRecorder(igrpc.CaptureConfig{Path: *captureFile, Methods: splitList(*captureMethods)})
+		if err != nil {
+			panic(err)
+		}
+		defer recorder.Close()
+		interceptors = append(interceptors, recorder.UnaryInterceptor)
+		streamInterceptors = append(streamInterceptors, recorder.StreamInterceptor)
+	}
+	if *faultRules != "" || *faultHeader {
+		rules, err := igrpc.ParseFaultRules(*faultRules)
+		if err != nil {
+			panic(err)
+		}
+		if *faultSeed == 0 {
+			*faultSeed = time.Now().UnixNano()
+		}
+		faults, err := igrpc.NewFaultInjector(igrpc.FaultConfig{Rules: rules, Seed: *faultSeed, AllowHeader: *faultHeader})
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("fault injection enabled, seed", *faultSeed)
+		interceptors = append(interceptors, faults.UnaryInterceptor)
+		streamInterceptors = append(streamInterceptors, faults.StreamInterceptor)
+	}
+	interceptors = append(interceptors, igrpc.DeprecationInterceptor, auth.AuthInterceptor)
+	streamInterceptors = append(streamInterceptors, auth.AuthStreamInterceptor)
+	if node != nil {
+		auth.AddPublicMethods(igrpc.ReplicationMethods...)
+		interceptors = append(interceptors, node.ReadInterceptor)
+	}
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		panic(err)
+	}
+	if *maxConns > 0 || *maxConnsPerHost > 0 {
+		limited := igrpc.LimitConnections(lis, igrpc.ConnLimits{Max: *maxConns, PerHost: *maxConnsPerHost})
+		expvar.Publish("connections", limited.Metrics())
+		lis = limited
+	}
+
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(interceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:              *keepaliveTime,
+			Timeout:           *keepaliveTimeout,
+			MaxConnectionIdle: *maxConnIdle,
+			MaxConnectionAge:  *maxConnAge,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             *keepaliveMinTime,
+			PermitWithoutStream: *keepaliveWithoutStream,
+		}),
+		grpc.MaxConcurrentStreams(uint32(*maxStreams)),
+	)
+	userServer := igrpc.NewUserGRPCService(userService)
+	userV2Server := igrpc.NewUserV2GRPCService(userService)
+	if *emailOutbox != "" {
+		notifier := igrpc.NewWriterNotifier(os.Stdout)
+		if *emailOutbox != "-" {
+			if notifier, err = igrpc.OpenFileNotifier(*emailOutbox); err != nil {
+				panic(err)
+			}
+		}
+		defer notifier.Close()
+		verifier := igrpc.NewEmailVerifier(userService, tokens, notifier, *emailTokenTTL)
+		userServer.SetEmailVerifier(verifier)
+		userV2Server.SetEmailVerifier(verifier)
+	}
+	pb.RegisterUserServiceServer(s, userServer)
+	pbv2.RegisterUserServiceServer(s, userV2Server)
+	pb.RegisterAdminServiceServer(s, igrpc.NewAdminGRPCService(userService))
+	authServer := igrpc.NewAuthGRPCService(userService, tokens, igrpc.DefaultPasswordPolicy)
+	authServer.SetMFAIssuer(*mfaIssuer)
+	pb.RegisterAuthServiceServer(s, authServer)
+	if apiKeys != nil {
+		pb.RegisterAPIKeyServiceServer(s, igrpc.NewAPIKeyGRPCService(apiKeys))
+	}
+	if groups != nil {
+		pb.RegisterGroupServiceServer(s, igrpc.NewGroupGRPCService(groups))
+	}
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	if node != nil {
+		pb.RegisterReplicationServiceServer(s, igrpc.NewReplicationGRPCService(node))
+	}
+	var web *http.Server
+	if *webAddr != "" {
+		gw, err := igrpc.NewGateway(s, igrpc.GatewayConfig{AllowedOrigins: splitList(*webOrigins)})
+		if err != nil {
+			panic(err)
+		}
+		defer gw.Close()
+		webLis, err := net.Listen("tcp", *webAddr)
+		if err != nil {
+			panic(err)
+		}
+		if *maxConns > 0 || *maxConnsPerHost > 0 {
+			limited := igrpc.LimitConnections(webLis, igrpc.ConnLimits{Max: *maxConns, PerHost: *maxConnsPerHost})
+			expvar.Publish("web_connections", limited.Metrics())
+			webLis = limited
+		}
+		web = &http.Server{
+			Handler:           gw.Handler(),
+			ReadHeaderTimeout: *webReadHeaderTimeout,
+			IdleTimeout:       *webIdleTimeout,
+		}
+		go func() {
+			if err := web.Serve(webLis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic(err)
+			}
+		}()
+	}
+
+	if *metricsAddr != "" {
+		// expvar registers /debug/vars on the default mux.
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
+				panic(err)
 			}
 		}()
-		return handler(ctx, req)
-	}, igrpc.AuthInterceptor))
-	pb.RegisterUserServiceServer(s, igrpc.NewUserGRPCService(igrpc.NewUserService()))
+	}
+
+	// Stop serving on SIGINT or SIGTERM, so that the deferred closes flush
+	// the write-ahead log and leave raft cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		fmt.Println("shutting down")
+		timer := time.AfterFunc(*shutdownTimeout, s.Stop)
+		defer timer.Stop()
+		if web != nil {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			if err := web.Shutdown(shutdownCtx); err != nil {
+				_ = web.Close()
+			}
+			cancel()
+		}
+		s.GracefulStop()
+	}()
+
 	if err = s.Serve(lis); err != nil {
 		panic(err)
 	}
+	// Serve returns as soon as the listener closes; wait for the calls and
+	// the post hooks they started.
+	<-stopped
+	hooks.Wait()
+}
+
+// ensureUser returns the default tenant user called name, creating it with
+// password if there is none.
+func ensureUser(users *igrpc.UserService, name, password string) *igrpc.User {
+	for _, u := range users.List(igrpc.DefaultTenant) {
+		if u.Name == name {
+			return &u
+		}
+	}
+
+	if password == "" {
+		panic(fmt.Sprintf("user %s does not exist and no password is given to create it", name))
+	}
+	now := users.Now()
+	user, err := users.Create(igrpc.User{Name: name, Tenant: igrpc.DefaultTenant, CreatedAt: now, UpdatedAt: now})
+	if err != nil {
+		panic(err)
+	}
+	if err = users.SetPassword(igrpc.AnyTenant, user.ID, password, igrpc.DefaultPasswordPolicy); err != nil {
+		panic(err)
+	}
+	return user
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
 }
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	tpb "google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+type (
+	AdminGRPCServer struct {
+		userService *UserService
+		pb.UnimplementedAdminServiceServer
+	}
+)
+
+func NewAdminGRPCService(userService *UserService) *AdminGRPCServer {
+	return &AdminGRPCServer{userService: userService}
+}
+
+func (s *AdminGRPCServer) TriggerSnapshot(ctx context.Context, _ *emptypb.Empty) (*pb.TriggerSnapshotResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	info, err := s.userService.Snapshot()
+	if err != nil {
+		if errors.Is(err, ErrPersistenceDisabled) {
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"persistence is not enabled",
+			)
+		}
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("snapshot: %v", err),
+		)
+	}
+
+	return &pb.TriggerSnapshotResponse{
+		Seq:     info.Seq,
+		Users:   int32(info.Users),
+		TakenAt: tpb.New(info.TakenAt),
+	}, nil
+}
+
+// GetUserStats returns figures kept up to date by the UserService, so it
+// costs the same however many users there are.
+func (s *AdminGRPCServer) GetUserStats(ctx context.Context, req *pb.GetUserStatsRequest) (*pb.GetUserStatsResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if req.Days < 0 || req.Days > MaxStatsDays {
+		return nil, status.Errorf(codes.InvalidArgument, "days must be between 0 and %d", MaxStatsDays)
+	}
+
+	scope := req.Tenant
+	if scope == "" {
+		scope = AnyTenant
+	}
+	stats := s.userService.Stats(scope, s.userService.Now(), int(req.Days))
+
+	res := &pb.GetUserStatsResponse{
+		Total:    int64(stats.Total),
+		Disabled: int64(stats.Disabled),
+		Ages:     make([]*pb.AgeBucket, 0, len(stats.Ages)),
+		Days:     make([]*pb.DailyUserStats, 0, len(stats.Days)),
+	}
+	for _, b := range stats.Ages {
+		res.Ages = append(res.Ages, &pb.AgeBucket{MinAge: int32(b.Min), MaxAge: int32(b.Max), Count: int64(b.Count)})
+	}
+	for _, d := range stats.Days {
+		res.Days = append(res.Days, &pb.DailyUserStats{Day: tpb.New(d.Day), Created: int64(d.Created), Deleted: int64(d.Deleted)})
+	}
+
+	return res, nil
+}
+
+func (s *AdminGRPCServer) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*emptypb.Empty, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.userService.Unlock(AnyTenant, req.Id); err != nil {
+		return nil, serviceError("unlock user", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func requireAdmin(ctx context.Context) error {
+	p, err := principal(ctx)
+	if err != nil {
+		return err
+	}
+	if !p.HasRole(RoleAdmin) {
+		return status.Errorf(codes.PermissionDenied, "admin role required")
+	}
+	return nil
+}
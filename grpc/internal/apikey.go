@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	ScopeAdmin      = "admin"
+
+	apiKeyPrefix = "usk"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+	ErrInvalidScope   = errors.New("invalid scope")
+)
+
+// methodScopes lists the RPCs API keys may call and the scope each one needs.
+// Anything else, including key management itself, requires an interactive login.
+var methodScopes = map[string]string{
+	pb.UserService_GetUser_FullMethodName:          ScopeUsersRead,
+	pb.UserService_GetUserByEmail_FullMethodName:   ScopeUsersRead,
+	pb.UserService_BatchGetUsers_FullMethodName:    ScopeUsersRead,
+	pb.UserService_ListUsers_FullMethodName:        ScopeUsersRead,
+	pb.UserService_SelectUsers_FullMethodName:      ScopeUsersRead,
+	pb.UserService_SearchUsers_FullMethodName:      ScopeUsersRead,
+	pb.UserService_SyncUsers_FullMethodName:        ScopeUsersRead,
+	pb.UserService_WatchUsers_FullMethodName:       ScopeUsersRead,
+	pb.UserService_ListTransitions_FullMethodName:  ScopeUsersRead,
+	pb.UserService_CreateUser_FullMethodName:       ScopeUsersWrite,
+	pb.UserService_DeleteUser_FullMethodName:       ScopeUsersWrite,
+	pbv2.UserService_GetUser_FullMethodName:        ScopeUsersRead,
+	pbv2.UserService_BatchGetUsers_FullMethodName:  ScopeUsersRead,
+	pbv2.UserService_ListUsers_FullMethodName:      ScopeUsersRead,
+	pbv2.UserService_CreateUser_FullMethodName:     ScopeUsersWrite,
+	pbv2.UserService_UpdateUser_FullMethodName:     ScopeUsersWrite,
+	pbv2.UserService_DeleteUser_FullMethodName:     ScopeUsersWrite,
+	pb.AdminService_TriggerSnapshot_FullMethodName: ScopeAdmin,
+	pb.AdminService_GetUserStats_FullMethodName:    ScopeAdmin,
+	pb.AdminService_UnlockUser_FullMethodName:      ScopeAdmin,
+}
+
+type (
+	APIKey struct {
+		ID         string
+		Name       string
+		OwnerID    string
+		Tenant     string
+		Scopes     []string
+		CreatedAt  time.Time
+		ExpiresAt  time.Time // zero means the key does not expire
+		LastUsedAt time.Time
+		Revoked    bool
+
+		hash []byte
+	}
+
+	// APIKeyStore keeps API keys for service-to-service callers in memory.
+	// Only the SHA-256 of a key's secret is retained.
+	APIKeyStore struct {
+		// clock is time.Now unless SetClock replaces it.
+		clock func() time.Time
+
+		mx   sync.RWMutex
+		keys map[string]*APIKey
+	}
+)
+
+func NewAPIKeyStore() *APIKeyStore {
+	return &APIKeyStore{clock: time.Now, keys: make(map[string]*APIKey)}
+}
+
+// SetClock makes keys expire by now instead of time.Now. It must be called
+// before the store is used.
+func (s *APIKeyStore) SetClock(now func() time.Time) {
+	s.clock = now
+}
+
+func (k *APIKey) allows(method string) bool {
+	scope, ok := methodScopes[method]
+	if !ok {
+		return false
+	}
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// Create stores a new key for owner and returns it with its secret, which is
+// not retrievable afterwards.
+func (s *APIKeyStore) Create(owner *Principal, name string, scopes []string, expiresAt time.Time) (*APIKey, string, error) {
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeUsersRead, ScopeUsersWrite:
+		case ScopeAdmin:
+			if !owner.HasRole(RoleAdmin) {
+				return nil, "", fmt.Errorf("%w: %s requires the admin role", ErrInvalidScope, scope)
+			}
+		default:
+			return nil, "", fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	now := s.clock()
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return nil, "", fmt.Errorf("%w: expiry is in the past", ErrInvalidAPIKey)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", fmt.Errorf("generate api key: %w", err)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	hash := sha256.Sum256([]byte(secret))
+
+	key := &APIKey{
+		ID:        strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Name:      name,
+		OwnerID:   owner.UserID,
+		Tenant:    owner.Tenant,
+		Scopes:    slices.Clone(scopes),
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+		hash:      hash[:],
+	}
+
+	s.mx.Lock()
+	s.keys[key.ID] = key
+	s.mx.Unlock()
+
+	res := *key
+	return &res, fmt.Sprintf("%s_%s_%s", apiKeyPrefix, key.ID, secret), nil
+}
+
+// List returns the keys of ownerID, or every key in scope if ownerID is empty.
+func (s *APIKeyStore) List(scope, ownerID string) []APIKey {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var res []APIKey
+	for _, key := range s.keys {
+		if !visible(scope, key.Tenant) || (ownerID != "" && key.OwnerID != ownerID) {
+			continue
+		}
+		res = append(res, *key)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+
+	return res
+}
+
+// Revoke disables key id. Unless ownerID is empty, the key must belong to it.
+func (s *APIKeyStore) Revoke(scope, ownerID, id string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok || !visible(scope, key.Tenant) || (ownerID != "" && key.OwnerID != ownerID) {
+		return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	key.Revoked = true
+
+	return nil
+}
+
+// Authenticate resolves a raw key presented by a caller and records its use.
+func (s *APIKeyStore) Authenticate(raw string) (*APIKey, error) {
+	parts := strings.SplitN(raw, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return nil, ErrInvalidAPIKey
+	}
+	hash := sha256.Sum256([]byte(parts[2]))
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	key, ok := s.keys[parts[1]]
+	if !ok || subtle.ConstantTimeCompare(key.hash, hash[:]) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := s.clock()
+	if key.Revoked {
+		return nil, fmt.Errorf("%w: revoked", ErrInvalidAPIKey)
+	}
+	if !key.ExpiresAt.IsZero() && !now.Before(key.ExpiresAt) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidAPIKey)
+	}
+	key.LastUsedAt = now
+
+	res := *key
+	return &res, nil
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	tpb "google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+type (
+	APIKeyGRPCServer struct {
+		apiKeys *APIKeyStore
+		pb.UnimplementedAPIKeyServiceServer
+	}
+)
+
+func NewAPIKeyGRPCService(apiKeys *APIKeyStore) *APIKeyGRPCServer {
+	return &APIKeyGRPCServer{apiKeys: apiKeys}
+}
+
+func (s *APIKeyGRPCServer) CreateAPIKey(ctx context.Context, req *pb.CreateAPIKeyRequest) (*pb.CreateAPIKeyResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var expiresAt time.Time
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.AsTime()
+	}
+
+	key, secret, err := s.apiKeys.Create(p, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		return nil, apiKeyError("create api key", err)
+	}
+
+	return &pb.CreateAPIKeyResponse{Key: toProtoAPIKey(key), Secret: secret}, nil
+}
+
+// ListAPIKeys returns the caller's keys, or every key of the tenant for admins.
+func (s *APIKeyGRPCServer) ListAPIKeys(ctx context.Context, _ *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := s.apiKeys.List(p.TenantScope(), keyOwnerFilter(p))
+	res := &pb.ListAPIKeysResponse{Keys: make([]*pb.APIKey, 0, len(keys))}
+	for i := range keys {
+		res.Keys = append(res.Keys, toProtoAPIKey(&keys[i]))
+	}
+
+	return res, nil
+}
+
+func (s *APIKeyGRPCServer) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*emptypb.Empty, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.apiKeys.Revoke(p.TenantScope(), keyOwnerFilter(p), req.Id); err != nil {
+		return nil, apiKeyError("revoke api key", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// keyOwnerFilter limits non-admins to their own keys.
+func keyOwnerFilter(p *Principal) string {
+	if p.HasRole(RoleAdmin) {
+		return ""
+	}
+	return p.UserID
+}
+
+func apiKeyError(op string, err error) error {
+	switch {
+	case errors.Is(err, ErrAPIKeyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrInvalidScope), errors.Is(err, ErrInvalidAPIKey):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Errorf(codes.Internal, fmt.Sprintf("%s: %v", op, err))
+	}
+}
+
+func toProtoAPIKey(key *APIKey) *pb.APIKey {
+	res := &pb.APIKey{
+		Id:        key.ID,
+		Name:      key.Name,
+		OwnerId:   key.OwnerID,
+		Tenant:    key.Tenant,
+		Scopes:    key.Scopes,
+		CreatedAt: tpb.New(key.CreatedAt),
+		Revoked:   key.Revoked,
+	}
+	if !key.ExpiresAt.IsZero() {
+		res.ExpiresAt = tpb.New(key.ExpiresAt)
+	}
+	if !key.LastUsedAt.IsZero() {
+		res.LastUsedAt = tpb.New(key.LastUsedAt)
+	}
+	return res
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+func TestAPIKeyAdminScopeFollowsOwnerRole(t *testing.T) {
+	s := NewUserService()
+	owner, err := s.Create(User{Name: "owner", Tenant: DefaultTenant})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewAPIKeyStore()
+	auth := NewAuthenticator(s, NewTokenIssuer([]byte("secret"), time.Minute, time.Hour), keys)
+	roles := StaticRoles{owner.ID: {RoleAdmin}}
+	auth.AddRoleSource(roles)
+
+	_, secret, err := keys.Create(&Principal{UserID: owner.ID, Tenant: owner.Tenant, Roles: []string{RoleAdmin}}, "ops", []string{ScopeAdmin}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", secret))
+
+	p, err := callAs(ctx, auth, pb.AdminService_UnlockUser_FullMethodName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasRole(RoleAdmin) {
+		t.Fatalf("roles of the key of an admin = %v, want %s", p.Roles, RoleAdmin)
+	}
+
+	delete(roles, owner.ID)
+	if p, err = callAs(ctx, auth, pb.AdminService_UnlockUser_FullMethodName); err != nil {
+		t.Fatal(err)
+	}
+	if p.HasRole(RoleAdmin) {
+		t.Fatalf("the key of a former admin kept the %s role", RoleAdmin)
+	}
+
+	if err = s.Delete(AnyTenant, owner.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = callAs(ctx, auth, pb.UserService_GetUser_FullMethodName); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("call with the key of a deleted owner: %v, want %v", err, codes.Unauthenticated)
+	}
+}
@@ -2,30 +2,314 @@ package internal
 
 import (
 	"context"
+	"slices"
+	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+const (
+	// DefaultTenant is used for callers that do not send a tenant header.
+	DefaultTenant = "default"
+
+	RoleAdmin = "admin"
 )
 
+type (
+	Principal struct {
+		UserID string
+		Tenant string
+		Roles  []string
+		// Token is set when the caller authenticated with an access token.
+		Token *TokenClaims
+		// APIKey is set when the caller authenticated with an API key.
+		APIKey *APIKey
+		// SteppedUp is set when the caller may call the methods that require
+		// a second factor: its access token carries a recent enough one. API
+		// keys outlive any verification, so they never may.
+		SteppedUp bool
+	}
+
+	// principalStream carries the authenticated principal in its context.
+	principalStream struct {
+		grpc.ServerStream
+		ctx context.Context
+	}
+
+	// Authenticator resolves the caller of every non-public RPC to a Principal.
+	Authenticator struct {
+		userService *UserService
+		tokens      *TokenIssuer
+		apiKeys     *APIKeyStore
+		roleSources []RoleSource
+		public      map[string]bool
+		// headerAuth accepts the userID header; see AllowHeaderAuth.
+		headerAuth bool
+		// stepUp holds the methods that require a second factor verified
+		// within stepUpMaxAge.
+		stepUp       map[string]bool
+		stepUpMaxAge time.Duration
+	}
+
+	// StaticRoles grants fixed roles to users by ID, e.g. to the first admin.
+	StaticRoles map[string][]string
+
+	// RoleSource grants additional roles to authenticated users, e.g. through
+	// group membership.
+	RoleSource interface {
+		RolesFor(tenant, userID string) []string
+	}
+
+	principalKey struct{}
+)
+
+// RolesFor makes StaticRoles a RoleSource.
+func (r StaticRoles) RolesFor(_, userID string) []string {
+	return r[userID]
+}
+
+func (p *Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// TenantScope is the tenant p may operate on: its own, or AnyTenant for admins.
+func (p *Principal) TenantScope() string {
+	if p.HasRole(RoleAdmin) {
+		return AnyTenant
+	}
+	return p.Tenant
+}
+
 func GetUserID(ctx context.Context) string {
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return ""
+	return firstMetadata(ctx, "userID")
+}
+
+// PrincipalFromContext returns the principal stored by AuthInterceptor.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+func ContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// NewAuthenticator accepts API keys from apiKeys in the x-api-key header and
+// bearer access tokens issued by tokens. A nil apiKeys rejects every key.
+func NewAuthenticator(userService *UserService, tokens *TokenIssuer, apiKeys *APIKeyStore) *Authenticator {
+	return &Authenticator{
+		userService: userService,
+		tokens:      tokens,
+		apiKeys:     apiKeys,
+		stepUp:      make(map[string]bool),
+		public: map[string]bool{
+			pb.AuthService_Login_FullMethodName:        true,
+			pb.AuthService_RefreshToken_FullMethodName: true,
+			pb.UserService_VerifyEmail_FullMethodName:  true,
+		},
 	}
-	userID := md.Get("userID")
-	if len(userID) == 0 {
-		return ""
+}
+
+// AllowHeaderAuth also accepts callers that only send the userID header of an
+// existing, active user. The header proves nothing, so this is for local
+// development only. Tenant and roles are never taken from headers.
+func (a *Authenticator) AllowHeaderAuth() {
+	a.headerAuth = true
+}
+
+// AddRoleSource merges the roles from src into every user principal. API key
+// principals keep the roles of their scopes only.
+func (a *Authenticator) AddRoleSource(src RoleSource) {
+	a.roleSources = append(a.roleSources, src)
+}
+
+// AddPublicMethods lets methods be called without credentials. Their
+// handlers authenticate the caller themselves.
+func (a *Authenticator) AddPublicMethods(methods ...string) {
+	for _, m := range methods {
+		a.public[m] = true
+	}
+}
+
+// RequireMFA makes users verify a second factor through
+// AuthService.VerifyMFA no longer than maxAge before calling methods. API
+// keys may not call them.
+func (a *Authenticator) RequireMFA(maxAge time.Duration, methods ...string) {
+	a.stepUpMaxAge = maxAge
+	for _, m := range methods {
+		a.stepUp[m] = true
+	}
+}
+
+func (a *Authenticator) AuthInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if a.public[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	p, err := a.principal(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ContextWithPrincipal(ctx, p), req)
+}
+
+// AuthStreamInterceptor is AuthInterceptor for streaming RPCs.
+func (a *Authenticator) AuthStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if a.public[info.FullMethod] {
+		return handler(srv, ss)
+	}
+
+	p, err := a.principal(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
 	}
-	return userID[0]
+
+	return handler(srv, &principalStream{ServerStream: ss, ctx: ContextWithPrincipal(ss.Context(), p)})
 }
 
-func AuthInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+// principal authenticates the caller of method.
+func (a *Authenticator) principal(ctx context.Context, method string) (*Principal, error) {
+	p, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.APIKey != nil && !p.APIKey.allows(method) {
+		return nil, status.Errorf(codes.PermissionDenied, "api key is not allowed to call %s", method)
+	}
+	p.SteppedUp = a.steppedUp(p)
+	if a.stepUp[method] && !p.SteppedUp {
+		if p.APIKey != nil {
+			return nil, status.Errorf(codes.PermissionDenied,
+				"%s requires a second factor, which api keys cannot carry; call it with an access token", method)
+		}
+		return nil, status.Errorf(codes.PermissionDenied,
+			"%s requires a second factor verified within %v; call AuthService.VerifyMFA", method, a.stepUpMaxAge)
+	}
+	for _, src := range a.roleSources {
+		for _, role := range src.RolesFor(p.Tenant, p.UserID) {
+			// A key holds no roles of its own: the admin scope only lets it
+			// act as admin while its owner is one.
+			if p.APIKey != nil && (role != RoleAdmin || !slices.Contains(p.APIKey.Scopes, ScopeAdmin)) {
+				continue
+			}
+			if !p.HasRole(role) {
+				p.Roles = append(p.Roles, role)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// steppedUp reports whether p verified a second factor recently enough.
+func (a *Authenticator) steppedUp(p *Principal) bool {
+	if p.Token == nil || p.Token.MFAAt == 0 {
+		return false
+	}
+	return a.userService.Now().Sub(time.Unix(p.Token.MFAAt, 0)) <= a.stepUpMaxAge
+}
+
+func (a *Authenticator) authenticate(ctx context.Context) (*Principal, error) {
+	if key := firstMetadata(ctx, "x-api-key"); key != "" {
+		return a.authenticateAPIKey(key)
+	}
+	if token := bearerToken(ctx); token != "" {
+		return a.authenticateToken(token)
+	}
+
 	userID := GetUserID(ctx)
-	if userID == "" {
-		return nil, status.Errorf(codes.Unauthenticated, "missing user ID")
+	if userID == "" || !a.headerAuth {
+		return nil, status.Errorf(codes.Unauthenticated, "missing credentials")
+	}
+	user, err := a.activeUser("userID header", AnyTenant, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		UserID: user.ID,
+		Tenant: user.Tenant,
+	}, nil
+}
+
+func (a *Authenticator) authenticateToken(token string) (*Principal, error) {
+	claims, err := a.tokens.Verify(token, TokenAccess)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "access token: %v", err)
 	}
 
-	return handler(ctx, req)
+	user, err := a.activeUser("access token", claims.Tenant, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		UserID: user.ID,
+		Tenant: user.Tenant,
+		Token:  claims,
+	}, nil
+}
+
+// activeUser loads the user that credentials of kind belong to, rejecting
+// unknown and inactive users.
+func (a *Authenticator) activeUser(kind, scope, id string) (*User, error) {
+	user, err := a.userService.Get(scope, id)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "%s: unknown user", kind)
+	}
+	if user.Inactive(a.userService.Now()) {
+		return nil, status.Errorf(codes.PermissionDenied, "user disabled: %s", user.ID)
+	}
+	return user, nil
+}
+
+func (a *Authenticator) authenticateAPIKey(raw string) (*Principal, error) {
+	if a.apiKeys == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "api keys are not enabled")
+	}
+	key, err := a.apiKeys.Authenticate(raw)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "api key: %v", err)
+	}
+	// A key dies with its owner, and is suspended while the owner is.
+	if _, err := a.activeUser("api key", key.Tenant, key.OwnerID); err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		UserID: key.OwnerID,
+		Tenant: key.Tenant,
+		APIKey: key,
+	}, nil
+}
+
+func (s *principalStream) Context() context.Context {
+	return s.ctx
+}
+
+func bearerToken(ctx context.Context) string {
+	token, ok := strings.CutPrefix(firstMetadata(ctx, "authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func firstMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
 }
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticatorHeaderAuth(t *testing.T) {
+	s := NewUserService()
+	user, err := s.Create(User{Name: "alice", Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthenticator(s, NewTokenIssuer([]byte("secret"), time.Minute, time.Hour), NewAPIKeyStore())
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"userID", user.ID, "tenant", "globex", "roles", RoleAdmin,
+	))
+
+	if _, err = callAs(ctx, auth, "/test/Call"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("userID header without AllowHeaderAuth: %v, want %v", err, codes.Unauthenticated)
+	}
+
+	auth.AllowHeaderAuth()
+	p, err := callAs(ctx, auth, "/test/Call")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Tenant != "acme" || p.HasRole(RoleAdmin) {
+		t.Fatalf("principal of tenant %q with roles %v, want the user's acme and no roles from headers", p.Tenant, p.Roles)
+	}
+
+	missing := metadata.NewIncomingContext(context.Background(), metadata.Pairs("userID", "missing"))
+	if _, err = callAs(missing, auth, "/test/Call"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("userID header of a missing user: %v, want %v", err, codes.Unauthenticated)
+	}
+
+	auth.AddRoleSource(StaticRoles{user.ID: {RoleAdmin}})
+	if p, err = callAs(ctx, auth, "/test/Call"); err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasRole(RoleAdmin) {
+		t.Fatalf("roles = %v, want %s from the static roles", p.Roles, RoleAdmin)
+	}
+}
+
+// callAs runs a unary call of method through auth and returns the principal
+// its handler sees.
+func callAs(ctx context.Context, auth *Authenticator, method string) (*Principal, error) {
+	var p *Principal
+	_, err := auth.AuthInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, _ any) (any, error) {
+		p, _ = PrincipalFromContext(ctx)
+		return nil, nil
+	})
+	return p, err
+}
@@ -0,0 +1,551 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+const (
+	BalanceRoundRobin = "round_robin"
+	BalancePickFirst  = "pick_first"
+
+	DefaultHealthCheckInterval = 5 * time.Second
+	DefaultResolveInterval     = 30 * time.Second
+	DefaultEjectionTime        = 10 * time.Second
+	DefaultMaxHedges           = 2
+)
+
+var ErrNoEndpoints = errors.New("no endpoints")
+
+type (
+	// EndpointResolver lists the addresses of the servers a Balancer spreads
+	// calls over. It is called again every ResolveInterval.
+	EndpointResolver interface {
+		Resolve(ctx context.Context) ([]string, error)
+	}
+
+	// StaticEndpoints is a fixed list of addresses.
+	StaticEndpoints []string
+
+	// DNSEndpoints resolves every address of a host:port name.
+	DNSEndpoints string
+
+	// FileEndpoints reads addresses from a file, one per line. Blank lines and
+	// lines starting with # are ignored.
+	FileEndpoints string
+
+	BalancerConfig struct {
+		// Policy is BalanceRoundRobin or BalancePickFirst. Round-robin when empty.
+		Policy string
+		// HealthCheckInterval is how often endpoints are probed with the gRPC
+		// health service; negative disables probing.
+		HealthCheckInterval time.Duration
+		// ResolveInterval is how often the resolver is asked again.
+		ResolveInterval time.Duration
+		// EjectionTime is how long an endpoint that failed with Unavailable or
+		// a health check is skipped, unless a health check readmits it first.
+		EjectionTime time.Duration
+		// HedgeDelay enables hedged reads: when a read has not completed after
+		// HedgeDelay, it is also sent to the next endpoint, up to MaxHedges
+		// extra times. The first answer wins.
+		HedgeDelay time.Duration
+		MaxHedges  int
+		// DialOptions default to plaintext connections.
+		DialOptions []grpc.DialOption
+	}
+
+	// Balancer is a grpc.ClientConnInterface over one connection per endpoint.
+	// Calls go to a healthy endpoint chosen by the configured policy. Reads
+	// that fail with Unavailable fail over to the next endpoint; writes are
+	// not retried, as they may have been applied.
+	Balancer struct {
+		cfg      BalancerConfig
+		resolver EndpointResolver
+
+		mx        sync.RWMutex
+		endpoints []*endpoint
+		next      atomic.Uint64
+
+		stop chan struct{}
+		done chan struct{}
+	}
+
+	endpoint struct {
+		addr string
+		conn *grpc.ClientConn
+		// ejectedUntil is a UnixNano time before which the endpoint is skipped.
+		ejectedUntil atomic.Int64
+
+		// calls counts the callers holding the endpoint. Once the resolver
+		// drops it, the connection is closed when the last one lets go.
+		mx      sync.Mutex
+		calls   int
+		retired bool
+	}
+
+	// endpointStream releases its endpoint once the stream is over.
+	endpointStream struct {
+		grpc.ClientStream
+		release func()
+		stop    func() bool
+	}
+)
+
+func (e StaticEndpoints) Resolve(context.Context) ([]string, error) {
+	return e, nil
+}
+
+func (e DNSEndpoints) Resolve(ctx context.Context) ([]string, error) {
+	host, port, err := net.SplitHostPort(string(e))
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", e, err)
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", e, err)
+	}
+
+	res := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		res = append(res, net.JoinHostPort(a, port))
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
+func (e FileEndpoints) Resolve(context.Context) ([]string, error) {
+	f, err := os.Open(string(e))
+	if err != nil {
+		return nil, fmt.Errorf("read endpoints: %w", err)
+	}
+	defer f.Close()
+
+	var res []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			res = append(res, line)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("read endpoints: %w", err)
+	}
+
+	return res, nil
+}
+
+// NewBalancer resolves the initial endpoints and starts re-resolving and
+// health checking them in the background.
+func NewBalancer(resolver EndpointResolver, cfg BalancerConfig) (*Balancer, error) {
+	if cfg.Policy == "" {
+		cfg.Policy = BalanceRoundRobin
+	}
+	if cfg.Policy != BalanceRoundRobin && cfg.Policy != BalancePickFirst {
+		return nil, fmt.Errorf("unknown balancing policy: %q", cfg.Policy)
+	}
+	if cfg.HealthCheckInterval == 0 {
+		cfg.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if cfg.ResolveInterval <= 0 {
+		cfg.ResolveInterval = DefaultResolveInterval
+	}
+	if cfg.EjectionTime <= 0 {
+		cfg.EjectionTime = DefaultEjectionTime
+	}
+	if cfg.MaxHedges <= 0 {
+		cfg.MaxHedges = DefaultMaxHedges
+	}
+	if len(cfg.DialOptions) == 0 {
+		cfg.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+
+	b := &Balancer{
+		cfg:      cfg,
+		resolver: resolver,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ResolveInterval)
+	defer cancel()
+	if err := b.resolve(ctx); err != nil {
+		return nil, err
+	}
+	if cfg.HealthCheckInterval > 0 {
+		b.checkHealth()
+	}
+
+	go b.loop()
+
+	return b, nil
+}
+
+// NewBalancedClient returns a Client spreading its calls over the endpoints
+// listed by resolver. Close releases its connections.
+func NewBalancedClient(resolver EndpointResolver, cfg BalancerConfig, opts ...ClientOption) (*Client, error) {
+	b, err := NewBalancer(resolver, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewClient(pb.NewUserServiceClient(b), opts...)
+	c.closer = b
+
+	return c, nil
+}
+
+func (b *Balancer) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	order := b.order()
+	defer release(order)
+	if len(order) == 0 {
+		return status.Error(codes.Unavailable, ErrNoEndpoints.Error())
+	}
+
+	msg, ok := reply.(proto.Message)
+	if !ok || methodScopes[method] != ScopeUsersRead {
+		err := order[0].conn.Invoke(ctx, method, args, reply, opts...)
+		b.observe(order[0], err)
+		return err
+	}
+
+	return b.read(ctx, order, method, args, msg, opts)
+}
+
+// NewStream opens streams on the first endpoint in order, without failover.
+// The endpoint is held until the stream ends with an error or io.EOF, or ctx
+// is done.
+func (b *Balancer) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	order := b.order()
+	if len(order) == 0 {
+		return nil, status.Error(codes.Unavailable, ErrNoEndpoints.Error())
+	}
+	ep := order[0]
+	release(order[1:])
+
+	stream, err := ep.conn.NewStream(ctx, desc, method, opts...)
+	b.observe(ep, err)
+	if err != nil {
+		ep.release()
+		return nil, err
+	}
+
+	s := &endpointStream{ClientStream: stream}
+	s.release = sync.OnceFunc(ep.release)
+	s.stop = context.AfterFunc(ctx, s.release)
+	return s, nil
+}
+
+// Endpoints returns the current addresses and whether each is in rotation.
+func (b *Balancer) Endpoints() map[string]bool {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+
+	res := make(map[string]bool, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		res[ep.addr] = ep.healthy()
+	}
+	return res
+}
+
+func (b *Balancer) Close() error {
+	close(b.stop)
+	<-b.done
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	var errs []error
+	for _, ep := range b.endpoints {
+		errs = append(errs, ep.retire())
+	}
+	b.endpoints = nil
+
+	return errors.Join(errs...)
+}
+
+// read sends a read to the endpoints of order in turn. The next endpoint is
+// tried when the previous attempt fails with Unavailable or, with hedging,
+// when it is still running after HedgeDelay. The first answer wins and the
+// other attempts are cancelled.
+func (b *Balancer) read(ctx context.Context, order []*endpoint, method string, args any, reply proto.Message, opts []grpc.CallOption) error {
+	hedging := b.cfg.HedgeDelay > 0
+	if hedging {
+		order = order[:min(len(order), 1+b.cfg.MaxHedges)]
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		reply proto.Message
+		err   error
+	}
+	results := make(chan result, len(order))
+	launched := 0
+	launch := func() {
+		ep := order[launched]
+		launched++
+		r := reply.ProtoReflect().New().Interface()
+		go func() {
+			err := ep.conn.Invoke(ctx, method, args, r, opts...)
+			b.observe(ep, err)
+			results <- result{reply: r, err: err}
+		}()
+	}
+
+	var hedge <-chan time.Time
+	launch()
+	if hedging && launched < len(order) {
+		hedge = time.After(b.cfg.HedgeDelay)
+	}
+
+	var err error
+	for pending := 1; pending > 0; {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				proto.Reset(reply)
+				proto.Merge(reply, res.reply)
+				return nil
+			}
+			err = res.err
+			if status.Code(err) != codes.Unavailable {
+				return err
+			}
+			if launched < len(order) {
+				launch()
+				pending++
+			}
+		case <-hedge:
+			hedge = nil
+			if launched < len(order) {
+				launch()
+				pending++
+				if launched < len(order) {
+					hedge = time.After(b.cfg.HedgeDelay)
+				}
+			}
+		}
+	}
+
+	return err
+}
+
+// order returns the endpoints to try, healthy ones first. Pick-first keeps
+// the resolver's order; round-robin starts one further on every call. The
+// caller must release them.
+func (b *Balancer) order() []*endpoint {
+	eps := b.acquire()
+	if b.cfg.Policy == BalanceRoundRobin && len(eps) > 0 {
+		i := int(b.next.Add(1)-1) % len(eps)
+		eps = slices.Concat(eps[i:], eps[:i])
+	}
+	sort.SliceStable(eps, func(i, j int) bool {
+		return eps[i].healthy() && !eps[j].healthy()
+	})
+
+	return eps
+}
+
+// observe ejects ep when a call fails in a way that suggests the server is gone.
+func (b *Balancer) observe(ep *endpoint, err error) {
+	if status.Code(err) == codes.Unavailable {
+		ep.eject(b.cfg.EjectionTime)
+	}
+}
+
+func (b *Balancer) loop() {
+	defer close(b.done)
+
+	resolve := time.NewTicker(b.cfg.ResolveInterval)
+	defer resolve.Stop()
+
+	var health <-chan time.Time
+	if b.cfg.HealthCheckInterval > 0 {
+		t := time.NewTicker(b.cfg.HealthCheckInterval)
+		defer t.Stop()
+		health = t.C
+	}
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-resolve.C:
+			ctx, cancel := context.WithTimeout(context.Background(), b.cfg.ResolveInterval)
+			if err := b.resolve(ctx); err != nil {
+				fmt.Println("resolve endpoints:", err)
+			}
+			cancel()
+		case <-health:
+			b.checkHealth()
+		}
+	}
+}
+
+// acquire returns the current endpoints, held so that a concurrent resolve
+// does not close them under the caller, who must release them.
+func (b *Balancer) acquire() []*endpoint {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+
+	eps := slices.Clone(b.endpoints)
+	for _, ep := range eps {
+		ep.acquire()
+	}
+	return eps
+}
+
+// resolve replaces the endpoints with the resolver's current list, keeping
+// the connections of the addresses that remain. If an address cannot be
+// dialed, the endpoints are left as they were. Dropped endpoints are closed
+// once the calls already using them end.
+func (b *Balancer) resolve(ctx context.Context) error {
+	addrs, err := b.resolver.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return ErrNoEndpoints
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	current := make(map[string]*endpoint, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		current[ep.addr] = ep
+	}
+
+	endpoints := make([]*endpoint, 0, len(addrs))
+	var dialed []*endpoint
+	for _, addr := range addrs {
+		if ep, ok := current[addr]; ok {
+			endpoints = append(endpoints, ep)
+			delete(current, addr)
+			continue
+		}
+		conn, err := grpc.Dial(addr, b.cfg.DialOptions...)
+		if err != nil {
+			for _, ep := range dialed {
+				_ = ep.conn.Close()
+			}
+			return fmt.Errorf("dial %s: %w", addr, err)
+		}
+		ep := &endpoint{addr: addr, conn: conn}
+		endpoints, dialed = append(endpoints, ep), append(dialed, ep)
+	}
+	b.endpoints = endpoints
+	for _, ep := range current {
+		_ = ep.retire()
+	}
+
+	return nil
+}
+
+// checkHealth probes every endpoint concurrently. Servers without a health
+// service count as healthy.
+func (b *Balancer) checkHealth() {
+	eps := b.acquire()
+	defer release(eps)
+
+	var wg sync.WaitGroup
+	for _, ep := range eps {
+		wg.Add(1)
+		go func(ep *endpoint) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), b.cfg.HealthCheckInterval)
+			defer cancel()
+
+			res, err := healthpb.NewHealthClient(ep.conn).Check(ctx, &healthpb.HealthCheckRequest{})
+			switch {
+			case status.Code(err) == codes.Unimplemented:
+				ep.readmit()
+			case err != nil || res.Status != healthpb.HealthCheckResponse_SERVING:
+				ep.eject(b.cfg.EjectionTime)
+			default:
+				ep.readmit()
+			}
+		}(ep)
+	}
+	wg.Wait()
+}
+
+func (e *endpoint) healthy() bool {
+	return time.Now().UnixNano() >= e.ejectedUntil.Load()
+}
+
+func (e *endpoint) eject(d time.Duration) {
+	e.ejectedUntil.Store(time.Now().Add(d).UnixNano())
+}
+
+func (e *endpoint) readmit() {
+	e.ejectedUntil.Store(0)
+}
+
+func (e *endpoint) acquire() {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	e.calls++
+}
+
+func (e *endpoint) release() {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if e.calls--; e.calls == 0 && e.retired {
+		_ = e.conn.Close()
+	}
+}
+
+// retire closes the connection of an endpoint no longer picked, or leaves
+// that to the last release.
+func (e *endpoint) retire() error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	e.retired = true
+	if e.calls > 0 {
+		return nil
+	}
+	return e.conn.Close()
+}
+
+func release(eps []*endpoint) {
+	for _, ep := range eps {
+		ep.release()
+	}
+}
+
+func (s *endpointStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.stop()
+		s.release()
+	}
+	return err
+}
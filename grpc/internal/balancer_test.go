@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+type (
+	// nameServer answers GetUser with its own name as the user ID.
+	nameServer struct {
+		pb.UnimplementedUserServiceServer
+		name string
+		addr string
+		grpc *grpc.Server
+		// started and unblock hold GetUser until the test lets it finish.
+		started chan struct{}
+		unblock chan struct{}
+	}
+
+	// mutableEndpoints resolves to whatever the test set last.
+	mutableEndpoints struct {
+		mx    sync.Mutex
+		addrs []string
+	}
+)
+
+func TestBalancerRoundRobinSpreadsCalls(t *testing.T) {
+	servers := startNameServers(t, "a", "b", "c")
+	b := newTestBalancer(t, StaticEndpoints{servers[0].addr, servers[1].addr, servers[2].addr}, BalanceRoundRobin)
+
+	got := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		got[callName(t, b)]++
+	}
+	for _, s := range servers {
+		if got[s.name] != 2 {
+			t.Fatalf("calls per server = %v, want 2 each", got)
+		}
+	}
+}
+
+func TestBalancerFailsOverReads(t *testing.T) {
+	servers := startNameServers(t, "a", "b")
+	b := newTestBalancer(t, StaticEndpoints{servers[0].addr, servers[1].addr}, BalancePickFirst)
+	servers[0].grpc.Stop()
+
+	for i := 0; i < 3; i++ {
+		if got := callName(t, b); got != "b" {
+			t.Fatalf("call %d went to %s, want b", i, got)
+		}
+	}
+	if b.Endpoints()[servers[0].addr] {
+		t.Fatalf("stopped server is still in rotation")
+	}
+}
+
+func TestBalancerResolveDrainsRemovedEndpoint(t *testing.T) {
+	servers := startNameServers(t, "a", "b")
+	servers[0].started, servers[0].unblock = make(chan struct{}), make(chan struct{})
+	resolver := &mutableEndpoints{addrs: []string{servers[0].addr}}
+	b := newTestBalancer(t, resolver, BalancePickFirst)
+	removed := b.endpoints[0]
+
+	done := make(chan string)
+	go func() {
+		done <- callName(t, b)
+	}()
+	<-servers[0].started
+
+	resolver.set(servers[1].addr)
+	if err := b.resolve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.Endpoints()[servers[0].addr]; ok {
+		t.Fatalf("removed endpoint is still listed")
+	}
+	if removed.conn.GetState() == connectivity.Shutdown {
+		t.Fatalf("removed endpoint was closed under an in-flight call")
+	}
+
+	close(servers[0].unblock)
+	if got := <-done; got != "a" {
+		t.Fatalf("in-flight call answered by %s, want a", got)
+	}
+	if state := removed.conn.GetState(); state != connectivity.Shutdown {
+		t.Fatalf("removed endpoint is %v after its last call, want %v", state, connectivity.Shutdown)
+	}
+	if got := callName(t, b); got != "b" {
+		t.Fatalf("call went to %s, want b", got)
+	}
+}
+
+func TestBalancerResolveKeepsEndpointsWhenDialFails(t *testing.T) {
+	servers := startNameServers(t, "a", "b")
+	resolver := &mutableEndpoints{addrs: []string{servers[0].addr}}
+	b := newTestBalancer(t, resolver, BalancePickFirst)
+
+	resolver.set(servers[0].addr, servers[1].addr, "dns:///a:b:c")
+	if err := b.resolve(context.Background()); err == nil {
+		t.Fatalf("resolve to an address that cannot be dialed succeeded")
+	}
+	if got := b.Endpoints(); len(got) != 1 || !got[servers[0].addr] {
+		t.Fatalf("endpoints after failed resolve = %v, want only %s", got, servers[0].addr)
+	}
+	if got := callName(t, b); got != "a" {
+		t.Fatalf("call went to %s, want a", got)
+	}
+
+	resolver.set(servers[0].addr, servers[1].addr)
+	if err := b.resolve(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Endpoints(); len(got) != 2 {
+		t.Fatalf("endpoints = %v, want both servers", got)
+	}
+}
+
+func (s *nameServer) GetUser(ctx context.Context, _ *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	if s.started != nil {
+		close(s.started)
+		select {
+		case <-s.unblock:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &pb.GetUserResponse{User: &pb.User{Id: &s.name}}, nil
+}
+
+func (r *mutableEndpoints) Resolve(context.Context) ([]string, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return r.addrs, nil
+}
+
+func (r *mutableEndpoints) set(addrs ...string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.addrs = addrs
+}
+
+func startNameServers(t *testing.T, names ...string) []*nameServer {
+	t.Helper()
+
+	res := make([]*nameServer, 0, len(names))
+	for _, name := range names {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &nameServer{name: name, addr: lis.Addr().String(), grpc: grpc.NewServer()}
+		pb.RegisterUserServiceServer(s.grpc, s)
+		healthpb.RegisterHealthServer(s.grpc, health.NewServer())
+		go func() {
+			_ = s.grpc.Serve(lis)
+		}()
+		t.Cleanup(s.grpc.Stop)
+		res = append(res, s)
+	}
+	return res
+}
+
+func newTestBalancer(t *testing.T, resolver EndpointResolver, policy string) *Balancer {
+	t.Helper()
+
+	b, err := NewBalancer(resolver, BalancerConfig{
+		Policy:              policy,
+		HealthCheckInterval: -1,
+		ResolveInterval:     time.Hour,
+		EjectionTime:        time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+	return b
+}
+
+func callName(t *testing.T, b *Balancer) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := pb.NewUserServiceClient(b).GetUser(ctx, &pb.GetUserRequest{})
+	if err != nil {
+		t.Errorf("get user: %v", err)
+		return ""
+	}
+	return res.User.GetId()
+}
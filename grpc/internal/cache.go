@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"container/list"
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+const (
+	DefaultCacheSize = 10000
+
+	watchRetryDelay = time.Second
+)
+
+type (
+	CacheConfig struct {
+		// Size is the maximum number of entries. DefaultCacheSize when zero.
+		Size int
+		// TTL is how long a user is served from the cache.
+		TTL time.Duration
+		// NegativeTTL is how long a NotFound answer is served from the cache.
+		// Zero disables negative caching.
+		NegativeTTL time.Duration
+	}
+
+	CacheStats struct {
+		Hits uint64
+		// NegativeHits are the hits answered with a cached NotFound.
+		NegativeHits  uint64
+		Misses        uint64
+		Evictions     uint64
+		Invalidations uint64
+		Size          int
+	}
+
+	// userCache is an LRU of GetUser answers. Entries are keyed by the
+	// caller's outgoing metadata as well as the ID, as callers may be allowed
+	// to see different users.
+	userCache struct {
+		cfg CacheConfig
+
+		mx      sync.Mutex
+		entries map[cacheKey]*list.Element
+		byID    map[string]map[cacheKey]struct{}
+		lru     *list.List
+		// epoch changes on every invalidation, so that answers fetched
+		// before one are not cached after it.
+		epoch uint64
+		stats CacheStats
+	}
+
+	cacheKey struct {
+		md string
+		id string
+	}
+
+	cacheEntry struct {
+		key cacheKey
+		// user is nil for a cached NotFound.
+		user    *User
+		expires time.Time
+	}
+)
+
+// WithCache serves GetUser from a read-through LRU cache. The client's own
+// CreateUser and DeleteUser calls invalidate it; WatchCacheInvalidations
+// extends that to changes made by others.
+func WithCache(cfg CacheConfig) ClientOption {
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultCacheSize
+	}
+	return func(c *Client) {
+		c.cache = &userCache{
+			cfg:     cfg,
+			entries: make(map[cacheKey]*list.Element),
+			byID:    make(map[string]map[cacheKey]struct{}),
+			lru:     list.New(),
+		}
+	}
+}
+
+// CacheStats returns the GetUser cache counters. They are zero without WithCache.
+func (c *Client) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+	return c.cache.snapshot()
+}
+
+// WatchCacheInvalidations keeps the cache coherent with changes made through
+// other clients until ctx is done, following the server's WatchUsers stream
+// and reconnecting when it breaks. ctx must carry the credentials the stream
+// is opened with. Against a server without the stream, entries only expire.
+func (c *Client) WatchCacheInvalidations(ctx context.Context) {
+	if c.cache == nil {
+		return
+	}
+
+	go func() {
+		var since uint64
+		for {
+			err := c.watchCache(ctx, &since)
+			if ctx.Err() != nil || status.Code(err) == codes.Unimplemented {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryDelay):
+			}
+		}
+	}()
+}
+
+// watchCache invalidates the entries of every change streamed after *since
+// and advances it.
+func (c *Client) watchCache(ctx context.Context, since *uint64) error {
+	stream, err := c.UserServiceClient.WatchUsers(ctx, &proto.WatchUsersRequest{SinceRevision: *since})
+	if err != nil {
+		return err
+	}
+
+	// Without a revision to resume from, the watch starts at the server's
+	// current one, and anything cached before its first message may predate
+	// it. Revision 0 stays unknown until a change advances it.
+	resumed := *since != 0
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if res.FullResync || !resumed {
+			c.cache.purge()
+			resumed = true
+		}
+		for _, u := range res.Users {
+			c.cache.invalidate(u.GetId())
+		}
+		for _, t := range res.Tombstones {
+			c.cache.invalidate(t.Id)
+		}
+		*since = res.Revision
+	}
+}
+
+// get returns the cached answer for key. A nil user with ok set is a cached
+// NotFound.
+func (c *userCache) get(key cacheKey) (user *User, ok bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	el, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	if e.user == nil {
+		c.stats.NegativeHits++
+		return nil, true
+	}
+	c.stats.Hits++
+
+	return copyUser(e.user), true
+}
+
+// put caches user, or NotFound when it is nil, unless the cache was
+// invalidated since epoch.
+func (c *userCache) put(key cacheKey, user *User, epoch uint64) {
+	ttl := c.cfg.TTL
+	if user == nil {
+		ttl = c.cfg.NegativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.epoch != epoch {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	e := &cacheEntry{key: key, expires: time.Now().Add(ttl)}
+	if user != nil {
+		e.user = copyUser(user)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	if c.byID[key.id] == nil {
+		c.byID[key.id] = make(map[cacheKey]struct{})
+	}
+	c.byID[key.id][key] = struct{}{}
+
+	for c.lru.Len() > c.cfg.Size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *userCache) currentEpoch() uint64 {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return c.epoch
+}
+
+// invalidate drops every entry of user id, whoever cached it.
+func (c *userCache) invalidate(id string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.epoch++
+	for key := range c.byID[id] {
+		c.remove(c.entries[key])
+		c.stats.Invalidations++
+	}
+}
+
+func (c *userCache) purge() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.epoch++
+	c.stats.Invalidations += uint64(c.lru.Len())
+	c.entries = make(map[cacheKey]*list.Element)
+	c.byID = make(map[string]map[cacheKey]struct{})
+	c.lru.Init()
+}
+
+func (c *userCache) snapshot() CacheStats {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
+
+// remove drops el. The caller must hold the lock.
+func (c *userCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	delete(c.byID[e.key.id], e.key)
+	if len(c.byID[e.key.id]) == 0 {
+		delete(c.byID, e.key.id)
+	}
+}
+
+func copyUser(user *User) *User {
+	u := *user
+	u.Labels = maps.Clone(user.Labels)
+	return &u
+}
@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+type (
+	// cacheBackend counts the GetUser calls that reach it and streams the
+	// watch steps it is given.
+	cacheBackend struct {
+		proto.UserServiceClient
+		users   map[string]bool
+		fetches map[string]int
+		steps   []func() *proto.SyncUsersResponse
+		since   []uint64
+	}
+
+	scriptedWatch struct {
+		grpc.ClientStream
+		b *cacheBackend
+	}
+)
+
+func (b *cacheBackend) GetUser(_ context.Context, req *proto.GetUserRequest, _ ...grpc.CallOption) (*proto.GetUserResponse, error) {
+	b.fetches[req.Id]++
+	if !b.users[req.Id] {
+		return nil, status.Errorf(codes.NotFound, "%v: %s", ErrUserNotFound, req.Id)
+	}
+	return &proto.GetUserResponse{User: &proto.User{Id: &req.Id}}, nil
+}
+
+func (b *cacheBackend) WatchUsers(_ context.Context, req *proto.WatchUsersRequest, _ ...grpc.CallOption) (proto.UserService_WatchUsersClient, error) {
+	b.since = append(b.since, req.SinceRevision)
+	return &scriptedWatch{b: b}, nil
+}
+
+// Recv runs the next step, so that a step sees the cache as every earlier
+// message left it.
+func (w *scriptedWatch) Recv() (*proto.SyncUsersResponse, error) {
+	if len(w.b.steps) == 0 {
+		return nil, io.EOF
+	}
+	step := w.b.steps[0]
+	w.b.steps = w.b.steps[1:]
+	return step(), nil
+}
+
+func TestCacheServesRepeatedGets(t *testing.T) {
+	b, c := newCachedClient(CacheConfig{TTL: time.Minute, NegativeTTL: time.Minute}, "a")
+	ctx := context.Background()
+
+	for range 2 {
+		if _, err := c.GetUser(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.GetUser(ctx, "missing"); status.Code(err) != codes.NotFound {
+			t.Fatalf("get of a missing user: %v, want %v", err, codes.NotFound)
+		}
+	}
+	if b.fetches["a"] != 1 || b.fetches["missing"] != 1 {
+		t.Fatalf("fetches = %v, want one per user", b.fetches)
+	}
+	want := CacheStats{Hits: 1, NegativeHits: 1, Misses: 2, Size: 2}
+	if got := c.CacheStats(); got != want {
+		t.Fatalf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestCacheKeepsCallersApart(t *testing.T) {
+	b, c := newCachedClient(CacheConfig{TTL: time.Minute}, "a")
+	alice := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer alice")
+	bob := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer bob")
+
+	for _, ctx := range []context.Context{alice, bob, alice} {
+		if _, err := c.GetUser(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.fetches["a"] != 2 {
+		t.Fatalf("fetched %d times, want once per caller", b.fetches["a"])
+	}
+
+	// Invalidation drops the user for every caller.
+	c.cache.invalidate("a")
+	if got := c.CacheStats(); got.Invalidations != 2 || got.Size != 0 {
+		t.Fatalf("stats after invalidating = %+v, want both entries dropped", got)
+	}
+}
+
+func TestCacheDropsAnswersFetchedBeforeInvalidation(t *testing.T) {
+	_, c := newCachedClient(CacheConfig{TTL: time.Minute})
+	key := cacheKey{id: "a"}
+
+	// A fetch that started before the user changed.
+	epoch := c.cache.currentEpoch()
+	c.cache.invalidate("a")
+	c.cache.put(key, &User{ID: "a"}, epoch)
+	if _, ok := c.cache.get(key); ok {
+		t.Fatal("cached an answer fetched before the invalidation")
+	}
+
+	c.cache.put(key, &User{ID: "a"}, c.cache.currentEpoch())
+	if _, ok := c.cache.get(key); !ok {
+		t.Fatal("did not cache an answer fetched after the invalidation")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	_, c := newCachedClient(CacheConfig{Size: 2, TTL: time.Minute})
+	for _, id := range []string{"a", "b"} {
+		c.cache.put(cacheKey{id: id}, &User{ID: id}, c.cache.currentEpoch())
+	}
+	c.cache.get(cacheKey{id: "a"})
+	c.cache.put(cacheKey{id: "c"}, &User{ID: "c"}, c.cache.currentEpoch())
+
+	if _, ok := c.cache.get(cacheKey{id: "b"}); ok {
+		t.Fatal("kept the least recently used entry")
+	}
+	for _, id := range []string{"a", "c"} {
+		if _, ok := c.cache.get(cacheKey{id: id}); !ok {
+			t.Fatalf("evicted %s", id)
+		}
+	}
+	if got := c.CacheStats().Evictions; got != 1 {
+		t.Fatalf("evictions = %d, want 1", got)
+	}
+}
+
+func TestWatchCacheInvalidatesChanges(t *testing.T) {
+	b, c := newCachedClient(CacheConfig{TTL: time.Minute}, "a", "b")
+	ctx := context.Background()
+	getAll := func() {
+		for _, id := range []string{"a", "b"} {
+			if _, err := c.GetUser(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	getAll()
+	b.steps = []func() *proto.SyncUsersResponse{
+		// Starts at the server's revision, 0 while nothing has changed.
+		func() *proto.SyncUsersResponse {
+			return &proto.SyncUsersResponse{}
+		},
+		func() *proto.SyncUsersResponse {
+			if size := c.CacheStats().Size; size != 0 {
+				t.Errorf("%d entries survived the start of the watch, want none", size)
+			}
+			getAll()
+			return &proto.SyncUsersResponse{}
+		},
+		func() *proto.SyncUsersResponse {
+			if size := c.CacheStats().Size; size != 2 {
+				t.Errorf("%d entries after another message at revision 0, want 2", size)
+			}
+			return &proto.SyncUsersResponse{Revision: 1, Tombstones: []*proto.Tombstone{{Id: "a", Revision: 1}}}
+		},
+	}
+
+	var since uint64
+	if err := c.watchCache(ctx, &since); err != io.EOF {
+		t.Fatalf("watch ended with %v, want %v", err, io.EOF)
+	}
+	if since != 1 {
+		t.Fatalf("watch advanced to revision %d, want 1", since)
+	}
+	getAll()
+	if b.fetches["a"] != 3 || b.fetches["b"] != 2 {
+		t.Fatalf("fetches = %v, want a refetched after its change and b cached", b.fetches)
+	}
+}
+
+func TestWatchCacheResumes(t *testing.T) {
+	b, c := newCachedClient(CacheConfig{TTL: time.Minute}, "a", "b")
+	ctx := context.Background()
+	for _, id := range []string{"a", "b"} {
+		if _, err := c.GetUser(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := "a"
+	b.steps = []func() *proto.SyncUsersResponse{
+		func() *proto.SyncUsersResponse {
+			return &proto.SyncUsersResponse{Revision: 6, Users: []*proto.User{{Id: &a}}}
+		},
+	}
+
+	since := uint64(5)
+	if err := c.watchCache(ctx, &since); err != io.EOF {
+		t.Fatal(err)
+	}
+	if b.since[0] != 5 {
+		t.Fatalf("watch resumed from %d, want 5", b.since[0])
+	}
+	if got := c.CacheStats(); got.Size != 1 || got.Invalidations != 1 {
+		t.Fatalf("stats = %+v, want only a invalidated", got)
+	}
+
+	// A full resync may hide any change, so nothing cached survives it.
+	b.steps = []func() *proto.SyncUsersResponse{
+		func() *proto.SyncUsersResponse {
+			return &proto.SyncUsersResponse{Revision: 9, FullResync: true}
+		},
+	}
+	if err := c.watchCache(ctx, &since); err != io.EOF {
+		t.Fatal(err)
+	}
+	if size := c.CacheStats().Size; size != 0 || since != 9 {
+		t.Fatalf("%d entries at revision %d after a full resync, want none at 9", size, since)
+	}
+}
+
+func newCachedClient(cfg CacheConfig, ids ...string) (*cacheBackend, *Client) {
+	b := &cacheBackend{users: make(map[string]bool), fetches: make(map[string]int)}
+	for _, id := range ids {
+		b.users[id] = true
+	}
+	return b, NewClient(b, WithCache(cfg))
+}
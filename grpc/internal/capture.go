@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	captureRedacted = "REDACTED"
+	// captureMaxLine bounds a record read back from a capture file.
+	captureMaxLine = 64 << 20
+)
+
+var (
+	// captureSkipMetadata are transport headers that are not recorded.
+	captureSkipMetadata = map[string]bool{
+		":authority":           true,
+		"content-type":         true,
+		"user-agent":           true,
+		"grpc-accept-encoding": true,
+	}
+
+	// captureSecretFields are message fields whose values are redacted.
+	captureSecretFields = map[protoreflect.Name]bool{
+		"password":         true,
+		"current_password": true,
+		"new_password":     true,
+		"access_token":     true,
+		"refresh_token":    true,
+		"secret":           true,
+		"otpauth_uri":      true,
+		"code":             true,
+		"recovery_code":    true,
+		"recovery_codes":   true,
+		// token is the email verification token of VerifyEmailRequest.
+		"token": true,
+	}
+)
+
+type (
+	// CaptureRecord is one RPC as written to a capture file, one JSON object
+	// per line. Messages are in the protobuf JSON mapping with secrets
+	// redacted.
+	CaptureRecord struct {
+		Time     time.Time           `json:"time"`
+		Method   string              `json:"method"`
+		Metadata map[string][]string `json:"metadata,omitempty"`
+		Request  json.RawMessage     `json:"request,omitempty"`
+		// Responses holds the response of a unary call or the messages of a
+		// server stream.
+		Responses []json.RawMessage `json:"responses,omitempty"`
+		Code      string            `json:"code"`
+		Message   string            `json:"message,omitempty"`
+		Duration  time.Duration     `json:"duration"`
+	}
+
+	CaptureConfig struct {
+		// Path is the file records are appended to.
+		Path string
+		// Methods limits capturing to these full method names. Every method
+		// is captured when empty.
+		Methods []string
+	}
+
+	// Recorder captures RPCs to a file for debugging and replay. The calls
+	// cluster members make to each other are never captured: they carry
+	// whole users, credentials included.
+	Recorder struct {
+		methods map[string]bool
+
+		mx  sync.Mutex
+		f   *os.File
+		enc *json.Encoder
+	}
+
+	// captureStream records the messages of a server stream.
+	captureStream struct {
+		grpc.ServerStream
+		rec *CaptureRecord
+	}
+)
+
+func NewRecorder(cfg CaptureConfig) (*Recorder, error) {
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open capture file: %w", err)
+	}
+
+	r := &Recorder{f: f, enc: json.NewEncoder(f)}
+	if len(cfg.Methods) > 0 {
+		r.methods = make(map[string]bool, len(cfg.Methods))
+		for _, m := range cfg.Methods {
+			r.methods[m] = true
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Recorder) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if !r.captures(info.FullMethod) {
+		return handler(ctx, req)
+	}
+
+	rec := newCaptureRecord(ctx, info.FullMethod)
+	rec.Request = captureMessage(req)
+
+	res, err := handler(ctx, req)
+	if err == nil {
+		rec.Responses = append(rec.Responses, captureMessage(res))
+	}
+	r.write(rec, err)
+
+	return res, err
+}
+
+func (r *Recorder) StreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !r.captures(info.FullMethod) {
+		return handler(srv, ss)
+	}
+
+	rec := newCaptureRecord(ss.Context(), info.FullMethod)
+	err := handler(srv, &captureStream{ServerStream: ss, rec: rec})
+	r.write(rec, err)
+
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return r.f.Close()
+}
+
+func (r *Recorder) captures(method string) bool {
+	if slices.Contains(ReplicationMethods, method) {
+		return false
+	}
+	return r.methods == nil || r.methods[method]
+}
+
+func (r *Recorder) write(rec *CaptureRecord, err error) {
+	rec.Duration = time.Since(rec.Time)
+	st := status.Convert(err)
+	rec.Code, rec.Message = st.Code().String(), st.Message()
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if err = r.enc.Encode(rec); err != nil {
+		fmt.Println("capture:", err)
+	}
+}
+
+func (s *captureStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && s.rec.Request == nil {
+		s.rec.Request = captureMessage(m)
+	}
+	return err
+}
+
+func (s *captureStream) SendMsg(m any) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.rec.Responses = append(s.rec.Responses, captureMessage(m))
+	}
+	return err
+}
+
+// ReadCapture calls fn for every record of a capture file in order.
+func ReadCapture(r io.Reader, fn func(CaptureRecord) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, captureMaxLine)
+	for line := 1; sc.Scan(); line++ {
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+		var rec CaptureRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("capture line %d: %w", line, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// Replay sends the request of rec through conn with its recorded metadata,
+// merged under any already outgoing in ctx, and records what comes back. A
+// stream is read until it has sent as many messages as were captured.
+func Replay(ctx context.Context, conn grpc.ClientConnInterface, rec CaptureRecord) (CaptureRecord, error) {
+	m, err := describeMethod(rec.Method)
+	if err != nil {
+		return CaptureRecord{}, err
+	}
+	req := m.input.New().Interface()
+	if len(rec.Request) > 0 {
+		if err = protojson.Unmarshal(rec.Request, req); err != nil {
+			return CaptureRecord{}, fmt.Errorf("decode %s request: %w", rec.Method, err)
+		}
+	}
+
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	for k, vs := range rec.Metadata {
+		if len(md.Get(k)) == 0 {
+			md.Append(k, vs...)
+		}
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, md))
+	defer cancel()
+
+	got := CaptureRecord{Time: time.Now(), Method: rec.Method, Metadata: rec.Metadata, Request: rec.Request}
+	err = func() error {
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: m.serverStreams}, rec.Method)
+		if err != nil {
+			return err
+		}
+		if err = stream.SendMsg(req); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if err = stream.CloseSend(); err != nil {
+			return err
+		}
+		for !m.serverStreams || len(got.Responses) < len(rec.Responses) {
+			res := m.output.New().Interface()
+			if err = stream.RecvMsg(res); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return err
+			}
+			got.Responses = append(got.Responses, captureMessage(res))
+			if !m.serverStreams {
+				break
+			}
+		}
+		return nil
+	}()
+	got.Duration = time.Since(got.Time)
+	st := status.Convert(err)
+	got.Code, got.Message = st.Code().String(), st.Message()
+
+	return got, nil
+}
+
+// DiffCapture describes how got differs from want in status and responses,
+// one difference per line. Fields named in ignore, such as generated IDs and
+// timestamps, are not compared.
+func DiffCapture(want, got CaptureRecord, ignore map[string]bool) []string {
+	var diffs []string
+	if want.Code != got.Code {
+		diffs = append(diffs, fmt.Sprintf("code: want %s, got %s", want.Code, got.Code))
+	}
+	if len(want.Responses) != len(got.Responses) {
+		diffs = append(diffs, fmt.Sprintf("responses: want %d, got %d", len(want.Responses), len(got.Responses)))
+	}
+	for i := 0; i < len(want.Responses) && i < len(got.Responses); i++ {
+		var w, g any
+		if err := json.Unmarshal(want.Responses[i], &w); err != nil {
+			diffs = append(diffs, fmt.Sprintf("responses[%d]: %v", i, err))
+			continue
+		}
+		if err := json.Unmarshal(got.Responses[i], &g); err != nil {
+			diffs = append(diffs, fmt.Sprintf("responses[%d]: %v", i, err))
+			continue
+		}
+		diffs = diffJSON(fmt.Sprintf("responses[%d]", i), w, g, ignore, diffs)
+	}
+	return diffs
+}
+
+func diffJSON(path string, want, got any, ignore map[string]bool, diffs []string) []string {
+	wm, wok := want.(map[string]any)
+	gm, gok := got.(map[string]any)
+	if wok && gok {
+		keys := make(map[string]bool)
+		for k := range wm {
+			keys[k] = true
+		}
+		for k := range gm {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			if !ignore[k] {
+				sorted = append(sorted, k)
+			}
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			diffs = diffJSON(path+"."+k, wm[k], gm[k], ignore, diffs)
+		}
+		return diffs
+	}
+
+	wl, wok := want.([]any)
+	gl, gok := got.([]any)
+	if wok && gok && len(wl) == len(gl) {
+		for i := range wl {
+			diffs = diffJSON(fmt.Sprintf("%s[%d]", path, i), wl[i], gl[i], ignore, diffs)
+		}
+		return diffs
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		w, _ := json.Marshal(want)
+		g, _ := json.Marshal(got)
+		diffs = append(diffs, fmt.Sprintf("%s: want %s, got %s", path, w, g))
+	}
+	return diffs
+}
+
+func newCaptureRecord(ctx context.Context, method string) *CaptureRecord {
+	rec := &CaptureRecord{Time: time.Now(), Method: method}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, vs := range md {
+		if captureSkipMetadata[k] || isSecretMetadata(k) {
+			continue
+		}
+		if rec.Metadata == nil {
+			rec.Metadata = make(map[string][]string)
+		}
+		rec.Metadata[k] = vs
+	}
+	return rec
+}
+
+func isSecretMetadata(key string) bool {
+	switch key {
+	case "authorization", "cookie", "x-api-key", clusterSecretHeader:
+		return true
+	}
+	return strings.Contains(key, "secret") || strings.Contains(key, "token") || strings.Contains(key, "password")
+}
+
+// captureMessage returns m in the JSON mapping with its secrets redacted.
+func captureMessage(m any) json.RawMessage {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return nil
+	}
+	msg = proto.Clone(msg)
+	redact(msg.ProtoReflect())
+
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	return b
+}
+
+// redact overwrites the secret fields of m and the messages within it. Bytes
+// fields are opaque, so any of them may hold a secret and all are redacted.
+func redact(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.Kind() == protoreflect.StringKind && !fd.IsList() && !fd.IsMap() && captureSecretFields[fd.Name()]:
+			m.Set(fd, protoreflect.ValueOfString(captureRedacted))
+		case fd.Kind() == protoreflect.BytesKind && !fd.IsList() && !fd.IsMap():
+			m.Set(fd, protoreflect.ValueOfBytes([]byte(captureRedacted)))
+		case fd.IsMap():
+			if fd.MapValue().Kind() == protoreflect.MessageKind {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					redact(mv.Message())
+					return true
+				})
+			}
+		case fd.IsList():
+			switch {
+			case fd.Kind() == protoreflect.MessageKind:
+				for i := 0; i < v.List().Len(); i++ {
+					redact(v.List().Get(i).Message())
+				}
+			case fd.Kind() == protoreflect.StringKind && captureSecretFields[fd.Name()]:
+				for i := 0; i < v.List().Len(); i++ {
+					v.List().Set(i, protoreflect.ValueOfString(captureRedacted))
+				}
+			case fd.Kind() == protoreflect.BytesKind:
+				for i := 0; i < v.List().Len(); i++ {
+					v.List().Set(i, protoreflect.ValueOfBytes([]byte(captureRedacted)))
+				}
+			}
+		case fd.Kind() == protoreflect.MessageKind:
+			redact(v.Message())
+		}
+		return true
+	})
+}
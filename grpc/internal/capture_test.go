@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+func TestRecorderRedactsSecrets(t *testing.T) {
+	path, r := newTestRecorder(t, nil)
+	handler := func(context.Context, any) (any, error) {
+		return &pb.LoginResponse{Tokens: &pb.TokenPair{AccessToken: "access-1", RefreshToken: "refresh-1"}}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.AuthService_Login_FullMethodName}
+	if _, err := r.UnaryInterceptor(context.Background(), &pb.LoginRequest{Name: "alice", Password: "hunter2-hunter2"}, info, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	data := readCapture(t, r, path)
+	for _, secret := range []string{"hunter2-hunter2", "access-1", "refresh-1"} {
+		if strings.Contains(data, secret) {
+			t.Errorf("capture holds %q: %s", secret, data)
+		}
+	}
+	if !strings.Contains(data, `"alice"`) {
+		t.Errorf("capture lacks the name: %s", data)
+	}
+}
+
+func TestRecorderSkipsReplication(t *testing.T) {
+	// Listing the method does not capture it either.
+	path, r := newTestRecorder(t, ReplicationMethods)
+	handler := func(context.Context, any) (any, error) { return &pb.ProposeResponse{}, nil }
+	for _, method := range ReplicationMethods {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		if _, err := r.UnaryInterceptor(context.Background(), &pb.ProposeRequest{Mutation: []byte(`{"user":{}}`)}, info, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if data := readCapture(t, r, path); data != "" {
+		t.Fatalf("replication calls were captured: %s", data)
+	}
+}
+
+func TestCaptureMessageRedactsBytes(t *testing.T) {
+	got := string(captureMessage(&pb.ProposeRequest{Mutation: []byte(`{"user":{"PasswordHash":"$argon2id$"}}`)}))
+	if strings.Contains(got, "argon2id") {
+		t.Fatalf("bytes field was captured: %s", got)
+	}
+}
+
+func newTestRecorder(t *testing.T, methods []string) (string, *Recorder) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	r, err := NewRecorder(CaptureConfig{Path: path, Methods: methods})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+	return path, r
+}
+
+func readCapture(t *testing.T, r *Recorder, path string) string {
+	t.Helper()
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -3,6 +3,12 @@ package internal
 import (
 	"context"
 	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/Roma7-7-7/sandbox/grpc/proto"
 )
@@ -10,11 +16,44 @@ import (
 type (
 	Client struct {
 		proto.UserServiceClient
+		loader *userLoader
+		cache  *userCache
+		// closer releases the connections of a client that owns them.
+		closer io.Closer
 	}
+
+	ClientOption func(*Client)
 )
 
-func NewClient(client proto.UserServiceClient) *Client {
-	return &Client{client}
+// WithGetUserBatching makes concurrent GetUser calls issued within window share
+// a single BatchGetUsers round trip.
+func WithGetUserBatching(window time.Duration) ClientOption {
+	return func(c *Client) {
+		c.loader = newUserLoader(window, MaxBatchGetIDs, c.batchGetUsers)
+	}
+}
+
+// WithReadConsistency returns a context whose reads against a replicated
+// server use consistency, ReadLinearizable or ReadStale.
+func WithReadConsistency(ctx context.Context, consistency string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, ReadConsistencyHeader, consistency)
+}
+
+func NewClient(client proto.UserServiceClient, opts ...ClientOption) *Client {
+	c := &Client{UserServiceClient: client}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Close releases the connections the client created itself. Clients built
+// around a caller's connection leave it open.
+func (c *Client) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
 }
 
 func (c *Client) CreateUser(ctx context.Context, name string) (*User, error) {
@@ -27,19 +66,47 @@ func (c *Client) CreateUser(ctx context.Context, name string) (*User, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create user: %w", err)
 	}
+	if c.cache != nil {
+		c.cache.invalidate(res.User.GetId())
+	}
 
-	return &User{
-		ID:        res.User.GetId(),
-		Name:      res.User.GetName(),
-		Surname:   res.User.GetSurname(),
-		Age:       int(res.User.GetAge()),
-		CreatedAt: res.User.CreatedAt.AsTime(),
-		UpdatedAt: res.User.UpdatedAt.AsTime(),
-		Disabled:  res.User.Disabled,
-	}, nil
+	return fromProtoUser(res.User), nil
 }
 
 func (c *Client) GetUser(ctx context.Context, id string) (*User, error) {
+	if c.cache == nil {
+		return c.getUser(ctx, id)
+	}
+
+	key := cacheKey{md: metadataKey(ctx), id: id}
+	if user, ok := c.cache.get(key); ok {
+		if user == nil {
+			return nil, fmt.Errorf("get user: %w", status.Errorf(codes.NotFound, "%v: %s", ErrUserNotFound, id))
+		}
+		return user, nil
+	}
+
+	epoch := c.cache.currentEpoch()
+	user, err := c.getUser(ctx, id)
+	switch {
+	case err == nil:
+		c.cache.put(key, user, epoch)
+	case status.Code(err) == codes.NotFound:
+		c.cache.put(key, nil, epoch)
+	}
+
+	return user, err
+}
+
+func (c *Client) getUser(ctx context.Context, id string) (*User, error) {
+	if c.loader != nil {
+		user, err := c.loader.Load(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("get user: %w", err)
+		}
+		return user, nil
+	}
+
 	req := &proto.GetUserRequest{
 		Id: id,
 	}
@@ -48,15 +115,57 @@ func (c *Client) GetUser(ctx context.Context, id string) (*User, error) {
 		return nil, fmt.Errorf("get user: %w", err)
 	}
 
-	return &User{
-		ID:        res.User.GetId(),
-		Name:      res.User.GetName(),
-		Surname:   res.User.GetSurname(),
-		Age:       int(res.User.GetAge()),
-		CreatedAt: res.User.CreatedAt.AsTime(),
-		UpdatedAt: res.User.UpdatedAt.AsTime(),
-		Disabled:  res.User.Disabled,
-	}, nil
+	return fromProtoUser(res.User), nil
+}
+
+// GetUserByEmail returns the user with email in the caller's tenant.
+func (c *Client) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	res, err := c.UserServiceClient.GetUserByEmail(ctx, &proto.GetUserByEmailRequest{Email: email})
+	if err != nil {
+		return nil, fmt.Errorf("get user by email: %w", err)
+	}
+
+	return fromProtoUser(res.User), nil
+}
+
+// BatchGetUsers returns the users found for ids and the IDs the server does not know.
+func (c *Client) BatchGetUsers(ctx context.Context, ids []string) ([]*User, []string, error) {
+	users, missing, err := c.batchGetUsers(ctx, ids)
+	if err != nil {
+		return nil, nil, fmt.Errorf("batch get users: %w", err)
+	}
+
+	return users, missing, nil
+}
+
+// ListUsers returns the users of tenant, or of the caller's tenant if it is empty.
+func (c *Client) ListUsers(ctx context.Context, tenant string) ([]*User, error) {
+	res, err := c.UserServiceClient.ListUsers(ctx, &proto.ListUsersRequest{Tenant: tenant})
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+
+	users := make([]*User, 0, len(res.Users))
+	for _, u := range res.Users {
+		users = append(users, fromProtoUser(u))
+	}
+
+	return users, nil
+}
+
+// SelectUsers returns the users matching a label selector such as "team=core,env in (prod,stage)".
+func (c *Client) SelectUsers(ctx context.Context, selector string) ([]*User, error) {
+	res, err := c.UserServiceClient.SelectUsers(ctx, &proto.SelectUsersRequest{Selector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("select users: %w", err)
+	}
+
+	users := make([]*User, 0, len(res.Users))
+	for _, u := range res.Users {
+		users = append(users, fromProtoUser(u))
+	}
+
+	return users, nil
 }
 
 func (c *Client) DeleteUser(ctx context.Context, id string) error {
@@ -64,9 +173,26 @@ func (c *Client) DeleteUser(ctx context.Context, id string) error {
 		Id: id,
 	}
 	_, err := c.UserServiceClient.DeleteUser(ctx, req)
+	if c.cache != nil {
+		c.cache.invalidate(id)
+	}
 	if err != nil {
 		return fmt.Errorf("delete user: %w", err)
 	}
 
 	return nil
 }
+
+func (c *Client) batchGetUsers(ctx context.Context, ids []string) ([]*User, []string, error) {
+	res, err := c.UserServiceClient.BatchGetUsers(ctx, &proto.BatchGetUsersRequest{Ids: ids})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	users := make([]*User, 0, len(res.Users))
+	for _, u := range res.Users {
+		users = append(users, fromProtoUser(u))
+	}
+
+	return users, res.MissingIds, nil
+}
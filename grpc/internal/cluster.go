@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+const (
+	// localHeartbeatTimeout keeps elections fast on loopback.
+	localHeartbeatTimeout = 300 * time.Millisecond
+	// localOperator is the user Operator authenticates as.
+	localOperator = "operator"
+)
+
+type (
+	// LocalCluster runs a replicated cluster inside one process, every node
+	// serving gRPC and raft on its own loopback listeners. It exists to
+	// exercise replication and failover locally.
+	LocalCluster struct {
+		dir    string
+		secret string
+		peers  []Peer
+		nodes  []*LocalNode
+		// tokens issues the operator's tokens. Every node verifies them with
+		// an issuer of its own sharing the secret, as separate processes would.
+		tokens   *TokenIssuer
+		operator *User
+	}
+
+	LocalNode struct {
+		ID   string
+		Addr string
+		// Users, Node and Tokens are nil while the node is stopped.
+		Users  *UserService
+		Node   *Node
+		Tokens *TokenIssuer
+
+		peer   Peer
+		server *grpc.Server
+		conn   *grpc.ClientConn
+	}
+)
+
+// StartLocalCluster starts size nodes keeping their state under dir.
+func StartLocalCluster(size int, dir string) (*LocalCluster, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate cluster secret: %w", err)
+	}
+	c := &LocalCluster{dir: dir, secret: hex.EncodeToString(secret)}
+	c.tokens = NewTokenIssuer([]byte(c.secret), time.Hour, time.Hour)
+
+	raftListeners := make([]net.Listener, size)
+	grpcListeners := make([]net.Listener, size)
+	for i := 0; i < size; i++ {
+		var err error
+		if raftListeners[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return nil, fmt.Errorf("listen raft: %w", err)
+		}
+		if grpcListeners[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return nil, fmt.Errorf("listen grpc: %w", err)
+		}
+		peer := Peer{
+			ID:       fmt.Sprintf("node%d", i+1),
+			RaftAddr: raftListeners[i].Addr().String(),
+			GRPCAddr: grpcListeners[i].Addr().String(),
+		}
+		c.peers = append(c.peers, peer)
+		c.nodes = append(c.nodes, &LocalNode{ID: peer.ID, Addr: peer.GRPCAddr, peer: peer})
+	}
+
+	for i, n := range c.nodes {
+		if err := c.start(n, raftListeners[i], grpcListeners[i]); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *LocalCluster) Nodes() []*LocalNode {
+	return c.nodes
+}
+
+func (c *LocalCluster) Node(id string) (*LocalNode, bool) {
+	for _, n := range c.nodes {
+		if n.ID == id {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// Leader waits until a running node leads the cluster.
+func (c *LocalCluster) Leader(ctx context.Context) (*LocalNode, error) {
+	for {
+		for _, n := range c.nodes {
+			if n.Node != nil && n.Node.isLeader() {
+				return n, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait for leader: %w", ctx.Err())
+		case <-time.After(raftRetryInterval):
+		}
+	}
+}
+
+// Stop shuts node id down as if its process exited.
+func (c *LocalCluster) Stop(id string) error {
+	n, ok := c.Node(id)
+	if !ok {
+		return fmt.Errorf("unknown node: %s", id)
+	}
+	if n.Node == nil {
+		return nil
+	}
+
+	n.server.Stop()
+	err := n.Node.Close()
+	n.Users, n.Node, n.Tokens, n.server = nil, nil, nil, nil
+
+	return err
+}
+
+// Restart starts a stopped node on its previous addresses and state.
+func (c *LocalCluster) Restart(id string) error {
+	n, ok := c.Node(id)
+	if !ok {
+		return fmt.Errorf("unknown node: %s", id)
+	}
+	if n.Node != nil {
+		return fmt.Errorf("node %s is running", id)
+	}
+
+	raftListener, err := net.Listen("tcp", n.peer.RaftAddr)
+	if err != nil {
+		return fmt.Errorf("listen raft: %w", err)
+	}
+	grpcListener, err := net.Listen("tcp", n.peer.GRPCAddr)
+	if err != nil {
+		_ = raftListener.Close()
+		return fmt.Errorf("listen grpc: %w", err)
+	}
+
+	return c.start(n, raftListener, grpcListener)
+}
+
+func (c *LocalCluster) Close() error {
+	var errs []error
+	for _, n := range c.nodes {
+		if n.Node != nil {
+			errs = append(errs, c.Stop(n.ID))
+		}
+		if n.conn != nil {
+			errs = append(errs, n.conn.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Operator returns ctx with the access token of an operator user of
+// DefaultTenant. The user is created through the leader on first use, and
+// Operator waits until every running node knows it.
+func (c *LocalCluster) Operator(ctx context.Context) (context.Context, error) {
+	if c.operator == nil {
+		leader, err := c.Leader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		now := leader.Users.Now()
+		user, err := leader.Users.Create(User{Name: localOperator, Tenant: DefaultTenant, CreatedAt: now, UpdatedAt: now})
+		if err != nil {
+			return nil, fmt.Errorf("create operator: %w", err)
+		}
+		c.operator = user
+	}
+	for _, n := range c.nodes {
+		for n.Users != nil {
+			if _, err := n.Users.Get(AnyTenant, c.operator.ID); err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("wait for operator on %s: %w", n.ID, ctx.Err())
+			case <-time.After(raftRetryInterval):
+			}
+		}
+	}
+
+	tokens, err := c.tokens.Issue(c.operator)
+	if err != nil {
+		return nil, fmt.Errorf("issue operator token: %w", err)
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tokens.AccessToken), nil
+}
+
+// Client returns a client of node n. Calls need credentials, such as those
+// of Operator.
+func (n *LocalNode) Client() (*Client, error) {
+	if n.conn == nil {
+		conn, err := grpc.Dial(n.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, fmt.Errorf("dial %s: %w", n.ID, err)
+		}
+		n.conn = conn
+	}
+	return NewClient(pb.NewUserServiceClient(n.conn)), nil
+}
+
+func (c *LocalCluster) start(n *LocalNode, raftListener, grpcListener net.Listener) error {
+	users := NewUserService()
+	tokens := NewTokenIssuer([]byte(c.secret), time.Hour, time.Hour)
+	node, err := StartNode(ReplicationConfig{
+		NodeID:           n.ID,
+		RaftListener:     raftListener,
+		Dir:              filepath.Join(c.dir, n.ID),
+		Peers:            c.peers,
+		Secret:           c.secret,
+		Tokens:           tokens,
+		HeartbeatTimeout: localHeartbeatTimeout,
+		LogOutput:        io.Discard,
+	}, users)
+	if err != nil {
+		_ = raftListener.Close()
+		_ = grpcListener.Close()
+		return fmt.Errorf("start %s: %w", n.ID, err)
+	}
+
+	auth := NewAuthenticator(users, tokens, nil)
+	auth.AddPublicMethods(ReplicationMethods...)
+	auth.AddPublicMethods(healthpb.Health_Check_FullMethodName, healthpb.Health_Watch_FullMethodName)
+
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(auth.AuthInterceptor, node.ReadInterceptor),
+		grpc.ChainStreamInterceptor(auth.AuthStreamInterceptor),
+	)
+	pb.RegisterUserServiceServer(s, NewUserGRPCService(users))
+	pb.RegisterReplicationServiceServer(s, NewReplicationGRPCService(node))
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go func() {
+		_ = s.Serve(grpcListener)
+	}()
+
+	n.Users, n.Node, n.Tokens, n.server = users, node, tokens, s
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package internal_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Roma7-7-7/sandbox/grpc/internal"
+	"github.com/Roma7-7-7/sandbox/grpc/internal/testserver"
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+var contractNow = time.Date(2024, 6, 15, 12, 0, 0, 123456789, time.UTC)
+
+func TestContractV2UserReadThroughV1(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithClock(func() time.Time { return contractNow }))
+	v1, v2 := pb.NewUserServiceClient(srv.Conn()), pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{
+		Name:      "alice",
+		Surname:   "smith",
+		BirthDate: &pbv2.Date{Year: 1990, Month: 6, Day: 16},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header metadata.MD
+	got, err := v1.GetUser(ctx, &pb.GetUserRequest{Id: created.User.Id}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertDeprecated(t, header, pb.UserService_GetUser_FullMethodName, pbv2.UserService_GetUser_FullMethodName)
+
+	if got.User.GetId() != created.User.Id || got.User.Name != "alice" || got.User.Surname != "smith" {
+		t.Fatalf("v1 user = %v, want the v2 user %v", got.User, created.User)
+	}
+	if got.User.Age != 33 {
+		t.Fatalf("v1 age = %d, want 33 the day before the 34th birthday", got.User.Age)
+	}
+	if !got.User.CreatedAt.AsTime().Equal(created.User.CreatedAt.AsTime()) {
+		t.Fatalf("v1 created_at = %v, want %v", got.User.CreatedAt.AsTime(), created.User.CreatedAt.AsTime())
+	}
+}
+
+func TestContractV1UserReadThroughV2(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithClock(func() time.Time { return contractNow }))
+	v1, v2 := pb.NewUserServiceClient(srv.Conn()), pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	var header metadata.MD
+	created, err := v1.CreateUser(ctx, &pb.CreateUserRequest{User: &pb.User{Name: "bob", Age: 40}}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertDeprecated(t, header, pb.UserService_CreateUser_FullMethodName, pbv2.UserService_CreateUser_FullMethodName)
+
+	header = nil
+	got, err := v2.GetUser(ctx, &pbv2.GetUserRequest{Id: created.User.GetId()}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.Get("deprecation")) > 0 || len(header.Get("warning")) > 0 {
+		t.Fatalf("v2 response carries deprecation headers: %v", header)
+	}
+	if got.User.Name != "bob" || got.User.BirthDate != nil {
+		t.Fatalf("v2 user = %v, want bob without a birth date", got.User)
+	}
+	if !got.User.CreatedAt.AsTime().Equal(contractNow) {
+		t.Fatalf("v2 created_at = %v, want %v", got.User.CreatedAt.AsTime(), contractNow)
+	}
+
+	if _, err = v1.DeleteUser(ctx, &pb.DeleteUserRequest{Id: created.User.GetId()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v2.GetUser(ctx, &pbv2.GetUserRequest{Id: created.User.GetId()}); status.Code(err) != codes.NotFound {
+		t.Fatalf("v2 get of a user deleted through v1: %v, want %v", err, codes.NotFound)
+	}
+}
+
+func TestContractUpdateKeepsBirthDate(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithClock(func() time.Time { return contractNow }))
+	v2 := pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{
+		Name:      "carol",
+		BirthDate: &pbv2.Date{Year: 2000, Month: 1, Day: 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An update built from a v1 user knows no birth date.
+	if _, err = srv.Service.Update(internal.AnyTenant, internal.User{ID: created.User.Id, Name: "carol", Surname: "jones"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := v2.GetUser(ctx, &pbv2.GetUserRequest{Id: created.User.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.User.Surname != "jones" {
+		t.Fatalf("surname = %q, want the update applied", got.User.Surname)
+	}
+	if d := got.User.BirthDate; d == nil || d.Year != 2000 || d.Month != 1 || d.Day != 2 {
+		t.Fatalf("birth date = %v, want 2000-01-02 kept", d)
+	}
+}
+
+func assertDeprecated(t *testing.T, header metadata.MD, method, successor string) {
+	t.Helper()
+
+	if got := header.Get("deprecation"); len(got) != 1 || got[0] != "true" {
+		t.Errorf("deprecation header = %v, want true", got)
+	}
+	warning := header.Get("warning")
+	if len(warning) != 1 || !strings.HasPrefix(warning[0], "299 ") || !strings.Contains(warning[0], method) || !strings.Contains(warning[0], successor) {
+		t.Errorf("warning header = %v, want a 299 warning naming %s and %s", warning, method, successor)
+	}
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	tpb "google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+type (
+	AuthGRPCServer struct {
+		userService *UserService
+		tokens      *TokenIssuer
+		policy      PasswordPolicy
+		// mfaIssuer names the service in authenticator apps.
+		mfaIssuer string
+		pb.UnimplementedAuthServiceServer
+	}
+)
+
+func NewAuthGRPCService(userService *UserService, tokens *TokenIssuer, policy PasswordPolicy) *AuthGRPCServer {
+	return &AuthGRPCServer{userService: userService, tokens: tokens, policy: policy, mfaIssuer: DefaultMFAIssuer}
+}
+
+// SetMFAIssuer sets the issuer shown by authenticator apps for TOTP secrets
+// enrolled from now on.
+func (s *AuthGRPCServer) SetMFAIssuer(issuer string) {
+	s.mfaIssuer = issuer
+}
+
+func (s *AuthGRPCServer) SetPassword(ctx context.Context, req *pb.SetPasswordRequest) (*emptypb.Empty, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	admin := p.HasRole(RoleAdmin)
+	if !admin && p.UserID != req.UserId {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot set password of another user")
+	}
+
+	user, err := s.userService.Get(p.TenantScope(), req.UserId)
+	if err != nil {
+		return nil, serviceError("set password", err)
+	}
+	if !admin && user.PasswordHash != "" {
+		ok, err := s.userService.CheckPassword(user.ID, req.CurrentPassword)
+		if err != nil {
+			return nil, serviceError("set password", err)
+		}
+		if !ok {
+			return nil, status.Errorf(codes.PermissionDenied, "current password does not match")
+		}
+	}
+
+	if err = s.userService.SetPassword(p.TenantScope(), req.UserId, req.NewPassword, s.policy); err != nil {
+		return nil, serviceError("set password", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *AuthGRPCServer) Login(_ context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+	tenant := req.Tenant
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+
+	user, err := s.userService.Authenticate(tenant, req.Name, req.Password)
+	if err != nil {
+		return nil, serviceError("login", err)
+	}
+
+	tokens, err := s.tokens.Issue(user)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, fmt.Sprintf("issue tokens: %v", err))
+	}
+
+	return &pb.LoginResponse{User: toProtoUser(user, s.userService.Now()), Tokens: toProtoTokens(tokens)}, nil
+}
+
+// RefreshToken exchanges a refresh token for a new pair. The old refresh token is revoked.
+func (s *AuthGRPCServer) RefreshToken(_ context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	claims, err := s.tokens.Verify(req.RefreshToken, TokenRefresh)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, fmt.Sprintf("refresh token: %v", err))
+	}
+
+	user, err := s.userService.Get(claims.Tenant, claims.Subject)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil, status.Errorf(codes.Unauthenticated, "refresh token: unknown user")
+		}
+		return nil, serviceError("refresh token", err)
+	}
+	if user.Inactive(s.userService.Now()) {
+		return nil, status.Errorf(codes.PermissionDenied, fmt.Sprintf("user disabled: %s", user.ID))
+	}
+
+	if err = s.tokens.Revoke(claims); err != nil {
+		return nil, serviceError("revoke refresh token", err)
+	}
+	tokens, err := s.tokens.Issue(user)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, fmt.Sprintf("issue tokens: %v", err))
+	}
+
+	return &pb.RefreshTokenResponse{Tokens: toProtoTokens(tokens)}, nil
+}
+
+// Logout revokes the given refresh token and the access token of the call, if any.
+func (s *AuthGRPCServer) Logout(ctx context.Context, req *pb.LogoutRequest) (*emptypb.Empty, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.RefreshToken != "" {
+		claims, err := s.tokens.Verify(req.RefreshToken, TokenRefresh)
+		if err != nil && !errors.Is(err, ErrTokenRevoked) {
+			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("refresh token: %v", err))
+		}
+		if claims != nil {
+			if claims.Subject != p.UserID && !p.HasRole(RoleAdmin) {
+				return nil, status.Errorf(codes.PermissionDenied, "refresh token belongs to another user")
+			}
+			if err = s.tokens.Revoke(claims); err != nil {
+				return nil, serviceError("revoke refresh token", err)
+			}
+		}
+	}
+	if p.Token != nil {
+		if err = s.tokens.Revoke(p.Token); err != nil {
+			return nil, serviceError("revoke access token", err)
+		}
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// EnrollTOTP gives the caller a new TOTP secret, replacing one that was not
+// confirmed yet.
+func (s *AuthGRPCServer) EnrollTOTP(ctx context.Context, _ *emptypb.Empty) (*pb.EnrollTOTPResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, uri, err := s.userService.EnrollTOTP(p.Tenant, p.UserID, s.mfaIssuer)
+	if err != nil {
+		return nil, serviceError("enroll totp", err)
+	}
+
+	return &pb.EnrollTOTPResponse{Secret: secret, OtpauthUri: uri}, nil
+}
+
+// ConfirmTOTP enables the caller's enrolled secret and returns its recovery codes.
+func (s *AuthGRPCServer) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recovery, err := s.userService.ConfirmTOTP(p.Tenant, p.UserID, req.Code)
+	if err != nil {
+		return nil, serviceError("confirm totp", err)
+	}
+
+	return &pb.ConfirmTOTPResponse{RecoveryCodes: recovery}, nil
+}
+
+// VerifyMFA checks a second factor of the caller and returns tokens carrying
+// the step-up. The caller must have authenticated with an access token.
+func (s *AuthGRPCServer) VerifyMFA(ctx context.Context, req *pb.VerifyMFARequest) (*pb.VerifyMFAResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.Token == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "verify mfa: an access token is required")
+	}
+
+	left, err := s.userService.VerifyMFA(p.Tenant, p.UserID, req.Code, req.RecoveryCode)
+	if err != nil {
+		return nil, serviceError("verify mfa", err)
+	}
+
+	user, err := s.userService.Get(p.Tenant, p.UserID)
+	if err != nil {
+		return nil, serviceError("verify mfa", err)
+	}
+	tokens, err := s.tokens.IssueMFA(user, s.userService.Now())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, fmt.Sprintf("issue tokens: %v", err))
+	}
+
+	return &pb.VerifyMFAResponse{Tokens: toProtoTokens(tokens), RecoveryCodesLeft: int32(left)}, nil
+}
+
+// DisableMFA removes the TOTP secret of a user. Users disabling their own
+// must give a current code; admins may disable anyone's.
+func (s *AuthGRPCServer) DisableMFA(ctx context.Context, req *pb.DisableMFARequest) (*emptypb.Empty, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id := req.UserId
+	if id == "" {
+		id = p.UserID
+	}
+	if id != p.UserID && !p.HasRole(RoleAdmin) {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot disable mfa of another user")
+	}
+
+	if id == p.UserID {
+		user, err := s.userService.Get(p.TenantScope(), id)
+		if err != nil {
+			return nil, serviceError("disable mfa", err)
+		}
+		if user.MFAEnabled {
+			if _, err = s.userService.VerifyMFA(p.TenantScope(), id, req.Code, ""); err != nil {
+				return nil, serviceError("disable mfa", err)
+			}
+		}
+	}
+
+	if err = s.userService.DisableMFA(p.TenantScope(), id); err != nil {
+		return nil, serviceError("disable mfa", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func toProtoTokens(tokens *TokenPair) *pb.TokenPair {
+	return &pb.TokenPair{
+		AccessToken:           tokens.AccessToken,
+		AccessTokenExpiresAt:  tpb.New(tokens.AccessExpiresAt),
+		RefreshToken:          tokens.RefreshToken,
+		RefreshTokenExpiresAt: tpb.New(tokens.RefreshExpiresAt),
+	}
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultEmailTokenTTL is how long an email verification token is valid.
+const DefaultEmailTokenTTL = 24 * time.Hour
+
+var (
+	ErrInvalidEmail         = errors.New("invalid email")
+	ErrEmailTaken           = errors.New("email already taken")
+	ErrNoEmail              = errors.New("user has no email")
+	ErrEmailChanged         = errors.New("email changed since the token was issued")
+	ErrVerificationDisabled = errors.New("email verification is not configured")
+	ErrEmailAlreadyVerified = errors.New("email already verified")
+)
+
+type (
+	Notification struct {
+		To      string
+		Subject string
+		Body    string
+	}
+
+	// Notifier delivers notifications such as email verification tokens.
+	Notifier interface {
+		Notify(ctx context.Context, n Notification) error
+	}
+
+	// WriterNotifier writes notifications to a writer instead of delivering
+	// them, for local development.
+	WriterNotifier struct {
+		mx sync.Mutex
+		w  io.Writer
+		c  io.Closer
+	}
+
+	// EmailVerifier issues one-time email verification tokens and confirms them.
+	EmailVerifier struct {
+		users    *UserService
+		tokens   *TokenIssuer
+		notifier Notifier
+		ttl      time.Duration
+	}
+)
+
+// NormalizeEmail trims and lowercases a bare address such as
+// "Jane.Doe@Example.com". An empty address is valid and stays empty.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", fmt.Errorf("%w: %q", ErrInvalidEmail, email)
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// GetByEmail returns the user of tenant with email, which is normalized first.
+func (s *UserService) GetByEmail(tenant, email string) (*User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	id, ok := s.emails[tenant][s.emailKey(tenant, email)]
+	if !ok || email == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, email)
+	}
+	user := s.store[id]
+	return &user, nil
+}
+
+// MarkEmailVerified records that the user of tenant with id controls email,
+// unless the user's address has changed since.
+func (s *UserService) MarkEmailVerified(tenant, id, email string) (*User, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	user, ok := s.store[id]
+	if !ok || user.Tenant != tenant {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, id)
+	}
+	if user.Email != email {
+		return nil, fmt.Errorf("%w: %s", ErrEmailChanged, id)
+	}
+	if user.EmailVerified {
+		return &user, nil
+	}
+
+	user.EmailVerified = true
+	user.UpdatedAt = s.Now()
+	m := mutation{Op: opUpdate, User: user}
+	if err := s.check(m); err != nil {
+		return nil, err
+	}
+	if err := s.commit(&m); err != nil {
+		return nil, err
+	}
+
+	return &m.User, nil
+}
+
+// indexEmail records user's email. The caller must hold the write lock.
+func (s *UserService) indexEmail(user User) {
+	if user.Email == "" {
+		return
+	}
+	emails, ok := s.emails[user.Tenant]
+	if !ok {
+		emails = make(map[string]string)
+		s.emails[user.Tenant] = emails
+	}
+	emails[s.emailKey(user.Tenant, user.Email)] = user.ID
+}
+
+func (s *UserService) unindexEmail(user User) {
+	emails := s.emails[user.Tenant]
+	key := s.emailKey(user.Tenant, user.Email)
+	if emails[key] != user.ID {
+		return
+	}
+	delete(emails, key)
+	if len(emails) == 0 {
+		delete(s.emails, user.Tenant)
+	}
+}
+
+func NewEmailVerifier(users *UserService, tokens *TokenIssuer, notifier Notifier, ttl time.Duration) *EmailVerifier {
+	if ttl <= 0 {
+		ttl = DefaultEmailTokenTTL
+	}
+	return &EmailVerifier{users: users, tokens: tokens, notifier: notifier, ttl: ttl}
+}
+
+// Send issues a verification token for the current email of user and hands
+// it to the notifier.
+func (v *EmailVerifier) Send(ctx context.Context, user *User) error {
+	if user.Email == "" {
+		return fmt.Errorf("%w: %s", ErrNoEmail, user.ID)
+	}
+	if user.EmailVerified {
+		return fmt.Errorf("%w: %s", ErrEmailAlreadyVerified, user.ID)
+	}
+
+	token, exp, err := v.tokens.IssueEmailVerification(user, v.ttl)
+	if err != nil {
+		return err
+	}
+	err = v.notifier.Notify(ctx, Notification{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Confirm %s by calling VerifyEmail with this token before %s:\n\n%s\n",
+			user.Email, exp.UTC().Format(time.RFC3339), token),
+	})
+	if err != nil {
+		return fmt.Errorf("notify %s: %w", user.Email, err)
+	}
+
+	return nil
+}
+
+// sendCreated sends the verification of a user just created, if it has an
+// email, and reports whether it did. A failure is only logged, as the user
+// exists either way.
+func (v *EmailVerifier) sendCreated(ctx context.Context, user *User) bool {
+	if v == nil || user.Email == "" || user.EmailVerified {
+		return false
+	}
+	if err := v.Send(ctx, user); err != nil {
+		fmt.Printf("send email verification of %s: %v\n", user.ID, err)
+		return false
+	}
+	return true
+}
+
+// Verify marks the address in token verified. A token can be used once: it is
+// revoked first, so that two concurrent uses cannot both succeed.
+func (v *EmailVerifier) Verify(token string) (*User, error) {
+	claims, err := v.tokens.Verify(token, TokenEmailVerification)
+	if err != nil {
+		return nil, err
+	}
+	if err = v.tokens.Revoke(claims); err != nil {
+		return nil, err
+	}
+
+	return v.users.MarkEmailVerified(claims.Tenant, claims.Subject, claims.Email)
+}
+
+// NewWriterNotifier writes notifications to w, such as os.Stdout.
+func NewWriterNotifier(w io.Writer) *WriterNotifier {
+	return &WriterNotifier{w: w}
+}
+
+// OpenFileNotifier appends notifications to the file at path.
+func OpenFileNotifier(path string) (*WriterNotifier, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open notification file: %w", err)
+	}
+	return &WriterNotifier{w: f, c: f}, nil
+}
+
+func (n *WriterNotifier) Notify(_ context.Context, msg Notification) error {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	_, err := fmt.Fprintf(n.w, "To: %s\nSubject: %s\nDate: %s\n\n%s\n",
+		msg.To, msg.Subject, time.Now().UTC().Format(time.RFC1123Z), msg.Body)
+	return err
+}
+
+func (n *WriterNotifier) Close() error {
+	if n.c == nil {
+		return nil
+	}
+	return n.c.Close()
+}
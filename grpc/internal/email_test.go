@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// inbox keeps the notifications sent to it.
+type inbox struct {
+	mx   sync.Mutex
+	sent []Notification
+}
+
+func (b *inbox) Notify(_ context.Context, n Notification) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.sent = append(b.sent, n)
+	return nil
+}
+
+// token returns the token of the last verification sent.
+func (b *inbox) token(t *testing.T) string {
+	t.Helper()
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if len(b.sent) == 0 {
+		t.Fatal("no verification was sent")
+	}
+	fields := strings.Fields(b.sent[len(b.sent)-1].Body)
+	return fields[len(fields)-1]
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                       "",
+		"  ":                     "",
+		" Jane.Doe@Example.COM ": "jane.doe@example.com",
+	} {
+		if got, err := NormalizeEmail(in); err != nil || got != want {
+			t.Errorf("NormalizeEmail(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"jane", "Jane <jane@example.com>", "jane@example.com, bob@example.com"} {
+		if _, err := NormalizeEmail(in); !errors.Is(err, ErrInvalidEmail) {
+			t.Errorf("NormalizeEmail(%q): %v, want %v", in, err, ErrInvalidEmail)
+		}
+	}
+}
+
+func TestEmailsAreUniqueWithinTenant(t *testing.T) {
+	s := NewUserService()
+	alice := createUser(t, s, User{Name: "alice", Email: "Alice@Example.com"})
+	if alice.Email != "alice@example.com" {
+		t.Fatalf("stored email %q, want it normalized", alice.Email)
+	}
+
+	if _, err := s.Create(User{Name: "bob", Email: "ALICE@example.com"}); !errors.Is(err, ErrEmailTaken) {
+		t.Fatalf("create with a taken email: %v, want %v", err, ErrEmailTaken)
+	}
+	createUser(t, s, User{Name: "bob", Email: "alice@example.com", Tenant: "other"})
+
+	got, err := s.GetByEmail(DefaultTenant, " ALICE@example.com")
+	if err != nil || got.ID != alice.ID {
+		t.Fatalf("get by email = %v, %v, want %s", got, err, alice.ID)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	s, v, box, _ := newEmailVerifier(t)
+	alice := createUser(t, s, User{Name: "alice", Email: "alice@example.com"})
+
+	if err := v.Send(context.Background(), alice); err != nil {
+		t.Fatal(err)
+	}
+	if to := box.sent[0].To; to != alice.Email {
+		t.Fatalf("sent to %q, want %q", to, alice.Email)
+	}
+	token := box.token(t)
+	verified, err := v.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified.EmailVerified {
+		t.Fatal("email not verified")
+	}
+
+	if _, err = v.Verify(token); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("second use of a token: %v, want %v", err, ErrTokenRevoked)
+	}
+	if err = v.Send(context.Background(), verified); !errors.Is(err, ErrEmailAlreadyVerified) {
+		t.Fatalf("send to a verified email: %v, want %v", err, ErrEmailAlreadyVerified)
+	}
+	if err = v.Send(context.Background(), createUser(t, s, User{Name: "bob"})); !errors.Is(err, ErrNoEmail) {
+		t.Fatalf("send without an email: %v, want %v", err, ErrNoEmail)
+	}
+}
+
+func TestEmailVerificationExpires(t *testing.T) {
+	s, v, box, now := newEmailVerifier(t)
+	alice := createUser(t, s, User{Name: "alice", Email: "alice@example.com"})
+	if err := v.Send(context.Background(), alice); err != nil {
+		t.Fatal(err)
+	}
+
+	*now = now.Add(time.Hour)
+	if _, err := v.Verify(box.token(t)); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("verify with an expired token: %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestEmailVerificationOfChangedEmail(t *testing.T) {
+	s, v, box, _ := newEmailVerifier(t)
+	alice := createUser(t, s, User{Name: "alice", Email: "alice@example.com"})
+	if err := v.Send(context.Background(), alice); err != nil {
+		t.Fatal(err)
+	}
+	alice.Email = "alice@example.org"
+	if _, err := s.Update(AnyTenant, *alice); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.Verify(box.token(t)); !errors.Is(err, ErrEmailChanged) {
+		t.Fatalf("verify the previous email: %v, want %v", err, ErrEmailChanged)
+	}
+	got, err := s.Get(AnyTenant, alice.ID)
+	if err != nil || got.EmailVerified {
+		t.Fatalf("user = %+v, %v, want the new email unverified", got, err)
+	}
+}
+
+func TestChangingEmailClearsVerification(t *testing.T) {
+	s, v, box, _ := newEmailVerifier(t)
+	alice := createUser(t, s, User{Name: "alice", Email: "alice@example.com"})
+	if err := v.Send(context.Background(), alice); err != nil {
+		t.Fatal(err)
+	}
+	verified, err := v.Verify(box.token(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a different address needs verifying again.
+	verified.Email = "ALICE@example.com"
+	if verified, err = s.Update(AnyTenant, *verified); err != nil || !verified.EmailVerified {
+		t.Fatalf("update to the same email = %+v, %v, want it still verified", verified, err)
+	}
+	verified.Email = "alice@example.org"
+	if verified, err = s.Update(AnyTenant, *verified); err != nil || verified.EmailVerified {
+		t.Fatalf("update to another email = %+v, %v, want it unverified", verified, err)
+	}
+}
+
+func newEmailVerifier(t *testing.T) (*UserService, *EmailVerifier, *inbox, *time.Time) {
+	t.Helper()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewUserService()
+	s.SetClock(func() time.Time { return now })
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour, time.Hour)
+	tokens.SetClock(func() time.Time { return now })
+	box := &inbox{}
+	return s, NewEmailVerifier(s, tokens, box, time.Hour), box, &now
+}
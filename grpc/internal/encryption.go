@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// sealedPrefix starts a field encrypted at rest, which is followed by the
+	// ID of the wrapping key, the wrapped data key and the ciphertext.
+	sealedPrefix = "enc:v1:"
+
+	fieldName      = "name"
+	fieldSurname   = "surname"
+	fieldEmail     = "email"
+	fieldBirthDate = "birth_date"
+	fieldTOTP      = "totp"
+
+	dataKeySize = 32
+)
+
+var (
+	ErrDecrypt = errors.New("cannot decrypt field")
+	// ErrKeyringRequired is returned when opening encrypted records without
+	// a keyring, which would otherwise serve their ciphertext.
+	ErrKeyringRequired = errors.New("records are encrypted, a keyring is required")
+)
+
+type (
+	// Keyring holds the keys that wrap the data keys of fields encrypted at
+	// rest, and the key of the blind indexes of names and emails.
+	Keyring struct {
+		primary string
+		keys    map[string][]byte
+		index   []byte
+	}
+
+	keyringFile struct {
+		Primary  string            `json:"primary"`
+		Keys     map[string]string `json:"keys"`
+		IndexKey string            `json:"indexKey"`
+	}
+)
+
+// LoadKeyring reads a keyring file such as
+//
+//	{"primary": "2024-06", "keys": {"2024-01": "...", "2024-06": "..."}, "indexKey": "..."}
+//
+// where the keys are 32 random bytes in standard base64, e.g. from
+// "head -c 32 /dev/urandom | base64". New records are encrypted with the
+// primary key; the others are kept to read records not re-encrypted yet. The
+// index key must never change: records carry the blind indexes of their names
+// and emails, and are refused on load when these do not match.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keyring: %w", err)
+	}
+	var f keyringFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("unmarshal keyring: %w", err)
+	}
+
+	k := &Keyring{primary: f.Primary, keys: make(map[string][]byte, len(f.Keys))}
+	for id, encoded := range f.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid keyring key id %q", id)
+		}
+		if k.keys[id], err = decodeKey(encoded); err != nil {
+			return nil, fmt.Errorf("keyring key %s: %w", id, err)
+		}
+	}
+	if _, ok := k.keys[k.primary]; !ok {
+		return nil, fmt.Errorf("keyring primary key %q not found", k.primary)
+	}
+	if k.index, err = decodeKey(f.IndexKey); err != nil {
+		return nil, fmt.Errorf("keyring index key: %w", err)
+	}
+
+	return k, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("want %d bytes, got %d", dataKeySize, len(key))
+	}
+	return key, nil
+}
+
+// Primary is the ID of the key new records are encrypted with.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// blindIndex is an HMAC of the field value within tenant, equal for equal
+// values without revealing them.
+func (k *Keyring) blindIndex(tenant, field, value string) string {
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(tenant))
+	mac.Write([]byte{0})
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts the field of the user with id under a fresh data key wrapped
+// by the primary key. The ciphertext is bound to the user and field, so it
+// cannot be moved to another record. Empty values stay empty.
+func (k *Keyring) seal(id, field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("generate data key: %w", err)
+	}
+	wrapped, err := gcmSeal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := gcmSeal(dataKey, []byte(value), fieldAAD(id, field))
+	if err != nil {
+		return "", err
+	}
+
+	return sealedPrefix + k.primary + ":" +
+		base64.RawURLEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a field sealed by seal and reports whether it should be
+// sealed again, being under a retired key or not encrypted at all.
+func (k *Keyring) open(id, field, value string) (string, bool, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, value != "", nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, sealedPrefix), ":")
+	if len(parts) != 3 {
+		return "", false, fmt.Errorf("%w: %s of %s: malformed", ErrDecrypt, field, id)
+	}
+	kek, ok := k.keys[parts[0]]
+	if !ok {
+		return "", false, fmt.Errorf("%w: %s of %s: unknown key %q", ErrDecrypt, field, id, parts[0])
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %s of %s: %v", ErrDecrypt, field, id, err)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %s of %s: %v", ErrDecrypt, field, id, err)
+	}
+	dataKey, err := gcmOpen(kek, wrapped, []byte(parts[0]))
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %s of %s: unwrap data key: %v", ErrDecrypt, field, id, err)
+	}
+	plain, err := gcmOpen(dataKey, sealed, fieldAAD(id, field))
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %s of %s: %v", ErrDecrypt, field, id, err)
+	}
+
+	return string(plain), parts[0] != k.primary, nil
+}
+
+// sealUser returns user with its sensitive fields sealed and the blind
+// indexes of its name and email set.
+func (k *Keyring) sealUser(user User) (User, error) {
+	if user.Name != "" {
+		user.NameIndex = k.blindIndex(user.Tenant, fieldName, user.Name)
+	}
+	if user.Email != "" {
+		user.EmailIndex = k.blindIndex(user.Tenant, fieldEmail, user.Email)
+	}
+	var birthDate string
+	if !user.BirthDate.IsZero() {
+		birthDate = user.BirthDate.Format(time.DateOnly)
+	}
+
+	var err error
+	if user.Name, err = k.seal(user.ID, fieldName, user.Name); err != nil {
+		return User{}, err
+	}
+	if user.Surname, err = k.seal(user.ID, fieldSurname, user.Surname); err != nil {
+		return User{}, err
+	}
+	if user.Email, err = k.seal(user.ID, fieldEmail, user.Email); err != nil {
+		return User{}, err
+	}
+	if user.SealedBirthDate, err = k.seal(user.ID, fieldBirthDate, birthDate); err != nil {
+		return User{}, err
+	}
+	if user.TOTPSecret, err = k.seal(user.ID, fieldTOTP, user.TOTPSecret); err != nil {
+		return User{}, err
+	}
+	user.BirthDate = time.Time{}
+	return user, nil
+}
+
+// openUser reverses sealUser, reporting whether the user should be sealed
+// again with the primary key. A blind index that does not match its field
+// means the index key has changed, which would break lookups, so it fails.
+func (k *Keyring) openUser(user User) (User, bool, error) {
+	var stale [5]bool
+	var err error
+	if user.Name, stale[0], err = k.open(user.ID, fieldName, user.Name); err != nil {
+		return User{}, false, err
+	}
+	if user.Surname, stale[1], err = k.open(user.ID, fieldSurname, user.Surname); err != nil {
+		return User{}, false, err
+	}
+	if user.Email, stale[2], err = k.open(user.ID, fieldEmail, user.Email); err != nil {
+		return User{}, false, err
+	}
+	if user.TOTPSecret, stale[3], err = k.open(user.ID, fieldTOTP, user.TOTPSecret); err != nil {
+		return User{}, false, err
+	}
+	if user.SealedBirthDate != "" {
+		birthDate, retired, err := k.open(user.ID, fieldBirthDate, user.SealedBirthDate)
+		if err != nil {
+			return User{}, false, err
+		}
+		if user.BirthDate, err = time.Parse(time.DateOnly, birthDate); err != nil {
+			return User{}, false, fmt.Errorf("%w: %s of %s: %v", ErrDecrypt, fieldBirthDate, user.ID, err)
+		}
+		stale[4] = retired
+	} else {
+		// Written unencrypted.
+		stale[4] = !user.BirthDate.IsZero()
+	}
+
+	for _, index := range []struct{ field, value, index string }{
+		{fieldName, user.Name, user.NameIndex},
+		{fieldEmail, user.Email, user.EmailIndex},
+	} {
+		switch {
+		case index.value == "":
+		case index.index == "":
+			// Written before records carried their indexes.
+			stale[4] = true
+		case index.index != k.blindIndex(user.Tenant, index.field, index.value):
+			return User{}, false, fmt.Errorf("%w: %s index of %s does not match, the index key has changed", ErrDecrypt, index.field, user.ID)
+		}
+	}
+	user.SealedBirthDate, user.NameIndex, user.EmailIndex = "", "", ""
+
+	return user, slices.Contains(stale[:], true), nil
+}
+
+// sealed reports whether user is a record encrypted at rest.
+func (u *User) sealed() bool {
+	for _, v := range []string{u.Name, u.Surname, u.Email, u.TOTPSecret} {
+		if strings.HasPrefix(v, sealedPrefix) {
+			return true
+		}
+	}
+	return u.SealedBirthDate != "" || u.NameIndex != "" || u.EmailIndex != ""
+}
+
+func fieldAAD(id, field string) []byte {
+	return []byte(id + "\x00" + field)
+}
+
+// gcmSeal encrypts plain with AES-GCM under key, prefixed with the nonce.
+func gcmSeal(key, plain, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+func gcmOpen(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nameKey is the key of name in the name index of tenant: its blind index
+// when records are encrypted at rest, and the name itself otherwise.
+func (s *UserService) nameKey(tenant, name string) string {
+	if s.keyring == nil {
+		return name
+	}
+	return s.keyring.blindIndex(tenant, fieldName, name)
+}
+
+// emailKey is the key of email in the email index of tenant, like nameKey.
+func (s *UserService) emailKey(tenant, email string) string {
+	if s.keyring == nil {
+		return email
+	}
+	return s.keyring.blindIndex(tenant, fieldEmail, email)
+}
+
+// indexName records user's name. The caller must hold the write lock.
+func (s *UserService) indexName(user User) {
+	names, ok := s.names[user.Tenant]
+	if !ok {
+		names = make(map[string]string)
+		s.names[user.Tenant] = names
+	}
+	names[s.nameKey(user.Tenant, user.Name)] = user.ID
+}
+
+func (s *UserService) unindexName(user User) {
+	names := s.names[user.Tenant]
+	key := s.nameKey(user.Tenant, user.Name)
+	if names[key] != user.ID {
+		return
+	}
+	delete(names, key)
+	if len(names) == 0 {
+		delete(s.names, user.Tenant)
+	}
+}
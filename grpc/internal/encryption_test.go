@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncryptedStoreSealsAndFindsEmails(t *testing.T) {
+	dir := t.TempDir()
+	keyring := testKeyring()
+	birthDate := time.Date(1990, 5, 17, 0, 0, 0, 0, time.UTC)
+
+	s := openEncrypted(t, dir, keyring)
+	alice, err := s.Create(User{Name: "alice", Tenant: DefaultTenant, Email: "alice@example.com", BirthDate: birthDate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// Only in the log.
+	if _, err = s.Create(User{Name: "bob", Tenant: DefaultTenant, Email: "bob@example.com", BirthDate: birthDate}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{snapshotFile, walFile} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, plain := range []string{"alice", "bob", "@example.com", "1990-05-17"} {
+			if bytes.Contains(data, []byte(plain)) {
+				t.Errorf("%s holds %q in plaintext", file, plain)
+			}
+		}
+	}
+
+	s = openEncrypted(t, dir, keyring)
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		got, err := s.GetByEmail(DefaultTenant, email)
+		if err != nil {
+			t.Fatalf("get %s after reopening: %v", email, err)
+		}
+		if got.Email != email || !got.BirthDate.Equal(birthDate) {
+			t.Errorf("reopened user has email %q born %v, want %q born %v", got.Email, got.BirthDate, email, birthDate)
+		}
+		if got.EmailIndex != "" || got.NameIndex != "" || got.SealedBirthDate != "" {
+			t.Errorf("reopened user %s kept its record-only fields", got.ID)
+		}
+	}
+	if got, err := s.Get(AnyTenant, alice.ID); err != nil || got.Name != "alice" {
+		t.Fatalf("get alice after reopening: %v, %v", got, err)
+	}
+}
+
+func TestEncryptedStoreRequiresKeyring(t *testing.T) {
+	dir := t.TempDir()
+	s := openEncrypted(t, dir, testKeyring())
+	if _, err := s.Create(User{Name: "alice", Tenant: DefaultTenant, Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenUserService(PersistenceConfig{Dir: dir}); !errors.Is(err, ErrKeyringRequired) {
+		t.Fatalf("open without a keyring: %v, want %v", err, ErrKeyringRequired)
+	}
+}
+
+func TestEncryptedStoreRejectsOtherIndexKey(t *testing.T) {
+	dir := t.TempDir()
+	keyring := testKeyring()
+	s := openEncrypted(t, dir, keyring)
+	if _, err := s.Create(User{Name: "alice", Tenant: DefaultTenant}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := testKeyring()
+	other.index = bytes.Repeat([]byte{2}, dataKeySize)
+	if _, err := OpenUserService(PersistenceConfig{Dir: dir, Keyring: other}); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("open with another index key: %v, want %v", err, ErrDecrypt)
+	}
+}
+
+func testKeyring() *Keyring {
+	return &Keyring{
+		primary: "k1",
+		keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, dataKeySize)},
+		index:   bytes.Repeat([]byte{3}, dataKeySize),
+	}
+}
+
+func openEncrypted(t *testing.T, dir string, keyring *Keyring) *UserService {
+	t.Helper()
+
+	s, err := OpenUserService(PersistenceConfig{Dir: dir, Keyring: keyring})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FaultHeader carries a fault spec for the call itself, such as
+// "latency=200ms;error=unavailable", when FaultConfig.AllowHeader is set.
+const FaultHeader = "x-fault-injection"
+
+// ErrFaultInjectionDisabled is returned by NewFaultInjector in builds without
+// the faultinjection tag, which is the kill switch keeping injected faults
+// out of production binaries.
+var ErrFaultInjectionDisabled = errors.New("fault injection is not compiled in, build with -tags faultinjection")
+
+type (
+	// FaultRule makes the calls of Method misbehave. Each rate is the
+	// probability, from 0 to 1, of the fault hitting a call.
+	FaultRule struct {
+		// Method is a full method name, a bare method name such as "GetUser",
+		// or "*" for the calls no other rule matches.
+		Method string
+
+		Latency     time.Duration
+		LatencyRate float64
+
+		// Code fails the call before it is handled.
+		Code      codes.Code
+		ErrorRate float64
+
+		// AbortRate is the probability of a call being handled but failing
+		// with Unavailable as if the connection dropped before the response,
+		// or after the first message of a server stream.
+		AbortRate float64
+	}
+
+	FaultConfig struct {
+		Rules []FaultRule
+		// Seed makes the faults of each rule reproducible for the same
+		// sequence of calls.
+		Seed int64
+		// AllowHeader lets callers request faults with FaultHeader.
+		AllowHeader bool
+	}
+
+	// FaultInjector injects latency, errors and aborts into RPCs for
+	// resilience testing.
+	FaultInjector struct {
+		cfg   FaultConfig
+		rules []*faultRule
+		// header draws the faults requested with FaultHeader.
+		header *faultRule
+	}
+
+	faultRule struct {
+		FaultRule
+		mx  sync.Mutex
+		rng *rand.Rand
+	}
+
+	faultPlan struct {
+		latency time.Duration
+		err     error
+		abort   bool
+	}
+
+	// brokenStream fails a server stream once it has sent after messages.
+	brokenStream struct {
+		grpc.ServerStream
+		ctx    context.Context
+		cancel context.CancelFunc
+		after  int
+		sent   int
+		err    error
+		broken bool
+	}
+)
+
+// NewFaultInjector fails with ErrFaultInjectionDisabled unless the binary is
+// built with the faultinjection tag.
+func NewFaultInjector(cfg FaultConfig) (*FaultInjector, error) {
+	if !faultInjectionBuild {
+		return nil, ErrFaultInjectionDisabled
+	}
+	return newFaultInjector(cfg)
+}
+
+// newFaultInjector builds the injector of cfg, whatever the build tags.
+func newFaultInjector(cfg FaultConfig) (*FaultInjector, error) {
+	f := &FaultInjector{
+		cfg:    cfg,
+		header: &faultRule{rng: rand.New(rand.NewSource(cfg.Seed - 1))},
+	}
+	for i, r := range cfg.Rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, &faultRule{
+			FaultRule: r,
+			rng:       rand.New(rand.NewSource(cfg.Seed + int64(i))),
+		})
+	}
+
+	return f, nil
+}
+
+// ParseFaultRules parses rules separated by commas, each a method and a spec
+// such as "GetUser:latency=200ms;latency-rate=0.5;error=unavailable;error-rate=0.1;abort-rate=0.01".
+// A rate left out is 1 for a given latency or error.
+func ParseFaultRules(s string) ([]FaultRule, error) {
+	var rules []FaultRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		method, spec, ok := strings.Cut(item, ":")
+		if !ok || method == "" {
+			return nil, fmt.Errorf("invalid fault rule %q: want method:spec", item)
+		}
+		r, err := parseFaultSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault rule %q: %w", item, err)
+		}
+		r.Method = method
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func (f *FaultInjector) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	plan, err := f.plan(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err = plan.wait(ctx); err != nil {
+		return nil, err
+	}
+	if plan.err != nil {
+		return nil, plan.err
+	}
+
+	res, err := handler(ctx, req)
+	if err == nil && plan.abort {
+		return nil, errAborted()
+	}
+	return res, err
+}
+
+func (f *FaultInjector) StreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	plan, err := f.plan(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	if err = plan.wait(ss.Context()); err != nil {
+		return err
+	}
+	if plan.err != nil {
+		return plan.err
+	}
+	if !plan.abort {
+		return handler(srv, ss)
+	}
+	return BreakStream(srv, ss, handler, 1, errAborted())
+}
+
+// BreakStream runs handler on ss until it has sent after messages. Then the
+// handler's context is cancelled, its further sends fail and the stream ends
+// with err, as if the connection dropped.
+func BreakStream(srv any, ss grpc.ServerStream, handler grpc.StreamHandler, after int, err error) error {
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+
+	bs := &brokenStream{ServerStream: ss, ctx: ctx, cancel: cancel, after: after, err: err}
+	herr := handler(srv, bs)
+	if bs.broken {
+		return err
+	}
+	return herr
+}
+
+// plan decides the faults of a call of method. A FaultHeader spec replaces
+// the configured rule.
+func (f *FaultInjector) plan(ctx context.Context, method string) (faultPlan, error) {
+	if f.cfg.AllowHeader {
+		if spec := firstMetadata(ctx, FaultHeader); spec != "" {
+			r, err := parseFaultSpec(spec)
+			if err != nil {
+				return faultPlan{}, status.Errorf(codes.InvalidArgument, "%s: %v", FaultHeader, err)
+			}
+			return r.plan(f.header.draw()), nil
+		}
+	}
+
+	if r := f.match(method); r != nil {
+		return r.plan(r.draw()), nil
+	}
+	return faultPlan{}, nil
+}
+
+func (f *FaultInjector) match(method string) *faultRule {
+	var fallback *faultRule
+	for _, r := range f.rules {
+		switch r.Method {
+		case method, path.Base(method):
+			return r
+		case "*":
+			if fallback == nil {
+				fallback = r
+			}
+		}
+	}
+	return fallback
+}
+
+// draw returns the random numbers of one call. Every fault is drawn whether
+// or not the rule has it, so that the sequence depends on the seed and the
+// call count only.
+func (r *faultRule) draw() [3]float64 {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return [3]float64{r.rng.Float64(), r.rng.Float64(), r.rng.Float64()}
+}
+
+// plan decides the faults of a call from its draw.
+func (r FaultRule) plan(draw [3]float64) faultPlan {
+	latency, fail, abort := draw[0], draw[1], draw[2]
+
+	var p faultPlan
+	if r.Latency > 0 && latency < r.LatencyRate {
+		p.latency = r.Latency
+	}
+	if r.Code != codes.OK && fail < r.ErrorRate {
+		p.err = status.Errorf(r.Code, "fault injection: %v", r.Code)
+	}
+	if abort < r.AbortRate {
+		p.abort = true
+	}
+	return p
+}
+
+func (p faultPlan) wait(ctx context.Context) error {
+	if p.latency <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	case <-time.After(p.latency):
+		return nil
+	}
+}
+
+func (r FaultRule) validate() error {
+	for _, rate := range []float64{r.LatencyRate, r.ErrorRate, r.AbortRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("fault rule %s: rate %v out of range [0, 1]", r.Method, rate)
+		}
+	}
+	return nil
+}
+
+func parseFaultSpec(spec string) (FaultRule, error) {
+	r := FaultRule{LatencyRate: -1, ErrorRate: -1}
+	for _, field := range strings.Split(spec, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "latency":
+			r.Latency, err = time.ParseDuration(value)
+		case "latency-rate":
+			r.LatencyRate, err = strconv.ParseFloat(value, 64)
+		case "error":
+			err = r.Code.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(value))))
+		case "error-rate":
+			r.ErrorRate, err = strconv.ParseFloat(value, 64)
+		case "abort":
+			r.AbortRate = 1
+		case "abort-rate":
+			r.AbortRate, err = strconv.ParseFloat(value, 64)
+		default:
+			return FaultRule{}, fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return FaultRule{}, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	if r.LatencyRate < 0 {
+		r.LatencyRate = 1
+	}
+	if r.ErrorRate < 0 {
+		r.ErrorRate = 1
+	}
+	return r, r.validate()
+}
+
+func errAborted() error {
+	return status.Error(codes.Unavailable, "fault injection: connection aborted")
+}
+
+func (s *brokenStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *brokenStream) SendMsg(m any) error {
+	if s.broken {
+		return s.err
+	}
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	if s.sent++; s.sent >= s.after {
+		s.broken = true
+		s.cancel()
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !faultinjection
+
+package internal
+
+// faultInjectionBuild keeps NewFaultInjector from working in binaries built
+// without the faultinjection tag.
+const faultInjectionBuild = false
@@ -0,0 +1,5 @@
+//go:build faultinjection
+
+package internal
+
+const faultInjectionBuild = true
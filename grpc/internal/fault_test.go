@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+// faultOutcome is what a plan does to a call, comparable across injectors.
+type faultOutcome struct {
+	latency time.Duration
+	code    codes.Code
+	abort   bool
+}
+
+var halfFaults = []FaultRule{
+	{Method: "GetUser", Latency: time.Second, LatencyRate: 0.5, Code: codes.Unavailable, ErrorRate: 0.5, AbortRate: 0.5},
+	{Method: "*", Code: codes.Internal, ErrorRate: 0.5},
+}
+
+func TestFaultSeedIsReproducible(t *testing.T) {
+	first := faultOutcomes(t, newTestFaultInjector(t, FaultConfig{Rules: halfFaults, Seed: 42}), pb.UserService_GetUser_FullMethodName, 200)
+	again := faultOutcomes(t, newTestFaultInjector(t, FaultConfig{Rules: halfFaults, Seed: 42}), pb.UserService_GetUser_FullMethodName, 200)
+	if !slices.Equal(first, again) {
+		t.Fatal("the same seed injected different faults")
+	}
+
+	other := faultOutcomes(t, newTestFaultInjector(t, FaultConfig{Rules: halfFaults, Seed: 43}), pb.UserService_GetUser_FullMethodName, 200)
+	if slices.Equal(first, other) {
+		t.Fatal("another seed injected the same faults")
+	}
+}
+
+func TestFaultRulesDrawIndependently(t *testing.T) {
+	want := faultOutcomes(t, newTestFaultInjector(t, FaultConfig{Rules: halfFaults, Seed: 42}), pb.UserService_GetUser_FullMethodName, 50)
+
+	// Calls of other methods and with a header spec draw from their own
+	// sequences, so they do not shift the faults of GetUser.
+	f := newTestFaultInjector(t, FaultConfig{Rules: halfFaults, Seed: 42, AllowHeader: true})
+	header := metadata.NewIncomingContext(context.Background(), metadata.Pairs(FaultHeader, "error=aborted;error-rate=0.5"))
+	var got []faultOutcome
+	for range 50 {
+		faultOutcomes(t, f, pb.UserService_ListUsers_FullMethodName, 1)
+		if _, err := f.plan(header, pb.UserService_GetUser_FullMethodName); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, faultOutcomes(t, f, pb.UserService_GetUser_FullMethodName, 1)...)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatal("calls of other methods changed the faults of GetUser")
+	}
+}
+
+func TestFaultRatesHold(t *testing.T) {
+	rule := FaultRule{Method: "*", Latency: time.Millisecond, LatencyRate: 0.2, Code: codes.Unavailable, ErrorRate: 0.5, AbortRate: 0.1}
+	f := newTestFaultInjector(t, FaultConfig{Rules: []FaultRule{rule}, Seed: 7})
+
+	var latencies, errs, aborts int
+	const calls = 2000
+	for _, o := range faultOutcomes(t, f, pb.UserService_GetUser_FullMethodName, calls) {
+		if o.latency == rule.Latency {
+			latencies++
+		}
+		if o.code == rule.Code {
+			errs++
+		}
+		if o.abort {
+			aborts++
+		}
+	}
+	for _, c := range []struct {
+		name string
+		got  int
+		rate float64
+	}{
+		{"latency", latencies, rule.LatencyRate},
+		{"error", errs, rule.ErrorRate},
+		{"abort", aborts, rule.AbortRate},
+	} {
+		if got := float64(c.got) / calls; got < c.rate-0.05 || got > c.rate+0.05 {
+			t.Errorf("%s rate = %.3f, want about %v", c.name, got, c.rate)
+		}
+	}
+}
+
+func TestFaultRuleMatching(t *testing.T) {
+	f := newTestFaultInjector(t, FaultConfig{Rules: []FaultRule{
+		{Method: "*", Code: codes.Internal, ErrorRate: 1},
+		{Method: pb.UserService_GetUser_FullMethodName, Code: codes.NotFound, ErrorRate: 1},
+		{Method: "ListUsers", Code: codes.Unavailable, ErrorRate: 1},
+	}})
+
+	for method, want := range map[string]codes.Code{
+		pb.UserService_GetUser_FullMethodName:   codes.NotFound,
+		pb.UserService_ListUsers_FullMethodName: codes.Unavailable,
+		// Only the fallback matches.
+		pb.UserService_DeleteUser_FullMethodName: codes.Internal,
+	} {
+		if got := faultOutcomes(t, f, method, 1)[0].code; got != want {
+			t.Errorf("fault of %s = %v, want %v", method, got, want)
+		}
+	}
+}
+
+func TestFaultHeader(t *testing.T) {
+	spec := metadata.NewIncomingContext(context.Background(), metadata.Pairs(FaultHeader, "error=unavailable"))
+
+	f := newTestFaultInjector(t, FaultConfig{AllowHeader: true})
+	plan, err := f.plan(spec, pb.UserService_GetUser_FullMethodName)
+	if err != nil || status.Code(plan.err) != codes.Unavailable {
+		t.Fatalf("plan = %+v, %v, want Unavailable from the header", plan, err)
+	}
+	bad := metadata.NewIncomingContext(context.Background(), metadata.Pairs(FaultHeader, "error-rate=2"))
+	if _, err = f.plan(bad, pb.UserService_GetUser_FullMethodName); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("plan of an invalid spec: %v, want %v", err, codes.InvalidArgument)
+	}
+
+	// Ignored unless allowed.
+	f = newTestFaultInjector(t, FaultConfig{})
+	if plan, err = f.plan(spec, pb.UserService_GetUser_FullMethodName); err != nil || plan.err != nil {
+		t.Fatalf("plan = %+v, %v, want the header ignored", plan, err)
+	}
+}
+
+func TestFaultUnaryInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: pb.UserService_GetUser_FullMethodName}
+
+	for _, c := range []struct {
+		name    string
+		rule    FaultRule
+		handled bool
+		code    codes.Code
+	}{
+		{"error", FaultRule{Method: "*", Code: codes.Unavailable, ErrorRate: 1}, false, codes.Unavailable},
+		// The call takes effect, only its response is lost.
+		{"abort", FaultRule{Method: "*", AbortRate: 1}, true, codes.Unavailable},
+		{"none", FaultRule{Method: "*"}, true, codes.OK},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newTestFaultInjector(t, FaultConfig{Rules: []FaultRule{c.rule}})
+			handled := false
+			_, err := f.UnaryInterceptor(context.Background(), nil, info, func(context.Context, any) (any, error) {
+				handled = true
+				return "ok", nil
+			})
+			if handled != c.handled || status.Code(err) != c.code {
+				t.Fatalf("handled = %v, err = %v, want %v and %v", handled, err, c.handled, c.code)
+			}
+		})
+	}
+}
+
+func TestParseFaultRules(t *testing.T) {
+	rules, err := ParseFaultRules("GetUser:latency=200ms;error=unavailable;error-rate=0.1, *:abort-rate=0.01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FaultRule{
+		// A latency without a rate always applies.
+		{Method: "GetUser", Latency: 200 * time.Millisecond, LatencyRate: 1, Code: codes.Unavailable, ErrorRate: 0.1},
+		{Method: "*", LatencyRate: 1, ErrorRate: 1, AbortRate: 0.01},
+	}
+	if !slices.Equal(rules, want) {
+		t.Fatalf("rules = %+v, want %+v", rules, want)
+	}
+
+	for _, s := range []string{"GetUser", "GetUser:error-rate=1.5", "GetUser:jitter=1s", "GetUser:error=nope"} {
+		if _, err = ParseFaultRules(s); err == nil {
+			t.Errorf("parsed %q, want an error", s)
+		}
+	}
+}
+
+func TestNewFaultInjectorNeedsBuildTag(t *testing.T) {
+	_, err := NewFaultInjector(FaultConfig{})
+	if faultInjectionBuild != (err == nil) || !faultInjectionBuild && !errors.Is(err, ErrFaultInjectionDisabled) {
+		t.Fatalf("NewFaultInjector: %v in a build with fault injection %v", err, faultInjectionBuild)
+	}
+}
+
+func newTestFaultInjector(t *testing.T, cfg FaultConfig) *FaultInjector {
+	t.Helper()
+
+	f, err := newFaultInjector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func faultOutcomes(t *testing.T, f *FaultInjector, method string, calls int) []faultOutcome {
+	t.Helper()
+
+	res := make([]faultOutcome, 0, calls)
+	for range calls {
+		plan, err := f.plan(context.Background(), method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, faultOutcome{latency: plan.latency, code: status.Code(plan.err), abort: plan.abort})
+	}
+	return res
+}
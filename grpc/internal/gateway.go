@@ -0,0 +1,654 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	gatewayMaxMessage = 4 << 20
+	gatewayBufferSize = 1 << 20
+
+	flagGRPCWebTrailer = 0x80
+	flagConnectEnd     = 0x02
+)
+
+// gatewayForwardHeaders are the only HTTP request headers the gateway passes
+// on as metadata: credentials and the read consistency. Anything else, such
+// as userID or x-fault-injection, could be set by any page a browser visits.
+var gatewayForwardHeaders = []string{"authorization", "x-api-key", ReadConsistencyHeader}
+
+// gatewaySkipHeaders are the metadata keys the gateway does not copy from
+// calls to responses.
+var gatewaySkipHeaders = map[string]bool{
+	"accept":                   true,
+	"accept-encoding":          true,
+	"connection":               true,
+	"content-length":           true,
+	"content-type":             true,
+	"cookie":                   true,
+	"host":                     true,
+	"keep-alive":               true,
+	"origin":                   true,
+	"referer":                  true,
+	"te":                       true,
+	"trailer":                  true,
+	"transfer-encoding":        true,
+	"upgrade":                  true,
+	"user-agent":               true,
+	"x-grpc-web":               true,
+	"x-user-agent":             true,
+	"grpc-timeout":             true,
+	"grpc-encoding":            true,
+	"grpc-accept-encoding":     true,
+	"connect-protocol-version": true,
+	"connect-timeout-ms":       true,
+}
+
+// connectCodes are the Connect protocol names of the gRPC status codes.
+var connectCodes = map[codes.Code]string{
+	codes.Canceled:           "canceled",
+	codes.Unknown:            "unknown",
+	codes.InvalidArgument:    "invalid_argument",
+	codes.DeadlineExceeded:   "deadline_exceeded",
+	codes.NotFound:           "not_found",
+	codes.AlreadyExists:      "already_exists",
+	codes.PermissionDenied:   "permission_denied",
+	codes.ResourceExhausted:  "resource_exhausted",
+	codes.FailedPrecondition: "failed_precondition",
+	codes.Aborted:            "aborted",
+	codes.OutOfRange:         "out_of_range",
+	codes.Unimplemented:      "unimplemented",
+	codes.Internal:           "internal",
+	codes.Unavailable:        "unavailable",
+	codes.DataLoss:           "data_loss",
+	codes.Unauthenticated:    "unauthenticated",
+}
+
+// connectHTTPStatus maps status codes to the HTTP status of a Connect unary error.
+var connectHTTPStatus = map[codes.Code]int{
+	codes.Canceled:           499,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+type (
+	GatewayConfig struct {
+		// AllowedOrigins lists the origins browsers may call from. "*" allows
+		// any origin; none disables CORS.
+		AllowedOrigins []string
+	}
+
+	// Gateway serves the gRPC-Web and Connect protocols over HTTP/1.1 and
+	// HTTP/2. Calls are forwarded to the gRPC server through an in-process
+	// connection, so they pass the same interceptors as native gRPC calls.
+	Gateway struct {
+		cfg     GatewayConfig
+		lis     *bufconn.Listener
+		conn    *grpc.ClientConn
+		methods map[string]gatewayMethod
+	}
+
+	gatewayMethod struct {
+		input, output protoreflect.MessageType
+		serverStreams bool
+	}
+
+	// gatewayCodec encodes messages of a Connect request.
+	gatewayCodec struct {
+		name      string
+		marshal   func(proto.Message) ([]byte, error)
+		unmarshal func([]byte, proto.Message) error
+	}
+
+	connectError struct {
+		Code    string `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+
+	connectEndStream struct {
+		Error    *connectError       `json:"error,omitempty"`
+		Metadata map[string][]string `json:"metadata,omitempty"`
+	}
+)
+
+var (
+	protoCodec = gatewayCodec{
+		name:      "proto",
+		marshal:   proto.Marshal,
+		unmarshal: proto.Unmarshal,
+	}
+	jsonCodec = gatewayCodec{
+		name:      "json",
+		marshal:   protojson.Marshal,
+		unmarshal: protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal,
+	}
+)
+
+// NewGateway starts serving server on an in-process listener for the gateway
+// to forward to. Every service must be registered on server beforehand.
+func NewGateway(server *grpc.Server, cfg GatewayConfig) (*Gateway, error) {
+	g := &Gateway{
+		cfg:     cfg,
+		lis:     bufconn.Listen(gatewayBufferSize),
+		methods: make(map[string]gatewayMethod),
+	}
+
+	for name, info := range server.GetServiceInfo() {
+		for _, mi := range info.Methods {
+			if mi.IsClientStream {
+				continue
+			}
+			method := "/" + name + "/" + mi.Name
+			m, err := describeMethod(method)
+			if err != nil {
+				return nil, err
+			}
+			g.methods[method] = m
+		}
+	}
+
+	conn, err := grpc.Dial("passthrough:///gateway",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return g.lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dial gateway listener: %w", err)
+	}
+	g.conn = conn
+
+	go func() {
+		if err := server.Serve(g.lis); err != nil {
+			fmt.Println("gateway listener:", err)
+		}
+	}()
+
+	return g, nil
+}
+
+// describeMethod looks up the message types of a full method name in the
+// registered proto files.
+func describeMethod(method string) (gatewayMethod, error) {
+	service, name, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if !ok {
+		return gatewayMethod{}, fmt.Errorf("describe %s: not a full method name", method)
+	}
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return gatewayMethod{}, fmt.Errorf("describe %s: %w", service, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return gatewayMethod{}, fmt.Errorf("describe %s: not a service", service)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return gatewayMethod{}, fmt.Errorf("describe %s: unknown method", method)
+	}
+	input, err := protoregistry.GlobalTypes.FindMessageByName(md.Input().FullName())
+	if err != nil {
+		return gatewayMethod{}, fmt.Errorf("describe %s: %w", method, err)
+	}
+	output, err := protoregistry.GlobalTypes.FindMessageByName(md.Output().FullName())
+	if err != nil {
+		return gatewayMethod{}, fmt.Errorf("describe %s: %w", method, err)
+	}
+	return gatewayMethod{input: input, output: output, serverStreams: md.IsStreamingServer()}, nil
+}
+
+// Handler returns the gateway for an http.Server, accepting HTTP/2 without
+// TLS as well as HTTP/1.1.
+func (g *Gateway) Handler() http.Handler {
+	return h2c.NewHandler(g, &http2.Server{})
+}
+
+func (g *Gateway) Close() error {
+	err := g.conn.Close()
+	if lerr := g.lis.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.cors(w, r) || r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	contentType = strings.TrimSpace(contentType)
+
+	switch contentType {
+	case "application/grpc-web", "application/grpc-web+proto", "application/grpc-web-text", "application/grpc-web-text+proto":
+		g.serveGRPCWeb(w, r, contentType)
+	case "application/proto":
+		g.serveConnectUnary(w, r, protoCodec)
+	case "application/json":
+		g.serveConnectUnary(w, r, jsonCodec)
+	case "application/connect+proto":
+		g.serveConnectStream(w, r, protoCodec)
+	case "application/connect+json":
+		g.serveConnectStream(w, r, jsonCodec)
+	default:
+		http.Error(w, "unsupported content type: "+contentType, http.StatusUnsupportedMediaType)
+	}
+}
+
+// cors sets the CORS headers for an allowed origin and answers preflight
+// requests. It reports whether the request may proceed.
+func (g *Gateway) cors(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !g.allowedOrigin(origin) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	h.Set("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin, *")
+
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		h.Set("Access-Control-Max-Age", "7200")
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	return true
+}
+
+func (g *Gateway) allowedOrigin(origin string) bool {
+	for _, o := range g.cfg.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) serveGRPCWeb(w http.ResponseWriter, r *http.Request, contentType string) {
+	text := strings.HasPrefix(contentType, "application/grpc-web-text")
+	w.Header().Set("Content-Type", contentType)
+
+	var out io.Writer = w
+	writeFrame := func(flags byte, payload []byte) error {
+		frame := envelope(flags, payload)
+		if text {
+			frame = []byte(base64.StdEncoding.EncodeToString(frame))
+		}
+		_, err := out.Write(frame)
+		flush(w)
+		return err
+	}
+	finish := func(st *status.Status, trailer metadata.MD) {
+		block := fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n", st.Code(), encodeGRPCMessage(st.Message()))
+		for k, vs := range trailer {
+			if gatewaySkipHeaders[k] {
+				continue
+			}
+			for _, v := range vs {
+				block += k + ": " + headerValue(k, v) + "\r\n"
+			}
+		}
+		_ = writeFrame(flagGRPCWebTrailer, []byte(block))
+	}
+
+	m, ok := g.methods[r.URL.Path]
+	if !ok {
+		finish(status.Newf(codes.Unimplemented, "unknown method %s", r.URL.Path), nil)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, r.Body)
+	}
+	_, payload, err := readEnvelope(body)
+	if err != nil {
+		finish(status.Newf(codes.InvalidArgument, "read request: %v", err), nil)
+		return
+	}
+	req := m.input.New().Interface()
+	if err = proto.Unmarshal(payload, req); err != nil {
+		finish(status.Newf(codes.InvalidArgument, "decode request: %v", err), nil)
+		return
+	}
+
+	ctx, cancel := g.context(r, parseGRPCTimeout(r.Header.Get("Grpc-Timeout")))
+	defer cancel()
+
+	trailer, err := g.forward(ctx, r.URL.Path, m, req,
+		func(header metadata.MD) {
+			setMetadataHeaders(w.Header(), header, "")
+		},
+		func(msg proto.Message) error {
+			data, err := proto.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			return writeFrame(0, data)
+		},
+	)
+	finish(status.Convert(err), trailer)
+}
+
+func (g *Gateway) serveConnectUnary(w http.ResponseWriter, r *http.Request, codec gatewayCodec) {
+	m, ok := g.methods[r.URL.Path]
+	if !ok {
+		writeConnectError(w, status.Newf(codes.Unimplemented, "unknown method %s", r.URL.Path))
+		return
+	}
+	if m.serverStreams {
+		http.Error(w, "streaming method requires application/connect+"+codec.name, http.StatusUnsupportedMediaType)
+		return
+	}
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		writeConnectError(w, status.Newf(codes.Unimplemented, "unsupported content encoding %q", enc))
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, gatewayMaxMessage+1))
+	if err != nil || len(payload) > gatewayMaxMessage {
+		writeConnectError(w, status.New(codes.InvalidArgument, "request body too large or unreadable"))
+		return
+	}
+	req := m.input.New().Interface()
+	if err = codec.unmarshal(payload, req); err != nil {
+		writeConnectError(w, status.Newf(codes.InvalidArgument, "decode request: %v", err))
+		return
+	}
+
+	ctx, cancel := g.context(r, parseConnectTimeout(r.Header.Get("Connect-Timeout-Ms")))
+	defer cancel()
+
+	var header metadata.MD
+	var res proto.Message
+	trailer, err := g.forward(ctx, r.URL.Path, m, req,
+		func(md metadata.MD) { header = md },
+		func(msg proto.Message) error {
+			res = msg
+			return nil
+		},
+	)
+	setMetadataHeaders(w.Header(), header, "")
+	setMetadataHeaders(w.Header(), trailer, "Trailer-")
+	if err != nil {
+		writeConnectError(w, status.Convert(err))
+		return
+	}
+
+	data, err := codec.marshal(res)
+	if err != nil {
+		writeConnectError(w, status.Newf(codes.Internal, "encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/"+codec.name)
+	_, _ = w.Write(data)
+}
+
+func (g *Gateway) serveConnectStream(w http.ResponseWriter, r *http.Request, codec gatewayCodec) {
+	w.Header().Set("Content-Type", "application/connect+"+codec.name)
+
+	finish := func(err error, trailer metadata.MD) {
+		end := connectEndStream{Metadata: make(map[string][]string)}
+		if err != nil {
+			st := status.Convert(err)
+			end.Error = &connectError{Code: connectCodes[st.Code()], Message: st.Message()}
+		}
+		for k, vs := range trailer {
+			if gatewaySkipHeaders[k] {
+				continue
+			}
+			for _, v := range vs {
+				end.Metadata[k] = append(end.Metadata[k], headerValue(k, v))
+			}
+		}
+		data, _ := json.Marshal(end)
+		_, _ = w.Write(envelope(flagConnectEnd, data))
+		flush(w)
+	}
+
+	m, ok := g.methods[r.URL.Path]
+	if !ok {
+		finish(status.Errorf(codes.Unimplemented, "unknown method %s", r.URL.Path), nil)
+		return
+	}
+
+	flags, payload, err := readEnvelope(r.Body)
+	if err != nil || flags != 0 {
+		finish(status.Errorf(codes.InvalidArgument, "read request: %v", err), nil)
+		return
+	}
+	req := m.input.New().Interface()
+	if err = codec.unmarshal(payload, req); err != nil {
+		finish(status.Errorf(codes.InvalidArgument, "decode request: %v", err), nil)
+		return
+	}
+
+	ctx, cancel := g.context(r, parseConnectTimeout(r.Header.Get("Connect-Timeout-Ms")))
+	defer cancel()
+
+	trailer, err := g.forward(ctx, r.URL.Path, m, req,
+		func(header metadata.MD) {
+			setMetadataHeaders(w.Header(), header, "")
+		},
+		func(msg proto.Message) error {
+			data, err := codec.marshal(msg)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(envelope(0, data))
+			flush(w)
+			return err
+		},
+	)
+	finish(err, trailer)
+}
+
+// context derives the context of the forwarded call from r: its
+// gatewayForwardHeaders become metadata and timeout, when positive, its
+// deadline.
+func (g *Gateway) context(r *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	md := metadata.MD{}
+	for _, key := range gatewayForwardHeaders {
+		if values := r.Header.Values(key); len(values) > 0 {
+			md.Append(key, values...)
+		}
+	}
+
+	ctx := metadata.NewOutgoingContext(r.Context(), md)
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// forward calls method with req, reporting the response headers to onHeader
+// once and every response message to onMsg. It returns the trailers and the
+// call's error.
+func (g *Gateway) forward(ctx context.Context, method string, m gatewayMethod, req proto.Message, onHeader func(metadata.MD), onMsg func(proto.Message) error) (metadata.MD, error) {
+	stream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: m.serverStreams}, method)
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.SendMsg(req); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	for first := true; ; first = false {
+		res := m.output.New().Interface()
+		err := stream.RecvMsg(res)
+		if first {
+			if header, herr := stream.Header(); herr == nil {
+				onHeader(header)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return stream.Trailer(), nil
+		}
+		if err != nil {
+			return stream.Trailer(), err
+		}
+		if err = onMsg(res); err != nil {
+			return nil, err
+		}
+		if !m.serverStreams {
+			return stream.Trailer(), nil
+		}
+	}
+}
+
+func writeConnectError(w http.ResponseWriter, st *status.Status) {
+	code, ok := connectHTTPStatus[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	data, _ := json.Marshal(connectError{Code: connectCodes[st.Code()], Message: st.Message()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+func setMetadataHeaders(h http.Header, md metadata.MD, prefix string) {
+	for k, vs := range md {
+		if gatewaySkipHeaders[k] {
+			continue
+		}
+		for _, v := range vs {
+			h.Add(prefix+k, headerValue(k, v))
+		}
+	}
+}
+
+// headerValue encodes binary metadata for an HTTP header.
+func headerValue(key, value string) string {
+	if strings.HasSuffix(key, "-bin") {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return value
+}
+
+// envelope frames payload as a gRPC-Web or Connect message: a flags byte, a
+// big-endian uint32 length and the payload.
+func envelope(flags byte, payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
+
+func readEnvelope(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > gatewayMaxMessage {
+		return 0, nil, fmt.Errorf("message too large: %d", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// parseGRPCTimeout parses a grpc-timeout header such as "250m" or "10S".
+func parseGRPCTimeout(s string) time.Duration {
+	if len(s) < 2 {
+		return 0
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	return time.Duration(n) * units[s[len(s)-1]]
+}
+
+func parseConnectTimeout(s string) time.Duration {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// encodeGRPCMessage percent-encodes a status message for the grpc-message
+// trailer.
+func encodeGRPCMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
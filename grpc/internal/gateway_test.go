@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+type (
+	// gatewayFixture serves a UserService behind a gateway, calling it as an
+	// admin, and records the metadata every call arrives with.
+	gatewayFixture struct {
+		url   string
+		users *UserService
+		alice *User
+
+		mx       sync.Mutex
+		incoming []metadata.MD
+	}
+)
+
+func TestGatewayGRPCWeb(t *testing.T) {
+	f := newGatewayFixture(t)
+
+	res := f.post(t, pb.UserService_GetUser_FullMethodName, "application/grpc-web+proto", nil,
+		envelope(0, marshal(t, &pb.GetUserRequest{Id: f.alice.ID})))
+	if ct := res.Header.Get("Content-Type"); ct != "application/grpc-web+proto" {
+		t.Fatalf("content type = %q, want application/grpc-web+proto", ct)
+	}
+	body := bytes.NewReader(readBody(t, res))
+
+	flags, payload, err := readEnvelope(body)
+	if err != nil || flags != 0 {
+		t.Fatalf("first frame flags %#x, %v, want a message", flags, err)
+	}
+	var got pb.GetUserResponse
+	if err = proto.Unmarshal(payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.User.GetName() != "alice" {
+		t.Fatalf("user = %v, want alice", got.User)
+	}
+	flags, payload, err = readEnvelope(body)
+	if err != nil || flags != flagGRPCWebTrailer {
+		t.Fatalf("second frame flags %#x, %v, want the trailer", flags, err)
+	}
+	if !strings.Contains(string(payload), "grpc-status: 0\r\n") {
+		t.Fatalf("trailer = %q, want status 0", payload)
+	}
+}
+
+func TestGatewayGRPCWebText(t *testing.T) {
+	f := newGatewayFixture(t)
+
+	req := base64.StdEncoding.EncodeToString(envelope(0, marshal(t, &pb.GetUserRequest{Id: "missing"})))
+	res := f.post(t, pb.UserService_GetUser_FullMethodName, "application/grpc-web-text", nil, []byte(req))
+	data, err := base64.StdEncoding.DecodeString(string(readBody(t, res)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags, payload, err := readEnvelope(bytes.NewReader(data))
+	if err != nil || flags != flagGRPCWebTrailer {
+		t.Fatalf("frame flags %#x, %v, want only the trailer", flags, err)
+	}
+	if trailer := string(payload); !strings.Contains(trailer, "grpc-status: 5\r\n") || !strings.Contains(trailer, "grpc-message: user not found: missing\r\n") {
+		t.Fatalf("trailer = %q, want a NotFound status", trailer)
+	}
+}
+
+func TestEncodeGRPCMessage(t *testing.T) {
+	if got, want := encodeGRPCMessage("50% off\r\nü"), "50%25 off%0D%0A%C3%BC"; got != want {
+		t.Fatalf("encoded %q, want %q", got, want)
+	}
+}
+
+func TestGatewayConnectUnary(t *testing.T) {
+	f := newGatewayFixture(t)
+
+	t.Run("json", func(t *testing.T) {
+		res := f.post(t, pb.UserService_GetUser_FullMethodName, "application/json", nil, []byte(`{"id":"`+f.alice.ID+`"}`))
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("status %d, content type %q, want 200 and JSON", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		var got struct {
+			User struct{ Name string }
+		}
+		if err := json.Unmarshal(readBody(t, res), &got); err != nil || got.User.Name != "alice" {
+			t.Fatalf("user = %+v, %v, want alice", got.User, err)
+		}
+	})
+
+	t.Run("proto", func(t *testing.T) {
+		res := f.post(t, pb.UserService_GetUser_FullMethodName, "application/proto", nil, marshal(t, &pb.GetUserRequest{Id: f.alice.ID}))
+		var got pb.GetUserResponse
+		if err := proto.Unmarshal(readBody(t, res), &got); err != nil || got.User.GetName() != "alice" {
+			t.Fatalf("user = %v, %v, want alice", got.User, err)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		res := f.post(t, pb.UserService_GetUser_FullMethodName, "application/json", nil, []byte(`{"id":"missing"}`))
+		var got connectError
+		if err := json.Unmarshal(readBody(t, res), &got); err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusNotFound || got.Code != "not_found" {
+			t.Fatalf("status %d, error %+v, want 404 and not_found", res.StatusCode, got)
+		}
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		res := f.post(t, "/user.UserService/Nope", "application/json", nil, []byte(`{}`))
+		if res.StatusCode != http.StatusNotImplemented {
+			t.Fatalf("status %d, want %d", res.StatusCode, http.StatusNotImplemented)
+		}
+	})
+}
+
+func TestGatewayConnectStream(t *testing.T) {
+	f := newGatewayFixture(t)
+
+	// The watch never ends by itself, so the timeout ends it.
+	res := f.post(t, pb.UserService_WatchUsers_FullMethodName, "application/connect+json",
+		http.Header{"Connect-Timeout-Ms": {"100"}}, envelope(0, []byte(`{}`)))
+	body := bytes.NewReader(readBody(t, res))
+
+	flags, payload, err := readEnvelope(body)
+	if err != nil || flags != 0 {
+		t.Fatalf("first frame flags %#x, %v, want a message", flags, err)
+	}
+	var first struct {
+		Revision string
+	}
+	if err = json.Unmarshal(payload, &first); err != nil || first.Revision == "" {
+		t.Fatalf("first message %s, %v, want the current revision", payload, err)
+	}
+
+	flags, payload, err = readEnvelope(body)
+	if err != nil || flags != flagConnectEnd {
+		t.Fatalf("last frame flags %#x, %v, want the end of the stream", flags, err)
+	}
+	var end connectEndStream
+	if err = json.Unmarshal(payload, &end); err != nil {
+		t.Fatal(err)
+	}
+	if end.Error == nil || end.Error.Code != "deadline_exceeded" {
+		t.Fatalf("end of stream %s, want deadline_exceeded", payload)
+	}
+}
+
+func TestGatewayForwardsOnlyAllowedHeaders(t *testing.T) {
+	f := newGatewayFixture(t)
+
+	headers := http.Header{
+		"Authorization":     {"Bearer token"},
+		"Userid":            {"admin"},
+		"X-Fault-Injection": {"unavailable"},
+	}
+	f.post(t, pb.UserService_GetUser_FullMethodName, "application/json", headers, []byte(`{"id":"`+f.alice.ID+`"}`))
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	md := f.incoming[0]
+	if got := md.Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Fatalf("authorization = %v, want it forwarded", got)
+	}
+	for _, key := range []string{"userid", "x-fault-injection"} {
+		if got := md.Get(key); len(got) != 0 {
+			t.Errorf("%s = %v, want it dropped", key, got)
+		}
+	}
+}
+
+func TestGatewayCORS(t *testing.T) {
+	const origin = "https://app.example"
+	f := newGatewayFixture(t, origin)
+
+	t.Run("preflight", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodOptions, f.url+pb.UserService_GetUser_FullMethodName, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		res := do(t, req)
+
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("preflight status %d, want %d", res.StatusCode, http.StatusNoContent)
+		}
+		for key, want := range map[string]string{
+			"Access-Control-Allow-Origin":  origin,
+			"Access-Control-Allow-Methods": "POST, OPTIONS",
+			"Access-Control-Allow-Headers": "authorization, content-type",
+		} {
+			if got := res.Header.Get(key); got != want {
+				t.Errorf("%s = %q, want %q", key, got, want)
+			}
+		}
+	})
+
+	t.Run("allowed origin", func(t *testing.T) {
+		res := f.post(t, pb.UserService_GetUser_FullMethodName, "application/json", http.Header{"Origin": {origin}}, []byte(`{"id":"`+f.alice.ID+`"}`))
+		if res.StatusCode != http.StatusOK || res.Header.Get("Access-Control-Allow-Origin") != origin {
+			t.Fatalf("status %d, allowed origin %q, want 200 and %s", res.StatusCode, res.Header.Get("Access-Control-Allow-Origin"), origin)
+		}
+		if !strings.Contains(res.Header.Get("Access-Control-Expose-Headers"), "Grpc-Status") {
+			t.Fatalf("exposed headers %q, want the gRPC status", res.Header.Get("Access-Control-Expose-Headers"))
+		}
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		f.mx.Lock()
+		calls := len(f.incoming)
+		f.mx.Unlock()
+
+		res := f.post(t, pb.UserService_GetUser_FullMethodName, "application/json", http.Header{"Origin": {"https://evil.example"}}, []byte(`{"id":"`+f.alice.ID+`"}`))
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("status %d, want %d", res.StatusCode, http.StatusForbidden)
+		}
+		f.mx.Lock()
+		defer f.mx.Unlock()
+		if len(f.incoming) != calls {
+			t.Fatal("forwarded a call from a disallowed origin")
+		}
+	})
+}
+
+func TestGatewayWithoutOriginsRejectsBrowsers(t *testing.T) {
+	f := newGatewayFixture(t)
+
+	res := f.post(t, pb.UserService_GetUser_FullMethodName, "application/json", http.Header{"Origin": {"https://app.example"}}, []byte(`{"id":"`+f.alice.ID+`"}`))
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %d, want %d", res.StatusCode, http.StatusForbidden)
+	}
+}
+
+func newGatewayFixture(t *testing.T, origins ...string) *gatewayFixture {
+	t.Helper()
+
+	f := &gatewayFixture{users: NewUserService()}
+	alice, err := f.users.Create(User{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.alice = alice
+
+	admin := &Principal{UserID: "admin", Roles: []string{RoleAdmin}}
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			f.record(ctx)
+			return handler(ContextWithPrincipal(ctx, admin), req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			f.record(ss.Context())
+			return handler(srv, &principalStream{ServerStream: ss, ctx: ContextWithPrincipal(ss.Context(), admin)})
+		}),
+	)
+	pb.RegisterUserServiceServer(s, NewUserGRPCService(f.users))
+	t.Cleanup(s.Stop)
+
+	g, err := NewGateway(s, GatewayConfig{AllowedOrigins: origins})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = g.Close() })
+	ts := httptest.NewServer(g.Handler())
+	t.Cleanup(ts.Close)
+	f.url = ts.URL
+
+	return f
+}
+
+func (f *gatewayFixture) record(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.incoming = append(f.incoming, md)
+}
+
+func (f *gatewayFixture) post(t *testing.T, method, contentType string, header http.Header, body []byte) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, f.url+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", contentType)
+	return do(t, req)
+}
+
+func do(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = res.Body.Close() })
+	return res
+}
+
+func readBody(t *testing.T, res *http.Response) []byte {
+	t.Helper()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func marshal(t *testing.T, m proto.Message) []byte {
+	t.Helper()
+
+	data, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
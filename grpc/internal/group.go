@@ -0,0 +1,499 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const groupsFile = "groups.json"
+
+var (
+	ErrGroupNotFound      = errors.New("group not found")
+	ErrGroupAlreadyExists = errors.New("group already exists")
+	ErrGroupCycle         = errors.New("group membership cycle")
+	ErrInvalidMember      = errors.New("invalid group member")
+)
+
+type (
+	// Group grants its Roles to every direct and transitive member.
+	Group struct {
+		ID        string
+		Tenant    string
+		Name      string
+		Roles     []string
+		CreatedAt time.Time
+	}
+
+	// GroupMember is either a user or a nested group.
+	GroupMember struct {
+		UserID  string
+		GroupID string
+	}
+
+	// GroupStore keeps groups and their memberships in memory, and on disk
+	// when opened with OpenGroupStore. Groups may contain other groups; a
+	// user is a transitive member of every group above the groups it belongs
+	// to directly.
+	GroupStore struct {
+		users *UserService
+		// path is the file the store is written to after every change; empty
+		// for a store kept in memory only.
+		path string
+
+		mx     sync.RWMutex
+		groups map[string]*Group
+		// userMembers and groupMembers map a group to its direct members.
+		userMembers  map[string]map[string]struct{}
+		groupMembers map[string]map[string]struct{}
+		// userGroups and parents are the reverse edges of the above.
+		userGroups map[string]map[string]struct{}
+		parents    map[string]map[string]struct{}
+	}
+
+	// groupState is the content of the groups file.
+	groupState struct {
+		Groups []Group
+		// Users and Nested map a group to its direct members.
+		Users  map[string][]string `json:",omitempty"`
+		Nested map[string][]string `json:",omitempty"`
+	}
+)
+
+// NewGroupStore creates a GroupStore that drops the memberships of users deleted from users.
+func NewGroupStore(users *UserService) *GroupStore {
+	s := &GroupStore{
+		users:        users,
+		groups:       make(map[string]*Group),
+		userMembers:  make(map[string]map[string]struct{}),
+		groupMembers: make(map[string]map[string]struct{}),
+		userGroups:   make(map[string]map[string]struct{}),
+		parents:      make(map[string]map[string]struct{}),
+	}
+	users.AddObserver(s)
+
+	return s
+}
+
+// OpenGroupStore is NewGroupStore for a store kept in dir, which is read now
+// and written after every change. Memberships of users deleted meanwhile are
+// dropped.
+func OpenGroupStore(users *UserService, dir string) (*GroupStore, error) {
+	s := NewGroupStore(users)
+	s.path = filepath.Join(dir, groupsFile)
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read groups: %w", err)
+	}
+	var state groupState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("unmarshal groups: %w", err)
+	}
+	for id, members := range state.Users {
+		state.Users[id] = slices.DeleteFunc(members, func(userID string) bool {
+			_, err := users.Get(AnyTenant, userID)
+			return errors.Is(err, ErrUserNotFound)
+		})
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.restore(state)
+	return s, nil
+}
+
+func (s *GroupStore) Create(tenant, name string, roles []string) (*Group, error) {
+	var res Group
+	err := s.change(func() error {
+		for _, g := range s.groups {
+			if g.Tenant == tenant && g.Name == name {
+				return fmt.Errorf("%w: %s", ErrGroupAlreadyExists, name)
+			}
+		}
+
+		g := &Group{
+			ID:        uuid.New().String(),
+			Tenant:    tenant,
+			Name:      name,
+			Roles:     slices.Clone(roles),
+			CreatedAt: s.users.Now(),
+		}
+		s.groups[g.ID] = g
+		res = *g
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// Delete removes a group together with all memberships in and of it.
+func (s *GroupStore) Delete(scope, id string) error {
+	return s.change(func() error {
+		if _, err := s.group(scope, id); err != nil {
+			return err
+		}
+
+		for userID := range s.userMembers[id] {
+			unlink(s.userGroups, userID, id)
+		}
+		for child := range s.groupMembers[id] {
+			unlink(s.parents, child, id)
+		}
+		for parent := range s.parents[id] {
+			unlink(s.groupMembers, parent, id)
+		}
+		delete(s.userMembers, id)
+		delete(s.groupMembers, id)
+		delete(s.parents, id)
+		delete(s.groups, id)
+		return nil
+	})
+}
+
+func (s *GroupStore) Get(scope, id string) (*Group, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	g, err := s.group(scope, id)
+	if err != nil {
+		return nil, err
+	}
+
+	res := *g
+	return &res, nil
+}
+
+// AddMember adds a user or a nested group to group id. Nesting a group inside
+// one of its own descendants is rejected with ErrGroupCycle.
+func (s *GroupStore) AddMember(scope, id string, member GroupMember) error {
+	if (member.UserID == "") == (member.GroupID == "") {
+		return fmt.Errorf("%w: exactly one of user and group is required", ErrInvalidMember)
+	}
+
+	if member.UserID == "" {
+		return s.addGroup(scope, id, member.GroupID)
+	}
+
+	// Looked up without the lock: UserService notifies this store with its
+	// own lock held. A user deleted after this lookup but before it is linked
+	// escapes UserDeleted, so it is looked up again afterwards.
+	user, err := s.users.Get(scope, member.UserID)
+	if err != nil {
+		return err
+	}
+	if err = s.addUser(scope, id, user); err != nil {
+		return err
+	}
+	if _, err = s.users.Get(scope, user.ID); err != nil {
+		_ = s.change(func() error {
+			unlink(s.userMembers, id, user.ID)
+			unlink(s.userGroups, user.ID, id)
+			return nil
+		})
+		return err
+	}
+
+	return nil
+}
+
+func (s *GroupStore) addUser(scope, id string, user *User) error {
+	return s.change(func() error {
+		g, err := s.group(scope, id)
+		if err != nil {
+			return err
+		}
+		if user.Tenant != g.Tenant {
+			return fmt.Errorf("%w: user %s is in another tenant", ErrInvalidMember, user.ID)
+		}
+		link(s.userMembers, id, user.ID)
+		link(s.userGroups, user.ID, id)
+		return nil
+	})
+}
+
+func (s *GroupStore) addGroup(scope, id, childID string) error {
+	return s.change(func() error {
+		g, err := s.group(scope, id)
+		if err != nil {
+			return err
+		}
+		child, err := s.group(scope, childID)
+		if err != nil {
+			return err
+		}
+		if child.Tenant != g.Tenant {
+			return fmt.Errorf("%w: group %s is in another tenant", ErrInvalidMember, child.ID)
+		}
+		if child.ID == id || s.isDescendant(id, child.ID) {
+			return fmt.Errorf("%w: %s already contains %s", ErrGroupCycle, child.Name, g.Name)
+		}
+		link(s.groupMembers, id, child.ID)
+		link(s.parents, child.ID, id)
+		return nil
+	})
+}
+
+func (s *GroupStore) RemoveMember(scope, id string, member GroupMember) error {
+	return s.change(func() error {
+		if _, err := s.group(scope, id); err != nil {
+			return err
+		}
+
+		switch {
+		case member.UserID != "":
+			if _, ok := s.userMembers[id][member.UserID]; !ok {
+				return fmt.Errorf("%w: user %s is not a member", ErrInvalidMember, member.UserID)
+			}
+			unlink(s.userMembers, id, member.UserID)
+			unlink(s.userGroups, member.UserID, id)
+		case member.GroupID != "":
+			if _, ok := s.groupMembers[id][member.GroupID]; !ok {
+				return fmt.Errorf("%w: group %s is not a member", ErrInvalidMember, member.GroupID)
+			}
+			unlink(s.groupMembers, id, member.GroupID)
+			unlink(s.parents, member.GroupID, id)
+		default:
+			return fmt.Errorf("%w: exactly one of user and group is required", ErrInvalidMember)
+		}
+		return nil
+	})
+}
+
+// Members returns the user and group IDs in group id. With transitive set the
+// members of nested groups are included.
+func (s *GroupStore) Members(scope, id string, transitive bool) ([]string, []string, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	if _, err := s.group(scope, id); err != nil {
+		return nil, nil, err
+	}
+
+	if !transitive {
+		return keys(s.userMembers[id]), keys(s.groupMembers[id]), nil
+	}
+
+	groups := s.closure(s.groupMembers, id)
+	users := make(map[string]struct{})
+	for _, gid := range groups {
+		for userID := range s.userMembers[gid] {
+			users[userID] = struct{}{}
+		}
+	}
+	nested := groups[1:]
+	sort.Strings(nested)
+
+	return keys(users), nested, nil
+}
+
+// UserGroups returns the groups userID belongs to, directly or, with
+// transitive set, through nested groups.
+func (s *GroupStore) UserGroups(scope, userID string, transitive bool) []Group {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	ids := s.userGroupIDs(userID, transitive)
+	res := make([]Group, 0, len(ids))
+	for _, id := range ids {
+		if g := s.groups[id]; visible(scope, g.Tenant) {
+			res = append(res, *g)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
+
+// RolesFor returns the roles userID receives from its groups. It makes
+// GroupStore a RoleSource.
+func (s *GroupStore) RolesFor(tenant, userID string) []string {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var roles []string
+	for _, id := range s.userGroupIDs(userID, true) {
+		g := s.groups[id]
+		if g.Tenant != tenant {
+			continue
+		}
+		for _, role := range g.Roles {
+			if !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return roles
+}
+
+// UserPut implements UserObserver.
+func (s *GroupStore) UserPut(User) {}
+
+// UserDeleted implements UserObserver by dropping the user's memberships. It
+// runs with the lock of the UserService held, so it leaves writing the file
+// to the next change; OpenGroupStore drops them again if there is none.
+func (s *GroupStore) UserDeleted(user User) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for id := range s.userGroups[user.ID] {
+		unlink(s.userMembers, id, user.ID)
+	}
+	delete(s.userGroups, user.ID)
+}
+
+// change runs fn with the write lock held and, for a store on disk, writes
+// the file afterwards, undoing fn if that fails.
+func (s *GroupStore) change(fn func() error) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	var prev groupState
+	if s.path != "" {
+		prev = s.state()
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if s.path == "" {
+		return nil
+	}
+	if err := writeJSONFile(s.path, "groups", s.state()); err != nil {
+		s.restore(prev)
+		return err
+	}
+
+	return nil
+}
+
+// state captures the store. The caller must hold the lock.
+func (s *GroupStore) state() groupState {
+	state := groupState{
+		Groups: make([]Group, 0, len(s.groups)),
+		Users:  make(map[string][]string, len(s.userMembers)),
+		Nested: make(map[string][]string, len(s.groupMembers)),
+	}
+	for _, g := range s.groups {
+		state.Groups = append(state.Groups, *g)
+	}
+	for id, members := range s.userMembers {
+		state.Users[id] = keys(members)
+	}
+	for id, members := range s.groupMembers {
+		state.Nested[id] = keys(members)
+	}
+	return state
+}
+
+// restore replaces the store with state. The caller must hold the write lock.
+func (s *GroupStore) restore(state groupState) {
+	clear(s.groups)
+	clear(s.userMembers)
+	clear(s.groupMembers)
+	clear(s.userGroups)
+	clear(s.parents)
+	for _, g := range state.Groups {
+		s.groups[g.ID] = &g
+	}
+	for id, members := range state.Users {
+		for _, userID := range members {
+			link(s.userMembers, id, userID)
+			link(s.userGroups, userID, id)
+		}
+	}
+	for id, members := range state.Nested {
+		for _, child := range members {
+			link(s.groupMembers, id, child)
+			link(s.parents, child, id)
+		}
+	}
+}
+
+func (s *GroupStore) group(scope, id string) (*Group, error) {
+	g, ok := s.groups[id]
+	if !ok || !visible(scope, g.Tenant) {
+		return nil, fmt.Errorf("%w: %s", ErrGroupNotFound, id)
+	}
+	return g, nil
+}
+
+func (s *GroupStore) userGroupIDs(userID string, transitive bool) []string {
+	var ids []string
+	seen := make(map[string]struct{})
+	for id := range s.userGroups[userID] {
+		if !transitive {
+			ids = append(ids, id)
+			continue
+		}
+		for _, gid := range s.closure(s.parents, id) {
+			if _, ok := seen[gid]; !ok {
+				seen[gid] = struct{}{}
+				ids = append(ids, gid)
+			}
+		}
+	}
+	return ids
+}
+
+// isDescendant reports whether id is reachable from root through nested groups.
+func (s *GroupStore) isDescendant(id, root string) bool {
+	return slices.Contains(s.closure(s.groupMembers, root), id)
+}
+
+// closure returns start and every group reachable from it along edges.
+func (s *GroupStore) closure(edges map[string]map[string]struct{}, start string) []string {
+	res := []string{start}
+	seen := map[string]struct{}{start: {}}
+	for i := 0; i < len(res); i++ {
+		for next := range edges[res[i]] {
+			if _, ok := seen[next]; !ok {
+				seen[next] = struct{}{}
+				res = append(res, next)
+			}
+		}
+	}
+	return res
+}
+
+func link(edges map[string]map[string]struct{}, from, to string) {
+	set, ok := edges[from]
+	if !ok {
+		set = make(map[string]struct{})
+		edges[from] = set
+	}
+	set[to] = struct{}{}
+}
+
+func unlink(edges map[string]map[string]struct{}, from, to string) {
+	delete(edges[from], to)
+	if len(edges[from]) == 0 {
+		delete(edges, from)
+	}
+}
+
+func keys(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	tpb "google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+type (
+	// GroupGRPCServer serves GroupService. Since groups grant roles, changing
+	// them requires the admin role.
+	GroupGRPCServer struct {
+		groups *GroupStore
+		pb.UnimplementedGroupServiceServer
+	}
+)
+
+func NewGroupGRPCService(groups *GroupStore) *GroupGRPCServer {
+	return &GroupGRPCServer{groups: groups}
+}
+
+func (s *GroupGRPCServer) CreateGroup(ctx context.Context, req *pb.CreateGroupRequest) (*pb.CreateGroupResponse, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	p, _ := PrincipalFromContext(ctx)
+
+	g, err := s.groups.Create(p.Tenant, req.Name, req.Roles)
+	if err != nil {
+		return nil, groupError("create group", err)
+	}
+
+	return &pb.CreateGroupResponse{Group: toProtoGroup(g)}, nil
+}
+
+func (s *GroupGRPCServer) DeleteGroup(ctx context.Context, req *pb.DeleteGroupRequest) (*emptypb.Empty, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.groups.Delete(AnyTenant, req.Id); err != nil {
+		return nil, groupError("delete group", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *GroupGRPCServer) AddMember(ctx context.Context, req *pb.AddMemberRequest) (*emptypb.Empty, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.groups.AddMember(AnyTenant, req.GroupId, fromProtoMember(req.Member)); err != nil {
+		return nil, groupError("add member", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *GroupGRPCServer) RemoveMember(ctx context.Context, req *pb.RemoveMemberRequest) (*emptypb.Empty, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := s.groups.RemoveMember(AnyTenant, req.GroupId, fromProtoMember(req.Member)); err != nil {
+		return nil, groupError("remove member", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *GroupGRPCServer) ListGroupMembers(ctx context.Context, req *pb.ListGroupMembersRequest) (*pb.ListGroupMembersResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users, groups, err := s.groups.Members(p.TenantScope(), req.GroupId, req.Transitive)
+	if err != nil {
+		return nil, groupError("list group members", err)
+	}
+
+	return &pb.ListGroupMembersResponse{UserIds: users, GroupIds: groups}, nil
+}
+
+func (s *GroupGRPCServer) ListUserGroups(ctx context.Context, req *pb.ListUserGroupsRequest) (*pb.ListUserGroupsResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := s.groups.UserGroups(p.TenantScope(), req.UserId, req.Transitive)
+	res := &pb.ListUserGroupsResponse{Groups: make([]*pb.Group, 0, len(groups))}
+	for i := range groups {
+		res.Groups = append(res.Groups, toProtoGroup(&groups[i]))
+	}
+
+	return res, nil
+}
+
+func groupError(op string, err error) error {
+	switch {
+	case errors.Is(err, ErrGroupNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrGroupAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrGroupCycle):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrInvalidMember):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return serviceError(op, err)
+	}
+}
+
+func fromProtoMember(member *pb.GroupMember) GroupMember {
+	return GroupMember{
+		UserID:  member.GetUserId(),
+		GroupID: member.GetGroupId(),
+	}
+}
+
+func toProtoGroup(g *Group) *pb.Group {
+	return &pb.Group{
+		Id:        g.ID,
+		Tenant:    g.Tenant,
+		Name:      g.Name,
+		Roles:     g.Roles,
+		CreatedAt: tpb.New(g.CreatedAt),
+	}
+}
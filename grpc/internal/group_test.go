@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestGroupStoreSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	users := NewUserService()
+	alice, err := users.Create(User{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := openGroups(t, users, dir)
+	admins, err := groups.Create(DefaultTenant, "admins", []string{RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := groups.Create(DefaultTenant, "ops", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = groups.AddMember(AnyTenant, admins.ID, GroupMember{GroupID: ops.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err = groups.AddMember(AnyTenant, ops.ID, GroupMember{UserID: alice.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openGroups(t, users, dir)
+	if roles := reopened.RolesFor(DefaultTenant, alice.ID); !slices.Equal(roles, []string{RoleAdmin}) {
+		t.Fatalf("roles after reopening = %v, want [%s] through the nested group", roles, RoleAdmin)
+	}
+	got, err := reopened.Get(AnyTenant, admins.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "admins" || !got.CreatedAt.Equal(admins.CreatedAt) {
+		t.Fatalf("reopened group = %+v, want %+v", got, admins)
+	}
+}
+
+func TestGroupStoreDropsMembershipsOfDeletedUsers(t *testing.T) {
+	dir := t.TempDir()
+	users := NewUserService()
+	alice, err := users.Create(User{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := openGroups(t, users, dir)
+	g, err := groups.Create(DefaultTenant, "admins", []string{RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = groups.AddMember(AnyTenant, g.ID, GroupMember{UserID: alice.ID}); err != nil {
+		t.Fatal(err)
+	}
+	// Dropped in memory, but still in the file.
+	if err = users.Delete(AnyTenant, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openGroups(t, users, dir)
+	if members, _, err := reopened.Members(AnyTenant, g.ID, false); err != nil || len(members) != 0 {
+		t.Fatalf("members after reopening = %v, %v, want none", members, err)
+	}
+}
+
+func TestGroupStoreUndoesChangesItCannotWrite(t *testing.T) {
+	dir := t.TempDir()
+	groups := openGroups(t, NewUserService(), dir)
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := groups.Create(DefaultTenant, "admins", nil); err == nil {
+		t.Fatal("create without a writable file succeeded")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	// Not kept in memory either, so the name is still free.
+	if _, err := groups.Create(DefaultTenant, "admins", nil); err != nil {
+		t.Fatalf("create after the failed one: %v", err)
+	}
+}
+
+func openGroups(t *testing.T, users *UserService, dir string) *GroupStore {
+	t.Helper()
+
+	s, err := OpenGroupStore(users, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,453 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HookCreate = "create"
+	HookUpdate = "update"
+	HookDelete = "delete"
+
+	DefaultHookTimeout = time.Second
+
+	// webhookMaxResponse caps the body read from a webhook.
+	webhookMaxResponse = 1 << 20
+)
+
+var (
+	ErrHookRejected = errors.New("rejected by hook")
+	ErrHookFailed   = errors.New("hook failed")
+)
+
+type (
+	// HookEvent is a user mutation about to be applied, or just applied for
+	// post hooks.
+	HookEvent struct {
+		Op string
+		// User is the user as it is to be stored; nil for a delete. Pre hooks
+		// may change it, except for its ID and tenant.
+		User *User
+		// Old is the stored user; nil for a create.
+		Old *User
+		// At is when the mutation happens, by the service's clock.
+		At time.Time
+	}
+
+	// Hook inspects a user mutation. A pre hook vetoes it by returning an
+	// error made by Reject; any other error is a failure of the hook itself.
+	Hook interface {
+		Handle(ctx context.Context, event *HookEvent) error
+	}
+
+	HookFunc func(ctx context.Context, event *HookEvent) error
+
+	HookConfig struct {
+		// Name identifies the hook in errors and logs.
+		Name string
+		// Ops limits the hook to HookCreate, HookUpdate or HookDelete; all
+		// of them when empty.
+		Ops []string
+		// Post runs the hook in the background after the mutation is applied.
+		// A post hook cannot change or veto it, so its errors are only
+		// logged.
+		Post bool
+		// Timeout defaults to DefaultHookTimeout.
+		Timeout time.Duration
+		// FailOpen lets the mutation go ahead when the hook fails or times
+		// out, instead of failing it with ErrHookFailed. A rejection vetoes
+		// the mutation either way.
+		FailOpen bool
+	}
+
+	// HookRegistry runs hooks around the mutations of a UserService, in the
+	// order they were registered. Each pre hook sees the changes of the ones
+	// before it. Hooks are not run for changes the service makes itself, such
+	// as scheduled transitions, failed logins or email verification.
+	HookRegistry struct {
+		mx    sync.RWMutex
+		hooks []registeredHook
+		// pending counts the mutations whose post hooks are running.
+		pending sync.WaitGroup
+	}
+
+	registeredHook struct {
+		HookConfig
+		hook Hook
+	}
+
+	// WebhookHook posts the event as JSON to a URL. The endpoint answers with
+	// an empty body or 204 to allow the mutation unchanged, with
+	// {"reject": true, "reason": "..."} to veto it, or with {"user": {...}}
+	// to replace the name, surname, age, email and labels of the user.
+	// Anything but a 2xx status is a failure.
+	WebhookHook struct {
+		url    string
+		client *http.Client
+	}
+
+	// WebhookConfig is a webhook hook as given by ParseWebhooks.
+	WebhookConfig struct {
+		HookConfig
+		URL string
+	}
+
+	webhookRequest struct {
+		Op   string       `json:"op"`
+		User *webhookUser `json:"user,omitempty"`
+		Old  *webhookUser `json:"old,omitempty"`
+	}
+
+	webhookResponse struct {
+		Reject bool         `json:"reject"`
+		Reason string       `json:"reason"`
+		User   *webhookUser `json:"user"`
+	}
+
+	// webhookUser is the part of a user a webhook sees, without credentials.
+	webhookUser struct {
+		ID            string            `json:"id,omitempty"`
+		Tenant        string            `json:"tenant"`
+		Name          string            `json:"name"`
+		Surname       string            `json:"surname"`
+		Age           int               `json:"age"`
+		Email         string            `json:"email,omitempty"`
+		EmailVerified bool              `json:"emailVerified,omitempty"`
+		Disabled      bool              `json:"disabled,omitempty"`
+		Labels        map[string]string `json:"labels,omitempty"`
+	}
+)
+
+func (f HookFunc) Handle(ctx context.Context, event *HookEvent) error {
+	return f(ctx, event)
+}
+
+// Reject returns the error a hook vetoes a mutation with.
+func Reject(reason string) error {
+	return fmt.Errorf("%w: %s", ErrHookRejected, reason)
+}
+
+func NewHookRegistry() *HookRegistry {
+	return &HookRegistry{}
+}
+
+func (r *HookRegistry) Register(cfg HookConfig, hook Hook) error {
+	if cfg.Name == "" {
+		return errors.New("hook name is required")
+	}
+	for _, op := range cfg.Ops {
+		if op != HookCreate && op != HookUpdate && op != HookDelete {
+			return fmt.Errorf("hook %s: unknown op %q", cfg.Name, op)
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultHookTimeout
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.hooks = append(r.hooks, registeredHook{HookConfig: cfg, hook: hook})
+	return nil
+}
+
+// SetHooks runs the hooks of r around Create, Update and Delete.
+func (s *UserService) SetHooks(r *HookRegistry) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.hooks = r
+}
+
+func (s *UserService) hookRegistry() *HookRegistry {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return s.hooks
+}
+
+// before runs the pre hooks of event.Op and returns the user they leave. It
+// fails with ErrHookRejected or ErrHookFailed naming the hook.
+func (r *HookRegistry) before(event HookEvent) (*User, error) {
+	if r == nil {
+		return event.User, nil
+	}
+
+	for _, h := range r.matching(event.Op, false) {
+		res, err := h.call(event)
+		switch {
+		case err == nil:
+			h.log(event, "allowed")
+			if res != nil && event.User != nil {
+				res.ID, res.Tenant = event.User.ID, event.User.Tenant
+				event.User = res
+			}
+		case errors.Is(err, ErrHookRejected):
+			h.log(event, err.Error())
+			return nil, fmt.Errorf("hook %s: %w", h.Name, err)
+		case h.FailOpen:
+			h.log(event, fmt.Sprintf("failed open: %v", err))
+		default:
+			h.log(event, fmt.Sprintf("failed closed: %v", err))
+			return nil, fmt.Errorf("%w: %s: %v", ErrHookFailed, h.Name, err)
+		}
+	}
+
+	return event.User, nil
+}
+
+// after starts the post hooks of event.Op in the background, so that the
+// caller does not wait for them, and logs their outcome. They run one after
+// the other, each within its timeout; those of different mutations may
+// overlap.
+func (r *HookRegistry) after(event HookEvent) {
+	if r == nil {
+		return
+	}
+	hooks := r.matching(event.Op, true)
+	if len(hooks) == 0 {
+		return
+	}
+
+	// The caller owns the users once after returns.
+	event.User, event.Old = cloneUser(event.User), cloneUser(event.Old)
+	r.pending.Add(1)
+	go func() {
+		defer r.pending.Done()
+		for _, h := range hooks {
+			if _, err := h.call(event); err != nil {
+				h.log(event, fmt.Sprintf("failed: %v", err))
+			} else {
+				h.log(event, "done")
+			}
+		}
+	}()
+}
+
+// Wait blocks until the post hooks of the mutations applied so far are done,
+// e.g. before the server exits.
+func (r *HookRegistry) Wait() {
+	r.pending.Wait()
+}
+
+func (r *HookRegistry) matching(op string, post bool) []registeredHook {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	var res []registeredHook
+	for _, h := range r.hooks {
+		if h.Post == post && (len(h.Ops) == 0 || slices.Contains(h.Ops, op)) {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// call runs the hook on a copy of event, so that one that outlives its
+// timeout cannot change the mutation, and returns the user it left.
+func (h registeredHook) call(event HookEvent) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	ev := HookEvent{Op: event.Op, User: cloneUser(event.User), Old: cloneUser(event.Old), At: event.At}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- h.hook.Handle(ctx, &ev)
+	}()
+
+	select {
+	case err := <-done:
+		return ev.User, err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out after %v", h.Timeout)
+	}
+}
+
+func (h registeredHook) log(event HookEvent, result string) {
+	phase := "pre"
+	if h.Post {
+		phase = "post"
+	}
+	// A user about to be created has no ID yet.
+	subject := ""
+	if event.User != nil {
+		subject = event.User.ID
+		if subject == "" {
+			subject = fmt.Sprintf("%q", event.User.Name)
+		}
+	} else if event.Old != nil {
+		subject = event.Old.ID
+	}
+	fmt.Printf("hook %s: %s %s %s: %s\n", h.Name, phase, event.Op, subject, result)
+}
+
+func cloneUser(u *User) *User {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	c.Labels = maps.Clone(u.Labels)
+	return &c
+}
+
+// BannedNames rejects users named one of names, ignoring case. It should be
+// registered for HookCreate and HookUpdate.
+func BannedNames(names ...string) Hook {
+	banned := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		banned[strings.ToLower(n)] = struct{}{}
+	}
+	return HookFunc(func(_ context.Context, event *HookEvent) error {
+		if event.User == nil {
+			return nil
+		}
+		if _, ok := banned[strings.ToLower(event.User.Name)]; ok {
+			return Reject(fmt.Sprintf("name %q is not allowed", event.User.Name))
+		}
+		return nil
+	})
+}
+
+// RequireSurname rejects users of tenants without a surname. It should be
+// registered for HookCreate and HookUpdate.
+func RequireSurname(tenants ...string) Hook {
+	return HookFunc(func(_ context.Context, event *HookEvent) error {
+		if event.User == nil {
+			return nil
+		}
+		if slices.Contains(tenants, event.User.Tenant) && strings.TrimSpace(event.User.Surname) == "" {
+			return Reject(fmt.Sprintf("surname is required in tenant %s", event.User.Tenant))
+		}
+		return nil
+	})
+}
+
+func NewWebhookHook(url string, client *http.Client) *WebhookHook {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &WebhookHook{url: url, client: client}
+}
+
+// ParseWebhooks parses webhook hooks separated by commas, each as
+// name=url followed by options separated by semicolons: timeout=500ms,
+// ops=create|update, post and fail-open. For example
+// "policy=http://localhost:8081/users;ops=create|update;timeout=500ms".
+func ParseWebhooks(s string) ([]WebhookConfig, error) {
+	var res []WebhookConfig
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ";")
+		name, url, ok := strings.Cut(parts[0], "=")
+		if !ok || name == "" || url == "" {
+			return nil, fmt.Errorf("invalid webhook %q: want name=url", item)
+		}
+		cfg := WebhookConfig{HookConfig: HookConfig{Name: name}, URL: url}
+		for _, opt := range parts[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+			switch key {
+			case "timeout":
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("invalid webhook %q: bad timeout %q", item, value)
+				}
+				cfg.Timeout = d
+			case "ops":
+				cfg.Ops = strings.Split(value, "|")
+			case "post":
+				cfg.Post = true
+			case "fail-open":
+				cfg.FailOpen = true
+			default:
+				return nil, fmt.Errorf("invalid webhook %q: unknown option %q", item, key)
+			}
+		}
+		res = append(res, cfg)
+	}
+	return res, nil
+}
+
+func (h *WebhookHook) Handle(ctx context.Context, event *HookEvent) error {
+	body, err := json.Marshal(webhookRequest{
+		Op:   event.Op,
+		User: toWebhookUser(event.User, event.At),
+		Old:  toWebhookUser(event.Old, event.At),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, webhookMaxResponse))
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	var out webhookResponse
+	if err = json.Unmarshal(data, &out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if out.Reject {
+		return Reject(out.Reason)
+	}
+	if out.User != nil && event.User != nil {
+		event.User.Name = out.User.Name
+		event.User.Surname = out.User.Surname
+		event.User.Age = out.User.Age
+		event.User.Email = out.User.Email
+		event.User.Labels = out.User.Labels
+	}
+	return nil
+}
+
+func toWebhookUser(u *User, now time.Time) *webhookUser {
+	if u == nil {
+		return nil
+	}
+	return &webhookUser{
+		ID:            u.ID,
+		Tenant:        u.Tenant,
+		Name:          u.Name,
+		Surname:       u.Surname,
+		Age:           u.AgeAt(now),
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		Disabled:      u.Disabled,
+		Labels:        u.Labels,
+	}
+}
@@ -0,0 +1,110 @@
+package internal_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"github.com/Roma7-7-7/sandbox/grpc/internal"
+	"github.com/Roma7-7-7/sandbox/grpc/internal/testserver"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+func TestHooksVetoUpdateUser(t *testing.T) {
+	srv := testserver.Start(t)
+	hooks := internal.NewHookRegistry()
+	if err := hooks.Register(internal.HookConfig{Name: "banned-names", Ops: []string{internal.HookUpdate}}, internal.BannedNames("root")); err != nil {
+		t.Fatal(err)
+	}
+	srv.Service.SetHooks(hooks)
+	v2 := pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{Name: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{
+		User:       &pbv2.User{Id: created.User.Id, Name: "Root"},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"name"}},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("rename to a banned name: %v, want %v", err, codes.FailedPrecondition)
+	}
+}
+
+func TestPostHooksRunInBackground(t *testing.T) {
+	srv := testserver.Start(t)
+	hooks := internal.NewHookRegistry()
+	release := make(chan struct{})
+	var seen atomic.Value
+	slow := internal.HookFunc(func(ctx context.Context, event *internal.HookEvent) error {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		seen.Store(event.User.Surname)
+		return nil
+	})
+	if err := hooks.Register(internal.HookConfig{Name: "slow", Post: true, Timeout: time.Minute}, slow); err != nil {
+		t.Fatal(err)
+	}
+	srv.Service.SetHooks(hooks)
+	v2 := pbv2.NewUserServiceClient(srv.Conn())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Returns while the post hook is still blocked.
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{Name: "alice", Surname: "smith"}})
+	if err != nil {
+		t.Fatalf("create with a blocked post hook: %v", err)
+	}
+	if seen.Load() != nil {
+		t.Fatal("post hook finished before it was released")
+	}
+	if created.User.Surname != "smith" {
+		t.Fatalf("created surname %q, want smith", created.User.Surname)
+	}
+
+	close(release)
+	hooks.Wait()
+	if got := seen.Load(); got != "smith" {
+		t.Fatalf("post hook saw surname %v, want smith", got)
+	}
+}
+
+func TestPostHooksTimeOut(t *testing.T) {
+	srv := testserver.Start(t)
+	hooks := internal.NewHookRegistry()
+	// Ignores its context, so only the timeout ends the call.
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	stuck := internal.HookFunc(func(context.Context, *internal.HookEvent) error {
+		<-block
+		return nil
+	})
+	if err := hooks.Register(internal.HookConfig{Name: "stuck", Post: true, Timeout: 10 * time.Millisecond}, stuck); err != nil {
+		t.Fatal(err)
+	}
+	srv.Service.SetHooks(hooks)
+
+	if _, err := srv.Service.Create(internal.User{Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		hooks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("post hook outlived its timeout")
+	}
+}
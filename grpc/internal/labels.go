@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	maxLabelNameLen   = 63
+	maxLabelPrefixLen = 253
+	maxLabelValueLen  = 63
+	maxLabels         = 64
+)
+
+var (
+	ErrInvalidLabel    = errors.New("invalid label")
+	ErrInvalidSelector = errors.New("invalid selector")
+
+	labelNameRe   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	labelPrefixRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+type (
+	selectorOp string
+
+	// Requirement is a single clause of a label selector.
+	Requirement struct {
+		Key    string
+		Op     selectorOp
+		Values []string
+	}
+
+	// Selector matches users whose labels satisfy all of its requirements.
+	Selector []Requirement
+
+	// labelIndex maps label keys and key/value pairs to user IDs.
+	labelIndex struct {
+		byKey   map[string]map[string]struct{}
+		byValue map[string]map[string]map[string]struct{}
+	}
+)
+
+const (
+	OpEquals       selectorOp = "="
+	OpNotEquals    selectorOp = "!="
+	OpIn           selectorOp = "in"
+	OpNotIn        selectorOp = "notin"
+	OpExists       selectorOp = "exists"
+	OpDoesNotExist selectorOp = "!"
+)
+
+// ValidateLabels checks labels against Kubernetes-style syntax: keys are an
+// optional DNS subdomain prefix and a slash followed by a name of at most 63
+// alphanumerics, '-', '_' or '.', and values follow the name rules but may be empty.
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("%w: at most %d labels allowed", ErrInvalidLabel, maxLabels)
+	}
+	for k, v := range labels {
+		if err := validateLabelKey(k); err != nil {
+			return err
+		}
+		if err := validateLabelValue(v); err != nil {
+			return fmt.Errorf("%w: key %q", err, k)
+		}
+	}
+	return nil
+}
+
+func validateLabelKey(key string) error {
+	name := key
+	if prefix, rest, ok := strings.Cut(key, "/"); ok {
+		if prefix == "" || len(prefix) > maxLabelPrefixLen || !labelPrefixRe.MatchString(prefix) {
+			return fmt.Errorf("%w: key prefix %q", ErrInvalidLabel, prefix)
+		}
+		name = rest
+	}
+	if name == "" || len(name) > maxLabelNameLen || !labelNameRe.MatchString(name) {
+		return fmt.Errorf("%w: key %q", ErrInvalidLabel, key)
+	}
+	return nil
+}
+
+func validateLabelValue(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) > maxLabelValueLen || !labelNameRe.MatchString(value) {
+		return fmt.Errorf("%w: value %q", ErrInvalidLabel, value)
+	}
+	return nil
+}
+
+// ParseSelector parses a comma separated list of requirements:
+//
+//	key=value, key==value, key!=value
+//	key in (v1,v2), key notin (v1,v2)
+//	key, !key
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, clause := range splitSelector(s) {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		r, err := parseRequirement(clause)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, r)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("%w: empty selector", ErrInvalidSelector)
+	}
+	return sel, nil
+}
+
+// splitSelector splits on commas outside of parentheses.
+func splitSelector(s string) []string {
+	var res []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				res = append(res, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, s[start:])
+}
+
+func parseRequirement(clause string) (Requirement, error) {
+	var r Requirement
+
+	switch {
+	case strings.HasPrefix(clause, "!") && !strings.ContainsAny(clause, "=()"):
+		r = Requirement{Key: strings.TrimSpace(clause[1:]), Op: OpDoesNotExist}
+	case strings.Contains(clause, "!="):
+		k, v, _ := strings.Cut(clause, "!=")
+		r = Requirement{Key: strings.TrimSpace(k), Op: OpNotEquals, Values: []string{strings.TrimSpace(v)}}
+	case strings.Contains(clause, "=="):
+		k, v, _ := strings.Cut(clause, "==")
+		r = Requirement{Key: strings.TrimSpace(k), Op: OpEquals, Values: []string{strings.TrimSpace(v)}}
+	case strings.Contains(clause, "="):
+		k, v, _ := strings.Cut(clause, "=")
+		r = Requirement{Key: strings.TrimSpace(k), Op: OpEquals, Values: []string{strings.TrimSpace(v)}}
+	case strings.Contains(clause, "("):
+		fields := strings.Fields(clause[:strings.Index(clause, "(")])
+		if len(fields) != 2 || !strings.HasSuffix(clause, ")") {
+			return r, fmt.Errorf("%w: %q", ErrInvalidSelector, clause)
+		}
+		switch selectorOp(fields[1]) {
+		case OpIn, OpNotIn:
+		default:
+			return r, fmt.Errorf("%w: unknown operator %q", ErrInvalidSelector, fields[1])
+		}
+		r = Requirement{Key: fields[0], Op: selectorOp(fields[1])}
+		list := clause[strings.Index(clause, "(")+1 : len(clause)-1]
+		for _, v := range strings.Split(list, ",") {
+			r.Values = append(r.Values, strings.TrimSpace(v))
+		}
+	default:
+		r = Requirement{Key: strings.TrimSpace(clause), Op: OpExists}
+	}
+
+	if err := validateLabelKey(r.Key); err != nil {
+		return r, fmt.Errorf("%w: %v", ErrInvalidSelector, err)
+	}
+	for _, v := range r.Values {
+		if err := validateLabelValue(v); err != nil {
+			return r, fmt.Errorf("%w: %v", ErrInvalidSelector, err)
+		}
+	}
+
+	return r, nil
+}
+
+func (r Requirement) Matches(labels map[string]string) bool {
+	v, ok := labels[r.Key]
+	switch r.Op {
+	case OpEquals, OpIn:
+		return ok && slices.Contains(r.Values, v)
+	case OpNotEquals, OpNotIn:
+		return !ok || !slices.Contains(r.Values, v)
+	case OpExists:
+		return ok
+	case OpDoesNotExist:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the users in scope that match sel, ordered by creation time.
+// Requirements that can only match labelled users are answered from the
+// index; the rest filter the candidates.
+func (s *UserService) Select(scope string, sel Selector) []User {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var candidates map[string]struct{}
+	for _, r := range sel {
+		ids, ok := s.labels.lookup(r)
+		if !ok {
+			continue
+		}
+		if candidates == nil || len(ids) < len(candidates) {
+			candidates = intersect(ids, candidates)
+		} else {
+			candidates = intersect(candidates, ids)
+		}
+	}
+	var users []User
+	match := func(u User) {
+		if visible(scope, u.Tenant) && sel.Matches(u.Labels) {
+			users = append(users, u)
+		}
+	}
+	switch {
+	case candidates != nil:
+		for id := range candidates {
+			match(s.store[id])
+		}
+	case scope == AnyTenant:
+		for _, u := range s.store {
+			match(u)
+		}
+	default:
+		for id := range s.tenants[scope] {
+			match(s.store[id])
+		}
+	}
+	sortByCreation(users)
+
+	return users
+}
+
+func newLabelIndex() *labelIndex {
+	return &labelIndex{
+		byKey:   make(map[string]map[string]struct{}),
+		byValue: make(map[string]map[string]map[string]struct{}),
+	}
+}
+
+func (idx *labelIndex) add(id string, labels map[string]string) {
+	for k, v := range labels {
+		link(idx.byKey, k, id)
+		values, ok := idx.byValue[k]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			idx.byValue[k] = values
+		}
+		link(values, v, id)
+	}
+}
+
+func (idx *labelIndex) remove(id string, labels map[string]string) {
+	for k, v := range labels {
+		unlink(idx.byKey, k, id)
+		unlink(idx.byValue[k], v, id)
+		if len(idx.byValue[k]) == 0 {
+			delete(idx.byValue, k)
+		}
+	}
+}
+
+// lookup returns the IDs that may satisfy r. ok is false for requirements that
+// also match users without the key, which the index cannot enumerate.
+func (idx *labelIndex) lookup(r Requirement) (map[string]struct{}, bool) {
+	switch r.Op {
+	case OpExists:
+		return idx.byKey[r.Key], true
+	case OpEquals, OpIn:
+		res := make(map[string]struct{})
+		for _, v := range r.Values {
+			for id := range idx.byValue[r.Key][v] {
+				res[id] = struct{}{}
+			}
+		}
+		return res, true
+	default:
+		return nil, false
+	}
+}
+
+// intersect returns the members of small that are also in big. A nil big is
+// treated as the universe.
+func intersect(small, big map[string]struct{}) map[string]struct{} {
+	res := make(map[string]struct{}, len(small))
+	for id := range small {
+		if big == nil {
+			res[id] = struct{}{}
+			continue
+		}
+		if _, ok := big[id]; ok {
+			res[id] = struct{}{}
+		}
+	}
+	return res
+}
+
+func sortByCreation(users []User) {
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].ID < users[j].ID
+		}
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+}
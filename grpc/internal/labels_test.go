@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseSelector(t *testing.T) {
+	for _, tc := range []struct {
+		selector string
+		want     Selector
+	}{
+		{"env=prod", Selector{{Key: "env", Op: OpEquals, Values: []string{"prod"}}}},
+		{"env==prod, team!=ops", Selector{
+			{Key: "env", Op: OpEquals, Values: []string{"prod"}},
+			{Key: "team", Op: OpNotEquals, Values: []string{"ops"}},
+		}},
+		{"env in (prod, staging),tier notin (db)", Selector{
+			{Key: "env", Op: OpIn, Values: []string{"prod", "staging"}},
+			{Key: "tier", Op: OpNotIn, Values: []string{"db"}},
+		}},
+		{"example.com/owner,!legacy", Selector{
+			{Key: "example.com/owner", Op: OpExists},
+			{Key: "legacy", Op: OpDoesNotExist},
+		}},
+	} {
+		got, err := ParseSelector(tc.selector)
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.selector, err)
+			continue
+		}
+		if !slices.EqualFunc(got, tc.want, func(a, b Requirement) bool {
+			return a.Key == b.Key && a.Op == b.Op && slices.Equal(a.Values, b.Values)
+		}) {
+			t.Errorf("parse %q = %v, want %v", tc.selector, got, tc.want)
+		}
+	}
+
+	for _, selector := range []string{"", "env in prod", "env like (a)", "-bad=x", "env=" + string(make([]byte, 64))} {
+		if _, err := ParseSelector(selector); !errors.Is(err, ErrInvalidSelector) {
+			t.Errorf("parse %q: %v, want %v", selector, err, ErrInvalidSelector)
+		}
+	}
+}
+
+func TestSelectFollowsUpdates(t *testing.T) {
+	s := NewUserService()
+	createdAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	create := func(name, tenant string, labels map[string]string) *User {
+		t.Helper()
+		createdAt = createdAt.Add(time.Second)
+		u, err := s.Create(User{Name: name, Tenant: tenant, Labels: labels, CreatedAt: createdAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	alice := create("alice", "acme", map[string]string{"env": "prod", "team": "ops"})
+	create("bob", "acme", map[string]string{"env": "staging"})
+	create("carol", "acme", nil)
+	create("dave", "globex", map[string]string{"env": "prod"})
+
+	selectNames := func(scope, selector string) []string {
+		t.Helper()
+		sel, err := ParseSelector(selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, u := range s.Select(scope, sel) {
+			names = append(names, u.Name)
+		}
+		return names
+	}
+	for _, tc := range []struct {
+		scope, selector string
+		want            []string
+	}{
+		{"acme", "env=prod", []string{"alice"}},
+		{AnyTenant, "env=prod", []string{"alice", "dave"}},
+		{"acme", "env in (prod,staging),team!=ops", []string{"bob"}},
+		{"acme", "!env", []string{"carol"}},
+		{"acme", "env notin (prod)", []string{"bob", "carol"}},
+	} {
+		if got := selectNames(tc.scope, tc.selector); !slices.Equal(got, tc.want) {
+			t.Errorf("select %q in %q = %v, want %v", tc.selector, tc.scope, got, tc.want)
+		}
+	}
+
+	alice.Labels = map[string]string{"env": "staging"}
+	if _, err := s.Update("acme", *alice); err != nil {
+		t.Fatal(err)
+	}
+	if got := selectNames("acme", "env=prod"); len(got) != 0 {
+		t.Fatalf("select env=prod after relabelling = %v, want none", got)
+	}
+	if got := selectNames("acme", "env=staging"); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Fatalf("select env=staging after relabelling = %v, want [alice bob]", got)
+	}
+
+	alice.Labels = map[string]string{"-bad": "x"}
+	if _, err := s.Update("acme", *alice); !errors.Is(err, ErrInvalidLabel) {
+		t.Fatalf("update with an invalid label: %v, want %v", err, ErrInvalidLabel)
+	}
+}
+
+func TestUpdateKeepsImmutableFields(t *testing.T) {
+	s := NewUserService()
+	created := createWithPassword(t, s, "alice")
+
+	update := *created
+	update.Name = "alice2"
+	update.CreatedAt = time.Time{}
+	update.PasswordHash = ""
+	got, err := s.Update(AnyTenant, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(created.CreatedAt) || got.PasswordHash != created.PasswordHash {
+		t.Fatalf("update changed the creation time to %v or the password hash", got.CreatedAt)
+	}
+	if _, err = s.Authenticate(DefaultTenant, "alice2", testPassword); err != nil {
+		t.Fatalf("login after the update: %v", err)
+	}
+}
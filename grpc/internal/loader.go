@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// loaderTimeout bounds a batch fetch when one of its callers has no deadline,
+// unless another caller allows longer.
+const loaderTimeout = 30 * time.Second
+
+type (
+	batchFetchFunc func(ctx context.Context, ids []string) ([]*User, []string, error)
+
+	// userLoader coalesces single-user lookups made within a short window into
+	// one batch request. Calls are only batched together when they carry the same
+	// outgoing metadata, so one caller's credentials are never used for another.
+	userLoader struct {
+		window   time.Duration
+		maxBatch int
+		fetch    batchFetchFunc
+
+		mx      sync.Mutex
+		pending map[string]*loaderBatch
+	}
+
+	loaderBatch struct {
+		key  string
+		ctx  context.Context
+		ids  []string
+		seen map[string]struct{}
+		// deadline is the latest deadline of the callers. The fetch outlives
+		// the cancellation of any one of them, but not all of their deadlines.
+		deadline   time.Time
+		noDeadline bool
+
+		done  chan struct{}
+		users map[string]*User
+		err   error
+	}
+)
+
+func newUserLoader(window time.Duration, maxBatch int, fetch batchFetchFunc) *userLoader {
+	return &userLoader{
+		window:   window,
+		maxBatch: maxBatch,
+		fetch:    fetch,
+		pending:  make(map[string]*loaderBatch),
+	}
+}
+
+func (l *userLoader) Load(ctx context.Context, id string) (*User, error) {
+	key := metadataKey(ctx)
+
+	l.mx.Lock()
+	b, ok := l.pending[key]
+	if !ok {
+		b = &loaderBatch{
+			key:  key,
+			ctx:  context.WithoutCancel(ctx),
+			seen: make(map[string]struct{}),
+			done: make(chan struct{}),
+		}
+		l.pending[key] = b
+		time.AfterFunc(l.window, func() { l.dispatch(b) })
+	}
+	if d, ok := ctx.Deadline(); !ok {
+		b.noDeadline = true
+	} else if d.After(b.deadline) {
+		b.deadline = d
+	}
+	if _, ok := b.seen[id]; !ok {
+		b.seen[id] = struct{}{}
+		b.ids = append(b.ids, id)
+	}
+	if len(b.ids) >= l.maxBatch {
+		delete(l.pending, key)
+		go l.send(b)
+	}
+	l.mx.Unlock()
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if b.err != nil {
+		return nil, b.err
+	}
+	user, ok := b.users[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "user not found: %s", id)
+	}
+
+	return user, nil
+}
+
+// dispatch sends b when its window closes, unless it was already sent because it filled up.
+func (l *userLoader) dispatch(b *loaderBatch) {
+	l.mx.Lock()
+	if l.pending[b.key] != b {
+		l.mx.Unlock()
+		return
+	}
+	delete(l.pending, b.key)
+	l.mx.Unlock()
+
+	l.send(b)
+}
+
+func (l *userLoader) send(b *loaderBatch) {
+	deadline := b.deadline
+	if b.noDeadline {
+		// Never shorter than what another caller allows.
+		if bound := time.Now().Add(loaderTimeout); bound.After(deadline) {
+			deadline = bound
+		}
+	}
+	ctx, cancel := context.WithDeadline(b.ctx, deadline)
+	defer cancel()
+
+	users, _, err := l.fetch(ctx, b.ids)
+	if err == nil {
+		b.users = make(map[string]*User, len(users))
+		for _, u := range users {
+			b.users[u.ID] = u
+		}
+	}
+	b.err = err
+	close(b.done)
+}
+
+func metadataKey(ctx context.Context) string {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok || len(md) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strings.Join(md[k], ","))
+		sb.WriteByte(';')
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeFetch records the batches it is asked for and knows the users in known.
+type fakeFetch struct {
+	mx      sync.Mutex
+	batches [][]string
+	keys    []string
+	ctxs    []context.Context
+	known   map[string]bool
+	err     error
+	// block holds every fetch until it is closed, when set.
+	block chan struct{}
+}
+
+func (f *fakeFetch) fetch(ctx context.Context, ids []string) ([]*User, []string, error) {
+	f.mx.Lock()
+	f.batches = append(f.batches, slices.Clone(ids))
+	f.keys = append(f.keys, metadataKey(ctx))
+	f.ctxs = append(f.ctxs, ctx)
+	f.mx.Unlock()
+	if f.block != nil {
+		<-f.block
+	}
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+
+	var users []*User
+	var missing []string
+	for _, id := range ids {
+		if f.known[id] {
+			users = append(users, &User{ID: id})
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return users, missing, nil
+}
+
+func TestLoaderCoalescesLoads(t *testing.T) {
+	f := &fakeFetch{known: map[string]bool{"a": true, "b": true}}
+	l := newUserLoader(20*time.Millisecond, MaxBatchGetIDs, f.fetch)
+
+	errs := loadAll(context.Background(), l, "a", "b", "a", "missing")
+	if len(f.batches) != 1 {
+		t.Fatalf("fetched %v, want a single batch", f.batches)
+	}
+	slices.Sort(f.batches[0])
+	if !slices.Equal(f.batches[0], []string{"a", "b", "missing"}) {
+		t.Fatalf("batch = %v, want each id once", f.batches[0])
+	}
+	for i, err := range errs[:3] {
+		if err != nil {
+			t.Errorf("load %d: %v", i, err)
+		}
+	}
+	if status.Code(errs[3]) != codes.NotFound {
+		t.Errorf("load of a missing user: %v, want %v", errs[3], codes.NotFound)
+	}
+}
+
+func TestLoaderSeparatesCredentials(t *testing.T) {
+	f := &fakeFetch{known: map[string]bool{"a": true}}
+	l := newUserLoader(20*time.Millisecond, MaxBatchGetIDs, f.fetch)
+	alice := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer alice")
+	bob := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer bob")
+
+	var wg sync.WaitGroup
+	for _, ctx := range []context.Context{alice, bob} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = l.Load(ctx, "a")
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(f.keys)
+	if want := []string{metadataKey(alice), metadataKey(bob)}; !slices.Equal(f.keys, want) {
+		t.Fatalf("batches sent with %v, want one per caller %v", f.keys, want)
+	}
+}
+
+func TestLoaderSendsFullBatchesAtOnce(t *testing.T) {
+	f := &fakeFetch{known: map[string]bool{"a": true, "b": true}}
+	// The window would outlive the test.
+	l := newUserLoader(time.Hour, 2, f.fetch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, err := range loadAll(ctx, l, "a", "b") {
+		if err != nil {
+			t.Fatalf("load %d of a full batch: %v", i, err)
+		}
+	}
+}
+
+func TestLoaderSharesFetchErrors(t *testing.T) {
+	f := &fakeFetch{err: status.Error(codes.Unavailable, "down")}
+	l := newUserLoader(10*time.Millisecond, MaxBatchGetIDs, f.fetch)
+
+	for i, err := range loadAll(context.Background(), l, "a", "b") {
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("load %d: %v, want %v", i, err, codes.Unavailable)
+		}
+	}
+}
+
+func TestLoaderBoundsTheFetch(t *testing.T) {
+	t.Run("without deadline", func(t *testing.T) {
+		f := &fakeFetch{known: map[string]bool{"a": true}}
+		l := newUserLoader(time.Millisecond, MaxBatchGetIDs, f.fetch)
+
+		if _, err := l.Load(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+		deadline, ok := f.ctxs[0].Deadline()
+		if !ok || time.Until(deadline) > loaderTimeout {
+			t.Fatalf("fetch deadline = %v, %v, want one within %v", deadline, ok, loaderTimeout)
+		}
+	})
+
+	t.Run("canceled caller", func(t *testing.T) {
+		f := &fakeFetch{known: map[string]bool{"a": true}, block: make(chan struct{})}
+		l := newUserLoader(10*time.Millisecond, MaxBatchGetIDs, f.fetch)
+		short, cancel := context.WithCancel(context.Background())
+		long, cancelLong := context.WithTimeout(context.Background(), time.Hour)
+		defer cancelLong()
+
+		res := make(chan error, 2)
+		for _, ctx := range []context.Context{short, long} {
+			go func() {
+				_, err := l.Load(ctx, "a")
+				res <- err
+			}()
+		}
+		waitForFetch(t, f)
+		cancel()
+		if err := <-res; !errors.Is(err, context.Canceled) {
+			t.Fatalf("canceled load: %v, want %v", err, context.Canceled)
+		}
+		// The other caller still gets its user, within its own deadline.
+		if err := f.ctxs[0].Err(); err != nil {
+			t.Fatalf("fetch canceled with one of its callers: %v", err)
+		}
+		if deadline, _ := f.ctxs[0].Deadline(); deadline.Before(time.Now().Add(time.Hour - time.Minute)) {
+			t.Fatalf("fetch deadline = %v, want the latest caller deadline", deadline)
+		}
+		close(f.block)
+		if err := <-res; err != nil {
+			t.Fatalf("load of the remaining caller: %v", err)
+		}
+	})
+}
+
+func loadAll(ctx context.Context, l *userLoader, ids ...string) []error {
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = l.Load(ctx, id)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func waitForFetch(t *testing.T, f *fakeFetch) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		f.mx.Lock()
+		n := len(f.batches)
+		f.mx.Unlock()
+		if n > 0 {
+			return
+		}
+	}
+	t.Fatal("no fetch was sent")
+}
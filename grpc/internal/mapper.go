@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	tpb "google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+// This file converts users between the stored form and the wire. Timestamps
+// keep their nanoseconds and come back in UTC; the zero time and an unset
+// timestamp stand for each other. Credentials never leave the server.
+
+// toProtoUser converts a stored user to v1, with the age at now.
+func toProtoUser(user *User, now time.Time) *pb.User {
+	return &pb.User{
+		Id:        &user.ID,
+		Tenant:    user.Tenant,
+		Name:      user.Name,
+		Surname:   user.Surname,
+		Age:       int32(user.AgeAt(now)),
+		Email:     user.Email,
+		CreatedAt: optionalTimestamp(user.CreatedAt),
+		UpdatedAt: optionalTimestamp(user.UpdatedAt),
+		Disabled:  user.Disabled,
+		Labels:    user.Labels,
+
+		ModifiedRevision: user.ModifiedRevision,
+		ExpiresAt:        optionalTimestamp(user.ExpiresAt),
+		DisableAt:        optionalTimestamp(user.DisableAt),
+		EmailVerified:    user.EmailVerified,
+	}
+}
+
+// fromProtoUser converts a v1 user to the stored form.
+func fromProtoUser(user *pb.User) *User {
+	return &User{
+		ID:        user.GetId(),
+		Tenant:    user.GetTenant(),
+		Name:      user.GetName(),
+		Surname:   user.GetSurname(),
+		Age:       int(user.GetAge()),
+		Email:     user.GetEmail(),
+		CreatedAt: optionalTime(user.GetCreatedAt()),
+		UpdatedAt: optionalTime(user.GetUpdatedAt()),
+		Disabled:  user.GetDisabled(),
+		Labels:    user.GetLabels(),
+
+		ModifiedRevision: user.GetModifiedRevision(),
+		ExpiresAt:        optionalTime(user.GetExpiresAt()),
+		DisableAt:        optionalTime(user.GetDisableAt()),
+		EmailVerified:    user.GetEmailVerified(),
+	}
+}
+
+// ToProtoUserV2 converts a stored user to v2. Users created through v1 have
+// no birth date.
+func ToProtoUserV2(user *User) *pbv2.User {
+	res := &pbv2.User{
+		Id:               user.ID,
+		Tenant:           user.Tenant,
+		Name:             user.Name,
+		Surname:          user.Surname,
+		Email:            user.Email,
+		EmailVerified:    user.EmailVerified,
+		CreatedAt:        optionalTimestamp(user.CreatedAt),
+		UpdatedAt:        optionalTimestamp(user.UpdatedAt),
+		Disabled:         user.Disabled,
+		Labels:           user.Labels,
+		ModifiedRevision: user.ModifiedRevision,
+		ExpiresAt:        optionalTimestamp(user.ExpiresAt),
+		DisableAt:        optionalTimestamp(user.DisableAt),
+	}
+	if !user.BirthDate.IsZero() {
+		res.BirthDate = &pbv2.Date{
+			Year:  int32(user.BirthDate.Year()),
+			Month: int32(user.BirthDate.Month()),
+			Day:   int32(user.BirthDate.Day()),
+		}
+	}
+	return res
+}
+
+// FromProtoUserV2 converts a v2 user to the stored form, failing on an
+// invalid birth date.
+func FromProtoUserV2(user *pbv2.User) (User, error) {
+	res := User{
+		ID:               user.GetId(),
+		Tenant:           user.GetTenant(),
+		Name:             user.GetName(),
+		Surname:          user.GetSurname(),
+		Email:            user.GetEmail(),
+		EmailVerified:    user.GetEmailVerified(),
+		CreatedAt:        optionalTime(user.GetCreatedAt()),
+		UpdatedAt:        optionalTime(user.GetUpdatedAt()),
+		Disabled:         user.GetDisabled(),
+		Labels:           user.GetLabels(),
+		ModifiedRevision: user.GetModifiedRevision(),
+		ExpiresAt:        optionalTime(user.GetExpiresAt()),
+		DisableAt:        optionalTime(user.GetDisableAt()),
+	}
+	if d := user.GetBirthDate(); d != nil {
+		date := time.Date(int(d.Year), time.Month(d.Month), int(d.Day), 0, 0, 0, 0, time.UTC)
+		if date.Year() != int(d.Year) || date.Month() != time.Month(d.Month) || date.Day() != int(d.Day) {
+			return User{}, fmt.Errorf("invalid birth date %04d-%02d-%02d", d.Year, d.Month, d.Day)
+		}
+		res.BirthDate = date
+	}
+	return res, nil
+}
+
+// UserV1ToV2 converts a v1 user to v2. The v1 age cannot become a birth
+// date, so it is dropped.
+func UserV1ToV2(user *pb.User) *pbv2.User {
+	return ToProtoUserV2(fromProtoUser(user))
+}
+
+// UserV2ToV1 converts a v2 user to v1, with the age at now.
+func UserV2ToV1(user *pbv2.User, now time.Time) (*pb.User, error) {
+	u, err := FromProtoUserV2(user)
+	if err != nil {
+		return nil, err
+	}
+	return toProtoUser(&u, now), nil
+}
+
+// optionalTimestamp returns nil for the zero time.
+func optionalTimestamp(t time.Time) *tpb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return tpb.New(t)
+}
+
+// optionalTime returns the zero time for an unset timestamp.
+func optionalTime(t *tpb.Timestamp) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.AsTime()
+}
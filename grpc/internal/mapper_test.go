@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+func TestMapperTimestampsRoundTrip(t *testing.T) {
+	kyiv := time.FixedZone("EET", 2*60*60)
+	created := time.Date(2024, 3, 1, 10, 20, 30, 123456789, kyiv)
+	user := &User{
+		ID:        "u1",
+		Name:      "alice",
+		CreatedAt: created,
+		UpdatedAt: created.Add(time.Nanosecond),
+		ExpiresAt: created.Add(time.Hour),
+	}
+
+	v1 := fromProtoUser(toProtoUser(user, created))
+	v2, err := FromProtoUserV2(ToProtoUserV2(user))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, got := range map[string]*User{"v1": v1, "v2": &v2} {
+		for field, pair := range map[string][2]time.Time{
+			"CreatedAt": {got.CreatedAt, user.CreatedAt},
+			"UpdatedAt": {got.UpdatedAt, user.UpdatedAt},
+			"ExpiresAt": {got.ExpiresAt, user.ExpiresAt},
+		} {
+			if !pair[0].Equal(pair[1]) {
+				t.Errorf("%s %s = %v, want %v", name, field, pair[0], pair[1])
+			}
+			if pair[0].Location() != time.UTC {
+				t.Errorf("%s %s is in %v, want UTC", name, field, pair[0].Location())
+			}
+		}
+	}
+}
+
+func TestMapperZeroTimeIsUnset(t *testing.T) {
+	user := &User{ID: "u1", CreatedAt: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)}
+
+	v1 := toProtoUser(user, user.CreatedAt)
+	if v1.UpdatedAt != nil || v1.ExpiresAt != nil || v1.DisableAt != nil {
+		t.Errorf("v1 zero times are set: %v %v %v", v1.UpdatedAt, v1.ExpiresAt, v1.DisableAt)
+	}
+	v2 := ToProtoUserV2(user)
+	if v2.UpdatedAt != nil || v2.ExpiresAt != nil || v2.DisableAt != nil || v2.BirthDate != nil {
+		t.Errorf("v2 zero times are set: %v %v %v %v", v2.UpdatedAt, v2.ExpiresAt, v2.DisableAt, v2.BirthDate)
+	}
+
+	back := fromProtoUser(v1)
+	if !back.UpdatedAt.IsZero() || !back.ExpiresAt.IsZero() || !back.DisableAt.IsZero() {
+		t.Errorf("unset v1 timestamps are not zero: %v %v %v", back.UpdatedAt, back.ExpiresAt, back.DisableAt)
+	}
+}
+
+func TestMapperBirthDate(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	in := &pbv2.User{Id: "u1", BirthDate: &pbv2.Date{Year: 2000, Month: 2, Day: 29}}
+
+	user, err := FromProtoUserV2(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC); !user.BirthDate.Equal(want) {
+		t.Fatalf("BirthDate = %v, want %v", user.BirthDate, want)
+	}
+	if got := ToProtoUserV2(&user).BirthDate; got.Year != 2000 || got.Month != 2 || got.Day != 29 {
+		t.Fatalf("BirthDate round trip = %v", got)
+	}
+	v1, err := UserV2ToV1(in, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.Age != 24 {
+		t.Fatalf("v1 Age = %d, want 24", v1.Age)
+	}
+}
+
+func TestMapperRejectsInvalidBirthDate(t *testing.T) {
+	for _, d := range []*pbv2.Date{
+		{Year: 2001, Month: 2, Day: 29},
+		{Year: 2000, Month: 13, Day: 1},
+		{Year: 2000, Month: 4, Day: 31},
+		{Year: 2000, Month: 1, Day: 0},
+	} {
+		if _, err := FromProtoUserV2(&pbv2.User{BirthDate: d}); err == nil {
+			t.Errorf("birth date %04d-%02d-%02d accepted", d.Year, d.Month, d.Day)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMFAIssuer names the service in authenticator apps.
+	DefaultMFAIssuer = "grpc-sandbox"
+	// DefaultStepUpMaxAge is how long a verified second factor satisfies
+	// the methods that require one.
+	DefaultStepUpMaxAge = 10 * time.Minute
+
+	// RFC 6238 defaults, as understood by every authenticator app.
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many steps a code may be off, for clock drift.
+	totpSkew       = 1
+	totpSecretSize = 20
+
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 5
+
+	// MaxMFAFailures is the number of consecutive wrong codes after which
+	// codes are refused for mfaLockout, doubling with every further failure
+	// up to mfaMaxLockout.
+	MaxMFAFailures = 5
+	mfaLockout     = time.Minute
+	mfaMaxLockout  = time.Hour
+)
+
+var (
+	ErrMFANotEnrolled    = errors.New("mfa not enrolled")
+	ErrMFAAlreadyEnabled = errors.New("mfa already enabled")
+	ErrInvalidMFACode    = errors.New("invalid mfa code")
+	ErrMFALocked         = errors.New("too many invalid mfa codes")
+)
+
+// totpEncoding encodes secrets the way otpauth URIs expect them.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP gives the user id a new TOTP secret, which takes effect once
+// ConfirmTOTP sees a code of it. It returns the secret and its otpauth URI.
+func (s *UserService) EnrollTOTP(scope, id, issuer string) (string, string, error) {
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("generate totp secret: %w", err)
+	}
+	secret := totpEncoding.EncodeToString(raw)
+
+	user, err := s.updateMFA(scope, id, func(u *User) error {
+		if u.MFAEnabled {
+			return fmt.Errorf("%w: %s", ErrMFAAlreadyEnabled, u.ID)
+		}
+		u.TOTPSecret, u.TOTPLastStep, u.RecoveryCodes = secret, 0, nil
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return secret, otpauthURI(issuer, user, secret), nil
+}
+
+// ConfirmTOTP enables the enrolled secret of the user id if code is valid and
+// returns new recovery codes, which are only kept hashed.
+func (s *UserService) ConfirmTOTP(scope, id, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.updateMFA(scope, id, func(u *User) error {
+		if u.MFAEnabled {
+			return fmt.Errorf("%w: %s", ErrMFAAlreadyEnabled, u.ID)
+		}
+		if u.TOTPSecret == "" {
+			return fmt.Errorf("%w: %s", ErrMFANotEnrolled, u.ID)
+		}
+		if err := u.useTOTP(code, s.Now()); err != nil {
+			return err
+		}
+		u.MFAEnabled, u.RecoveryCodes = true, hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// VerifyMFA checks a TOTP code of the user id, or a recovery code if code is
+// empty, and returns how many recovery codes are left. Either is accepted
+// once: a TOTP code is rejected in the time step it was used in, and a
+// recovery code is discarded.
+func (s *UserService) VerifyMFA(scope, id, code, recoveryCode string) (int, error) {
+	user, err := s.updateMFA(scope, id, func(u *User) error {
+		if !u.MFAEnabled {
+			return fmt.Errorf("%w: %s", ErrMFANotEnrolled, u.ID)
+		}
+		if code != "" {
+			return u.useTOTP(code, s.Now())
+		}
+		return u.useRecoveryCode(recoveryCode, s.Now())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(user.RecoveryCodes), nil
+}
+
+// DisableMFA removes the TOTP secret and recovery codes of the user id.
+func (s *UserService) DisableMFA(scope, id string) error {
+	_, err := s.updateMFA(scope, id, func(u *User) error {
+		if u.TOTPSecret == "" {
+			return fmt.Errorf("%w: %s", ErrMFANotEnrolled, u.ID)
+		}
+		u.TOTPSecret, u.MFAEnabled, u.TOTPLastStep, u.RecoveryCodes = "", false, 0, nil
+		u.MFAFailures, u.MFALockedUntil = 0, time.Time{}
+		return nil
+	})
+	return err
+}
+
+// updateMFA applies fn to the user id in scope and commits the result. A
+// wrong code is committed too, so that it counts towards the lockout, and fn
+// runs again on the new version of a user changed concurrently.
+func (s *UserService) updateMFA(scope, id string, fn func(*User) error) (*User, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for {
+		user, ok := s.store[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUserNotFound, id)
+		}
+		if !visible(scope, user.Tenant) {
+			return nil, fmt.Errorf("%w: %s", ErrCrossTenant, id)
+		}
+
+		user.RecoveryCodes = slices.Clone(user.RecoveryCodes)
+		ferr := fn(&user)
+		if ferr != nil && !errors.Is(ferr, ErrInvalidMFACode) {
+			return nil, ferr
+		}
+		user.UpdatedAt = s.Now()
+		m := mutation{Op: opUpdate, User: user}
+		err := s.commit(&m)
+		if errors.Is(err, ErrConcurrentUpdate) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ferr != nil {
+			return nil, ferr
+		}
+
+		return &m.User, nil
+	}
+}
+
+// useTOTP accepts code if it is valid at now and of a later time step than
+// the last accepted one.
+func (u *User) useTOTP(code string, now time.Time) error {
+	if err := u.mfaAllowed(now); err != nil {
+		return err
+	}
+	secret, err := totpEncoding.DecodeString(u.TOTPSecret)
+	if err != nil {
+		return fmt.Errorf("decode totp secret of %s: %w", u.ID, err)
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= u.TOTPLastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			u.TOTPLastStep = step
+			u.MFAFailures, u.MFALockedUntil = 0, time.Time{}
+			return nil
+		}
+	}
+	return u.mfaFailed(now)
+}
+
+func (u *User) useRecoveryCode(code string, now time.Time) error {
+	if err := u.mfaAllowed(now); err != nil {
+		return err
+	}
+	hash := hashRecoveryCode(code)
+	for i, h := range u.RecoveryCodes {
+		if hmac.Equal([]byte(h), []byte(hash)) {
+			u.RecoveryCodes = slices.Delete(u.RecoveryCodes, i, i+1)
+			u.MFAFailures, u.MFALockedUntil = 0, time.Time{}
+			return nil
+		}
+	}
+	return u.mfaFailed(now)
+}
+
+func (u *User) mfaAllowed(now time.Time) error {
+	if now.Before(u.MFALockedUntil) {
+		return fmt.Errorf("%w: %s is locked until %s", ErrMFALocked, u.ID, u.MFALockedUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// mfaFailed counts a wrong code and locks codes out once there are too many.
+func (u *User) mfaFailed(now time.Time) error {
+	u.MFAFailures++
+	if excess := u.MFAFailures - MaxMFAFailures; excess >= 0 {
+		u.MFALockedUntil = now.Add(lockout(excess, mfaLockout, mfaMaxLockout))
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidMFACode, u.ID)
+}
+
+// totpCode is the RFC 6238 code of secret at a time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+func otpauthURI(issuer string, user *User, secret string) string {
+	if issuer == "" {
+		issuer = DefaultMFAIssuer
+	}
+	account := user.Email
+	if account == "" {
+		account = user.Name + "@" + user.Tenant
+	}
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}).String()
+}
+
+// newRecoveryCodes returns recovery codes such as "abcdefgh-ijklmnop" and
+// their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 2*recoveryCodeSize)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		enc := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = enc[:8] + "-" + enc[8:16]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes, as users retype codes.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+func TestMFARejectsReplayedCode(t *testing.T) {
+	s, now := newPasswordService(t)
+	user, secret := enrollMFA(t, s, *now)
+
+	*now = now.Add(totpPeriod * time.Second)
+	code := currentCode(t, secret, *now)
+	if _, err := s.VerifyMFA(AnyTenant, user.ID, code, ""); err != nil {
+		t.Fatalf("first use of a code: %v", err)
+	}
+	if _, err := s.VerifyMFA(AnyTenant, user.ID, code, ""); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("replay of a code: %v, want %v", err, ErrInvalidMFACode)
+	}
+}
+
+func TestMFALocksOutWrongCodes(t *testing.T) {
+	s, now := newPasswordService(t)
+	user, secret := enrollMFA(t, s, *now)
+
+	for i := 0; i < MaxMFAFailures; i++ {
+		if _, err := s.VerifyMFA(AnyTenant, user.ID, "000000", ""); !errors.Is(err, ErrInvalidMFACode) {
+			t.Fatalf("wrong code %d: %v", i, err)
+		}
+	}
+	*now = now.Add(totpPeriod * time.Second)
+	if _, err := s.VerifyMFA(AnyTenant, user.ID, currentCode(t, secret, *now), ""); !errors.Is(err, ErrMFALocked) {
+		t.Fatalf("right code while locked out: %v, want %v", err, ErrMFALocked)
+	}
+
+	*now = now.Add(mfaLockout)
+	if _, err := s.VerifyMFA(AnyTenant, user.ID, currentCode(t, secret, *now), ""); err != nil {
+		t.Fatalf("right code after the lockout: %v", err)
+	}
+	got, err := s.Get(AnyTenant, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MFAFailures != 0 || !got.MFALockedUntil.IsZero() {
+		t.Fatalf("failures = %d locked until %v after a right code, want them reset", got.MFAFailures, got.MFALockedUntil)
+	}
+}
+
+func TestStepUpRefusesAPIKeys(t *testing.T) {
+	s, now := newPasswordService(t)
+	user := createWithPassword(t, s, "alice")
+	tokens := NewTokenIssuer([]byte("secret"), time.Hour, time.Hour)
+	tokens.SetClock(func() time.Time { return *now })
+	keys := NewAPIKeyStore()
+	keys.SetClock(func() time.Time { return *now })
+	auth := NewAuthenticator(s, tokens, keys)
+	method := pb.UserService_DeleteUser_FullMethodName
+	auth.RequireMFA(time.Hour, method)
+
+	// Even a key created right after a verification outlives it.
+	_, secret, err := keys.Create(&Principal{UserID: user.ID, Tenant: user.Tenant, SteppedUp: true}, "ci", []string{ScopeUsersWrite}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", secret))
+	if _, err = auth.principal(ctx, method); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("step-up method with an api key: %v, want %v", err, codes.PermissionDenied)
+	}
+
+	pair, err := tokens.IssueMFA(user, *now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+pair.AccessToken))
+	if _, err = auth.principal(ctx, method); err != nil {
+		t.Fatalf("step-up method with a stepped up token: %v", err)
+	}
+}
+
+// enrollMFA enables MFA for a new user and returns it with its secret.
+func enrollMFA(t *testing.T, s *UserService, now time.Time) (*User, []byte) {
+	t.Helper()
+
+	user := createWithPassword(t, s, "mfa")
+	encoded, _, err := s.EnrollTOTP(AnyTenant, user.ID, DefaultMFAIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totpEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ConfirmTOTP(AnyTenant, user.ID, currentCode(t, secret, now)); err != nil {
+		t.Fatal(err)
+	}
+	return user, secret
+}
+
+func currentCode(t *testing.T, secret []byte, now time.Time) string {
+	t.Helper()
+
+	return totpCode(secret, now.Unix()/totpPeriod)
+}
@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"context"
+	"expvar"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// latencyWeight is the weight of the latest call in the latency average.
+	latencyWeight = 0.1
+	// maxShedRatio leaves some calls through however slow the server is, so
+	// that the latency average sees it recover.
+	maxShedRatio = 0.95
+)
+
+type (
+	// ConnLimits caps the connections of a listener. Zero values are unlimited.
+	ConnLimits struct {
+		Max     int
+		PerHost int
+	}
+
+	// ConnLimitListener closes the connections accepted over its limits
+	// right away, so that clients fail over instead of queueing.
+	ConnLimitListener struct {
+		net.Listener
+		limits ConnLimits
+
+		mx     sync.Mutex
+		active int
+		hosts  map[string]int
+
+		metrics  *expvar.Map
+		rejected *expvar.Int
+	}
+
+	limitedConn struct {
+		net.Conn
+		once    sync.Once
+		release func()
+	}
+
+	LoadShedConfig struct {
+		// MaxInFlight caps the unary calls handled at once; zero is unlimited.
+		MaxInFlight int
+		// MaxLatency sheds a share of the calls that grows with how far the
+		// average latency of unary calls is above it; zero disables it.
+		MaxLatency time.Duration
+		// Exempt are full method names never shed, such as health checks.
+		Exempt []string
+	}
+
+	// LoadShedder rejects calls with codes.Unavailable while the server is
+	// overloaded. New streams are rejected too, but long-lived streams do
+	// not count as in flight.
+	LoadShedder struct {
+		cfg LoadShedConfig
+
+		mx       sync.Mutex
+		inFlight int
+		latency  time.Duration
+		rng      *rand.Rand
+
+		metrics      *expvar.Map
+		shedInFlight *expvar.Int
+		shedLatency  *expvar.Int
+		shedStreams  *expvar.Int
+		accepted     *expvar.Int
+	}
+)
+
+// LimitConnections wraps lis to enforce limits.
+func LimitConnections(lis net.Listener, limits ConnLimits) *ConnLimitListener {
+	l := &ConnLimitListener{
+		Listener: lis,
+		limits:   limits,
+		hosts:    make(map[string]int),
+		metrics:  new(expvar.Map).Init(),
+		rejected: new(expvar.Int),
+	}
+	l.metrics.Set("rejected", l.rejected)
+	l.metrics.Set("active", expvar.Func(func() any {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+		return l.active
+	}))
+	return l
+}
+
+func (l *ConnLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			host = conn.RemoteAddr().String()
+		}
+		if !l.acquire(host) {
+			l.rejected.Add(1)
+			_ = conn.Close()
+			continue
+		}
+		return &limitedConn{Conn: conn, release: func() { l.release(host) }}, nil
+	}
+}
+
+// Metrics are the active and rejected connections, for expvar.Publish.
+func (l *ConnLimitListener) Metrics() expvar.Var {
+	return l.metrics
+}
+
+func (l *ConnLimitListener) acquire(host string) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.limits.Max > 0 && l.active >= l.limits.Max {
+		return false
+	}
+	if l.limits.PerHost > 0 && l.hosts[host] >= l.limits.PerHost {
+		return false
+	}
+	l.active++
+	l.hosts[host]++
+	return true
+}
+
+func (l *ConnLimitListener) release(host string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.active--
+	if l.hosts[host]--; l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func NewLoadShedder(cfg LoadShedConfig) *LoadShedder {
+	s := &LoadShedder{
+		cfg:          cfg,
+		rng:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		metrics:      new(expvar.Map).Init(),
+		shedInFlight: new(expvar.Int),
+		shedLatency:  new(expvar.Int),
+		shedStreams:  new(expvar.Int),
+		accepted:     new(expvar.Int),
+	}
+	s.metrics.Set("shed_in_flight", s.shedInFlight)
+	s.metrics.Set("shed_latency", s.shedLatency)
+	s.metrics.Set("shed_streams", s.shedStreams)
+	s.metrics.Set("accepted", s.accepted)
+	s.metrics.Set("in_flight", expvar.Func(func() any {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		return s.inFlight
+	}))
+	s.metrics.Set("latency_ms", expvar.Func(func() any {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		return float64(s.latency) / float64(time.Millisecond)
+	}))
+	return s
+}
+
+// Metrics are the shed calls by reason, the accepted calls, the calls in
+// flight and the average latency, for expvar.Publish.
+func (s *LoadShedder) Metrics() expvar.Var {
+	return s.metrics
+}
+
+func (s *LoadShedder) UnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if slices.Contains(s.cfg.Exempt, info.FullMethod) {
+		return handler(ctx, req)
+	}
+	if err := s.admit(true); err != nil {
+		return nil, err
+	}
+	s.accepted.Add(1)
+
+	start := time.Now()
+	defer func() {
+		s.done(time.Since(start))
+	}()
+	return handler(ctx, req)
+}
+
+func (s *LoadShedder) StreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if slices.Contains(s.cfg.Exempt, info.FullMethod) {
+		return handler(srv, ss)
+	}
+	if err := s.admit(false); err != nil {
+		s.shedStreams.Add(1)
+		return err
+	}
+	s.accepted.Add(1)
+	return handler(srv, ss)
+}
+
+// admit decides whether a call is handled, taking an in-flight slot for it
+// if track is set.
+func (s *LoadShedder) admit(track bool) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.cfg.MaxInFlight > 0 && s.inFlight >= s.cfg.MaxInFlight {
+		if track {
+			s.shedInFlight.Add(1)
+		}
+		return status.Errorf(codes.Unavailable, "server overloaded: %d calls in flight", s.inFlight)
+	}
+	if s.cfg.MaxLatency > 0 && s.latency > s.cfg.MaxLatency {
+		ratio := min(float64(s.latency-s.cfg.MaxLatency)/float64(s.cfg.MaxLatency), maxShedRatio)
+		if s.rng.Float64() < ratio {
+			if track {
+				s.shedLatency.Add(1)
+			}
+			return status.Errorf(codes.Unavailable, "server overloaded: latency %v over %v",
+				s.latency.Round(time.Millisecond), s.cfg.MaxLatency)
+		}
+	}
+
+	if track {
+		s.inFlight++
+	}
+	return nil
+}
+
+func (s *LoadShedder) done(latency time.Duration) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.inFlight--
+	if s.latency == 0 {
+		s.latency = latency
+	} else {
+		s.latency += time.Duration(latencyWeight * float64(latency-s.latency))
+	}
+}
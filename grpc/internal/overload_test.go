@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+func TestLoadShedderCapsCallsInFlight(t *testing.T) {
+	s := NewLoadShedder(LoadShedConfig{MaxInFlight: 2, Exempt: []string{"/grpc.health.v1.Health/Check"}})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := s.UnaryInterceptor(context.Background(), nil, unaryInfo(pb.UserService_GetUser_FullMethodName), func(context.Context, any) (any, error) {
+				started <- struct{}{}
+				<-release
+				return nil, nil
+			})
+			done <- err
+		}()
+	}
+	<-started
+	<-started
+
+	if _, err := s.UnaryInterceptor(context.Background(), nil, unaryInfo(pb.UserService_GetUser_FullMethodName), okHandler); status.Code(err) != codes.Unavailable {
+		t.Fatalf("call over the limit: %v, want %v", err, codes.Unavailable)
+	}
+	err := s.StreamInterceptor(nil, nil, &grpc.StreamServerInfo{FullMethod: pb.UserService_WatchUsers_FullMethodName}, func(any, grpc.ServerStream) error {
+		return nil
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("stream over the limit: %v, want %v", err, codes.Unavailable)
+	}
+	if _, err = s.UnaryInterceptor(context.Background(), nil, unaryInfo("/grpc.health.v1.Health/Check"), okHandler); err != nil {
+		t.Fatalf("exempt call over the limit: %v", err)
+	}
+
+	close(release)
+	for range 2 {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = s.UnaryInterceptor(context.Background(), nil, unaryInfo(pb.UserService_GetUser_FullMethodName), okHandler); err != nil {
+		t.Fatalf("call once the others finished: %v", err)
+	}
+	if s.shedInFlight.Value() != 1 || s.shedStreams.Value() != 1 || s.accepted.Value() != 3 {
+		t.Fatalf("metrics = %s, want one unary call and one stream shed and 3 accepted", s.Metrics())
+	}
+}
+
+func TestLoadShedderStreamsDoNotCountInFlight(t *testing.T) {
+	s := NewLoadShedder(LoadShedConfig{MaxInFlight: 1})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = s.StreamInterceptor(nil, nil, &grpc.StreamServerInfo{FullMethod: pb.UserService_WatchUsers_FullMethodName}, func(any, grpc.ServerStream) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	defer close(release)
+	<-started
+
+	if _, err := s.UnaryInterceptor(context.Background(), nil, unaryInfo(pb.UserService_GetUser_FullMethodName), okHandler); err != nil {
+		t.Fatalf("call beside a long-lived stream: %v", err)
+	}
+}
+
+func TestLoadShedderShedsByLatency(t *testing.T) {
+	const calls = 2000
+	for _, c := range []struct {
+		latency time.Duration
+		shed    float64
+	}{
+		{latency: 10 * time.Millisecond, shed: 0},
+		// Half as slow again as allowed.
+		{latency: 15 * time.Millisecond, shed: 0.5},
+		// Some calls are let through however slow.
+		{latency: time.Second, shed: maxShedRatio},
+	} {
+		s := NewLoadShedder(LoadShedConfig{MaxLatency: 10 * time.Millisecond})
+		s.rng = rand.New(rand.NewSource(1))
+		s.latency = c.latency
+
+		shed := 0
+		for range calls {
+			if err := s.admit(false); err != nil {
+				shed++
+			}
+		}
+		if got := float64(shed) / calls; got < c.shed-0.05 || got > c.shed+0.05 {
+			t.Errorf("shed %.3f of the calls at %v, want about %v", got, c.latency, c.shed)
+		}
+	}
+}
+
+func TestLoadShedderAveragesLatency(t *testing.T) {
+	s := NewLoadShedder(LoadShedConfig{})
+	for _, latency := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if err := s.admit(true); err != nil {
+			t.Fatal(err)
+		}
+		s.done(latency)
+	}
+
+	// The first call sets the average, later ones move it by latencyWeight.
+	if want := 110 * time.Millisecond; s.latency != want {
+		t.Fatalf("average latency = %v, want %v", s.latency, want)
+	}
+	if s.inFlight != 0 {
+		t.Fatalf("%d calls in flight after they finished", s.inFlight)
+	}
+}
+
+func TestConnLimitListener(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := LimitConnections(lis, ConnLimits{Max: 1})
+	t.Cleanup(func() { _ = l.Close() })
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first := dial(t, lis.Addr())
+	server := <-accepted
+
+	// Closed by the listener instead of being handed out.
+	second := dial(t, lis.Addr())
+	if err = second.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = second.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("read from a connection over the limit: %v, want it closed", err)
+	}
+	if l.rejected.Value() != 1 {
+		t.Fatalf("rejected %d connections, want 1", l.rejected.Value())
+	}
+
+	// Closing twice releases the slot once.
+	_ = server.Close()
+	_ = server.Close()
+	_ = first.Close()
+	dial(t, lis.Addr())
+	select {
+	case conn := <-accepted:
+		_ = conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection accepted once the first one closed")
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.active != 0 {
+		t.Fatalf("%d connections active after all closed, want 0", l.active)
+	}
+}
+
+func TestConnLimitListenerPerHost(t *testing.T) {
+	l := &ConnLimitListener{limits: ConnLimits{PerHost: 1}, hosts: make(map[string]int)}
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.2") {
+		t.Fatal("rejected the first connection of a host")
+	}
+	if l.acquire("10.0.0.1") {
+		t.Fatal("accepted a second connection of a host")
+	}
+	l.release("10.0.0.1")
+	if !l.acquire("10.0.0.1") {
+		t.Fatal("rejected a host whose connection closed")
+	}
+}
+
+func unaryInfo(method string) *grpc.UnaryServerInfo {
+	return &grpc.UnaryServerInfo{FullMethod: method}
+}
+
+func okHandler(context.Context, any) (any, error) {
+	return nil, nil
+}
+
+func dial(t *testing.T, addr net.Addr) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// MaxFailedLogins is the number of consecutive failed logins after which
+	// logins are refused for loginLockout, doubling with every further
+	// failure up to loginMaxLockout. A lockout, unlike disabling the
+	// account, cannot be used to keep a user out for good.
+	MaxFailedLogins = 5
+	loginLockout    = time.Minute
+	loginMaxLockout = time.Hour
+
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrWeakPassword       = errors.New("password does not satisfy policy")
+)
+
+// dummyHash is verified against when the user does not exist so that unknown
+// names take as long to reject as wrong passwords. It is hashed on first use
+// rather than at start-up, which hashing would slow down.
+var dummyHash = sync.OnceValue(func() string {
+	return mustHashPassword("dummy-password-0")
+})
+
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLetter bool
+	RequireDigit  bool
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:     10,
+	MaxLength:     128,
+	RequireLetter: true,
+	RequireDigit:  true,
+}
+
+func (p PasswordPolicy) Validate(password string) error {
+	n := len([]rune(password))
+	if n < p.MinLength {
+		return fmt.Errorf("%w: at least %d characters required", ErrWeakPassword, p.MinLength)
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return fmt.Errorf("%w: at most %d characters allowed", ErrWeakPassword, p.MaxLength)
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if p.RequireLetter && !letter {
+		return fmt.Errorf("%w: a letter is required", ErrWeakPassword)
+	}
+	if p.RequireDigit && !digit {
+		return fmt.Errorf("%w: a digit is required", ErrWeakPassword)
+	}
+
+	return nil
+}
+
+// SetPassword validates password against policy and stores its argon2id hash.
+func (s *UserService) SetPassword(scope, id, password string, policy PasswordPolicy) error {
+	if err := policy.Validate(password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	user, ok := s.store[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id)
+	}
+	if !visible(scope, user.Tenant) {
+		return fmt.Errorf("%w: %s", ErrCrossTenant, id)
+	}
+
+	user.PasswordHash = hash
+	user.FailedLogins, user.LockedUntil = 0, time.Time{}
+
+	return s.commit(&mutation{Op: opUpdate, User: user})
+}
+
+// CheckPassword reports whether password matches the stored one of user id.
+// It does not count towards the lockout.
+func (s *UserService) CheckPassword(id, password string) (bool, error) {
+	s.mx.RLock()
+	user, ok := s.store[id]
+	s.mx.RUnlock()
+	if !ok {
+		return false, fmt.Errorf("%w: %s", ErrUserNotFound, id)
+	}
+	if user.PasswordHash == "" {
+		return false, nil
+	}
+
+	return verifyPassword(user.PasswordHash, password)
+}
+
+// Authenticate verifies the password of the user called name in tenant.
+// Unknown, inactive and locked out users are refused with
+// ErrInvalidCredentials like a wrong password, after as long a wait, so that
+// logins reveal nothing about the account.
+func (s *UserService) Authenticate(tenant, name, password string) (*User, error) {
+	s.mx.RLock()
+	user, found := s.store[s.names[tenant][s.nameKey(tenant, name)]]
+	s.mx.RUnlock()
+
+	// Hashing is slow, so it runs without the lock and the outcome is applied
+	// to whatever the user looks like afterwards.
+	hash := user.PasswordHash
+	if hash == "" {
+		hash = dummyHash()
+	}
+	ok, err := verifyPassword(hash, password)
+	if err != nil {
+		return nil, err
+	}
+	now := s.Now()
+	if !found || user.PasswordHash == "" || !user.loginAllowed(now) {
+		return nil, ErrInvalidCredentials
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	current, exists := s.store[user.ID]
+	if !exists {
+		return nil, ErrInvalidCredentials
+	}
+	if !ok {
+		// A failure must be counted, so a concurrent change is retried.
+		for {
+			current.loginFailed(now)
+			err = s.commit(&mutation{Op: opUpdate, User: current})
+			if !errors.Is(err, ErrConcurrentUpdate) {
+				break
+			}
+			if current, exists = s.store[user.ID]; !exists {
+				return nil, ErrInvalidCredentials
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if !current.loginAllowed(now) {
+		return nil, ErrInvalidCredentials
+	}
+	if current.FailedLogins > 0 || !current.LockedUntil.IsZero() {
+		current.FailedLogins, current.LockedUntil = 0, time.Time{}
+		m := mutation{Op: opUpdate, User: current}
+		if err = s.commit(&m); err != nil {
+			return nil, err
+		}
+		current = m.User
+	}
+
+	return &current, nil
+}
+
+// Unlock lifts the login and MFA lockouts of the user id and forgets its
+// failures, for admins to let a user back in before the lockout ends.
+func (s *UserService) Unlock(scope, id string) (*User, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	user, ok := s.store[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, id)
+	}
+	if !visible(scope, user.Tenant) {
+		return nil, fmt.Errorf("%w: %s", ErrCrossTenant, id)
+	}
+
+	user.FailedLogins, user.LockedUntil = 0, time.Time{}
+	user.MFAFailures, user.MFALockedUntil = 0, time.Time{}
+	m := mutation{Op: opUpdate, User: user}
+	if err := s.commit(&m); err != nil {
+		return nil, err
+	}
+
+	return &m.User, nil
+}
+
+// loginAllowed reports whether u may log in at now.
+func (u *User) loginAllowed(now time.Time) bool {
+	return !u.Inactive(now) && !now.Before(u.LockedUntil)
+}
+
+// loginFailed counts a wrong password and locks logins out once there are
+// too many.
+func (u *User) loginFailed(now time.Time) {
+	u.FailedLogins++
+	if excess := u.FailedLogins - MaxFailedLogins; excess >= 0 {
+		u.LockedUntil = now.Add(lockout(excess, loginLockout, loginMaxLockout))
+	}
+}
+
+// lockout is how long to lock out after excess failures beyond the limit:
+// base, doubling with every further failure up to limit.
+func lockout(excess int, base, limit time.Duration) time.Duration {
+	if excess >= 10 {
+		return limit
+	}
+	return min(base<<excess, limit)
+}
+
+// hashPassword returns password's argon2id hash in PHC string format.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func verifyPassword(encoded, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, fmt.Errorf("unsupported password hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("parse argon2 params: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("decode salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("decode hash: %w", err)
+	}
+
+	got := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+func mustHashPassword(password string) string {
+	hash, err := hashPassword(password)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const testPassword = "correct-horse-1"
+
+func TestAuthenticateLocksOutForAWhile(t *testing.T) {
+	s, now := newPasswordService(t)
+	user := createWithPassword(t, s, "alice")
+
+	for i := 0; i < MaxFailedLogins; i++ {
+		if _, err := s.Authenticate(DefaultTenant, "alice", "wrong-password-1"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("failure %d: %v, want %v", i, err, ErrInvalidCredentials)
+		}
+	}
+	if _, err := s.Authenticate(DefaultTenant, "alice", testPassword); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("login while locked out: %v, want %v", err, ErrInvalidCredentials)
+	}
+	locked, err := s.Get(AnyTenant, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked.Disabled {
+		t.Fatalf("lockout disabled the account")
+	}
+
+	*now = now.Add(loginLockout)
+	got, err := s.Authenticate(DefaultTenant, "alice", testPassword)
+	if err != nil {
+		t.Fatalf("login after the lockout: %v", err)
+	}
+	if got.FailedLogins != 0 || !got.LockedUntil.IsZero() {
+		t.Fatalf("failures = %d locked until %v after a login, want them reset", got.FailedLogins, got.LockedUntil)
+	}
+}
+
+func TestAuthenticateLockoutDoubles(t *testing.T) {
+	s, now := newPasswordService(t)
+	createWithPassword(t, s, "alice")
+
+	for i := 0; i < MaxFailedLogins; i++ {
+		_, _ = s.Authenticate(DefaultTenant, "alice", "wrong-password-1")
+	}
+	*now = now.Add(loginLockout)
+	_, _ = s.Authenticate(DefaultTenant, "alice", "wrong-password-1")
+
+	*now = now.Add(loginLockout)
+	if _, err := s.Authenticate(DefaultTenant, "alice", testPassword); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("login a lockout after the second one began: %v, want %v", err, ErrInvalidCredentials)
+	}
+	*now = now.Add(loginLockout)
+	if _, err := s.Authenticate(DefaultTenant, "alice", testPassword); err != nil {
+		t.Fatalf("login after the doubled lockout: %v", err)
+	}
+}
+
+func TestUnlockLiftsLockout(t *testing.T) {
+	s, _ := newPasswordService(t)
+	user := createWithPassword(t, s, "alice")
+
+	for i := 0; i < MaxFailedLogins; i++ {
+		_, _ = s.Authenticate(DefaultTenant, "alice", "wrong-password-1")
+	}
+	if _, err := s.Unlock("other", user.ID); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("unlock from another tenant: %v, want %v", err, ErrCrossTenant)
+	}
+	unlocked, err := s.Unlock(DefaultTenant, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked.FailedLogins != 0 || !unlocked.LockedUntil.IsZero() {
+		t.Fatalf("failures = %d locked until %v after unlock", unlocked.FailedLogins, unlocked.LockedUntil)
+	}
+	if _, err = s.Authenticate(DefaultTenant, "alice", testPassword); err != nil {
+		t.Fatalf("login after unlock: %v", err)
+	}
+}
+
+func TestAuthenticateHidesAccountState(t *testing.T) {
+	s, now := newPasswordService(t)
+	disabled := createWithPassword(t, s, "disabled")
+	disabled.Disabled = true
+	if _, err := s.Update(AnyTenant, *disabled); err != nil {
+		t.Fatal(err)
+	}
+	expired := createWithPassword(t, s, "expired")
+	expired.ExpiresAt = *now
+	if _, err := s.Update(AnyTenant, *expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"disabled", "expired", "missing"} {
+		if _, err := s.Authenticate(DefaultTenant, name, testPassword); !errors.Is(err, ErrInvalidCredentials) || err.Error() != ErrInvalidCredentials.Error() {
+			t.Errorf("login of %s: %v, want a bare %v", name, err, ErrInvalidCredentials)
+		}
+	}
+}
+
+func newPasswordService(t *testing.T) (*UserService, *time.Time) {
+	t.Helper()
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewUserService()
+	s.SetClock(func() time.Time { return now })
+	return s, &now
+}
+
+func createWithPassword(t *testing.T, s *UserService, name string) *User {
+	t.Helper()
+
+	user, err := s.Create(User{Name: name, Tenant: DefaultTenant, CreatedAt: s.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetPassword(AnyTenant, user.ID, testPassword, DefaultPasswordPolicy); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = s.Get(AnyTenant, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFile = "users.snapshot"
+	walFile      = "users.wal"
+)
+
+var ErrPersistenceDisabled = errors.New("persistence disabled")
+
+type (
+	PersistenceConfig struct {
+		// Dir holds the snapshot and the write-ahead log.
+		Dir          string
+		Sync         SyncPolicy
+		SyncInterval time.Duration
+		// SnapshotInterval enables periodic snapshots when positive.
+		SnapshotInterval time.Duration
+		// Keyring encrypts names, surnames, emails, birth dates and TOTP
+		// secrets on disk when set. Records under a retired key, or written
+		// unencrypted, are re-encrypted with the primary key in the
+		// background once the service is open. Without it, opening a store
+		// with encrypted records fails with ErrKeyringRequired.
+		Keyring *Keyring
+	}
+
+	SnapshotInfo struct {
+		Seq     uint64
+		Users   int
+		TakenAt time.Time
+	}
+
+	persistence struct {
+		snapshotPath string
+		wal          *WAL
+		seq          uint64
+		keyring      *Keyring
+		// snapshotMx serializes writing snapshots.
+		snapshotMx sync.Mutex
+
+		stop chan struct{}
+		done chan struct{}
+		// reencrypted is closed once stale records are re-encrypted.
+		reencrypted chan struct{}
+	}
+)
+
+// OpenUserService restores a durable UserService from cfg.Dir by loading the
+// latest snapshot and replaying the write-ahead log on top of it.
+func OpenUserService(cfg PersistenceConfig) (*UserService, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+
+	p := &persistence{snapshotPath: filepath.Join(cfg.Dir, snapshotFile), keyring: cfg.Keyring}
+	snap, err := readSnapshot(p.snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	stale := 0
+	for i, u := range snap.Users {
+		var resealed bool
+		if snap.Users[i], resealed, err = p.open(u); err != nil {
+			return nil, fmt.Errorf("read snapshot: %w", err)
+		}
+		if resealed {
+			stale++
+		}
+	}
+
+	s := NewUserService()
+	s.keyring = cfg.Keyring
+	s.restore(snap)
+	p.seq = snap.Seq
+
+	p.wal, err = OpenWAL(filepath.Join(cfg.Dir, walFile), cfg.Sync, cfg.SyncInterval)
+	if err != nil {
+		return nil, err
+	}
+	err = p.wal.Replay(func(m mutation) error {
+		// Records already covered by the snapshot survive a crash between
+		// writing the snapshot and resetting the log.
+		if m.Seq <= snap.Seq {
+			return nil
+		}
+		var resealed bool
+		if m.User, resealed, err = p.open(m.User); err != nil {
+			return err
+		}
+		if resealed {
+			stale++
+		}
+		s.apply(m)
+		p.seq = m.Seq
+		return nil
+	})
+	if err != nil {
+		_ = p.wal.Close()
+		return nil, fmt.Errorf("replay wal: %w", err)
+	}
+
+	s.persistence = p
+	if cfg.SnapshotInterval > 0 {
+		p.stop = make(chan struct{})
+		p.done = make(chan struct{})
+		go s.snapshotLoop(cfg.SnapshotInterval)
+	}
+	if stale > 0 {
+		p.reencrypted = make(chan struct{})
+		go s.reencrypt(stale)
+	}
+
+	return s, nil
+}
+
+// open reads a user record from disk, reporting whether it should be sealed
+// again with the primary key.
+func (p *persistence) open(user User) (User, bool, error) {
+	if p.keyring != nil {
+		return p.keyring.openUser(user)
+	}
+	if user.sealed() {
+		return User{}, false, fmt.Errorf("%w: user %s", ErrKeyringRequired, user.ID)
+	}
+	return user, false, nil
+}
+
+// Snapshot writes the current store to disk and compacts the write-ahead log.
+// Mutations go on while the snapshot is written; the log keeps those it
+// does not cover.
+func (s *UserService) Snapshot() (*SnapshotInfo, error) {
+	if s.persistence == nil {
+		return nil, ErrPersistenceDisabled
+	}
+
+	s.persistence.snapshotMx.Lock()
+	defer s.persistence.snapshotMx.Unlock()
+
+	snap, end, err := s.captureSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if k := s.persistence.keyring; k != nil {
+		for i, u := range snap.Users {
+			if snap.Users[i], err = k.sealUser(u); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err = writeSnapshot(s.persistence.snapshotPath, snap); err != nil {
+		return nil, err
+	}
+	if err = s.persistence.wal.DiscardBefore(end); err != nil {
+		return nil, err
+	}
+
+	return &SnapshotInfo{Seq: snap.Seq, Users: len(snap.Users), TakenAt: snap.TakenAt}, nil
+}
+
+// captureSnapshot copies the store with its sequence number and the end of
+// the log records it covers. Mutations hold the write lock while they are
+// logged, so the three agree.
+func (s *UserService) captureSnapshot() (snapshot, int64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	end, err := s.persistence.wal.End()
+	if err != nil {
+		return snapshot{}, 0, err
+	}
+	snap := s.snapshot()
+	snap.Seq = s.persistence.seq
+	return snap, end, nil
+}
+
+// snapshot captures the store. The caller must hold the lock.
+func (s *UserService) snapshot() snapshot {
+	snap := snapshot{
+		TakenAt:    s.Now(),
+		Users:      make([]User, 0, len(s.store)),
+		Revision:   s.revision,
+		Compacted:  s.changes.compacted,
+		Tombstones: s.changes.tombstones(),
+		Days:       s.dayStats(),
+	}
+	for _, u := range s.store {
+		snap.Users = append(snap.Users, u)
+	}
+	return snap
+}
+
+// restore replaces the store with the contents of snap. The caller must hold
+// the write lock unless the service is not shared yet.
+func (s *UserService) restore(snap snapshot) {
+	for _, u := range s.store {
+		s.apply(mutation{Op: opDelete, Revision: s.revision, User: User{ID: u.ID}})
+	}
+	for _, u := range snap.Users {
+		s.apply(mutation{Op: opCreate, Revision: u.ModifiedRevision, User: u})
+	}
+	s.revision = max(s.revision, snap.Revision)
+	s.restoreChangelog(snap.Compacted, snap.Tombstones)
+	if snap.Days != nil {
+		// Otherwise the creations are those of the users in the snapshot.
+		s.restoreDayStats(snap.Days)
+	}
+}
+
+// Close stops periodic snapshots and closes the write-ahead log.
+func (s *UserService) Close() error {
+	if s.persistence == nil {
+		return nil
+	}
+	if s.persistence.stop != nil {
+		close(s.persistence.stop)
+		<-s.persistence.done
+	}
+	if s.persistence.reencrypted != nil {
+		<-s.persistence.reencrypted
+	}
+
+	return s.persistence.wal.Close()
+}
+
+func (s *UserService) snapshotLoop(interval time.Duration) {
+	defer close(s.persistence.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.persistence.stop:
+			return
+		case <-ticker.C:
+			if _, err := s.Snapshot(); err != nil {
+				fmt.Println("snapshot:", err)
+			}
+		}
+	}
+}
+
+// reencrypt seals the records found under a retired key, or unencrypted,
+// with the primary key. A snapshot rewrites every record, after which the
+// retired key can be removed from the keyring.
+func (s *UserService) reencrypt(stale int) {
+	defer close(s.persistence.reencrypted)
+
+	if _, err := s.Snapshot(); err != nil {
+		fmt.Println("re-encrypt users:", err)
+		return
+	}
+	fmt.Printf("re-encrypted %d user records with key %s\n", stale, s.persistence.keyring.Primary())
+}
+
+// log assigns the next sequence number to m and appends it to the WAL, with
+// its user sealed if records are encrypted at rest.
+func (p *persistence) log(m *mutation) error {
+	m.Seq = p.seq + 1
+	rec := *m
+	if p.keyring != nil {
+		var err error
+		if rec.User, err = p.keyring.sealUser(m.User); err != nil {
+			return fmt.Errorf("encrypt wal record: %w", err)
+		}
+	}
+	if err := p.wal.Append(rec); err != nil {
+		return fmt.Errorf("append wal: %w", err)
+	}
+	p.seq = m.Seq
+
+	return nil
+}
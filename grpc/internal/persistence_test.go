@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotKeepsConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenUserService(PersistenceConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const users = 200
+	ids := make([]string, 0, users)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range users {
+			u, err := s.Create(User{Name: fmt.Sprintf("user%d", i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids = append(ids, u.ID)
+		}
+	}()
+	for range 20 {
+		if _, err = s.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenUserService(PersistenceConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = reopened.Close() })
+	if len(ids) != users {
+		t.Fatalf("created %d users, want %d", len(ids), users)
+	}
+	for _, id := range ids {
+		if _, err = reopened.Get(AnyTenant, id); err != nil {
+			t.Fatalf("get %s after reopening: %v", id, err)
+		}
+	}
+	if reopened.Revision() != s.Revision() {
+		t.Fatalf("reopened at revision %d, want %d", reopened.Revision(), s.Revision())
+	}
+}
@@ -0,0 +1,807 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+const (
+	// ReadConsistencyHeader selects the consistency of a read on a replicated
+	// server: ReadLinearizable or ReadStale.
+	ReadConsistencyHeader = "x-read-consistency"
+	// ReadLinearizable reads observe every write acknowledged before them.
+	ReadLinearizable = "linearizable"
+	// ReadStale reads are served from the local replica, which may lag behind.
+	ReadStale = "stale"
+
+	DefaultApplyTimeout = 5 * time.Second
+
+	clusterSecretHeader = "x-cluster-secret"
+	raftStoreFile       = "raft.db"
+	raftRetryInterval   = 50 * time.Millisecond
+	raftPollInterval    = 5 * time.Millisecond
+
+	raftNonceSize        = 32
+	raftHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrNoLeader      = errors.New("no cluster leader")
+	ErrRaftHandshake = errors.New("raft peer does not know the cluster secret")
+
+	// replicatedErrors are the store errors a leader reports back to the node
+	// that forwarded the rejected mutation.
+	replicatedErrors = []error{ErrUserAlreadyExists, ErrUserNotFound, ErrCrossTenant, ErrQuotaExceeded, ErrEmailTaken,
+		ErrConcurrentUpdate}
+)
+
+type (
+	// Peer is a member of a replicated cluster.
+	Peer struct {
+		ID       string
+		RaftAddr string
+		GRPCAddr string
+	}
+
+	ReplicationConfig struct {
+		NodeID string
+		// RaftAddr is the consensus transport address of this node. The
+		// transport listens on it unless RaftListener is set.
+		RaftAddr     string
+		RaftListener net.Listener
+		// Dir holds the consensus log and its snapshots.
+		Dir string
+		// Peers lists every member of the cluster, this node included.
+		Peers []Peer
+		// Secret authenticates the requests nodes forward to each other and
+		// the connections of the consensus transport.
+		Secret string
+		// Tokens, when set, has its revocations replicated through the log,
+		// so that a token revoked on one member is rejected by all of them.
+		Tokens *TokenIssuer
+		// ReadConsistency applies to reads without the x-read-consistency
+		// header. ReadLinearizable when empty.
+		ReadConsistency string
+		// HeartbeatTimeout tunes failure detection; raft's default when zero.
+		HeartbeatTimeout time.Duration
+		// ApplyTimeout bounds a write, including forwarding and retries while
+		// a leader is elected. DefaultApplyTimeout when zero.
+		ApplyTimeout time.Duration
+		// LogOutput receives the consensus library's logs. os.Stderr when nil.
+		LogOutput io.Writer
+	}
+
+	NodeStatus struct {
+		ID           string
+		State        string
+		LeaderID     string
+		AppliedIndex uint64
+	}
+
+	// Node is the member of a replicated cluster backing a UserService. Every
+	// mutation is appended to a raft log and applied on all members in log
+	// order; members that are not the leader forward their writes to it.
+	//
+	// The leader checks mutations one at a time before appending them, so
+	// that applying the log depends on nothing but the log: settings such as
+	// tenant quotas are only enforced by the leader.
+	//
+	// Users and, with ReplicationConfig.Tokens, token revocations are
+	// replicated. API keys and groups are not, so a cluster must not serve
+	// them.
+	Node struct {
+		cfg       ReplicationConfig
+		users     *UserService
+		raft      *raft.Raft
+		transport *raft.NetworkTransport
+		store     *raftboltdb.BoltStore
+
+		// ready is set while this node leads and has applied every entry of
+		// the previous terms, so its commit index can serve linearizable reads
+		// and mutations can be checked against its store.
+		ready atomic.Bool
+		// proposeMx makes the leader check and apply one mutation at a time.
+		proposeMx sync.Mutex
+
+		mx    sync.Mutex
+		conns map[string]*grpc.ClientConn
+
+		stop chan struct{}
+		done chan struct{}
+	}
+
+	// fsm applies committed log entries to the store and the revoked tokens.
+	fsm struct {
+		s      *UserService
+		tokens *TokenIssuer
+	}
+
+	fsmSnapshot struct {
+		snap raftSnapshot
+	}
+
+	// raftSnapshot is the store and the revoked tokens, which raft snapshots
+	// hold in place of the log entries they replace.
+	raftSnapshot struct {
+		snapshot
+		Revoked map[string]time.Time `json:"revoked,omitempty"`
+	}
+
+	applyResult struct {
+		m   mutation
+		err error
+	}
+
+	// streamLayer is raft's TCP transport over an existing listener. Both
+	// ends of a connection prove they know the cluster secret before any
+	// raft traffic, see handshake.
+	streamLayer struct {
+		net.Listener
+		advertise net.Addr
+		secret    []byte
+	}
+
+	// acceptedConn is an accepted raft connection. Its handshake runs on
+	// first use, so that a slow peer does not hold up the accept loop.
+	acceptedConn struct {
+		net.Conn
+		layer *streamLayer
+
+		once sync.Once
+		err  error
+	}
+)
+
+// ParsePeers parses a comma-separated list of id=raftAddr/grpcAddr members.
+func ParsePeers(s string) ([]Peer, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var res []Peer
+	for _, entry := range strings.Split(s, ",") {
+		id, addrs, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid peer %q: want id=raftAddr/grpcAddr", entry)
+		}
+		raftAddr, grpcAddr, ok := strings.Cut(addrs, "/")
+		if !ok || raftAddr == "" || grpcAddr == "" {
+			return nil, fmt.Errorf("invalid peer %q: want id=raftAddr/grpcAddr", entry)
+		}
+		res = append(res, Peer{ID: id, RaftAddr: raftAddr, GRPCAddr: grpcAddr})
+	}
+
+	return res, nil
+}
+
+// StartNode joins s to the cluster described by cfg. s must be a new, empty
+// in-memory service: its state is rebuilt from the consensus log, which takes
+// the place of the write-ahead log. A node without previous state bootstraps
+// the cluster with cfg.Peers.
+func StartNode(cfg ReplicationConfig, s *UserService) (*Node, error) {
+	if cfg.NodeID == "" {
+		return nil, errors.New("start node: node ID is required")
+	}
+	if cfg.Secret == "" {
+		return nil, errors.New("start node: cluster secret is required")
+	}
+	if s.persistence != nil || len(s.store) > 0 {
+		return nil, errors.New("start node: user service must be empty and in-memory")
+	}
+	if cfg.ReadConsistency == "" {
+		cfg.ReadConsistency = ReadLinearizable
+	}
+	if cfg.ReadConsistency != ReadLinearizable && cfg.ReadConsistency != ReadStale {
+		return nil, fmt.Errorf("start node: unknown read consistency: %q", cfg.ReadConsistency)
+	}
+	if cfg.ApplyTimeout <= 0 {
+		cfg.ApplyTimeout = DefaultApplyTimeout
+	}
+	if cfg.LogOutput == nil {
+		cfg.LogOutput = os.Stderr
+	}
+
+	self, ok := findPeer(cfg.Peers, cfg.NodeID)
+	if !ok {
+		return nil, fmt.Errorf("start node: %s is not one of the peers", cfg.NodeID)
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", self.RaftAddr)
+	if err != nil {
+		return nil, fmt.Errorf("start node: resolve raft address: %w", err)
+	}
+
+	if err = os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create raft dir: %w", err)
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, raftStoreFile))
+	if err != nil {
+		return nil, fmt.Errorf("open raft store: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStore(cfg.Dir, 2, cfg.LogOutput)
+	if err != nil {
+		_ = store.Close()
+		return nil, fmt.Errorf("open raft snapshots: %w", err)
+	}
+
+	lis := cfg.RaftListener
+	if lis == nil {
+		addr := cfg.RaftAddr
+		if addr == "" {
+			addr = self.RaftAddr
+		}
+		if lis, err = net.Listen("tcp", addr); err != nil {
+			_ = store.Close()
+			return nil, fmt.Errorf("listen raft: %w", err)
+		}
+	}
+	layer := &streamLayer{Listener: lis, advertise: advertise, secret: []byte(cfg.Secret)}
+	transport := raft.NewNetworkTransport(layer, 3, 10*time.Second, cfg.LogOutput)
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.NodeID)
+	conf.LogOutput = cfg.LogOutput
+	conf.LogLevel = "INFO"
+	if cfg.HeartbeatTimeout > 0 {
+		conf.HeartbeatTimeout = cfg.HeartbeatTimeout
+		conf.ElectionTimeout = cfg.HeartbeatTimeout
+		conf.LeaderLeaseTimeout = cfg.HeartbeatTimeout / 2
+		conf.CommitTimeout = min(conf.CommitTimeout, cfg.HeartbeatTimeout/4)
+	}
+
+	n := &Node{
+		cfg:       cfg,
+		users:     s,
+		transport: transport,
+		store:     store,
+		conns:     make(map[string]*grpc.ClientConn),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	hasState, err := raft.HasExistingState(store, store, snaps)
+	if err != nil {
+		_ = transport.Close()
+		_ = store.Close()
+		return nil, fmt.Errorf("inspect raft state: %w", err)
+	}
+	if cfg.Tokens != nil {
+		cfg.Tokens.replica = n
+	}
+	n.raft, err = raft.NewRaft(conf, &fsm{s: s, tokens: cfg.Tokens}, store, store, snaps, transport)
+	if err != nil {
+		_ = transport.Close()
+		_ = store.Close()
+		return nil, fmt.Errorf("start raft: %w", err)
+	}
+	if !hasState {
+		var servers []raft.Server
+		for _, p := range cfg.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(p.ID), Address: raft.ServerAddress(p.RaftAddr)})
+		}
+		err = n.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			_ = n.raft.Shutdown().Error()
+			_ = store.Close()
+			return nil, fmt.Errorf("bootstrap cluster: %w", err)
+		}
+	}
+
+	s.mx.Lock()
+	s.replica = n
+	s.mx.Unlock()
+
+	go n.watchLeadership()
+
+	return n, nil
+}
+
+func (n *Node) Status() NodeStatus {
+	_, leader := n.raft.LeaderWithID()
+	return NodeStatus{
+		ID:           n.cfg.NodeID,
+		State:        n.raft.State().String(),
+		LeaderID:     string(leader),
+		AppliedIndex: n.raft.AppliedIndex(),
+	}
+}
+
+func (n *Node) isLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// ReadBarrier waits until this node has applied every mutation committed
+// before the call, so that local reads made afterwards are linearizable.
+func (n *Node) ReadBarrier(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.ApplyTimeout)
+	defer cancel()
+
+	var index uint64
+	err := n.retry(ctx, func() error {
+		var err error
+		index, err = n.readIndex(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for n.raft.AppliedIndex() < index {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(raftPollInterval):
+		}
+	}
+
+	return nil
+}
+
+// ReadInterceptor makes UserService reads linearizable, or serves them from
+// the local replica when the caller or the node configuration asks for stale
+// reads.
+func (n *Node) ReadInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if methodScopes[info.FullMethod] != ScopeUsersRead {
+		return handler(ctx, req)
+	}
+
+	consistency := firstMetadata(ctx, ReadConsistencyHeader)
+	if consistency == "" {
+		consistency = n.cfg.ReadConsistency
+	}
+	switch consistency {
+	case ReadStale:
+	case ReadLinearizable:
+		if err := n.ReadBarrier(ctx); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "linearizable read: %v", err)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown read consistency: %q", consistency)
+	}
+
+	return handler(ctx, req)
+}
+
+// Close leaves the cluster without removing this node from its configuration,
+// so a restart with the same directory rejoins it.
+func (n *Node) Close() error {
+	err := n.raft.Shutdown().Error()
+
+	close(n.stop)
+	<-n.done
+
+	n.mx.Lock()
+	for _, conn := range n.conns {
+		_ = conn.Close()
+	}
+	n.conns = nil
+	n.mx.Unlock()
+
+	if cerr := n.store.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// propose appends m to the log, through the leader when this node is not the
+// leader, and waits until it is applied. On success m holds the applied
+// mutation.
+func (n *Node) propose(m *mutation) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal mutation: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ApplyTimeout)
+	defer cancel()
+
+	var applied []byte
+	err = n.retry(ctx, func() error {
+		var err error
+		if n.isLeader() {
+			applied, err = n.applyLocal(data)
+		} else {
+			applied, err = n.forward(ctx, data)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(applied, m); err != nil {
+		return fmt.Errorf("unmarshal mutation: %w", err)
+	}
+	return nil
+}
+
+// applyLocal checks the mutation in data against the store and appends it to
+// the log of this node, which must be the leader. The next mutation is only
+// checked once this one is applied, so every check sees the state the
+// mutation will be applied to.
+func (n *Node) applyLocal(data []byte) ([]byte, error) {
+	var m mutation
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("unmarshal mutation: %w", err)
+	}
+
+	n.proposeMx.Lock()
+	defer n.proposeMx.Unlock()
+
+	if !n.isLeader() || !n.ready.Load() {
+		return nil, fmt.Errorf("%w: not a leader that is caught up", ErrNoLeader)
+	}
+	if m.Op != opRevoke {
+		n.users.mx.RLock()
+		err := n.users.check(m)
+		n.users.mx.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f := n.raft.Apply(data, n.cfg.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+			return nil, fmt.Errorf("%w: %v", ErrNoLeader, err)
+		}
+		return nil, fmt.Errorf("apply mutation: %w", err)
+	}
+
+	res := f.Response().(*applyResult)
+	if res.err != nil {
+		return nil, res.err
+	}
+	return json.Marshal(res.m)
+}
+
+func (n *Node) forward(ctx context.Context, data []byte) ([]byte, error) {
+	client, err := n.leaderClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Propose(n.outgoing(ctx), &pb.ProposeRequest{Mutation: data})
+	if err != nil {
+		if status.Code(err) == codes.Unavailable {
+			return nil, fmt.Errorf("%w: %v", ErrNoLeader, err)
+		}
+		return nil, fmt.Errorf("forward mutation: %w", err)
+	}
+	if res.Error != "" {
+		return nil, decodeReplicatedError(res.Error)
+	}
+
+	return res.Mutation, nil
+}
+
+// readIndex returns the leader's commit index, confirming the leadership
+// first when this node is the leader.
+func (n *Node) readIndex(ctx context.Context) (uint64, error) {
+	if n.isLeader() {
+		if !n.ready.Load() {
+			return 0, fmt.Errorf("%w: leader is catching up", ErrNoLeader)
+		}
+		if err := n.raft.VerifyLeader().Error(); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrNoLeader, err)
+		}
+		return n.raft.CommitIndex(), nil
+	}
+
+	client, err := n.leaderClient()
+	if err != nil {
+		return 0, err
+	}
+	res, err := client.ReadIndex(n.outgoing(ctx), &emptypb.Empty{})
+	if err != nil {
+		if status.Code(err) == codes.Unavailable {
+			return 0, fmt.Errorf("%w: %v", ErrNoLeader, err)
+		}
+		return 0, fmt.Errorf("read index: %w", err)
+	}
+
+	return res.Index, nil
+}
+
+// retry calls fn until it returns anything but ErrNoLeader or ctx is done.
+func (n *Node) retry(ctx context.Context, fn func() error) error {
+	for {
+		err := fn()
+		if !errors.Is(err, ErrNoLeader) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(raftRetryInterval):
+		}
+	}
+}
+
+func (n *Node) leaderClient() (pb.ReplicationServiceClient, error) {
+	_, id := n.raft.LeaderWithID()
+	if id == "" || string(id) == n.cfg.NodeID {
+		return nil, ErrNoLeader
+	}
+	peer, ok := findPeer(n.cfg.Peers, string(id))
+	if !ok {
+		return nil, fmt.Errorf("unknown leader: %s", id)
+	}
+
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	if n.conns == nil {
+		return nil, fmt.Errorf("%w: node is closed", ErrNoLeader)
+	}
+	conn, ok := n.conns[peer.GRPCAddr]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(peer.GRPCAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, fmt.Errorf("dial leader: %w", err)
+		}
+		n.conns[peer.GRPCAddr] = conn
+	}
+
+	return pb.NewReplicationServiceClient(conn), nil
+}
+
+func (n *Node) outgoing(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, clusterSecretHeader, n.cfg.Secret)
+}
+
+// watchLeadership keeps ready up to date. A new leader only serves reads once
+// a barrier has applied the entries committed by its predecessors.
+func (n *Node) watchLeadership() {
+	defer close(n.done)
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case leader := <-n.raft.LeaderCh():
+			n.ready.Store(false)
+			for leader && n.isLeader() {
+				err := n.raft.Barrier(n.cfg.ApplyTimeout).Error()
+				if err == nil {
+					n.ready.Store(true)
+					break
+				}
+				fmt.Println("raft barrier:", err)
+			}
+		}
+	}
+}
+
+func (f *fsm) Apply(l *raft.Log) any {
+	var m mutation
+	if err := json.Unmarshal(l.Data, &m); err != nil {
+		return &applyResult{err: fmt.Errorf("unmarshal mutation: %w", err)}
+	}
+
+	if m.Op == opRevoke {
+		if f.tokens != nil && m.Token != nil {
+			f.tokens.revoke(m.Token.ID, m.Token.ExpiresAt)
+		}
+		return &applyResult{m: m}
+	}
+
+	f.s.mx.Lock()
+	defer f.s.mx.Unlock()
+
+	// The leader checked the mutation, but an entry of a deposed leader may
+	// have been computed from a user changed since. Only the log decides.
+	if err := f.s.checkRevision(m); err != nil {
+		return &applyResult{err: err}
+	}
+	m.Seq = l.Index
+	f.s.stamp(&m)
+	f.s.apply(m)
+
+	return &applyResult{m: m}
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.s.mx.RLock()
+	defer f.s.mx.RUnlock()
+
+	snap := raftSnapshot{snapshot: f.s.snapshot()}
+	if f.tokens != nil {
+		snap.Revoked = f.tokens.revocations()
+	}
+	return &fsmSnapshot{snap: snap}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var snap raftSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+
+	f.s.mx.Lock()
+	defer f.s.mx.Unlock()
+
+	f.s.restore(snap.snapshot)
+	if f.tokens != nil {
+		f.tokens.restoreRevocations(snap.Revoked)
+	}
+
+	return nil
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	data, err := json.Marshal(s.snap)
+	if err != nil {
+		_ = sink.Cancel()
+		return fmt.Errorf("marshal snapshot: %w", err)
+	}
+	if _, err = sink.Write(data); err != nil {
+		_ = sink.Cancel()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
+
+func (l *streamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+func (l *streamLayer) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &acceptedConn{Conn: conn, layer: l}, nil
+}
+
+func (l *streamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = raftHandshakeTimeout
+	}
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.handshake(conn, true, timeout); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshake authenticates both ends of conn by the cluster secret. Each end
+// sends a random nonce and proves the secret with an HMAC of both nonces and
+// its role, so that a recorded handshake cannot be replayed nor reflected:
+//
+//	dialer   -> nonce
+//	acceptor -> nonce, HMAC(secret, "accept" || dialer nonce || acceptor nonce)
+//	dialer   -> HMAC(secret, "dial" || dialer nonce || acceptor nonce)
+func (l *streamLayer) handshake(conn net.Conn, dialer bool, timeout time.Duration) error {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("raft handshake: %w", err)
+	}
+
+	var ours, theirs [raftNonceSize]byte
+	if _, err := rand.Read(ours[:]); err != nil {
+		return fmt.Errorf("raft handshake: %w", err)
+	}
+	dialNonce, acceptNonce := ours[:], theirs[:]
+	if !dialer {
+		dialNonce, acceptNonce = theirs[:], ours[:]
+	}
+
+	if dialer {
+		if _, err := conn.Write(ours[:]); err != nil {
+			return fmt.Errorf("raft handshake: %w", err)
+		}
+		msg := make([]byte, raftNonceSize+sha256.Size)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return fmt.Errorf("raft handshake: %w", err)
+		}
+		copy(theirs[:], msg)
+		if !hmac.Equal(msg[raftNonceSize:], l.proof("accept", dialNonce, acceptNonce)) {
+			return ErrRaftHandshake
+		}
+		if _, err := conn.Write(l.proof("dial", dialNonce, acceptNonce)); err != nil {
+			return fmt.Errorf("raft handshake: %w", err)
+		}
+	} else {
+		if _, err := io.ReadFull(conn, theirs[:]); err != nil {
+			return fmt.Errorf("raft handshake: %w", err)
+		}
+		if _, err := conn.Write(append(ours[:], l.proof("accept", dialNonce, acceptNonce)...)); err != nil {
+			return fmt.Errorf("raft handshake: %w", err)
+		}
+		proof := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(conn, proof); err != nil {
+			return fmt.Errorf("raft handshake: %w", err)
+		}
+		if !hmac.Equal(proof, l.proof("dial", dialNonce, acceptNonce)) {
+			return ErrRaftHandshake
+		}
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("raft handshake: %w", err)
+	}
+	return nil
+}
+
+func (l *streamLayer) proof(role string, dialNonce, acceptNonce []byte) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(role))
+	mac.Write(dialNonce)
+	mac.Write(acceptNonce)
+	return mac.Sum(nil)
+}
+
+func (c *acceptedConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *acceptedConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *acceptedConn) handshake() error {
+	c.once.Do(func() {
+		c.err = c.layer.handshake(c.Conn, false, raftHandshakeTimeout)
+	})
+	return c.err
+}
+
+func findPeer(peers []Peer, id string) (Peer, bool) {
+	for _, p := range peers {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+// decodeReplicatedError restores the sentinel of an error reported by the
+// leader, so that it maps to the same status code as a local one.
+func decodeReplicatedError(msg string) error {
+	for _, sentinel := range replicatedErrors {
+		if rest, ok := strings.CutPrefix(msg, sentinel.Error()); ok {
+			return fmt.Errorf("%w%s", sentinel, rest)
+		}
+	}
+	return errors.New(msg)
+}
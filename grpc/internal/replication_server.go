@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+type (
+	// ReplicationGRPCServer serves the requests other members of the cluster
+	// forward to the leader.
+	ReplicationGRPCServer struct {
+		node *Node
+		pb.UnimplementedReplicationServiceServer
+	}
+)
+
+// ReplicationMethods are public to the Authenticator: the service checks the
+// cluster secret itself.
+var ReplicationMethods = []string{
+	pb.ReplicationService_Propose_FullMethodName,
+	pb.ReplicationService_ReadIndex_FullMethodName,
+}
+
+func NewReplicationGRPCService(node *Node) *ReplicationGRPCServer {
+	return &ReplicationGRPCServer{node: node}
+}
+
+func (s *ReplicationGRPCServer) Propose(ctx context.Context, req *pb.ProposeRequest) (*pb.ProposeResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	applied, err := s.node.applyLocal(req.Mutation)
+	if err != nil {
+		if errors.Is(err, ErrNoLeader) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return &pb.ProposeResponse{Error: err.Error()}, nil
+	}
+
+	return &pb.ProposeResponse{Mutation: applied}, nil
+}
+
+func (s *ReplicationGRPCServer) ReadIndex(ctx context.Context, _ *emptypb.Empty) (*pb.ReadIndexResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if !s.node.isLeader() {
+		return nil, status.Errorf(codes.Unavailable, "%v: not the leader", ErrNoLeader)
+	}
+
+	index, err := s.node.readIndex(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &pb.ReadIndexResponse{Index: index}, nil
+}
+
+func (s *ReplicationGRPCServer) authorize(ctx context.Context) error {
+	secret := firstMetadata(ctx, clusterSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.node.cfg.Secret)) != 1 {
+		return status.Errorf(codes.Unauthenticated, "invalid cluster secret")
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestRaftHandshake(t *testing.T) {
+	for name, tc := range map[string]struct {
+		dialSecret string
+		wantErr    error
+	}{
+		"same secret":  {dialSecret: "secret"},
+		"other secret": {dialSecret: "other", wantErr: ErrRaftHandshake},
+	} {
+		t.Run(name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			acceptor := &streamLayer{Listener: lis, advertise: lis.Addr(), secret: []byte("secret")}
+			t.Cleanup(func() { _ = acceptor.Close() })
+			dialer := &streamLayer{secret: []byte(tc.dialSecret)}
+
+			received := make(chan error, 1)
+			go func() {
+				conn, err := acceptor.Accept()
+				if err != nil {
+					received <- err
+					return
+				}
+				defer conn.Close()
+				buf := make([]byte, 4)
+				_, err = io.ReadFull(conn, buf)
+				if err == nil && string(buf) != "ping" {
+					err = errors.New("unexpected payload: " + string(buf))
+				}
+				received <- err
+			}()
+
+			conn, err := dialer.Dial(raft.ServerAddress(lis.Addr().String()), time.Second)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("dial: %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				if err = <-received; err == nil {
+					t.Fatal("acceptor read from a peer without the secret")
+				}
+				return
+			}
+			defer conn.Close()
+			if _, err = conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if err = <-received; err != nil {
+				t.Fatalf("acceptor: %v", err)
+			}
+		})
+	}
+}
+
+func TestClusterReplicatesRevocations(t *testing.T) {
+	c := startTestCluster(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.Operator(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := c.tokens.Issue(c.operator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := c.tokens.Verify(tokens.RefreshToken, TokenRefresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower := otherNode(c, leader.ID)
+	if err = follower.Tokens.Revoke(claims); err != nil {
+		t.Fatalf("revoke through a follower: %v", err)
+	}
+
+	for _, n := range c.Nodes() {
+		waitFor(t, ctx, func() bool {
+			_, err := n.Tokens.Verify(tokens.RefreshToken, TokenRefresh)
+			return errors.Is(err, ErrTokenRevoked)
+		}, "revocation on "+n.ID)
+	}
+}
+
+func TestClusterApplyIgnoresLocalSettings(t *testing.T) {
+	c := startTestCluster(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	leader, err := c.Leader(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A quota of the follower alone must not make its store diverge.
+	follower := otherNode(c, leader.ID)
+	follower.Users.SetTenantQuotas(TenantQuotas{Default: 1})
+
+	var ids []string
+	for _, name := range []string{"alice", "bob"} {
+		user, err := leader.Users.Create(User{Name: name, Tenant: DefaultTenant, CreatedAt: leader.Users.Now()})
+		if err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+		ids = append(ids, user.ID)
+	}
+
+	for _, id := range ids {
+		waitFor(t, ctx, func() bool {
+			_, err := follower.Users.Get(AnyTenant, id)
+			return err == nil
+		}, "user "+id+" on "+follower.ID)
+	}
+}
+
+func startTestCluster(t *testing.T) *LocalCluster {
+	t.Helper()
+
+	c, err := StartLocalCluster(3, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func otherNode(c *LocalCluster, id string) *LocalNode {
+	for _, n := range c.Nodes() {
+		if n.ID != id {
+			return n
+		}
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, ctx context.Context, ok func() bool, what string) {
+	t.Helper()
+
+	for !ok() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("wait for %s: %v", what, ctx.Err())
+		case <-time.After(raftRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package internal_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/Roma7-7-7/sandbox/grpc/internal"
+	"github.com/Roma7-7-7/sandbox/grpc/internal/testserver"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+// roundTripNow has nanoseconds, which a lossy conversion would drop.
+var roundTripNow = time.Date(2024, 6, 15, 12, 0, 0, 987654321, time.UTC)
+
+type (
+	// roundTripUser is a random user that the server accepts unchanged.
+	roundTripUser struct {
+		internal.User
+	}
+)
+
+func (roundTripUser) Generate(r *rand.Rand, _ int) reflect.Value {
+	const (
+		lower    = "abcdefghijklmnopqrstuvwxyz0123456789"
+		surnames = "abcxyzABCXYZ -'äßéøłżжя漢字"
+	)
+	u := internal.User{
+		// Names are unique within a tenant.
+		Name:    "user-" + randString(r, lower, 16),
+		Surname: randString(r, surnames, r.Intn(16)),
+	}
+	if r.Intn(4) > 0 {
+		u.BirthDate = time.Date(1900+r.Intn(120), time.Month(1+r.Intn(12)), 1+r.Intn(28), 0, 0, 0, 0, time.UTC)
+	}
+	if r.Intn(2) == 0 {
+		u.Email = fmt.Sprintf("%s@%s.example", randString(r, lower, 1+r.Intn(10)), randString(r, lower, 1+r.Intn(10)))
+	}
+	if n := r.Intn(4); n > 0 {
+		u.Labels = make(map[string]string, n)
+		for range n {
+			u.Labels[randString(r, lower, 1+r.Intn(10))] = randString(r, lower, r.Intn(10))
+		}
+	}
+	if r.Intn(2) == 0 {
+		u.ExpiresAt = roundTripNow.Add(time.Duration(r.Int63n(int64(1000 * 24 * time.Hour))))
+	}
+	if r.Intn(2) == 0 {
+		u.DisableAt = roundTripNow.Add(time.Duration(r.Int63n(int64(1000 * 24 * time.Hour))))
+	}
+	return reflect.ValueOf(roundTripUser{u})
+}
+
+func TestRoundTripPreservesEveryField(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithClock(func() time.Time { return roundTripNow }))
+	v2 := pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	roundTrip := func(in roundTripUser) bool {
+		created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: internal.ToProtoUserV2(&in.User)})
+		if err != nil {
+			t.Logf("create %+v: %v", in.User, err)
+			return false
+		}
+		want := in.User
+		want.ID, want.Tenant = created.User.Id, internal.DefaultTenant
+		want.CreatedAt, want.UpdatedAt = roundTripNow, roundTripNow
+		want.ModifiedRevision = created.User.ModifiedRevision
+
+		// v2 carries the birth date.
+		res, err := v2.GetUser(ctx, &pbv2.GetUserRequest{Id: want.ID})
+		if err != nil {
+			t.Logf("v2 get %s: %v", want.ID, err)
+			return false
+		}
+		got, err := internal.FromProtoUserV2(res.User)
+		if err != nil || !sameUser(t, "v2", got, want) {
+			return false
+		}
+
+		// The client reads v1, which carries the age at the time instead.
+		want.Age, want.BirthDate = want.AgeAt(roundTripNow), time.Time{}
+		read, err := srv.Client.GetUser(ctx, want.ID)
+		if err != nil {
+			t.Logf("client get %s: %v", want.ID, err)
+			return false
+		}
+		if !sameUser(t, "client get", *read, want) {
+			return false
+		}
+		batch, _, err := srv.Client.BatchGetUsers(ctx, []string{want.ID})
+		if err != nil || len(batch) != 1 {
+			t.Logf("client batch get %s: %v, %v", want.ID, batch, err)
+			return false
+		}
+		return sameUser(t, "client batch get", *batch[0], want)
+	}
+
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 200}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sameUser reports whether got equals want, comparing times by instant.
+func sameUser(t *testing.T, path string, got, want internal.User) bool {
+	t.Helper()
+
+	for _, ts := range []struct {
+		name      string
+		got, want *time.Time
+	}{
+		{"BirthDate", &got.BirthDate, &want.BirthDate},
+		{"CreatedAt", &got.CreatedAt, &want.CreatedAt},
+		{"UpdatedAt", &got.UpdatedAt, &want.UpdatedAt},
+		{"ExpiresAt", &got.ExpiresAt, &want.ExpiresAt},
+		{"DisableAt", &got.DisableAt, &want.DisableAt},
+	} {
+		if !ts.got.Equal(*ts.want) || ts.got.Location() != time.UTC {
+			t.Logf("%s: %s = %v, want %v in UTC", path, ts.name, *ts.got, *ts.want)
+			return false
+		}
+		*ts.got, *ts.want = time.Time{}, time.Time{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Logf("%s:\n got %+v\nwant %+v", path, got, want)
+		return false
+	}
+	return true
+}
+
+func randString(r *rand.Rand, alphabet string, n int) string {
+	runes := []rune(alphabet)
+	res := make([]rune, n)
+	for i := range res {
+		res[i] = runes[r.Intn(len(runes))]
+	}
+	return string(res)
+}
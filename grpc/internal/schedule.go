@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	TransitionDisable = "disable"
+	TransitionExpire  = "expire"
+
+	// schedulerMaxWait bounds a scheduler sleep, so that wall clock jumps are
+	// noticed.
+	schedulerMaxWait = time.Minute
+	// schedulerRetryInterval is the wait after transitions failed to apply.
+	schedulerRetryInterval = 5 * time.Second
+)
+
+type (
+	// Transition is a scheduled change of a user's state.
+	Transition struct {
+		UserID string
+		Tenant string
+		Kind   string
+		At     time.Time
+	}
+
+	// Scheduler applies the transitions of a UserService when they are due.
+	// Transitions are part of the users, so with a durable store the ones
+	// missed while the server was down are applied when it starts again.
+	Scheduler struct {
+		users *UserService
+		stop  chan struct{}
+		done  chan struct{}
+	}
+)
+
+// Expired reports whether the account has expired at now.
+func (u User) Expired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt)
+}
+
+// Inactive reports whether the user may not act, being disabled or expired.
+func (u User) Inactive(now time.Time) bool {
+	return u.Disabled || u.Expired(now)
+}
+
+// transitions returns the pending transitions of u. A disabled user has none.
+func (u User) transitions() []Transition {
+	if u.Disabled {
+		return nil
+	}
+
+	var res []Transition
+	if !u.DisableAt.IsZero() {
+		res = append(res, Transition{UserID: u.ID, Tenant: u.Tenant, Kind: TransitionDisable, At: u.DisableAt})
+	}
+	if !u.ExpiresAt.IsZero() {
+		res = append(res, Transition{UserID: u.ID, Tenant: u.Tenant, Kind: TransitionExpire, At: u.ExpiresAt})
+	}
+	return res
+}
+
+// Transitions returns the pending transitions in scope due before before, or
+// all of them if it is zero, ordered by when they are due.
+func (s *UserService) Transitions(scope string, before time.Time) []Transition {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var res []Transition
+	for id := range s.scheduled {
+		u := s.store[id]
+		if !visible(scope, u.Tenant) {
+			continue
+		}
+		for _, t := range u.transitions() {
+			if before.IsZero() || t.At.Before(before) {
+				res = append(res, t)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].At.Equal(res[j].At) {
+			return res[i].At.Before(res[j].At)
+		}
+		return res[i].UserID < res[j].UserID
+	})
+
+	return res
+}
+
+// ApplyTransitions disables the users whose transitions are due at now and
+// returns how many it changed. A replica that does not lead the cluster
+// leaves it to the leader.
+func (s *UserService) ApplyTransitions(now time.Time) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.replica != nil && !s.replica.isLeader() {
+		return 0, nil
+	}
+
+	var due []string
+	for id := range s.scheduled {
+		for _, t := range s.store[id].transitions() {
+			if !t.At.After(now) {
+				due = append(due, id)
+				break
+			}
+		}
+	}
+
+	applied := 0
+	for _, id := range due {
+		// commit may release the lock, so every user is read afresh.
+		user, ok := s.store[id]
+		if !ok || user.Disabled {
+			continue
+		}
+		disable := !user.DisableAt.IsZero() && !user.DisableAt.After(now)
+		if !disable && !user.Expired(now) {
+			continue
+		}
+
+		user.Disabled = true
+		if disable {
+			user.DisableAt = time.Time{}
+		}
+		user.UpdatedAt = now
+		m := mutation{Op: opUpdate, User: user}
+		if err := s.check(m); err != nil {
+			continue
+		}
+		if err := s.commit(&m); err != nil {
+			if errors.Is(err, ErrConcurrentUpdate) {
+				// Reconsidered on the next run against the new version.
+				continue
+			}
+			return applied, fmt.Errorf("apply transitions of %s: %w", id, err)
+		}
+		applied++
+	}
+
+	return applied, nil
+}
+
+// nextTransition returns when the earliest pending transition is due.
+func (s *UserService) nextTransition() (time.Time, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var next time.Time
+	for id := range s.scheduled {
+		for _, t := range s.store[id].transitions() {
+			if next.IsZero() || t.At.Before(next) {
+				next = t.At
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// indexSchedule tracks whether user has pending transitions. The caller
+// must hold the write lock.
+func (s *UserService) indexSchedule(user User) {
+	if len(user.transitions()) > 0 {
+		s.scheduled[user.ID] = struct{}{}
+	} else {
+		delete(s.scheduled, user.ID)
+	}
+}
+
+// StartScheduler applies due transitions right away and then whenever the
+// next one falls due, until Close.
+func StartScheduler(users *UserService) *Scheduler {
+	s := &Scheduler{
+		users: users,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Scheduler) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	for {
+		// Taken first so that a transition scheduled meanwhile wakes the loop.
+		changed := s.users.Changed()
+
+		wait := schedulerMaxWait
+		if n, err := s.users.ApplyTransitions(s.users.Now()); err != nil {
+			fmt.Println("scheduler:", err)
+			wait = schedulerRetryInterval
+		} else if n > 0 {
+			fmt.Printf("scheduler: disabled %d users\n", n)
+		}
+		if next, ok := s.users.nextTransition(); ok {
+			if d := next.Sub(s.users.Now()); d > 0 {
+				wait = min(wait, d)
+			} else {
+				// One still due was left to the leader or failed; retry later.
+				wait = min(wait, schedulerRetryInterval)
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
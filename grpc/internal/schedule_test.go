@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var scheduleNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func TestTransitionsAreOrderedAndScoped(t *testing.T) {
+	s := NewUserService()
+	late := createScheduled(t, s, User{Name: "late", ExpiresAt: scheduleNow.Add(48 * time.Hour)})
+	soon := createScheduled(t, s, User{Name: "soon", DisableAt: scheduleNow.Add(time.Hour), ExpiresAt: scheduleNow.Add(72 * time.Hour)})
+	createScheduled(t, s, User{Name: "other", Tenant: "acme", DisableAt: scheduleNow})
+	createScheduled(t, s, User{Name: "idle"})
+	createScheduled(t, s, User{Name: "disabled", Disabled: true, DisableAt: scheduleNow})
+
+	got := s.Transitions(DefaultTenant, time.Time{})
+	want := []Transition{
+		{UserID: soon.ID, Tenant: DefaultTenant, Kind: TransitionDisable, At: soon.DisableAt},
+		{UserID: late.ID, Tenant: DefaultTenant, Kind: TransitionExpire, At: late.ExpiresAt},
+		{UserID: soon.ID, Tenant: DefaultTenant, Kind: TransitionExpire, At: soon.ExpiresAt},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d transitions %v, want %v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("transition %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if got = s.Transitions(DefaultTenant, scheduleNow.Add(24*time.Hour)); len(got) != 1 || got[0].UserID != soon.ID {
+		t.Fatalf("transitions due within a day: %v, want the disable of soon", got)
+	}
+	if got = s.Transitions(AnyTenant, time.Time{}); len(got) != 4 {
+		t.Fatalf("transitions of every tenant: %d, want 4", len(got))
+	}
+}
+
+func TestApplyTransitions(t *testing.T) {
+	s := NewUserService()
+	disable := createScheduled(t, s, User{Name: "disable", DisableAt: scheduleNow})
+	expire := createScheduled(t, s, User{Name: "expire", ExpiresAt: scheduleNow.Add(-time.Minute)})
+	later := createScheduled(t, s, User{Name: "later", DisableAt: scheduleNow.Add(time.Hour)})
+
+	if n, err := s.ApplyTransitions(scheduleNow); err != nil || n != 2 {
+		t.Fatalf("apply at now: %d, %v, want 2 applied", n, err)
+	}
+	for _, id := range []string{disable.ID, expire.ID} {
+		u, err := s.Get(AnyTenant, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !u.Disabled {
+			t.Fatalf("%s not disabled", u.Name)
+		}
+		if !u.DisableAt.IsZero() {
+			t.Fatalf("%s still disables at %v", u.Name, u.DisableAt)
+		}
+	}
+	if u, _ := s.Get(AnyTenant, later.ID); u.Disabled {
+		t.Fatal("user disabled before its transition is due")
+	}
+	if n, err := s.ApplyTransitions(scheduleNow); err != nil || n != 0 {
+		t.Fatalf("apply again: %d, %v, want nothing applied", n, err)
+	}
+	if got := s.Transitions(AnyTenant, time.Time{}); len(got) != 1 || got[0].UserID != later.ID {
+		t.Fatalf("pending transitions %v, want only that of later", got)
+	}
+}
+
+func TestTransitionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenUserService(PersistenceConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := createScheduled(t, s, User{Name: "contractor", DisableAt: scheduleNow})
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenUserService(PersistenceConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = reopened.Close() })
+	if got := reopened.Transitions(AnyTenant, time.Time{}); len(got) != 1 || got[0].UserID != user.ID {
+		t.Fatalf("transitions after restart: %v, want the disable of %s", got, user.ID)
+	}
+	if n, err := reopened.ApplyTransitions(scheduleNow); err != nil || n != 1 {
+		t.Fatalf("apply after restart: %d, %v, want 1 applied", n, err)
+	}
+}
+
+func TestAuthenticatorRejectsExpiredUsers(t *testing.T) {
+	s := NewUserService()
+	expired := createScheduled(t, s, User{Name: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+	active := createScheduled(t, s, User{Name: "active", ExpiresAt: time.Now().Add(time.Hour)})
+	tokens := NewTokenIssuer([]byte("secret"), time.Minute, time.Hour)
+	auth := NewAuthenticator(s, tokens, NewAPIKeyStore())
+
+	for _, tc := range []struct {
+		user *User
+		want codes.Code
+	}{
+		{user: expired, want: codes.PermissionDenied},
+		{user: active, want: codes.OK},
+	} {
+		issued, err := tokens.Issue(tc.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+issued.AccessToken))
+		if _, err = callAs(ctx, auth, "/test/Call"); status.Code(err) != tc.want {
+			t.Fatalf("%s: got %v, want %v", tc.user.Name, err, tc.want)
+		}
+	}
+}
+
+func createScheduled(t *testing.T, s *UserService, u User) *User {
+	t.Helper()
+
+	if u.Tenant == "" {
+		u.Tenant = DefaultTenant
+	}
+	u.CreatedAt, u.UpdatedAt = scheduleNow, scheduleNow
+	created, err := s.Create(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
@@ -0,0 +1,393 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+
+	FieldName    = "name"
+	FieldSurname = "surname"
+
+	scoreExact  = 3.0
+	scorePrefix = 2.0
+	scoreFuzzy  = 1.0
+
+	// gramPad marks the start and end of a term, so that its first and last
+	// runes are part of two bigrams like the others.
+	gramPad = '\x00'
+)
+
+type (
+	// SearchHit is a user matching a search query. Highlights mark the parts of
+	// the name and surname that matched.
+	SearchHit struct {
+		User       User
+		Score      float64
+		Highlights []Highlight
+	}
+
+	// Highlight is a matched range of a field in rune offsets, End exclusive.
+	Highlight struct {
+		Field string
+		Start int
+		End   int
+	}
+
+	token struct {
+		term       string
+		start, end int
+	}
+
+	// termMatch is how well a query token matched an indexed term.
+	termMatch struct {
+		score float64
+		// prefix is the number of leading runes of the term that matched, or
+		// zero when the whole term did.
+		prefix int
+	}
+
+	// searchIndex is an inverted index from lower-cased name and surname
+	// tokens to user IDs. Its vocabulary is kept in a trie for prefix lookups
+	// and indexed by bigrams for fuzzy ones.
+	searchIndex struct {
+		postings map[string]map[string]struct{}
+		terms    *termNode
+		// grams maps the bigrams of every term, padded with gramPad, to the
+		// terms they occur in.
+		grams map[string]map[string]struct{}
+	}
+
+	// termNode is a node of the vocabulary trie, keyed by rune.
+	termNode struct {
+		children map[rune]*termNode
+		// term is the term ending at this node, if any.
+		term string
+	}
+)
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string]struct{}),
+		terms:    &termNode{},
+		grams:    make(map[string]map[string]struct{}),
+	}
+}
+
+func (idx *searchIndex) add(user User) {
+	for _, t := range userTokens(user) {
+		if _, ok := idx.postings[t.term]; !ok {
+			idx.terms.insert(t.term)
+			for _, g := range bigrams(t.term) {
+				link(idx.grams, g, t.term)
+			}
+		}
+		link(idx.postings, t.term, user.ID)
+	}
+}
+
+func (idx *searchIndex) remove(user User) {
+	for _, t := range userTokens(user) {
+		unlink(idx.postings, t.term, user.ID)
+		if _, ok := idx.postings[t.term]; !ok {
+			idx.terms.remove([]rune(t.term))
+			for _, g := range bigrams(t.term) {
+				unlink(idx.grams, g, t.term)
+			}
+		}
+	}
+}
+
+// matches returns every indexed term that q matches exactly, as a prefix or
+// within the edit distance allowed for its length, with the best score per term.
+func (idx *searchIndex) matches(q string) map[string]termMatch {
+	res := make(map[string]termMatch)
+
+	qlen := len([]rune(q))
+	idx.terms.find(q).walk(func(term string) {
+		if term == q {
+			res[q] = termMatch{score: scoreExact}
+		} else {
+			res[term] = termMatch{score: scorePrefix, prefix: qlen}
+		}
+	})
+
+	maxDist := fuzziness(qlen)
+	if maxDist == 0 {
+		return res
+	}
+	for term := range idx.fuzzyCandidates(q, maxDist) {
+		if _, ok := res[term]; ok {
+			continue
+		}
+		if d := editDistance(q, term, maxDist); d <= maxDist {
+			res[term] = termMatch{score: scoreFuzzy / float64(d)}
+		}
+	}
+
+	return res
+}
+
+// fuzzyCandidates returns the terms that may be within maxDist edits of q.
+// An edit changes at most two bigrams, so such a term lacks at most 2*maxDist
+// of the distinct bigrams of q, and shares at least one with it since q has
+// more than 2*maxDist bigrams for any fuzziness.
+func (idx *searchIndex) fuzzyCandidates(q string, maxDist int) map[string]struct{} {
+	grams := bigrams(q)
+	shared := make(map[string]int)
+	for _, g := range grams {
+		for term := range idx.grams[g] {
+			shared[term]++
+		}
+	}
+
+	need := max(1, len(grams)-2*maxDist)
+	res := make(map[string]struct{})
+	for term, n := range shared {
+		if n >= need {
+			res[term] = struct{}{}
+		}
+	}
+	return res
+}
+
+// bigrams returns the distinct pairs of consecutive runes of term, padded
+// with gramPad on both sides.
+func bigrams(term string) []string {
+	runes := append(append([]rune{gramPad}, []rune(term)...), gramPad)
+	seen := make(map[string]struct{}, len(runes)-1)
+	res := make([]string, 0, len(runes)-1)
+	for i := 1; i < len(runes); i++ {
+		g := string(runes[i-1 : i+1])
+		if _, ok := seen[g]; !ok {
+			seen[g] = struct{}{}
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+func (n *termNode) insert(term string) {
+	for _, r := range term {
+		child, ok := n.children[r]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[rune]*termNode)
+			}
+			child = &termNode{}
+			n.children[r] = child
+		}
+		n = child
+	}
+	n.term = term
+}
+
+// remove removes the term spelled by rest below n, pruning the nodes left
+// without terms, and reports whether n itself is left empty.
+func (n *termNode) remove(rest []rune) bool {
+	if len(rest) == 0 {
+		n.term = ""
+	} else if child, ok := n.children[rest[0]]; ok && child.remove(rest[1:]) {
+		delete(n.children, rest[0])
+	}
+	return n.term == "" && len(n.children) == 0
+}
+
+// find returns the node of prefix, or nil if no term starts with it.
+func (n *termNode) find(prefix string) *termNode {
+	for _, r := range prefix {
+		if n = n.children[r]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// walk calls fn with every term at or below n.
+func (n *termNode) walk(fn func(term string)) {
+	if n == nil {
+		return
+	}
+	if n.term != "" {
+		fn(n.term)
+	}
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
+
+// Search returns up to limit users in scope whose name or surname matches
+// every token of query, best matches first.
+func (s *UserService) Search(scope, query string, limit int) []SearchHit {
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	limit = min(limit, MaxSearchLimit)
+
+	queryTokens := tokenize(query)
+	if len(queryTokens) == 0 {
+		return nil
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var scores map[string]float64
+	perToken := make([]map[string]termMatch, len(queryTokens))
+	for i, qt := range queryTokens {
+		perToken[i] = s.search.matches(qt.term)
+
+		best := make(map[string]float64)
+		for term, m := range perToken[i] {
+			for id := range s.search.postings[term] {
+				best[id] = max(best[id], m.score)
+			}
+		}
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for id, score := range scores {
+			if b, ok := best[id]; ok {
+				scores[id] = score + b
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for id, score := range scores {
+		user := s.store[id]
+		if !visible(scope, user.Tenant) {
+			continue
+		}
+		hits = append(hits, SearchHit{User: user, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].User.Name != hits[j].User.Name {
+			return hits[i].User.Name < hits[j].User.Name
+		}
+		return hits[i].User.ID < hits[j].User.ID
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	for i := range hits {
+		hits[i].Highlights = highlights(hits[i].User, perToken)
+	}
+
+	return hits
+}
+
+func highlights(user User, perToken []map[string]termMatch) []Highlight {
+	var res []Highlight
+	for _, f := range []struct{ field, value string }{{FieldName, user.Name}, {FieldSurname, user.Surname}} {
+		for _, t := range tokenize(f.value) {
+			var best termMatch
+			for _, matches := range perToken {
+				if m, ok := matches[t.term]; ok && m.score > best.score {
+					best = m
+				}
+			}
+			if best.score == 0 {
+				continue
+			}
+			end := t.end
+			if best.prefix > 0 {
+				end = t.start + best.prefix
+			}
+			res = append(res, Highlight{Field: f.field, Start: t.start, End: end})
+		}
+	}
+	return res
+}
+
+func userTokens(user User) []token {
+	return append(tokenize(user.Name), tokenize(user.Surname)...)
+}
+
+// tokenize splits s into lower-cased runs of letters and digits.
+func tokenize(s string) []token {
+	var res []token
+	var sb strings.Builder
+	start := -1
+	i := 0
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			sb.WriteRune(unicode.ToLower(r))
+		} else if start >= 0 {
+			res = append(res, token{term: sb.String(), start: start, end: i})
+			sb.Reset()
+			start = -1
+		}
+		i++
+	}
+	if start >= 0 {
+		res = append(res, token{term: sb.String(), start: start, end: i})
+	}
+	return res
+}
+
+// fuzziness is the edit distance tolerated for a query token of n runes.
+func fuzziness(n int) int {
+	switch {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the Levenshtein distance between a and b, or maxDist+1
+// as soon as it is known to exceed maxDist.
+func editDistance(a, b string, maxDist int) int {
+	ar, br := []rune(a), []rune(b)
+	if abs(len(ar)-len(br)) > maxDist {
+		return maxDist + 1
+	}
+
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > maxDist {
+			return maxDist + 1
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(br)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
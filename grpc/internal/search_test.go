@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestSearchRanksExactThenPrefixThenTypo(t *testing.T) {
+	s := newSearchService(t, "alice", "alicia", "alise", "bob")
+
+	hits := s.Search(AnyTenant, "alice", 0)
+	if got := hitNames(hits); !slices.Equal(got, []string{"alice", "alise"}) {
+		t.Fatalf("hits for alice = %v, want [alice alise]", got)
+	}
+	if hits[0].Score != scoreExact || hits[1].Score != scoreFuzzy {
+		t.Fatalf("scores = %v, %v, want %v and %v", hits[0].Score, hits[1].Score, scoreExact, scoreFuzzy)
+	}
+
+	hits = s.Search(AnyTenant, "ali", 0)
+	if got := hitNames(hits); !slices.Equal(got, []string{"alice", "alicia", "alise"}) {
+		t.Fatalf("hits for the prefix ali = %v, want [alice alicia alise]", got)
+	}
+	for _, h := range hits {
+		if h.Score != scorePrefix {
+			t.Fatalf("score of prefix hit %s = %v, want %v", h.User.Name, h.Score, scorePrefix)
+		}
+	}
+}
+
+func TestSearchMatchesEveryToken(t *testing.T) {
+	s := NewUserService()
+	for _, u := range []User{
+		{Name: "alice", Surname: "smith"},
+		{Name: "alice", Surname: "jones", Tenant: "other"},
+		{Name: "bob", Surname: "smith"},
+	} {
+		if _, err := s.Create(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := hitNames(s.Search(AnyTenant, "Alice SMITH", 0)); !slices.Equal(got, []string{"alice"}) {
+		t.Fatalf("hits for alice smith = %v, want [alice]", got)
+	}
+	if got := hitNames(s.Search(DefaultTenant, "alice", 0)); !slices.Equal(got, []string{"alice"}) {
+		t.Fatalf("hits for alice in %s = %v, want only its alice", DefaultTenant, got)
+	}
+}
+
+func TestSearchTypos(t *testing.T) {
+	s := newSearchService(t, "bob", "jonathan", "alexander")
+
+	for query, want := range map[string][]string{
+		// Too short to tolerate a typo.
+		"rob": nil,
+		// One edit within four to seven runes.
+		"jonatan": {"jonathan"},
+		// Two edits from eight runes on.
+		"alexandre": {"alexander"},
+		"jonathon":  {"jonathan"},
+		"alxndr":    nil,
+	} {
+		if got := hitNames(s.Search(AnyTenant, query, 0)); !slices.Equal(got, want) {
+			t.Errorf("hits for %q = %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestSearchHighlights(t *testing.T) {
+	s := NewUserService()
+	if _, err := s.Create(User{Name: "Zoë Ann", Surname: "O'Brien"}); err != nil {
+		t.Fatal(err)
+	}
+
+	hits := s.Search(AnyTenant, "zo brien", 0)
+	if len(hits) != 1 {
+		t.Fatalf("hits = %v, want one", hitNames(hits))
+	}
+	want := []Highlight{
+		// Rune offsets, and only the prefix that matched.
+		{Field: FieldName, Start: 0, End: 2},
+		{Field: FieldSurname, Start: 2, End: 7},
+	}
+	if !slices.Equal(hits[0].Highlights, want) {
+		t.Fatalf("highlights = %v, want %v", hits[0].Highlights, want)
+	}
+}
+
+func TestSearchForgetsRemovedTerms(t *testing.T) {
+	s := newSearchService(t, "alice", "alicia")
+	for _, u := range s.List(AnyTenant) {
+		if u.Name == "alice" {
+			if err := s.Delete(AnyTenant, u.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if got := hitNames(s.Search(AnyTenant, "ali", 0)); !slices.Equal(got, []string{"alicia"}) {
+		t.Fatalf("hits after deleting alice = %v, want [alicia]", got)
+	}
+	if s.search.terms.find("alice") != nil {
+		t.Fatal("the trie kept the nodes of a removed term")
+	}
+	for _, g := range bigrams("alice") {
+		if _, ok := s.search.grams[g]["alice"]; ok {
+			t.Fatalf("bigram %q still points at alice", g)
+		}
+	}
+}
+
+func TestSearchFuzzyCandidatesAreComplete(t *testing.T) {
+	idx := newSearchIndex()
+	var terms []string
+	for i := 0; i < 500; i++ {
+		term := fmt.Sprintf("user%dname", i*7919%1000)
+		terms = append(terms, term)
+		idx.add(User{ID: term, Name: term})
+	}
+
+	for _, q := range []string{"user42name", "usr421nam", "user9name", "name"} {
+		maxDist := fuzziness(len([]rune(q)))
+		candidates := idx.fuzzyCandidates(q, maxDist)
+		for _, term := range terms {
+			if editDistance(q, term, maxDist) > maxDist {
+				continue
+			}
+			if _, ok := candidates[term]; !ok {
+				t.Errorf("%s is within %d edits of %s but not a candidate", term, maxDist, q)
+			}
+		}
+	}
+}
+
+func newSearchService(t *testing.T, names ...string) *UserService {
+	t.Helper()
+
+	s := NewUserService()
+	for _, name := range names {
+		if _, err := s.Create(User{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func hitNames(hits []SearchHit) []string {
+	var res []string
+	for _, h := range hits {
+		res = append(res, h.User.Name)
+	}
+	return res
+}
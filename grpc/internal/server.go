@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -14,9 +16,18 @@ import (
 	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
 )
 
+const (
+	// allTenants is the ListUsers tenant value that asks for every tenant.
+	allTenants = "*"
+	// watchBatchSize caps the changes sent in one WatchUsers message.
+	watchBatchSize = 500
+)
+
 type (
 	UserGRPCServer struct {
 		userService *UserService
+		// verifier is nil when email verification is not configured.
+		verifier *EmailVerifier
 		pb.UnimplementedUserServiceServer
 	}
 )
@@ -25,87 +36,419 @@ func NewUserGRPCService(userService *UserService) *UserGRPCServer {
 	return &UserGRPCServer{userService: userService}
 }
 
-func (s *UserGRPCServer) CreateUser(_ context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
-	now := time.Now()
+// SetEmailVerifier makes CreateUser send a verification token to new
+// addresses and enables SendEmailVerification and VerifyEmail.
+func (s *UserGRPCServer) SetEmailVerifier(v *EmailVerifier) {
+	s.verifier = v
+}
 
-	user := User{
-		Name:      req.User.Name,
-		Surname:   req.User.Surname,
-		Age:       int(req.User.Age),
-		CreatedAt: now,
-		UpdatedAt: now,
+func (s *UserGRPCServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	res, err := s.userService.Create(user)
-	if err != nil {
-		if errors.Is(err, ErrUserAlreadyExists) {
+	if req.User == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "user is required")
+	}
+
+	tenant := p.Tenant
+	if req.User.Tenant != "" && req.User.Tenant != p.Tenant {
+		if !p.HasRole(RoleAdmin) {
 			return nil, status.Errorf(
-				codes.AlreadyExists,
-				fmt.Sprintf("user already exists: %s", user.Name),
+				codes.PermissionDenied,
+				fmt.Sprintf("cannot create users in tenant %s", req.User.Tenant),
 			)
 		}
+		tenant = req.User.Tenant
+	}
 
-		return nil, status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("create user: %v", err),
-		)
+	now := s.userService.Now()
+
+	user := fromProtoUser(req.User)
+	user.ID, user.Tenant = "", tenant
+	user.CreatedAt, user.UpdatedAt = now, now
+	user.Disabled, user.ModifiedRevision = false, 0
+
+	res, err := s.userService.Create(*user)
+	if err != nil {
+		return nil, serviceError("create user", err)
+	}
+	sent := s.verifier.sendCreated(ctx, res)
+
+	return &pb.CreateUserResponse{User: toProtoUser(res, s.userService.Now()), VerificationSent: sent}, nil
+}
+
+func (s *UserGRPCServer) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userService.Get(p.TenantScope(), req.Id)
+	if err != nil {
+		return nil, serviceError("get user", err)
 	}
 
-	return &pb.CreateUserResponse{
-		User: &pb.User{
-			Id:        &res.ID,
-			Name:      res.Name,
-			Surname:   res.Surname,
-			Age:       int32(user.Age),
-			CreatedAt: &tpb.Timestamp{Seconds: res.CreatedAt.Unix()},
-			UpdatedAt: &tpb.Timestamp{Seconds: res.UpdatedAt.Unix()},
-			Disabled:  res.Disabled,
-		}}, nil
+	return &pb.GetUserResponse{User: toProtoUser(user, s.userService.Now())}, nil
 }
 
-func (s *UserGRPCServer) GetUser(_ context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
-	user, err := s.userService.Get(req.Id)
+func (s *UserGRPCServer) GetUserByEmail(ctx context.Context, req *pb.GetUserByEmailRequest) (*pb.GetUserByEmailResponse, error) {
+	p, err := principal(ctx)
 	if err != nil {
-		if errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	tenant := p.Tenant
+	if req.Tenant != "" && req.Tenant != p.Tenant {
+		if !p.HasRole(RoleAdmin) {
 			return nil, status.Errorf(
-				codes.NotFound,
-				fmt.Sprintf("user not found: %s", req.Id),
+				codes.PermissionDenied,
+				fmt.Sprintf("cannot look up users of tenant %s", req.Tenant),
 			)
 		}
-		return nil, status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("get user: %v", err),
-		)
+		tenant = req.Tenant
 	}
 
-	return &pb.GetUserResponse{
-		User: &pb.User{
-			Id:        &user.ID,
-			Name:      user.Name,
-			Surname:   user.Surname,
-			Age:       int32(user.Age),
-			CreatedAt: &tpb.Timestamp{Seconds: user.CreatedAt.Unix()},
-			UpdatedAt: &tpb.Timestamp{Seconds: user.UpdatedAt.Unix()},
-			Disabled:  user.Disabled,
-		},
-	}, nil
+	user, err := s.userService.GetByEmail(tenant, req.Email)
+	if err != nil {
+		return nil, serviceError("get user by email", err)
+	}
+
+	return &pb.GetUserByEmailResponse{User: toProtoUser(user, s.userService.Now())}, nil
 }
 
-func (s *UserGRPCServer) DeleteUser(_ context.Context, req *pb.DeleteUserRequest) (*emptypb.Empty, error) {
-	err := s.userService.Delete(req.Id)
+func (s *UserGRPCServer) SendEmailVerification(ctx context.Context, req *pb.SendEmailVerificationRequest) (*emptypb.Empty, error) {
+	p, err := principal(ctx)
 	if err != nil {
-		if errors.Is(err, ErrUserNotFound) {
-			return nil, status.Errorf(
-				codes.NotFound,
-				fmt.Sprintf("user not found: %s", req.Id),
-			)
+		return nil, err
+	}
+	if s.verifier == nil {
+		return nil, serviceError("send email verification", ErrVerificationDisabled)
+	}
+	if req.Id != p.UserID && !p.HasRole(RoleAdmin) {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot verify the email of another user")
+	}
 
+	user, err := s.userService.Get(p.TenantScope(), req.Id)
+	if err != nil {
+		return nil, serviceError("send email verification", err)
+	}
+	if err = s.verifier.Send(ctx, user); err != nil {
+		return nil, serviceError("send email verification", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *UserGRPCServer) VerifyEmail(_ context.Context, req *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+	if s.verifier == nil {
+		return nil, serviceError("verify email", ErrVerificationDisabled)
+	}
+
+	user, err := s.verifier.Verify(req.Token)
+	if err != nil {
+		return nil, serviceError("verify email", err)
+	}
+
+	return &pb.VerifyEmailResponse{User: toProtoUser(user, s.userService.Now())}, nil
+}
+
+func (s *UserGRPCServer) BatchGetUsers(ctx context.Context, req *pb.BatchGetUsersRequest) (*pb.BatchGetUsersResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users, missing, err := s.userService.BatchGet(p.TenantScope(), req.Ids)
+	if err != nil {
+		return nil, serviceError("batch get users", err)
+	}
+
+	res := &pb.BatchGetUsersResponse{
+		Users:      make([]*pb.User, 0, len(users)),
+		MissingIds: missing,
+	}
+	now := s.userService.Now()
+	for i := range users {
+		res.Users = append(res.Users, toProtoUser(&users[i], now))
+	}
+
+	return res, nil
+}
+
+func (s *UserGRPCServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scope, err := listScope(p, req.Tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	users := s.userService.List(scope)
+	res := &pb.ListUsersResponse{Users: make([]*pb.User, 0, len(users))}
+	now := s.userService.Now()
+	for i := range users {
+		res.Users = append(res.Users, toProtoUser(&users[i], now))
+	}
+
+	return res, nil
+}
+
+func (s *UserGRPCServer) SelectUsers(ctx context.Context, req *pb.SelectUsersRequest) (*pb.SelectUsersResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sel, err := ParseSelector(req.Selector)
+	if err != nil {
+		return nil, serviceError("select users", err)
+	}
+
+	users := s.userService.Select(p.TenantScope(), sel)
+	res := &pb.SelectUsersResponse{Users: make([]*pb.User, 0, len(users))}
+	now := s.userService.Now()
+	for i := range users {
+		res.Users = append(res.Users, toProtoUser(&users[i], now))
+	}
+
+	return res, nil
+}
+
+func (s *UserGRPCServer) SearchUsers(ctx context.Context, req *pb.SearchUsersRequest) (*pb.SearchUsersResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := s.userService.Search(p.TenantScope(), req.Query, int(req.Limit))
+	res := &pb.SearchUsersResponse{Hits: make([]*pb.SearchHit, 0, len(hits))}
+	now := s.userService.Now()
+	for i := range hits {
+		hit := &pb.SearchHit{
+			User:       toProtoUser(&hits[i].User, now),
+			Score:      hits[i].Score,
+			Highlights: make([]*pb.Highlight, 0, len(hits[i].Highlights)),
 		}
-		return nil, status.Errorf(
-			codes.Internal,
-			fmt.Sprintf("delete user: %v", err),
-		)
+		for _, h := range hits[i].Highlights {
+			hit.Highlights = append(hit.Highlights, &pb.Highlight{
+				Field: h.Field,
+				Start: int32(h.Start),
+				End:   int32(h.End),
+			})
+		}
+		res.Hits = append(res.Hits, hit)
+	}
+
+	return res, nil
+}
+
+// SyncUsers returns the changes since req.SinceRevision, or the full state
+// when that revision is no longer covered by the retained history.
+func (s *UserGRPCServer) SyncUsers(ctx context.Context, req *pb.SyncUsersRequest) (*pb.SyncUsersResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.sync(p.TenantScope(), req.SinceRevision, int(req.Limit)), nil
+}
+
+// WatchUsers sends the changes after req.SinceRevision and then every further
+// change until the client goes away.
+func (s *UserGRPCServer) WatchUsers(req *pb.WatchUsersRequest, stream pb.UserService_WatchUsersServer) error {
+	p, err := principal(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	since := req.SinceRevision
+	if since == 0 {
+		since = s.userService.Revision()
+		if err = stream.Send(&pb.SyncUsersResponse{Revision: since}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		// Taken before reading so that no change slips in between.
+		changed := s.userService.Changed()
+
+		res := s.sync(p.TenantScope(), since, watchBatchSize)
+		if res.FullResync || len(res.Users) > 0 || len(res.Tombstones) > 0 {
+			if err = stream.Send(res); err != nil {
+				return err
+			}
+		}
+		since = res.Revision
+		if res.HasMore {
+			continue
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// sync returns the changes in scope after since, or every user in scope
+// flagged as a full resync when since is outside the retained history.
+func (s *UserGRPCServer) sync(scope string, since uint64, limit int) *pb.SyncUsersResponse {
+	res := &pb.SyncUsersResponse{}
+	changes, err := s.userService.Sync(scope, since, limit)
+	if errors.Is(err, ErrResyncRequired) {
+		changes = s.userService.FullSync(scope)
+		res.FullResync = true
+	}
+
+	res.Revision = changes.Revision
+	res.HasMore = changes.HasMore
+	res.Users = make([]*pb.User, 0, len(changes.Users))
+	now := s.userService.Now()
+	for i := range changes.Users {
+		res.Users = append(res.Users, toProtoUser(&changes.Users[i], now))
+	}
+	res.Tombstones = make([]*pb.Tombstone, 0, len(changes.Tombstones))
+	for _, t := range changes.Tombstones {
+		res.Tombstones = append(res.Tombstones, &pb.Tombstone{Id: t.ID, Revision: t.Revision})
+	}
+
+	return res
+}
+
+func (s *UserGRPCServer) ListTransitions(ctx context.Context, req *pb.ListTransitionsRequest) (*pb.ListTransitionsResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var before time.Time
+	if req.Before != nil {
+		before = req.Before.AsTime()
+	}
+
+	transitions := s.userService.Transitions(p.TenantScope(), before)
+	res := &pb.ListTransitionsResponse{Transitions: make([]*pb.Transition, 0, len(transitions))}
+	for _, t := range transitions {
+		res.Transitions = append(res.Transitions, &pb.Transition{
+			UserId: t.UserID,
+			Tenant: t.Tenant,
+			Kind:   t.Kind,
+			At:     tpb.New(t.At),
+		})
+	}
+
+	return res, nil
+}
+
+func (s *UserGRPCServer) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*emptypb.Empty, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.userService.Delete(p.TenantScope(), req.Id); err != nil {
+		return nil, serviceError("delete user", err)
 	}
 
 	return &emptypb.Empty{}, nil
 }
+
+// RecoverInterceptor turns a panicking handler into an Internal error instead
+// of a crashed server.
+func RecoverInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("panic:", r)
+			err = status.Errorf(codes.Internal, "panic: %v", r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// RecoverStreamInterceptor is RecoverInterceptor for streams.
+func RecoverStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("panic:", r)
+			err = status.Errorf(codes.Internal, "panic: %v", r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// listScope is the scope of a ListUsers call for tenant, which defaults to
+// the caller's own.
+func listScope(p *Principal, tenant string) (string, error) {
+	if tenant == "" || tenant == p.Tenant {
+		return p.Tenant, nil
+	}
+	if !p.HasRole(RoleAdmin) {
+		return "", status.Errorf(
+			codes.PermissionDenied,
+			fmt.Sprintf("cannot list users of tenant %s", tenant),
+		)
+	}
+	if tenant == allTenants {
+		return AnyTenant, nil
+	}
+	return tenant, nil
+}
+
+func principal(ctx context.Context) (*Principal, error) {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "missing principal")
+	}
+	return p, nil
+}
+
+// serviceError maps UserService errors to gRPC statuses.
+func serviceError(op string, err error) error {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrUserAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrTooManyIDs):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrCrossTenant):
+		// Indistinguishable from a missing user, so that IDs of other
+		// tenants cannot be probed.
+		msg := strings.Replace(err.Error(), ErrCrossTenant.Error(), ErrUserNotFound.Error(), 1)
+		return status.Error(codes.NotFound, msg)
+	case errors.Is(err, ErrQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrInvalidCredentials):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrWeakPassword), errors.Is(err, ErrInvalidLabel), errors.Is(err, ErrInvalidSelector):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrEmailTaken):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrInvalidEmail), errors.Is(err, ErrInvalidToken), errors.Is(err, ErrTokenRevoked):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrNoEmail), errors.Is(err, ErrEmailAlreadyVerified), errors.Is(err, ErrEmailChanged),
+		errors.Is(err, ErrVerificationDisabled):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrHookRejected):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrInvalidMFACode):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrMFALocked):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrMFANotEnrolled), errors.Is(err, ErrMFAAlreadyEnabled):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrConcurrentUpdate):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, ErrNoLeader), errors.Is(err, ErrHookFailed):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Errorf(codes.Internal, "%s: %v", op, err)
+	}
+}
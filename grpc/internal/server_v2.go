@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+// deprecatedMethods maps the v1 methods superseded by v2 to their successors.
+var deprecatedMethods = map[string]string{
+	pb.UserService_CreateUser_FullMethodName:    pbv2.UserService_CreateUser_FullMethodName,
+	pb.UserService_GetUser_FullMethodName:       pbv2.UserService_GetUser_FullMethodName,
+	pb.UserService_BatchGetUsers_FullMethodName: pbv2.UserService_BatchGetUsers_FullMethodName,
+	pb.UserService_ListUsers_FullMethodName:     pbv2.UserService_ListUsers_FullMethodName,
+	pb.UserService_DeleteUser_FullMethodName:    pbv2.UserService_DeleteUser_FullMethodName,
+}
+
+// updateFields copies the fields UpdateUser may change, by update mask path,
+// from the request to the stored user.
+var updateFields = map[string]func(dst *User, src User){
+	"name":       func(dst *User, src User) { dst.Name = src.Name },
+	"surname":    func(dst *User, src User) { dst.Surname = src.Surname },
+	"birth_date": func(dst *User, src User) { dst.BirthDate = src.BirthDate },
+	"email":      func(dst *User, src User) { dst.Email = src.Email },
+	"labels":     func(dst *User, src User) { dst.Labels = src.Labels },
+	"expires_at": func(dst *User, src User) { dst.ExpiresAt = src.ExpiresAt },
+	"disable_at": func(dst *User, src User) { dst.DisableAt = src.DisableAt },
+	"disabled":   func(dst *User, src User) { dst.Disabled = src.Disabled },
+}
+
+type (
+	// UserV2GRPCServer serves proto/v2 from the same UserService as
+	// UserGRPCServer.
+	UserV2GRPCServer struct {
+		userService *UserService
+		verifier    *EmailVerifier
+		pbv2.UnimplementedUserServiceServer
+	}
+)
+
+func NewUserV2GRPCService(userService *UserService) *UserV2GRPCServer {
+	return &UserV2GRPCServer{userService: userService}
+}
+
+// SetEmailVerifier makes CreateUser send a verification token to new addresses.
+func (s *UserV2GRPCServer) SetEmailVerifier(v *EmailVerifier) {
+	s.verifier = v
+}
+
+func (s *UserV2GRPCServer) CreateUser(ctx context.Context, req *pbv2.CreateUserRequest) (*pbv2.CreateUserResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.User == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "user is required")
+	}
+	if req.User.Id != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "id is assigned by the server")
+	}
+
+	user, err := FromProtoUserV2(req.User)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if user.Tenant == "" {
+		user.Tenant = p.Tenant
+	}
+	if user.Tenant != p.Tenant && !p.HasRole(RoleAdmin) {
+		return nil, status.Errorf(
+			codes.PermissionDenied,
+			fmt.Sprintf("cannot create users in tenant %s", user.Tenant),
+		)
+	}
+
+	now := s.userService.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+	user.Disabled, user.ModifiedRevision = false, 0
+
+	res, err := s.userService.Create(user)
+	if err != nil {
+		return nil, serviceError("create user", err)
+	}
+	sent := s.verifier.sendCreated(ctx, res)
+
+	return &pbv2.CreateUserResponse{User: ToProtoUserV2(res), VerificationSent: sent}, nil
+}
+
+func (s *UserV2GRPCServer) GetUser(ctx context.Context, req *pbv2.GetUserRequest) (*pbv2.GetUserResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "id is required")
+	}
+
+	user, err := s.userService.Get(p.TenantScope(), req.Id)
+	if err != nil {
+		return nil, serviceError("get user", err)
+	}
+
+	return &pbv2.GetUserResponse{User: ToProtoUserV2(user)}, nil
+}
+
+func (s *UserV2GRPCServer) BatchGetUsers(ctx context.Context, req *pbv2.BatchGetUsersRequest) (*pbv2.BatchGetUsersResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users, missing, err := s.userService.BatchGet(p.TenantScope(), req.Ids)
+	if err != nil {
+		return nil, serviceError("batch get users", err)
+	}
+
+	res := &pbv2.BatchGetUsersResponse{
+		Users:      make([]*pbv2.User, 0, len(users)),
+		MissingIds: missing,
+	}
+	for i := range users {
+		res.Users = append(res.Users, ToProtoUserV2(&users[i]))
+	}
+
+	return res, nil
+}
+
+func (s *UserV2GRPCServer) ListUsers(ctx context.Context, req *pbv2.ListUsersRequest) (*pbv2.ListUsersResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scope, err := listScope(p, req.Tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	users := s.userService.List(scope)
+	res := &pbv2.ListUsersResponse{Users: make([]*pbv2.User, 0, len(users))}
+	for i := range users {
+		res.Users = append(res.Users, ToProtoUserV2(&users[i]))
+	}
+
+	return res, nil
+}
+
+func (s *UserV2GRPCServer) UpdateUser(ctx context.Context, req *pbv2.UpdateUserRequest) (*pbv2.UpdateUserResponse, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.User.GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "user.id is required")
+	}
+	paths := req.UpdateMask.GetPaths()
+	if len(paths) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "update_mask is required")
+	}
+	for _, path := range paths {
+		if _, ok := updateFields[path]; !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "field %q cannot be updated", path)
+		}
+	}
+	src, err := FromProtoUserV2(req.User)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	for {
+		user, err := s.userService.Get(p.TenantScope(), src.ID)
+		if err != nil {
+			return nil, serviceError("update user", err)
+		}
+		for _, path := range paths {
+			updateFields[path](user, src)
+		}
+		if src.ModifiedRevision != 0 {
+			user.ModifiedRevision = src.ModifiedRevision
+		}
+
+		res, err := s.userService.Update(p.TenantScope(), *user)
+		// Without a revision from the caller, a concurrent change is merged
+		// instead of overwritten.
+		if errors.Is(err, ErrConcurrentUpdate) && src.ModifiedRevision == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, serviceError("update user", err)
+		}
+
+		return &pbv2.UpdateUserResponse{User: ToProtoUserV2(res)}, nil
+	}
+}
+
+func (s *UserV2GRPCServer) DeleteUser(ctx context.Context, req *pbv2.DeleteUserRequest) (*emptypb.Empty, error) {
+	p, err := principal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Id == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "id is required")
+	}
+
+	if err = s.userService.Delete(p.TenantScope(), req.Id); err != nil {
+		return nil, serviceError("delete user", err)
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// DeprecationInterceptor adds Deprecation and Warning headers to the
+// responses of v1 methods that v2 supersedes.
+func DeprecationInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if successor, ok := deprecatedMethods[info.FullMethod]; ok {
+		_ = grpc.SetHeader(ctx, metadata.Pairs(
+			"deprecation", "true",
+			"warning", fmt.Sprintf(`299 - "%s is deprecated, use %s"`, info.FullMethod, successor),
+		))
+	}
+	return handler(ctx, req)
+}
+
+// AgeAt is the user's age in whole years at now, from BirthDate when known
+// and the v1 age otherwise.
+func (u User) AgeAt(now time.Time) int {
+	if u.BirthDate.IsZero() {
+		return u.Age
+	}
+	now = now.UTC()
+	age := now.Year() - u.BirthDate.Year()
+	if now.Month() < u.BirthDate.Month() || now.Month() == u.BirthDate.Month() && now.Day() < u.BirthDate.Day() {
+		age--
+	}
+	return max(age, 0)
+}
@@ -0,0 +1,146 @@
+package internal_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/Roma7-7-7/sandbox/grpc/internal/testserver"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+func TestUpdateUserChangesMaskedFieldsOnly(t *testing.T) {
+	now := contractNow
+	srv := testserver.Start(t, testserver.WithClock(func() time.Time { return now }))
+	v2 := pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{Name: "alice", Surname: "smith"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Hour)
+	disableAt := now.Add(24 * time.Hour)
+	updated, err := v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{
+		User: &pbv2.User{
+			Id:        created.User.Id,
+			Surname:   "ignored",
+			Labels:    map[string]string{"team": "ops"},
+			DisableAt: timestamppb.New(disableAt),
+			CreatedAt: timestamppb.New(now),
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"labels", "disable_at"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := updated.User
+	if got.Name != "alice" || got.Surname != "smith" {
+		t.Errorf("name %q surname %q, want the unmasked alice smith", got.Name, got.Surname)
+	}
+	if got.Labels["team"] != "ops" || !got.DisableAt.AsTime().Equal(disableAt) {
+		t.Errorf("labels %v disable_at %v, want team=ops and %v", got.Labels, got.DisableAt.AsTime(), disableAt)
+	}
+	if !got.CreatedAt.AsTime().Equal(contractNow) || !got.UpdatedAt.AsTime().Equal(now) {
+		t.Errorf("created %v updated %v, want %v and %v", got.CreatedAt.AsTime(), got.UpdatedAt.AsTime(), contractNow, now)
+	}
+	if got.ModifiedRevision <= created.User.ModifiedRevision {
+		t.Errorf("modified_revision %d, want above %d", got.ModifiedRevision, created.User.ModifiedRevision)
+	}
+}
+
+func TestUpdateUserRejectsStaleRevision(t *testing.T) {
+	srv := testserver.Start(t)
+	v2 := pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{Name: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"surname"}}
+	user := &pbv2.User{Id: created.User.Id, Surname: "smith", ModifiedRevision: created.User.ModifiedRevision}
+	if _, err = v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{User: user, UpdateMask: mask}); err != nil {
+		t.Fatal(err)
+	}
+
+	user.Surname = "jones"
+	if _, err = v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{User: user, UpdateMask: mask}); status.Code(err) != codes.Aborted {
+		t.Fatalf("update from a stale revision: %v, want %v", err, codes.Aborted)
+	}
+}
+
+func TestUpdateUserRejectsInvalidMasks(t *testing.T) {
+	srv := testserver.Start(t)
+	v2 := pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{Name: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, paths := range map[string][]string{
+		"empty":      nil,
+		"unknown":    {"nickname"},
+		"tenant":     {"tenant"},
+		"created_at": {"name", "created_at"},
+		"verified":   {"email_verified"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{
+				User:       &pbv2.User{Id: created.User.Id, Name: "mallory", Tenant: "other"},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: paths},
+			})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("update of %v: %v, want %v", paths, err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestUpdateUserSchedulesDisable(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithClock(func() time.Time { return contractNow }))
+	v2 := pbv2.NewUserServiceClient(srv.Conn())
+	ctx := context.Background()
+
+	created, err := v2.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{Name: "contractor"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disableAt := contractNow.Add(24 * time.Hour)
+	if _, err = v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{
+		User:       &pbv2.User{Id: created.User.Id, DisableAt: timestamppb.New(disableAt)},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"disable_at"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := srv.Service.ApplyTransitions(disableAt); err != nil || n != 1 {
+		t.Fatalf("apply transitions at %v: %d, %v, want 1 applied", disableAt, n, err)
+	}
+	got, err := v2.GetUser(ctx, &pbv2.GetUserRequest{Id: created.User.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.User.Disabled {
+		t.Fatal("user not disabled by the schedule set through UpdateUser")
+	}
+
+	enabled, err := v2.UpdateUser(ctx, &pbv2.UpdateUserRequest{
+		User:       &pbv2.User{Id: created.User.Id},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"disabled"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled.User.Disabled {
+		t.Fatal("user still disabled after UpdateUser cleared it")
+	}
+}
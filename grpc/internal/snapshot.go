@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type snapshot struct {
+	// Seq is the sequence number of the last mutation the snapshot contains.
+	Seq     uint64    `json:"seq"`
+	TakenAt time.Time `json:"taken_at"`
+	Users   []User    `json:"users"`
+
+	// Revision, Compacted and Tombstones restore the sync history.
+	Revision   uint64      `json:"revision"`
+	Compacted  uint64      `json:"compacted"`
+	Tombstones []Tombstone `json:"tombstones"`
+
+	// Days restores the daily creations and deletions, which include users
+	// no longer in the store.
+	Days []TenantDayStats `json:"days,omitempty"`
+}
+
+// writeSnapshot atomically replaces the snapshot at path: it is written to a
+// temporary file, fsynced and renamed over the previous one.
+func writeSnapshot(path string, snap snapshot) error {
+	return writeJSONFile(path, "snapshot", snap)
+}
+
+// writeJSONFile replaces the file at path with v as JSON, atomically and
+// durably. what names the file in errors.
+func writeJSONFile(path, what string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", what, err)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", what, err)
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write %s: %w", what, err)
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("sync %s: %w", what, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", what, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename %s: %w", what, err)
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("open %s dir: %w", what, err)
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// readSnapshot loads the snapshot at path. A missing file is an empty snapshot.
+func readSnapshot(path string) (snapshot, error) {
+	var snap snapshot
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return snap, nil
+		}
+		return snap, fmt.Errorf("read snapshot: %w", err)
+	}
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return snap, fmt.Errorf("unmarshal snapshot: %w", err)
+	}
+
+	return snap, nil
+}
@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultStatsDays is how many days of creations and deletions Stats
+	// returns by default.
+	DefaultStatsDays = 30
+	// MaxStatsDays is how many days of creations and deletions are kept.
+	MaxStatsDays = 366
+
+	// ageBucketWidth and ageBuckets shape the age histogram: 0-9, 10-19, ...
+	// and a last bucket for everyone older.
+	ageBucketWidth = 10
+	ageBuckets     = 11
+
+	day = 24 * time.Hour
+)
+
+type (
+	UserStats struct {
+		Total    int
+		Disabled int
+		Ages     []AgeBucket
+		// Days are in chronological order, including days without changes.
+		Days []DayStats
+	}
+
+	AgeBucket struct {
+		Min int
+		// Max is inclusive, or 0 for the last, unbounded bucket.
+		Max   int
+		Count int
+	}
+
+	DayStats struct {
+		// Day is the start of the UTC day.
+		Day     time.Time `json:"day"`
+		Created int       `json:"created"`
+		Deleted int       `json:"deleted"`
+	}
+
+	// TenantDayStats are the DayStats of a tenant, as kept in snapshots.
+	TenantDayStats struct {
+		Tenant string `json:"tenant"`
+		DayStats
+	}
+
+	// userStats are the figures of a tenant, updated as mutations are applied.
+	userStats struct {
+		users    int
+		disabled int
+		// ages counts the users without a birth date by age. births counts the
+		// others by birth date, since their age changes over time.
+		ages   map[int]int
+		births map[time.Time]int
+		days   map[time.Time]*DayStats
+	}
+)
+
+func newUserStats() *userStats {
+	return &userStats{
+		ages:   make(map[int]int),
+		births: make(map[time.Time]int),
+		days:   make(map[time.Time]*DayStats),
+	}
+}
+
+// Stats returns the figures of the users in scope, with the creations and
+// deletions of the last days up to now.
+func (s *UserService) Stats(scope string, now time.Time, days int) UserStats {
+	if days <= 0 {
+		days = DefaultStatsDays
+	}
+	days = min(days, MaxStatsDays)
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var tenants []*userStats
+	if scope == AnyTenant {
+		for _, ts := range s.stats {
+			tenants = append(tenants, ts)
+		}
+	} else if ts, ok := s.stats[scope]; ok {
+		tenants = append(tenants, ts)
+	}
+
+	res := UserStats{Ages: make([]AgeBucket, ageBuckets)}
+	for i := range res.Ages {
+		res.Ages[i].Min = i * ageBucketWidth
+		if i < ageBuckets-1 {
+			res.Ages[i].Max = res.Ages[i].Min + ageBucketWidth - 1
+		}
+	}
+	today := now.UTC().Truncate(day)
+	first := today.AddDate(0, 0, 1-days)
+	res.Days = make([]DayStats, days)
+	for i := range res.Days {
+		res.Days[i].Day = first.AddDate(0, 0, i)
+	}
+
+	for _, ts := range tenants {
+		res.Total += ts.users
+		res.Disabled += ts.disabled
+		for age, n := range ts.ages {
+			res.Ages[ageBucket(age)].Count += n
+		}
+		for birth, n := range ts.births {
+			res.Ages[ageBucket(User{BirthDate: birth}.AgeAt(now))].Count += n
+		}
+		for d, counts := range ts.days {
+			if i := int(d.Sub(first) / day); !d.Before(first) && i < days {
+				res.Days[i].Created += counts.Created
+				res.Days[i].Deleted += counts.Deleted
+			}
+		}
+	}
+
+	return res
+}
+
+func ageBucket(age int) int {
+	return min(max(age, 0)/ageBucketWidth, ageBuckets-1)
+}
+
+// tenantStats returns the figures of tenant. The caller must hold the write
+// lock.
+func (s *UserService) tenantStats(tenant string) *userStats {
+	ts, ok := s.stats[tenant]
+	if !ok {
+		ts = newUserStats()
+		s.stats[tenant] = ts
+	}
+	return ts
+}
+
+// countUser adds user to the figures of its tenant, or removes it when delta
+// is -1. The caller must hold the write lock.
+func (s *UserService) countUser(user User, delta int) {
+	ts := s.tenantStats(user.Tenant)
+	ts.users += delta
+	if user.Disabled {
+		ts.disabled += delta
+	}
+	if user.BirthDate.IsZero() {
+		if ts.ages[user.Age] += delta; ts.ages[user.Age] == 0 {
+			delete(ts.ages, user.Age)
+		}
+	} else {
+		if ts.births[user.BirthDate] += delta; ts.births[user.BirthDate] == 0 {
+			delete(ts.births, user.BirthDate)
+		}
+	}
+}
+
+// countDay records a creation or deletion in tenant at t. Unknown times are
+// not counted. The caller must hold the write lock.
+func (s *UserService) countDay(tenant string, t time.Time, deleted bool) {
+	if t.IsZero() {
+		return
+	}
+	d := t.UTC().Truncate(day)
+	ts := s.tenantStats(tenant)
+	counts, ok := ts.days[d]
+	if !ok {
+		counts = &DayStats{Day: d}
+		ts.days[d] = counts
+		for old := range ts.days {
+			if d.Sub(old) >= MaxStatsDays*day {
+				delete(ts.days, old)
+			}
+		}
+	}
+	if deleted {
+		counts.Deleted++
+	} else {
+		counts.Created++
+	}
+}
+
+// dayStats returns the daily figures of every tenant for a snapshot. The
+// caller must hold the lock.
+func (s *UserService) dayStats() []TenantDayStats {
+	var res []TenantDayStats
+	for tenant, ts := range s.stats {
+		for _, counts := range ts.days {
+			res = append(res, TenantDayStats{Tenant: tenant, DayStats: *counts})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Tenant != res[j].Tenant {
+			return res[i].Tenant < res[j].Tenant
+		}
+		return res[i].Day.Before(res[j].Day)
+	})
+	return res
+}
+
+// restoreDayStats replaces the daily figures with those of a snapshot. The
+// caller must hold the write lock.
+func (s *UserService) restoreDayStats(days []TenantDayStats) {
+	for _, ts := range s.stats {
+		clear(ts.days)
+	}
+	for _, d := range days {
+		counts := d.DayStats
+		s.tenantStats(d.Tenant).days[counts.Day] = &counts
+	}
+}
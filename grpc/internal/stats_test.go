@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsMatchRecount(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	s := NewUserService()
+	s.SetClock(func() time.Time { return now })
+	r := rand.New(rand.NewSource(1))
+
+	// The days of every creation and deletion, per tenant.
+	days := make(map[string]map[time.Time]*DayStats)
+	count := func(tenant string, deleted bool) {
+		if days[tenant] == nil {
+			days[tenant] = make(map[time.Time]*DayStats)
+		}
+		d := now.Truncate(day)
+		if days[tenant][d] == nil {
+			days[tenant][d] = &DayStats{Day: d}
+		}
+		if deleted {
+			days[tenant][d].Deleted++
+		} else {
+			days[tenant][d].Created++
+		}
+	}
+
+	for i := range 500 {
+		now = now.Add(time.Duration(r.Intn(12)) * time.Hour)
+		users := s.List(AnyTenant)
+		switch op := r.Intn(4); {
+		case op == 0 && len(users) > 0:
+			u := users[r.Intn(len(users))]
+			if err := s.Delete(AnyTenant, u.ID); err != nil {
+				t.Fatal(err)
+			}
+			count(u.Tenant, true)
+		case op == 1 && len(users) > 0:
+			u := users[r.Intn(len(users))]
+			randomizeStats(r, &u)
+			if _, err := s.Update(AnyTenant, u); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			// Set by the servers, not by the store.
+			u := User{Name: fmt.Sprintf("user%d", i), Tenant: []string{DefaultTenant, "other"}[r.Intn(2)], CreatedAt: now}
+			randomizeStats(r, &u)
+			if _, err := s.Create(u); err != nil {
+				t.Fatal(err)
+			}
+			count(u.Tenant, false)
+		}
+	}
+
+	// Also later, once users with a birth date have aged and the days have
+	// left the window.
+	for _, at := range []time.Time{now, now.AddDate(5, 0, 0)} {
+		for _, scope := range []string{AnyTenant, DefaultTenant, "other", "none"} {
+			got := s.Stats(scope, at, MaxStatsDays)
+			want := recountStats(s.List(scope), days, scope, at, MaxStatsDays)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("stats of %q at %v:\n got %+v\nwant %+v", scope, at, got, want)
+			}
+		}
+	}
+	created := 0
+	for _, d := range s.Stats(AnyTenant, now, MaxStatsDays).Days {
+		created += d.Created
+	}
+	if created == 0 {
+		t.Fatal("no creation was counted within the window")
+	}
+}
+
+func TestStatsDays(t *testing.T) {
+	now := time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC)
+	s := NewUserService()
+	s.SetClock(func() time.Time { return now })
+	alice := createUser(t, s, User{Name: "alice", CreatedAt: now})
+	now = now.Add(2 * time.Hour)
+	createUser(t, s, User{Name: "bob", CreatedAt: now})
+	if err := s.Delete(AnyTenant, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.Stats(AnyTenant, now, 3)
+	want := []DayStats{
+		{Day: time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)},
+		{Day: time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), Created: 1},
+		{Day: time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), Created: 1, Deleted: 1},
+	}
+	if !reflect.DeepEqual(got.Days, want) {
+		t.Fatalf("days = %+v, want %+v", got.Days, want)
+	}
+	if got = s.Stats(AnyTenant, now, 0); len(got.Days) != DefaultStatsDays {
+		t.Fatalf("%d days by default, want %d", len(got.Days), DefaultStatsDays)
+	}
+}
+
+func TestStatsForgetOldDays(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewUserService()
+	s.SetClock(func() time.Time { return now })
+	createUser(t, s, User{Name: "alice", CreatedAt: now})
+	now = now.Add(MaxStatsDays * day)
+	createUser(t, s, User{Name: "bob", CreatedAt: now})
+
+	if n := len(s.stats[DefaultTenant].days); n != 1 {
+		t.Fatalf("kept %d days, want only the last %d", n, MaxStatsDays)
+	}
+}
+
+func TestDayStatsSurviveRestore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewUserService()
+	s.SetClock(func() time.Time { return now })
+	createUser(t, s, User{Name: "alice", CreatedAt: now})
+	createUser(t, s, User{Name: "bob", Tenant: "other", CreatedAt: now})
+	saved := s.dayStats()
+
+	now = now.Add(day)
+	createUser(t, s, User{Name: "carol", CreatedAt: now})
+	s.restoreDayStats(saved)
+	if got := s.dayStats(); !reflect.DeepEqual(got, saved) {
+		t.Fatalf("days after the restore = %+v, want %+v", got, saved)
+	}
+}
+
+// randomizeStats sets the fields the stats count to random values.
+func randomizeStats(r *rand.Rand, u *User) {
+	u.Disabled = r.Intn(3) == 0
+	u.Age, u.BirthDate = 0, time.Time{}
+	if r.Intn(2) == 0 {
+		u.BirthDate = time.Date(1900+r.Intn(125), time.Month(1+r.Intn(12)), 1+r.Intn(28), 0, 0, 0, 0, time.UTC)
+	} else {
+		u.Age = r.Intn(130)
+	}
+}
+
+// recountStats computes the stats of users from scratch.
+func recountStats(users []User, days map[string]map[time.Time]*DayStats, scope string, now time.Time, n int) UserStats {
+	res := UserStats{Ages: make([]AgeBucket, ageBuckets), Days: make([]DayStats, n)}
+	for i := range res.Ages {
+		res.Ages[i].Min = i * ageBucketWidth
+		if i < ageBuckets-1 {
+			res.Ages[i].Max = res.Ages[i].Min + ageBucketWidth - 1
+		}
+	}
+	for _, u := range users {
+		res.Total++
+		if u.Disabled {
+			res.Disabled++
+		}
+		res.Ages[ageBucket(u.AgeAt(now))].Count++
+	}
+
+	first := now.Truncate(day).AddDate(0, 0, 1-n)
+	for i := range res.Days {
+		d := first.AddDate(0, 0, i)
+		res.Days[i].Day = d
+		for tenant, counts := range days {
+			if c, ok := counts[d]; ok && visible(scope, tenant) {
+				res.Days[i].Created += c.Created
+				res.Days[i].Deleted += c.Deleted
+			}
+		}
+	}
+	return res
+}
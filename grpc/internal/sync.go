@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// DefaultChangelogLimit is the number of changes kept for incremental sync.
+const DefaultChangelogLimit = 10000
+
+var ErrResyncRequired = errors.New("revision is outside the retained history")
+
+type (
+	// Tombstone records the deletion of a user at a revision.
+	Tombstone struct {
+		ID       string `json:"id"`
+		Tenant   string `json:"tenant"`
+		Revision uint64 `json:"rev"`
+	}
+
+	// SyncResult is the set of changes since a revision. Revision is the
+	// high-water mark to pass to the next call.
+	SyncResult struct {
+		Users      []User
+		Tombstones []Tombstone
+		Revision   uint64
+		HasMore    bool
+	}
+
+	changeEntry struct {
+		Revision uint64
+		ID       string
+		Tenant   string
+		Deleted  bool
+	}
+
+	// changelog is the ordered tail of store changes. Changes at or below
+	// compacted have been dropped.
+	changelog struct {
+		entries   []changeEntry
+		compacted uint64
+		limit     int
+	}
+)
+
+func newChangelog(limit int) *changelog {
+	return &changelog{limit: limit}
+}
+
+func (l *changelog) append(e changeEntry) {
+	l.entries = append(l.entries, e)
+	if len(l.entries) > 2*l.limit {
+		drop := len(l.entries) - l.limit
+		l.compacted = l.entries[drop-1].Revision
+		l.entries = append([]changeEntry(nil), l.entries[drop:]...)
+	}
+}
+
+// since returns the changes after rev in revision order.
+func (l *changelog) since(rev uint64) []changeEntry {
+	i := sort.Search(len(l.entries), func(i int) bool {
+		return l.entries[i].Revision > rev
+	})
+	return l.entries[i:]
+}
+
+// tombstones returns the retained deletions, for snapshots.
+func (l *changelog) tombstones() []Tombstone {
+	var res []Tombstone
+	for _, e := range l.entries {
+		if e.Deleted {
+			res = append(res, Tombstone{ID: e.ID, Tenant: e.Tenant, Revision: e.Revision})
+		}
+	}
+	return res
+}
+
+// Revision returns the revision of the latest mutation.
+func (s *UserService) Revision() uint64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return s.revision
+}
+
+// Changed returns a channel that is closed by the next mutation.
+func (s *UserService) Changed() <-chan struct{} {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return s.changed
+}
+
+// Sync returns the users in scope changed after since and the IDs deleted
+// after it, reporting at most limit users and tombstones when limit is
+// positive. Each user is returned in its current state. If since predates the
+// retained history, or is ahead of the current revision as after a restore
+// from an older snapshot, ErrResyncRequired is returned and the caller should
+// fall back to FullSync.
+func (s *UserService) Sync(scope string, since uint64, limit int) (*SyncResult, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	if since < s.changes.compacted {
+		return nil, ErrResyncRequired
+	}
+	if since > s.revision {
+		return nil, fmt.Errorf("%w: %d is ahead of revision %d", ErrResyncRequired, since, s.revision)
+	}
+
+	res := &SyncResult{Revision: s.revision}
+	seen := make(map[string]struct{})
+	for _, e := range s.changes.since(since) {
+		if limit > 0 && len(res.Users)+len(res.Tombstones) >= limit {
+			res.HasMore = true
+			break
+		}
+		res.Revision = e.Revision
+		if _, ok := seen[e.ID]; ok || !visible(scope, e.Tenant) {
+			continue
+		}
+		seen[e.ID] = struct{}{}
+
+		if user, ok := s.store[e.ID]; ok {
+			res.Users = append(res.Users, user)
+		} else {
+			res.Tombstones = append(res.Tombstones, Tombstone{ID: e.ID, Tenant: e.Tenant, Revision: e.Revision})
+		}
+	}
+	if !res.HasMore {
+		res.Revision = s.revision
+	}
+
+	return res, nil
+}
+
+// FullSync returns every user in scope with the revision they reflect.
+func (s *UserService) FullSync(scope string) *SyncResult {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	res := &SyncResult{Revision: s.revision}
+	for _, u := range s.store {
+		if visible(scope, u.Tenant) {
+			res.Users = append(res.Users, u)
+		}
+	}
+	sortByCreation(res.Users)
+
+	return res
+}
+
+// restoreChangelog rebuilds the changelog after loading a snapshot, from the
+// users' modification revisions and the retained tombstones.
+func (s *UserService) restoreChangelog(compacted uint64, tombstones []Tombstone) {
+	entries := make([]changeEntry, 0, len(s.store)+len(tombstones))
+	for _, u := range s.store {
+		if u.ModifiedRevision > compacted {
+			entries = append(entries, changeEntry{Revision: u.ModifiedRevision, ID: u.ID, Tenant: u.Tenant})
+		}
+	}
+	for _, t := range tombstones {
+		if t.Revision > compacted {
+			entries = append(entries, changeEntry{Revision: t.Revision, ID: t.ID, Tenant: t.Tenant, Deleted: true})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Revision < entries[j].Revision
+	})
+
+	s.changes = newChangelog(s.changes.limit)
+	s.changes.compacted = compacted
+	for _, e := range entries {
+		s.changes.append(e)
+	}
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSyncReturnsChangesSinceRevision(t *testing.T) {
+	s := NewUserService()
+	alice := createUser(t, s, User{Name: "alice"})
+	bob := createUser(t, s, User{Name: "bob"})
+	since := s.Revision()
+
+	alice.Surname = "smith"
+	if _, err := s.Update(AnyTenant, *alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(AnyTenant, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	carol := createUser(t, s, User{Name: "carol"})
+
+	res, err := s.Sync(AnyTenant, since, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := syncedIDs(res.Users); !slices.Equal(got, []string{alice.ID, carol.ID}) {
+		t.Fatalf("synced users %v, want %v", got, []string{alice.ID, carol.ID})
+	}
+	if res.Users[0].Surname != "smith" {
+		t.Fatalf("synced %+v, want its current state", res.Users[0])
+	}
+	if len(res.Tombstones) != 1 || res.Tombstones[0].ID != bob.ID {
+		t.Fatalf("tombstones = %+v, want one for %s", res.Tombstones, bob.ID)
+	}
+	if res.Revision != s.Revision() || res.HasMore {
+		t.Fatalf("revision = %d, has more = %v, want %d and no more", res.Revision, res.HasMore, s.Revision())
+	}
+
+	res, err = s.Sync(AnyTenant, res.Revision, 0)
+	if err != nil || len(res.Users) != 0 || len(res.Tombstones) != 0 {
+		t.Fatalf("sync at the latest revision = %+v, %v, want no changes", res, err)
+	}
+}
+
+func TestSyncReportsEachUserOnce(t *testing.T) {
+	s := NewUserService()
+	alice := createUser(t, s, User{Name: "alice"})
+	for _, surname := range []string{"smith", "jones"} {
+		alice.Surname = surname
+		updated, err := s.Update(AnyTenant, *alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice = updated
+	}
+
+	res, err := s.Sync(AnyTenant, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Users) != 1 || res.Users[0].Surname != "jones" {
+		t.Fatalf("synced %+v, want alice once in its latest state", res.Users)
+	}
+}
+
+func TestSyncPages(t *testing.T) {
+	s := NewUserService()
+	var want []string
+	for _, name := range []string{"alice", "bob", "carol", "dave", "eve"} {
+		want = append(want, createUser(t, s, User{Name: name}).ID)
+	}
+
+	var got []string
+	var since uint64
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("sync never ran out of changes")
+		}
+		res, err := s.Sync(AnyTenant, since, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Users) > 2 {
+			t.Fatalf("page of %d users, want at most 2", len(res.Users))
+		}
+		got = append(got, syncedIDs(res.Users)...)
+		since = res.Revision
+		if !res.HasMore {
+			break
+		}
+	}
+	if !slices.Equal(got, want) || since != s.Revision() {
+		t.Fatalf("paged through %v up to %d, want %v up to %d", got, since, want, s.Revision())
+	}
+}
+
+func TestSyncIsScopedToTenant(t *testing.T) {
+	s := NewUserService()
+	alice := createUser(t, s, User{Name: "alice"})
+	other := createUser(t, s, User{Name: "bob", Tenant: "other"})
+	if err := s.Delete(AnyTenant, other.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.Sync(DefaultTenant, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := syncedIDs(res.Users); !slices.Equal(got, []string{alice.ID}) || len(res.Tombstones) != 0 {
+		t.Fatalf("synced %v and %+v, want only %s", got, res.Tombstones, alice.ID)
+	}
+}
+
+func TestSyncRequiresResyncOutsideHistory(t *testing.T) {
+	s := NewUserService()
+	s.changes = newChangelog(2)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "eve"} {
+		createUser(t, s, User{Name: name})
+	}
+	if s.changes.compacted == 0 {
+		t.Fatal("the changelog was not compacted")
+	}
+
+	if _, err := s.Sync(AnyTenant, s.changes.compacted-1, 0); !errors.Is(err, ErrResyncRequired) {
+		t.Fatalf("sync before the retained history: %v, want %v", err, ErrResyncRequired)
+	}
+	if _, err := s.Sync(AnyTenant, s.Revision()+1, 0); !errors.Is(err, ErrResyncRequired) {
+		t.Fatalf("sync ahead of the revision: %v, want %v", err, ErrResyncRequired)
+	}
+	if _, err := s.Sync(AnyTenant, s.changes.compacted, 0); err != nil {
+		t.Fatalf("sync at the compacted revision: %v", err)
+	}
+
+	full := s.FullSync(AnyTenant)
+	if len(full.Users) != 5 || full.Revision != s.Revision() {
+		t.Fatalf("full sync of %d users at %d, want 5 at %d", len(full.Users), full.Revision, s.Revision())
+	}
+}
+
+func TestRestoreChangelogKeepsTombstones(t *testing.T) {
+	s := NewUserService()
+	alice := createUser(t, s, User{Name: "alice"})
+	bob := createUser(t, s, User{Name: "bob"})
+	if err := s.Delete(AnyTenant, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	s.restoreChangelog(0, s.changes.tombstones())
+	res, err := s.Sync(AnyTenant, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := syncedIDs(res.Users); !slices.Equal(got, []string{alice.ID}) {
+		t.Fatalf("synced %v after the restore, want %s", got, alice.ID)
+	}
+	if len(res.Tombstones) != 1 || res.Tombstones[0].ID != bob.ID {
+		t.Fatalf("tombstones after the restore = %+v, want one for %s", res.Tombstones, bob.ID)
+	}
+}
+
+func createUser(t *testing.T, s *UserService, u User) *User {
+	t.Helper()
+
+	created, err := s.Create(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func syncedIDs(users []User) []string {
+	var res []string
+	for _, u := range users {
+		res = append(res, u.ID)
+	}
+	return res
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AnyTenant as a scope lifts tenant isolation. Only admins get it.
+const AnyTenant = ""
+
+var (
+	ErrCrossTenant   = errors.New("cross-tenant access denied")
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+)
+
+// TenantQuotas limits the number of users per tenant. Zero means unlimited.
+type TenantQuotas struct {
+	Default   int
+	PerTenant map[string]int
+}
+
+func (q TenantQuotas) Limit(tenant string) int {
+	if limit, ok := q.PerTenant[tenant]; ok {
+		return limit
+	}
+	return q.Default
+}
+
+// ParseTenantQuotas parses a comma separated list of tenant=limit pairs.
+func ParseTenantQuotas(s string) (map[string]int, error) {
+	res := make(map[string]int)
+	if s == "" {
+		return res, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		tenant, limit, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || tenant == "" {
+			return nil, fmt.Errorf("invalid tenant quota: %q", pair)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid tenant quota: %q", pair)
+		}
+		res[tenant] = n
+	}
+
+	return res, nil
+}
+
+func (s *UserService) SetTenantQuotas(q TenantQuotas) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.quotas = q
+}
+
+// visible reports whether a user of tenant can be seen from scope.
+func visible(scope, tenant string) bool {
+	return scope == AnyTenant || scope == tenant
+}
+
+// checkQuota fails if tenant cannot take one more user. The caller must hold the lock.
+func (s *UserService) checkQuota(tenant string) error {
+	limit := s.quotas.Limit(tenant)
+	if limit > 0 && len(s.tenants[tenant]) >= limit {
+		return fmt.Errorf("%w: %s has %d users", ErrQuotaExceeded, tenant, limit)
+	}
+	return nil
+}
+
+func (s *UserService) indexTenant(user User) {
+	ids, ok := s.tenants[user.Tenant]
+	if !ok {
+		ids = make(map[string]struct{})
+		s.tenants[user.Tenant] = ids
+	}
+	ids[user.ID] = struct{}{}
+}
+
+func (s *UserService) unindexTenant(user User) {
+	delete(s.tenants[user.Tenant], user.ID)
+	if len(s.tenants[user.Tenant]) == 0 {
+		delete(s.tenants, user.Tenant)
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+// tenantFixture serves users as the acme caller of the returned context.
+func tenantFixture(t *testing.T, users ...User) (*UserGRPCServer, context.Context, []*User) {
+	t.Helper()
+	s := NewUserService()
+	created := make([]*User, 0, len(users))
+	for _, u := range users {
+		res, err := s.Create(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, res)
+	}
+	ctx := ContextWithPrincipal(context.Background(), &Principal{UserID: "acme-user", Tenant: "acme"})
+	return NewUserGRPCService(s), ctx, created
+}
+
+func TestTenantOtherTenantLooksMissing(t *testing.T) {
+	srv, ctx, users := tenantFixture(t, User{Name: "globex-user", Tenant: "globex"})
+
+	other := users[0].ID
+	_, crossErr := srv.GetUser(ctx, &pb.GetUserRequest{Id: other})
+	if status.Code(crossErr) != codes.NotFound {
+		t.Fatalf("get of another tenant's user: %v, want %v", crossErr, codes.NotFound)
+	}
+	missing := "missing"
+	_, missingErr := srv.GetUser(ctx, &pb.GetUserRequest{Id: missing})
+	if status.Code(missingErr) != codes.NotFound {
+		t.Fatalf("get of a missing user: %v, want %v", missingErr, codes.NotFound)
+	}
+	if got, want := status.Convert(crossErr).Message(), strings.Replace(status.Convert(missingErr).Message(), missing, other, 1); got != want {
+		t.Fatalf("cross-tenant message = %q, want the missing user message %q", got, want)
+	}
+
+	if _, err := srv.DeleteUser(ctx, &pb.DeleteUserRequest{Id: other}); status.Code(err) != codes.NotFound {
+		t.Fatalf("delete of another tenant's user: %v, want %v", err, codes.NotFound)
+	}
+	if _, err := srv.userService.Get(AnyTenant, other); err != nil {
+		t.Fatalf("another tenant's user is gone: %v", err)
+	}
+}
+
+func TestTenantListIsScoped(t *testing.T) {
+	srv, ctx, _ := tenantFixture(t,
+		User{Name: "acme-user", Tenant: "acme"},
+		User{Name: "acme-other", Tenant: "acme"},
+		User{Name: "globex-user", Tenant: "globex"},
+	)
+
+	res, err := srv.ListUsers(ctx, &pb.ListUsersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range res.Users {
+		if u.Tenant != "acme" {
+			t.Fatalf("listed %s of tenant %q, want only acme", u.Name, u.Tenant)
+		}
+	}
+	if len(res.Users) != 2 {
+		t.Fatalf("listed %d users, want acme-user and acme-other", len(res.Users))
+	}
+
+	if _, err = srv.ListUsers(ctx, &pb.ListUsersRequest{Tenant: "globex"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("list of another tenant: %v, want %v", err, codes.PermissionDenied)
+	}
+}
+
+func TestTenantCreate(t *testing.T) {
+	srv, ctx, _ := tenantFixture(t)
+
+	if _, err := srv.CreateUser(ctx, &pb.CreateUserRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("create without a user: %v, want %v", err, codes.InvalidArgument)
+	}
+	if _, err := srv.CreateUser(ctx, &pb.CreateUserRequest{User: &pb.User{Name: "eve", Tenant: "globex"}}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("create in another tenant: %v, want %v", err, codes.PermissionDenied)
+	}
+
+	res, err := srv.CreateUser(ctx, &pb.CreateUserRequest{User: &pb.User{Name: "dave"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.User.Tenant != "acme" {
+		t.Fatalf("tenant = %q, want the caller's acme", res.User.Tenant)
+	}
+	// Names are unique per tenant only.
+	if _, err = srv.userService.Create(User{Name: "dave", Tenant: "globex"}); err != nil {
+		t.Fatalf("create dave in globex: %v", err)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	s := NewUserService()
+	s.SetTenantQuotas(TenantQuotas{Default: 1, PerTenant: map[string]int{"acme": 2}})
+	for _, u := range []User{{Name: "a", Tenant: "acme"}, {Name: "b", Tenant: "acme"}, {Name: "c", Tenant: "globex"}} {
+		if _, err := s.Create(u); err != nil {
+			t.Fatalf("create %s: %v", u.Name, err)
+		}
+	}
+	if _, err := s.Create(User{Name: "d", Tenant: "acme"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("third acme user over its quota of 2: %v, want %v", err, ErrQuotaExceeded)
+	}
+	if _, err := s.Create(User{Name: "e", Tenant: "globex"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("second globex user over the default quota of 1: %v, want %v", err, ErrQuotaExceeded)
+	}
+}
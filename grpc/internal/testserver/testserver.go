@@ -0,0 +1,357 @@
+// Package testserver runs a real UserService server in memory for the tests
+// of its consumers, so that they need not fake proto.UserServiceClient.
+//
+//	srv := testserver.Start(t, testserver.WithUsers(internal.User{Name: "alice"}))
+//	srv.InjectFault(proto.UserService_GetUser_FullMethodName, testserver.Fault{Code: codes.Unavailable, Times: 1})
+//	user, err := srv.Client.GetUser(ctx, srv.Users[0].ID)
+package testserver
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Roma7-7-7/sandbox/grpc/internal"
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+	pbv2 "github.com/Roma7-7-7/sandbox/grpc/proto/v2"
+)
+
+const bufferSize = 1 << 20
+
+type (
+	// Server serves the user, admin, auth, API key and group services of
+	// cmd/server on an in-memory listener, behind its recovery, deprecation
+	// and authentication interceptors. Replication, persistence and the
+	// optional interceptors of cmd/server are left out.
+	Server struct {
+		// Client calls the server as Caller.
+		Client *internal.Client
+		// Service is the server's store, for seeding and inspection.
+		Service *internal.UserService
+		// Users are the seeded users, in order, with their assigned IDs.
+		Users []*internal.User
+		// Caller is the user Client authenticates as. It is stored like any
+		// other user, so it shows up when its tenant is listed.
+		Caller *internal.User
+
+		tb     testing.TB
+		server *grpc.Server
+		lis    *bufconn.Listener
+		conn   *grpc.ClientConn
+		tokens *internal.TokenIssuer
+
+		mx     sync.Mutex
+		faults map[string]*Fault
+	}
+
+	// Fault is how the calls of a method misbehave.
+	Fault struct {
+		// Latency delays the call before it is handled. A caller deadline that
+		// expires first fails the call with DeadlineExceeded.
+		Latency time.Duration
+		// Code fails the call without handling it unless it is codes.OK.
+		Code    codes.Code
+		Message string
+		// DropAfter breaks a server stream with Unavailable once it has sent
+		// that many messages. Zero leaves streams alone.
+		DropAfter int
+		// Times limits the fault to that many calls. Zero applies it until
+		// the faults are cleared.
+		Times int
+	}
+
+	Option func(*config)
+
+	config struct {
+		users     []internal.User
+		caller    caller
+		clientOps []internal.ClientOption
+		clock     func() time.Time
+	}
+
+	caller struct {
+		name   string
+		tenant string
+		roles  []string
+	}
+)
+
+// WithUsers seeds the store with users before the server starts.
+func WithUsers(users ...internal.User) Option {
+	return func(c *config) {
+		c.users = append(c.users, users...)
+	}
+}
+
+// WithCaller makes Client authenticate as a user called name in tenant, which
+// has roles. By default it is an admin called "testserver" of
+// internal.DefaultTenant. Calls whose context already carries credentials,
+// such as those of As, keep them.
+func WithCaller(name, tenant string, roles ...string) Option {
+	return func(c *config) {
+		c.caller = caller{name: name, tenant: tenant, roles: roles}
+	}
+}
+
+// WithClientOptions configures Client, e.g. with internal.WithCache.
+func WithClientOptions(opts ...internal.ClientOption) Option {
+	return func(c *config) {
+		c.clientOps = append(c.clientOps, opts...)
+	}
+}
+
+// WithClock makes the service, its tokens and API keys read the time from now,
+// for deterministic timestamps, ages and expiries.
+func WithClock(now func() time.Time) Option {
+	return func(c *config) {
+		c.clock = now
+	}
+}
+
+// Start serves until the test ends. Any failure to start fails tb.
+func Start(tb testing.TB, opts ...Option) *Server {
+	tb.Helper()
+
+	cfg := config{
+		caller: caller{name: "testserver", tenant: internal.DefaultTenant, roles: []string{internal.RoleAdmin}},
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		tb.Fatalf("generate token secret: %v", err)
+	}
+
+	s := &Server{
+		Service: internal.NewUserService(),
+		tb:      tb,
+		lis:     bufconn.Listen(bufferSize),
+		tokens:  internal.NewTokenIssuer(secret, 24*time.Hour, 24*time.Hour),
+		faults:  make(map[string]*Fault),
+	}
+	tb.Cleanup(s.Close)
+	apiKeys := internal.NewAPIKeyStore()
+	if cfg.clock != nil {
+		s.Service.SetClock(cfg.clock)
+		s.tokens.SetClock(cfg.clock)
+		apiKeys.SetClock(cfg.clock)
+	}
+
+	s.Seed(cfg.users...)
+	now := s.Service.Now()
+	callerUser, err := s.Service.Create(internal.User{Name: cfg.caller.name, Tenant: cfg.caller.tenant, CreatedAt: now, UpdatedAt: now})
+	if err != nil {
+		tb.Fatalf("create caller %q: %v", cfg.caller.name, err)
+	}
+	s.Caller = callerUser
+
+	groups := internal.NewGroupStore(s.Service)
+	auth := internal.NewAuthenticator(s.Service, s.tokens, apiKeys)
+	auth.AddRoleSource(groups)
+	auth.AddRoleSource(internal.StaticRoles{callerUser.ID: cfg.caller.roles})
+	auth.AddPublicMethods(healthpb.Health_Check_FullMethodName, healthpb.Health_Watch_FullMethodName)
+
+	s.server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(internal.RecoverInterceptor, s.faultInterceptor, internal.DeprecationInterceptor, auth.AuthInterceptor),
+		grpc.ChainStreamInterceptor(internal.RecoverStreamInterceptor, s.faultStreamInterceptor, auth.AuthStreamInterceptor),
+	)
+	pb.RegisterUserServiceServer(s.server, internal.NewUserGRPCService(s.Service))
+	pbv2.RegisterUserServiceServer(s.server, internal.NewUserV2GRPCService(s.Service))
+	pb.RegisterAdminServiceServer(s.server, internal.NewAdminGRPCService(s.Service))
+	pb.RegisterAuthServiceServer(s.server, internal.NewAuthGRPCService(s.Service, s.tokens, internal.DefaultPasswordPolicy))
+	pb.RegisterAPIKeyServiceServer(s.server, internal.NewAPIKeyGRPCService(apiKeys))
+	pb.RegisterGroupServiceServer(s.server, internal.NewGroupGRPCService(groups))
+	healthpb.RegisterHealthServer(s.server, health.NewServer())
+	go func() {
+		_ = s.server.Serve(s.lis)
+	}()
+
+	caller := s.credentials(callerUser)
+	conn, err := grpc.Dial("passthrough:///testserver",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return s.lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(withCaller(ctx, caller), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return streamer(withCaller(ctx, caller), desc, cc, method, opts...)
+		}),
+	)
+	if err != nil {
+		tb.Fatalf("dial test server: %v", err)
+	}
+	s.conn = conn
+	s.Client = internal.NewClient(pb.NewUserServiceClient(conn), cfg.clientOps...)
+
+	return s
+}
+
+// Conn is the client connection, for clients of other services such as the
+// v2 UserService.
+func (s *Server) Conn() *grpc.ClientConn {
+	return s.conn
+}
+
+// As returns ctx with the credentials of user, so that a call through any
+// client of Conn is made as user instead of Caller.
+func (s *Server) As(ctx context.Context, user *internal.User) context.Context {
+	return metadata.NewOutgoingContext(ctx, s.credentials(user))
+}
+
+// credentials are the metadata of an access token of user.
+func (s *Server) credentials(user *internal.User) metadata.MD {
+	s.tb.Helper()
+
+	tokens, err := s.tokens.Issue(user)
+	if err != nil {
+		s.tb.Fatalf("issue token of %s: %v", user.ID, err)
+	}
+	return metadata.Pairs("authorization", "Bearer "+tokens.AccessToken)
+}
+
+// Seed stores users and appends them to s.Users. Any failure fails the test.
+func (s *Server) Seed(users ...internal.User) []*internal.User {
+	s.tb.Helper()
+
+	seeded := make([]*internal.User, 0, len(users))
+	now := s.Service.Now()
+	for _, u := range users {
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = now
+		}
+		if u.UpdatedAt.IsZero() {
+			u.UpdatedAt = u.CreatedAt
+		}
+		created, err := s.Service.Create(u)
+		if err != nil {
+			s.tb.Fatalf("seed user %q: %v", u.Name, err)
+		}
+		seeded = append(seeded, created)
+	}
+	s.Users = append(s.Users, seeded...)
+
+	return seeded
+}
+
+// InjectFault makes the calls of method, a full method name such as
+// proto.UserService_GetUser_FullMethodName, misbehave as f describes. An
+// empty method matches every call without a fault of its own.
+func (s *Server) InjectFault(method string, f Fault) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.faults[method] = &f
+}
+
+// ClearFaults lets every call behave again.
+func (s *Server) ClearFaults() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	clear(s.faults)
+}
+
+// Close stops the server. Start registers it with the test's cleanup.
+func (s *Server) Close() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	if s.server != nil {
+		s.server.Stop()
+	}
+	_ = s.lis.Close()
+}
+
+// fault returns the fault of the next call of method, counting it.
+func (s *Server) fault(method string) (Fault, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	key := method
+	f, ok := s.faults[key]
+	if !ok {
+		key = ""
+		if f, ok = s.faults[key]; !ok {
+			return Fault{}, false
+		}
+	}
+	if f.Times > 0 {
+		if f.Times--; f.Times == 0 {
+			delete(s.faults, key)
+		}
+	}
+
+	return *f, true
+}
+
+func (s *Server) faultInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	f, ok := s.fault(info.FullMethod)
+	if !ok {
+		return handler(ctx, req)
+	}
+	if err := f.apply(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) faultStreamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	f, ok := s.fault(info.FullMethod)
+	if !ok {
+		return handler(srv, ss)
+	}
+	if err := f.apply(ss.Context()); err != nil {
+		return err
+	}
+	if f.DropAfter <= 0 {
+		return handler(srv, ss)
+	}
+
+	return internal.BreakStream(srv, ss, handler, f.DropAfter, status.Error(codes.Unavailable, "stream dropped by test server"))
+}
+
+// apply waits out the latency of f and returns its error, if any.
+func (f Fault) apply(ctx context.Context) error {
+	if f.Latency > 0 {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(f.Latency):
+		}
+	}
+	if f.Code != codes.OK {
+		msg := f.Message
+		if msg == "" {
+			msg = "injected by test server"
+		}
+		return status.Error(f.Code, msg)
+	}
+	return nil
+}
+
+// withCaller adds the caller's credentials unless ctx carries some already.
+func withCaller(ctx context.Context, caller metadata.MD) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for _, key := range []string{"authorization", "x-api-key"} {
+		if len(md.Get(key)) > 0 {
+			return ctx
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, metadata.Join(md, caller))
+}
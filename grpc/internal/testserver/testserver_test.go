@@ -0,0 +1,107 @@
+package testserver_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Roma7-7-7/sandbox/grpc/internal"
+	"github.com/Roma7-7-7/sandbox/grpc/internal/testserver"
+	pb "github.com/Roma7-7-7/sandbox/grpc/proto"
+)
+
+func TestServesSeededUsers(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithUsers(internal.User{Name: "alice"}, internal.User{Name: "bob"}))
+	ctx := context.Background()
+
+	user, err := srv.Client.GetUser(ctx, srv.Users[1].ID)
+	if err != nil {
+		t.Fatalf("get bob: %v", err)
+	}
+	if user.Name != "bob" {
+		t.Fatalf("got %q, want bob", user.Name)
+	}
+
+	users, err := srv.Client.ListUsers(ctx, internal.DefaultTenant)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	// alice, bob and the caller.
+	if len(users) != 3 {
+		t.Fatalf("listed %d users, want 3", len(users))
+	}
+}
+
+func TestAuthenticatesAsCaller(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithCaller("reader", "acme"))
+	ctx := context.Background()
+
+	if _, err := srv.Client.ListUsers(ctx, internal.DefaultTenant); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("listing another tenant: got %v, want PermissionDenied", err)
+	}
+
+	other := srv.Seed(internal.User{Name: "mallory", Tenant: "acme"})[0]
+	res, err := pb.NewUserServiceClient(srv.Conn()).GetUser(srv.As(ctx, other), &pb.GetUserRequest{Id: other.ID})
+	if err != nil {
+		t.Fatalf("get as mallory: %v", err)
+	}
+	if res.User.GetName() != "mallory" {
+		t.Fatalf("got %q, want mallory", res.User.GetName())
+	}
+}
+
+func TestInjectFaultCode(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithUsers(internal.User{Name: "alice"}))
+	ctx := context.Background()
+	id := srv.Users[0].ID
+
+	srv.InjectFault(pb.UserService_GetUser_FullMethodName, testserver.Fault{Code: codes.Unavailable, Times: 1})
+	if _, err := srv.Client.GetUser(ctx, id); status.Code(err) != codes.Unavailable {
+		t.Fatalf("first call: got %v, want Unavailable", err)
+	}
+	if _, err := srv.Client.GetUser(ctx, id); err != nil {
+		t.Fatalf("second call: %v", err)
+	}
+
+	srv.InjectFault("", testserver.Fault{Code: codes.Internal, Message: "boom"})
+	if _, err := srv.Client.ListUsers(ctx, internal.DefaultTenant); status.Code(err) != codes.Internal {
+		t.Fatalf("any method: got %v, want Internal", err)
+	}
+	srv.ClearFaults()
+	if _, err := srv.Client.ListUsers(ctx, internal.DefaultTenant); err != nil {
+		t.Fatalf("after clear: %v", err)
+	}
+}
+
+func TestInjectFaultLatency(t *testing.T) {
+	srv := testserver.Start(t, testserver.WithUsers(internal.User{Name: "alice"}))
+	srv.InjectFault(pb.UserService_GetUser_FullMethodName, testserver.Fault{Latency: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := srv.Client.GetUser(ctx, srv.Users[0].ID); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestInjectFaultDropsStream(t *testing.T) {
+	srv := testserver.Start(t)
+	srv.Seed(internal.User{Name: "alice"}, internal.User{Name: "bob"})
+	srv.InjectFault(pb.UserService_WatchUsers_FullMethodName, testserver.Fault{DropAfter: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := srv.Client.WatchUsers(ctx, &pb.WatchUsersRequest{SinceRevision: 1})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if _, err = stream.Recv(); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	if _, err = stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("after the drop: got %v, want Unavailable", err)
+	}
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TokenAccess  = "access"
+	TokenRefresh = "refresh"
+	// TokenEmailVerification proves control of the address in its claims.
+	TokenEmailVerification = "email_verification"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+type (
+	TokenClaims struct {
+		ID        string `json:"jti"`
+		Type      string `json:"typ"`
+		Subject   string `json:"sub"`
+		Tenant    string `json:"tenant"`
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		// Email is the address an email verification token was sent to.
+		Email string `json:"email,omitempty"`
+		// MFAAt is when the subject of an access token last verified a
+		// second factor; zero if it did not.
+		MFAAt int64 `json:"mfa,omitempty"`
+	}
+
+	TokenPair struct {
+		AccessToken      string
+		AccessExpiresAt  time.Time
+		RefreshToken     string
+		RefreshExpiresAt time.Time
+	}
+
+	// TokenIssuer mints and verifies HMAC-SHA256 signed tokens of the form
+	// base64url(claims).base64url(signature) and keeps a revocation list
+	// until the revoked tokens expire.
+	TokenIssuer struct {
+		secret     []byte
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+
+		// clock is time.Now unless SetClock replaces it.
+		clock func() time.Time
+
+		mx      sync.Mutex
+		revoked map[string]time.Time
+		// replica is the cluster node revocations are proposed to, so that
+		// every member rejects a revoked token. Nil unless replicated.
+		replica *Node
+	}
+
+	// revokedToken is a revocation in the log of a replicated cluster.
+	revokedToken struct {
+		ID        string    `json:"id"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+)
+
+func NewTokenIssuer(secret []byte, accessTTL, refreshTTL time.Duration) *TokenIssuer {
+	return &TokenIssuer{
+		secret:     secret,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		clock:      time.Now,
+		revoked:    make(map[string]time.Time),
+	}
+}
+
+// SetClock makes tokens issue and expire by now instead of time.Now. It must
+// be called before the issuer is used.
+func (t *TokenIssuer) SetClock(now func() time.Time) {
+	t.clock = now
+}
+
+func (t *TokenIssuer) Issue(user *User) (*TokenPair, error) {
+	return t.issue(user, time.Time{})
+}
+
+// IssueMFA mints a pair whose access token records a second factor verified
+// at mfaAt. Tokens refreshed from it do not.
+func (t *TokenIssuer) IssueMFA(user *User, mfaAt time.Time) (*TokenPair, error) {
+	return t.issue(user, mfaAt)
+}
+
+func (t *TokenIssuer) issue(user *User, mfaAt time.Time) (*TokenPair, error) {
+	now := t.clock()
+
+	claims := userClaims(user, TokenAccess)
+	if !mfaAt.IsZero() {
+		claims.MFAAt = mfaAt.Unix()
+	}
+	access, accessExp, err := t.sign(claims, now, t.accessTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh, refreshExp, err := t.sign(userClaims(user, TokenRefresh), now, t.refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:      access,
+		AccessExpiresAt:  accessExp,
+		RefreshToken:     refresh,
+		RefreshExpiresAt: refreshExp,
+	}, nil
+}
+
+// IssueEmailVerification mints a token proving control of user's current
+// email address, valid for ttl.
+func (t *TokenIssuer) IssueEmailVerification(user *User, ttl time.Duration) (string, time.Time, error) {
+	claims := userClaims(user, TokenEmailVerification)
+	claims.Email = user.Email
+	return t.sign(claims, t.clock(), ttl)
+}
+
+// Verify checks the signature, type, expiry and revocation of token.
+func (t *TokenIssuer) Verify(token, typ string) (*TokenClaims, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	gotSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal(gotSig, t.mac(payload)) {
+		return nil, ErrInvalidToken
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims TokenClaims
+	if err = json.Unmarshal(data, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Type != typ {
+		return nil, fmt.Errorf("%w: %s token expected", ErrInvalidToken, typ)
+	}
+	if t.clock().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	t.mx.Lock()
+	_, revoked := t.revoked[claims.ID]
+	t.mx.Unlock()
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	return &claims, nil
+}
+
+// Revoke rejects the token described by claims until it expires. On a
+// replicated server the revocation goes through the cluster log, so it fails
+// without a leader to take it.
+func (t *TokenIssuer) Revoke(claims *TokenClaims) error {
+	exp := time.Unix(claims.ExpiresAt, 0)
+	if t.replica != nil {
+		return t.replica.propose(&mutation{Op: opRevoke, Token: &revokedToken{ID: claims.ID, ExpiresAt: exp}})
+	}
+
+	t.revoke(claims.ID, exp)
+	return nil
+}
+
+// revoke rejects the token id until exp, forgetting the revocations of
+// tokens that have expired since.
+func (t *TokenIssuer) revoke(id string, exp time.Time) {
+	now := t.clock()
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	for id, exp := range t.revoked {
+		if now.After(exp) {
+			delete(t.revoked, id)
+		}
+	}
+	t.revoked[id] = exp
+}
+
+// revocations returns the revoked tokens and when they expire.
+func (t *TokenIssuer) revocations() map[string]time.Time {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	return maps.Clone(t.revoked)
+}
+
+// restoreRevocations replaces the revoked tokens with revoked.
+func (t *TokenIssuer) restoreRevocations(revoked map[string]time.Time) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	t.revoked = maps.Clone(revoked)
+	if t.revoked == nil {
+		t.revoked = make(map[string]time.Time)
+	}
+}
+
+func userClaims(user *User, typ string) TokenClaims {
+	return TokenClaims{
+		Type:    typ,
+		Subject: user.ID,
+		Tenant:  user.Tenant,
+	}
+}
+
+func (t *TokenIssuer) sign(claims TokenClaims, now time.Time, ttl time.Duration) (string, time.Time, error) {
+	exp := now.Add(ttl)
+	claims.ID = uuid.New().String()
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = exp.Unix()
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("marshal claims: %w", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	sig := base64.RawURLEncoding.EncodeToString(t.mac(payload))
+
+	return payload + "." + sig, exp, nil
+}
+
+func (t *TokenIssuer) mac(payload string) []byte {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
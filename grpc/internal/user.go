@@ -3,76 +3,282 @@ package internal
 import (
 	"errors"
 	"fmt"
+	"maps"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// MaxBatchGetIDs caps the number of IDs accepted by a single BatchGet call.
+const MaxBatchGetIDs = 100
+
 var (
 	ErrUserAlreadyExists = errors.New("user already exists")
 	ErrUserNotFound      = errors.New("user not found")
+	ErrTooManyIDs        = errors.New("too many ids")
+	// ErrConcurrentUpdate rejects an update computed from a version of the
+	// user that another update has replaced in the meantime.
+	ErrConcurrentUpdate = errors.New("user changed concurrently")
 )
 
 type (
 	User struct {
-		ID        string
-		Name      string
-		Surname   string
-		Age       int
-		CreatedAt time.Time
-		UpdatedAt time.Time
-		Disabled  bool
+		ID      string
+		Tenant  string
+		Name    string
+		Surname string
+		// Age is the age given through v1. BirthDate supersedes it when set.
+		Age int
+		// BirthDate is a UTC date, or zero when unknown.
+		BirthDate time.Time
+		// Email is normalized by NormalizeEmail and unique within the tenant.
+		Email         string
+		EmailVerified bool
+		CreatedAt     time.Time
+		UpdatedAt     time.Time
+		Disabled      bool
+		Labels        map[string]string
+		// ModifiedRevision is the store revision of the user's last change.
+		ModifiedRevision uint64
+		// ExpiresAt is when the account stops being usable; zero never.
+		ExpiresAt time.Time
+		// DisableAt is when the scheduler disables the account; zero never.
+		DisableAt time.Time
+
+		// PasswordHash is empty until a password is set.
+		PasswordHash string
+		// FailedLogins counts consecutive wrong passwords; logins are
+		// refused until LockedUntil.
+		FailedLogins int
+		LockedUntil  time.Time
+		// TOTPSecret is the base32 TOTP secret, enrolled but unconfirmed
+		// until MFAEnabled.
+		TOTPSecret string
+		MFAEnabled bool
+		// TOTPLastStep is the time step of the last accepted code.
+		TOTPLastStep int64
+		// RecoveryCodes are the hex SHA-256 hashes of the unused codes.
+		RecoveryCodes []string
+		// MFAFailures counts consecutive wrong codes; codes are refused
+		// until MFALockedUntil.
+		MFAFailures    int
+		MFALockedUntil time.Time
+
+		// SealedBirthDate, NameIndex and EmailIndex are only set in records
+		// encrypted at rest: the sealed BirthDate, which has no string form to
+		// seal in place, and the blind indexes of Name and Email.
+		SealedBirthDate string `json:",omitempty"`
+		NameIndex       string `json:",omitempty"`
+		EmailIndex      string `json:",omitempty"`
 	}
 
 	UserService struct {
 		store map[string]User
 		mx    *sync.RWMutex
+
+		// tenants indexes user IDs by tenant.
+		tenants map[string]map[string]struct{}
+		quotas  TenantQuotas
+		labels  *labelIndex
+		search  *searchIndex
+		// emails indexes user IDs by tenant and emailKey.
+		emails map[string]map[string]string
+		// names indexes user IDs by tenant and nameKey.
+		names map[string]map[string]string
+		// keyring is set when records are encrypted at rest.
+		keyring *Keyring
+		// scheduled holds the IDs of users with pending transitions.
+		scheduled map[string]struct{}
+		// stats holds the figures of each tenant for Stats.
+		stats map[string]*userStats
+
+		// revision counts mutations; changes keeps the recent ones for Sync.
+		revision uint64
+		changes  *changelog
+		// changed is closed and replaced whenever a mutation is applied.
+		changed chan struct{}
+
+		// persistence is nil for a purely in-memory service.
+		persistence *persistence
+		// replica is set when mutations go through a consensus log.
+		replica   *Node
+		observers []UserObserver
+		hooks     *HookRegistry
+		// clock is read through Now.
+		clock func() time.Time
+	}
+
+	// UserObserver is notified of every change applied to the store. It is
+	// called with the store's write lock held and must not call back into the
+	// UserService.
+	UserObserver interface {
+		UserPut(user User)
+		UserDeleted(user User)
 	}
 )
 
 func NewUserService() *UserService {
 	return &UserService{
-		store: make(map[string]User),
-		mx:    &sync.RWMutex{},
+		store:     make(map[string]User),
+		mx:        &sync.RWMutex{},
+		tenants:   make(map[string]map[string]struct{}),
+		labels:    newLabelIndex(),
+		search:    newSearchIndex(),
+		emails:    make(map[string]map[string]string),
+		names:     make(map[string]map[string]string),
+		scheduled: make(map[string]struct{}),
+		stats:     make(map[string]*userStats),
+		changes:   newChangelog(DefaultChangelogLimit),
+		changed:   make(chan struct{}),
+		clock:     time.Now,
 	}
 }
 
+// SetClock makes the service read the time from now instead of time.Now, so
+// that tests are deterministic. It must be called before the service is
+// shared.
+func (s *UserService) SetClock(now func() time.Time) {
+	s.clock = now
+}
+
+// Now is the current time of the service's clock.
+func (s *UserService) Now() time.Time {
+	return s.clock()
+}
+
+func (s *UserService) AddObserver(o UserObserver) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.observers = append(s.observers, o)
+}
+
+// Create stores user in user.Tenant, or DefaultTenant if it is empty.
+// Names are unique within a tenant.
 func (s *UserService) Create(user User) (*User, error) {
-	s.mx.RLock()
+	if user.Tenant == "" {
+		user.Tenant = DefaultTenant
+	}
 
-	for _, u := range s.store {
-		if u.Name == user.Name {
-			s.mx.RUnlock()
-			return nil, fmt.Errorf("%w: %s", ErrUserAlreadyExists, u.Name)
-		}
+	hooks := s.hookRegistry()
+	hooked, err := hooks.before(HookEvent{Op: HookCreate, User: &user, At: s.Now()})
+	if err != nil {
+		return nil, err
 	}
-	s.mx.RUnlock()
+	res, err := s.create(*hooked)
+	if err != nil {
+		return nil, err
+	}
+	hooks.after(HookEvent{Op: HookCreate, User: res, At: s.Now()})
+
+	return res, nil
+}
+
+func (s *UserService) create(user User) (*User, error) {
+	if err := ValidateLabels(user.Labels); err != nil {
+		return nil, err
+	}
+	email, err := NormalizeEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	user.Email, user.EmailVerified = email, false
+	user.Labels = maps.Clone(user.Labels)
 
 	s.mx.Lock()
 	defer s.mx.Unlock()
+
 	user.ID = uuid.New().String()
-	s.store[user.ID] = user
+	m := mutation{Op: opCreate, User: user}
+	if err := s.check(m); err != nil {
+		return nil, err
+	}
+	if err := s.commit(&m); err != nil {
+		return nil, err
+	}
 
-	return &user, nil
+	return &m.User, nil
 }
 
-func (s *UserService) Update(user User) (*User, error) {
+// Update replaces the user user.ID in scope. Its tenant, creation time and
+// credentials are kept. A non-zero user.ModifiedRevision makes it fail with
+// ErrConcurrentUpdate if the stored user has changed since.
+func (s *UserService) Update(scope string, user User) (*User, error) {
+	hooks := s.hookRegistry()
+	if hooks != nil {
+		old, err := s.Get(scope, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		user.Tenant = old.Tenant
+		hooked, err := hooks.before(HookEvent{Op: HookUpdate, User: &user, Old: old, At: s.Now()})
+		if err != nil {
+			return nil, err
+		}
+		user = *hooked
+	}
+
+	res, err := s.update(scope, user)
+	if err != nil {
+		return nil, err
+	}
+	hooks.after(HookEvent{Op: HookUpdate, User: res, At: s.Now()})
+
+	return res, nil
+}
+
+func (s *UserService) update(scope string, user User) (*User, error) {
+	if err := ValidateLabels(user.Labels); err != nil {
+		return nil, err
+	}
+	email, err := NormalizeEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	user.Email = email
+	user.Labels = maps.Clone(user.Labels)
+
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
-	_, ok := s.store[user.ID]
+	existing, ok := s.store[user.ID]
 	if !ok {
 		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, user.ID)
 	}
+	if !visible(scope, existing.Tenant) {
+		return nil, fmt.Errorf("%w: %s", ErrCrossTenant, user.ID)
+	}
+	if user.ModifiedRevision != 0 && user.ModifiedRevision != existing.ModifiedRevision {
+		return nil, fmt.Errorf("%w: %s", ErrConcurrentUpdate, user.ID)
+	}
 
-	user.UpdatedAt = time.Now()
-	s.store[user.ID] = user
+	user.Tenant, user.CreatedAt = existing.Tenant, existing.CreatedAt
+	// Credentials change through SetPassword and the MFA methods only.
+	user.PasswordHash, user.FailedLogins = existing.PasswordHash, existing.FailedLogins
+	user.LockedUntil = existing.LockedUntil
+	user.TOTPSecret, user.MFAEnabled = existing.TOTPSecret, existing.MFAEnabled
+	user.TOTPLastStep, user.RecoveryCodes = existing.TOTPLastStep, existing.RecoveryCodes
+	user.MFAFailures, user.MFALockedUntil = existing.MFAFailures, existing.MFALockedUntil
+	// Only VerifyEmail marks an address verified.
+	user.EmailVerified = existing.EmailVerified && existing.Email == user.Email
+	// A user converted from v1 has no birth date; it does not clear one.
+	if user.BirthDate.IsZero() {
+		user.BirthDate = existing.BirthDate
+	}
+	user.UpdatedAt = s.Now()
+	m := mutation{Op: opUpdate, User: user}
+	if err := s.check(m); err != nil {
+		return nil, err
+	}
+	if err := s.commit(&m); err != nil {
+		return nil, err
+	}
 
-	return &user, nil
+	return &m.User, nil
 }
 
-func (s *UserService) Get(id string) (*User, error) {
+func (s *UserService) Get(scope, id string) (*User, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
 
@@ -80,20 +286,242 @@ func (s *UserService) Get(id string) (*User, error) {
 	if !ok {
 		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, id)
 	}
+	if !visible(scope, user.Tenant) {
+		return nil, fmt.Errorf("%w: %s", ErrCrossTenant, id)
+	}
 
 	return &user, nil
 }
 
-func (s *UserService) Delete(id string) error {
+// BatchGet returns the users found for ids, in request order, and the IDs that
+// are not in the store. Duplicate IDs are returned once. Users outside scope
+// are reported as missing.
+func (s *UserService) BatchGet(scope string, ids []string) ([]User, []string, error) {
+	if len(ids) > MaxBatchGetIDs {
+		return nil, nil, fmt.Errorf("%w: %d > %d", ErrTooManyIDs, len(ids), MaxBatchGetIDs)
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	users := make([]User, 0, len(ids))
+	var missing []string
+	seen := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		user, ok := s.store[id]
+		if !ok || !visible(scope, user.Tenant) {
+			missing = append(missing, id)
+			continue
+		}
+		users = append(users, user)
+	}
+
+	return users, missing, nil
+}
+
+// List returns the users in scope ordered by creation time.
+func (s *UserService) List(scope string) []User {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	var users []User
+	if scope == AnyTenant {
+		users = make([]User, 0, len(s.store))
+		for _, u := range s.store {
+			users = append(users, u)
+		}
+	} else {
+		users = make([]User, 0, len(s.tenants[scope]))
+		for id := range s.tenants[scope] {
+			users = append(users, s.store[id])
+		}
+	}
+
+	sortByCreation(users)
+
+	return users
+}
+
+func (s *UserService) Delete(scope, id string) error {
+	hooks := s.hookRegistry()
+	if hooks != nil {
+		old, err := s.Get(scope, id)
+		if err != nil {
+			return err
+		}
+		if _, err = hooks.before(HookEvent{Op: HookDelete, Old: old, At: s.Now()}); err != nil {
+			return err
+		}
+	}
+
+	old, err := s.delete(scope, id)
+	if err != nil {
+		return err
+	}
+	hooks.after(HookEvent{Op: HookDelete, Old: &old, At: s.Now()})
+
+	return nil
+}
+
+func (s *UserService) delete(scope, id string) (User, error) {
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
-	_, ok := s.store[id]
+	user, ok := s.store[id]
 	if !ok {
-		return fmt.Errorf("%w: %s", ErrUserNotFound, id)
+		return User{}, fmt.Errorf("%w: %s", ErrUserNotFound, id)
+	}
+	if !visible(scope, user.Tenant) {
+		return User{}, fmt.Errorf("%w: %s", ErrCrossTenant, id)
+	}
+
+	// UpdatedAt of a deletion is when it happened.
+	return user, s.commit(&mutation{Op: opDelete, User: User{ID: user.ID, UpdatedAt: s.Now()}})
+}
+
+// check validates m against the current store. The caller must hold the lock.
+func (s *UserService) check(m mutation) error {
+	if err := s.checkRevision(m); err != nil {
+		return err
+	}
+	if m.Op == opDelete {
+		return nil
+	}
+	if existing, ok := s.store[m.User.ID]; ok && m.Op == opUpdate && existing.Tenant != m.User.Tenant {
+		return fmt.Errorf("%w: %s", ErrCrossTenant, m.User.ID)
+	}
+
+	if id, ok := s.names[m.User.Tenant][s.nameKey(m.User.Tenant, m.User.Name)]; ok && id != m.User.ID {
+		return fmt.Errorf("%w: %s", ErrUserAlreadyExists, m.User.Name)
+	}
+	if m.User.Email != "" {
+		if id, ok := s.emails[m.User.Tenant][s.emailKey(m.User.Tenant, m.User.Email)]; ok && id != m.User.ID {
+			return fmt.Errorf("%w: %s", ErrEmailTaken, m.User.Email)
+		}
+	}
+	if m.Op == opCreate {
+		return s.checkQuota(m.User.Tenant)
+	}
+
+	return nil
+}
+
+// checkRevision checks that m applies to the user it was computed from. It
+// depends on the store alone, unlike check, which also enforces the settings
+// of the service.
+func (s *UserService) checkRevision(m mutation) error {
+	existing, ok := s.store[m.User.ID]
+	switch m.Op {
+	case opCreate:
+		if ok {
+			return fmt.Errorf("%w: %s", ErrUserAlreadyExists, m.User.ID)
+		}
+	case opUpdate, opDelete:
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, m.User.ID)
+		}
+		if m.Expect != 0 && existing.ModifiedRevision != m.Expect {
+			return fmt.Errorf("%w: %s", ErrConcurrentUpdate, m.User.ID)
+		}
+	}
+	return nil
+}
+
+// commit assigns m the next revision, logs it if the service is durable and
+// applies it to the store. The caller must hold the write lock.
+//
+// A replicated service instead proposes m to the cluster and releases the lock
+// until it is applied, so the leader checks m again against its own store. An update
+// expects the revision of the user it was computed from, so it fails with
+// ErrConcurrentUpdate rather than overwrite a change made meanwhile.
+func (s *UserService) commit(m *mutation) error {
+	if s.replica != nil {
+		if existing, ok := s.store[m.User.ID]; ok && m.Op == opUpdate {
+			m.Expect = existing.ModifiedRevision
+		}
+		s.mx.Unlock()
+		defer s.mx.Lock()
+
+		return s.replica.propose(m)
 	}
 
-	delete(s.store, id)
+	s.stamp(m)
+	if s.persistence != nil {
+		if err := s.persistence.log(m); err != nil {
+			return err
+		}
+	}
+	s.apply(*m)
 
 	return nil
 }
+
+// stamp assigns m the next revision.
+func (s *UserService) stamp(m *mutation) {
+	m.Revision = s.revision + 1
+	if m.Op != opDelete {
+		m.User.ModifiedRevision = m.Revision
+	}
+}
+
+func (s *UserService) apply(m mutation) {
+	if m.Revision == 0 {
+		// Records written before revisions existed.
+		m.Revision = s.revision + 1
+		m.User.ModifiedRevision = m.Revision
+	}
+	s.revision = max(s.revision, m.Revision)
+
+	switch m.Op {
+	case opCreate, opUpdate:
+		if m.User.Tenant == "" {
+			// Records written before tenants existed.
+			m.User.Tenant = DefaultTenant
+		}
+		if old, ok := s.store[m.User.ID]; ok {
+			s.labels.remove(old.ID, old.Labels)
+			s.search.remove(old)
+			s.unindexEmail(old)
+			s.unindexName(old)
+			s.countUser(old, -1)
+		} else {
+			s.countDay(m.User.Tenant, m.User.CreatedAt, false)
+		}
+		s.store[m.User.ID] = m.User
+		s.indexTenant(m.User)
+		s.labels.add(m.User.ID, m.User.Labels)
+		s.search.add(m.User)
+		s.indexSchedule(m.User)
+		s.indexEmail(m.User)
+		s.indexName(m.User)
+		s.countUser(m.User, 1)
+		s.changes.append(changeEntry{Revision: m.Revision, ID: m.User.ID, Tenant: m.User.Tenant})
+		for _, o := range s.observers {
+			o.UserPut(m.User)
+		}
+	case opDelete:
+		if old, ok := s.store[m.User.ID]; ok {
+			s.unindexTenant(old)
+			s.labels.remove(old.ID, old.Labels)
+			s.search.remove(old)
+			delete(s.scheduled, old.ID)
+			s.unindexEmail(old)
+			s.unindexName(old)
+			s.countUser(old, -1)
+			s.countDay(old.Tenant, m.User.UpdatedAt, true)
+			delete(s.store, m.User.ID)
+			s.changes.append(changeEntry{Revision: m.Revision, ID: old.ID, Tenant: old.Tenant, Deleted: true})
+			for _, o := range s.observers {
+				o.UserDeleted(old)
+			}
+		}
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when the write-ahead log is fsynced.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every record. A mutation is durable once it returns.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background at a fixed interval, so the last
+	// interval of mutations may be lost on power failure.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+const (
+	opCreate mutationOp = "create"
+	opUpdate mutationOp = "update"
+	opDelete mutationOp = "delete"
+	// opRevoke revokes a token. It is only found in the raft log.
+	opRevoke mutationOp = "revoke"
+
+	walHeaderSize = 12
+	walMaxRecord  = 16 << 20
+)
+
+var ErrWALCorrupt = errors.New("wal corrupt")
+
+type (
+	mutationOp string
+
+	// mutation is a single change to the user store as recorded in the WAL.
+	mutation struct {
+		Seq      uint64     `json:"seq"`
+		Revision uint64     `json:"rev"`
+		Op       mutationOp `json:"op"`
+		User     User       `json:"user"`
+		// Expect is the ModifiedRevision the updated user must still have
+		// when a replicated update is applied; zero is unconditional.
+		Expect uint64 `json:"expect,omitempty"`
+		// Token is the token an opRevoke revokes.
+		Token *revokedToken `json:"token,omitempty"`
+	}
+
+	// WAL is an append-only log of store mutations. Each record is framed as a
+	// big-endian uint32 payload length, a CRC-32 of the payload, a CRC-32 of
+	// those two and the JSON payload. The header checksum tells a damaged
+	// length apart from a record cut short by a crash.
+	WAL struct {
+		path     string
+		policy   SyncPolicy
+		interval time.Duration
+
+		mx sync.Mutex
+		f  *os.File
+		w  *bufio.Writer
+		// offset is where the last complete record ends.
+		offset int64
+		dirty  bool
+		stop   chan struct{}
+		done   chan struct{}
+	}
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, fmt.Errorf("unknown sync policy: %q", s)
+	}
+}
+
+func OpenWAL(path string, policy SyncPolicy, interval time.Duration) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %w", err)
+	}
+
+	w := &WAL{
+		path:     path,
+		policy:   policy,
+		interval: interval,
+		f:        f,
+	}
+	if policy == SyncInterval {
+		if interval <= 0 {
+			_ = f.Close()
+			return nil, fmt.Errorf("open wal: sync interval must be positive")
+		}
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop()
+	}
+
+	return w, nil
+}
+
+// Replay calls fn for every record in the log. A torn or corrupt final record,
+// as left behind by a crash in the middle of a write, is truncated away.
+// Corruption followed by further data is reported as ErrWALCorrupt.
+func (w *WAL) Replay(fn func(mutation) error) error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat wal: %w", err)
+	}
+	size := info.Size()
+
+	r := bufio.NewReader(w.f)
+	var offset int64
+	for offset < size {
+		m, n, err := readRecord(r)
+		if err != nil {
+			if !tornRecord(r, err, offset+n, size) {
+				return fmt.Errorf("%w: record at offset %d: %v", ErrWALCorrupt, offset, err)
+			}
+			if err := w.f.Truncate(offset); err != nil {
+				return fmt.Errorf("truncate torn wal record: %w", err)
+			}
+			break
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	if _, err := w.f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	w.w = bufio.NewWriter(w.f)
+	w.offset = offset
+
+	return nil
+}
+
+func (w *WAL) Append(m mutation) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal wal record: %w", err)
+	}
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if err := w.seekEnd(); err != nil {
+		return err
+	}
+	if err := w.write(payload); err != nil {
+		// Cut off whatever part of the record reached the file, so that the
+		// next record does not follow a torn one.
+		if rerr := w.rewind(); rerr != nil {
+			return errors.Join(err, rerr)
+		}
+		return err
+	}
+	w.offset += int64(walHeaderSize + len(payload))
+	if w.policy == SyncInterval {
+		w.dirty = true
+	}
+
+	return nil
+}
+
+func (w *WAL) write(payload []byte) error {
+	var header [walHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(header[8:], crc32.ChecksumIEEE(header[:8]))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return fmt.Errorf("write wal record: %w", err)
+	}
+	if _, err := w.w.Write(payload); err != nil {
+		return fmt.Errorf("write wal record: %w", err)
+	}
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("flush wal: %w", err)
+	}
+	if w.policy == SyncAlways {
+		if err := w.f.Sync(); err != nil {
+			return fmt.Errorf("sync wal: %w", err)
+		}
+	}
+	return nil
+}
+
+// rewind truncates the log to the end of the last complete record.
+func (w *WAL) rewind() error {
+	if err := w.f.Truncate(w.offset); err != nil {
+		return fmt.Errorf("truncate failed wal record: %w", err)
+	}
+	if _, err := w.f.Seek(w.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	w.w = bufio.NewWriter(w.f)
+	return nil
+}
+
+// End returns where the last record ends. Once a snapshot covers the records
+// up to there, DiscardBefore drops them.
+func (w *WAL) End() (int64, error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if err := w.seekEnd(); err != nil {
+		return 0, err
+	}
+	return w.offset, nil
+}
+
+// DiscardBefore drops the records before offset, as returned by End, and
+// keeps those appended since. Appends wait while the kept records are
+// copied, which are only those of the time it took to write the snapshot.
+func (w *WAL) DiscardBefore(offset int64) error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if err := w.seekEnd(); err != nil {
+		return err
+	}
+	if offset >= w.offset {
+		if err := w.f.Truncate(0); err != nil {
+			return fmt.Errorf("truncate wal: %w", err)
+		}
+		if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek wal: %w", err)
+		}
+		w.w = bufio.NewWriter(w.f)
+		w.offset, w.dirty = 0, false
+
+		return w.f.Sync()
+	}
+
+	tail := make([]byte, w.offset-offset)
+	if _, err := w.f.ReadAt(tail, offset); err != nil {
+		return fmt.Errorf("read wal: %w", err)
+	}
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("create wal: %w", err)
+	}
+	if _, err = f.Write(tail); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write wal: %w", err)
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	if err = os.Rename(tmp, w.path); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("rename wal: %w", err)
+	}
+
+	_ = w.f.Close()
+	w.f, w.w = f, bufio.NewWriter(f)
+	w.offset, w.dirty = int64(len(tail)), false
+
+	return nil
+}
+
+// seekEnd readies the log for appending at its end, unless Replay already
+// did. The caller must hold the lock.
+func (w *WAL) seekEnd() error {
+	if w.w != nil {
+		return nil
+	}
+	offset, err := w.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	w.w, w.offset = bufio.NewWriter(w.f), offset
+	return nil
+}
+
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if err := w.f.Sync(); err != nil {
+		_ = w.f.Close()
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	return w.f.Close()
+}
+
+func (w *WAL) syncLoop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mx.Lock()
+			if w.dirty {
+				if err := w.f.Sync(); err != nil {
+					fmt.Println("sync wal:", err)
+				} else {
+					w.dirty = false
+				}
+			}
+			w.mx.Unlock()
+		}
+	}
+}
+
+// errWALHeader is a header that does not match its checksum.
+var errWALHeader = errors.New("header checksum mismatch")
+
+// tornRecord reports whether the record that failed with err, declared to end
+// at end, is the final one of a log of size bytes and was cut short by a
+// crash rather than damaged: either it was not written completely, or its
+// header was never written and only zeros follow, as a file system may leave
+// behind when it extended the file but lost the data.
+func tornRecord(r io.Reader, err error, end, size int64) bool {
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.Is(err, errWALHeader):
+		return zeros(r)
+	default:
+		return end >= size
+	}
+}
+
+// zeros reports whether r has nothing but zero bytes left.
+func zeros(r io.Reader) bool {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
+			}
+		}
+		if err != nil {
+			return errors.Is(err, io.EOF)
+		}
+	}
+}
+
+// readRecord returns the decoded record and the number of bytes it occupies.
+// When the header is readable but the record is not, n is the record's declared size.
+func readRecord(r io.Reader) (mutation, int64, error) {
+	var m mutation
+
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return m, 0, err
+	}
+	if crc32.ChecksumIEEE(header[:8]) != binary.BigEndian.Uint32(header[8:]) {
+		return m, walHeaderSize, errWALHeader
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	n := int64(walHeaderSize) + int64(length)
+	if length > walMaxRecord {
+		return m, walHeaderSize, fmt.Errorf("record too large: %d", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return m, n, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return m, n, fmt.Errorf("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return m, n, fmt.Errorf("unmarshal record: %w", err)
+	}
+
+	return m, n, nil
+}